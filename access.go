@@ -0,0 +1,68 @@
+package cowfs
+
+import "os"
+
+// Op identifies the kind of operation reported to an access hook.
+type Op string
+
+const (
+	OpRead    Op = "read"    // OpenFile without write flags, ReadFile, Diff
+	OpStat    Op = "stat"    // Stat, Lstat and Readlink
+	OpReadDir Op = "readdir" // ReadDir
+	OpWrite   Op = "write"   // OpenFile with write flags, WriteFile and Truncate
+	OpMkdir   Op = "mkdir"   // Mkdir
+	OpRemove  Op = "remove"  // Remove
+	OpRename  Op = "rename"  // Rename, reported for both paths
+	OpChmod   Op = "chmod"   // Chmod
+	OpChtimes Op = "chtimes" // Chtimes
+	OpChown   Op = "chown"   // Chown and Lchown
+	OpSymlink Op = "symlink" // Symlink, reported for the new link
+	OpLink    Op = "link"    // Link, reported for both paths
+)
+
+// Mutates reports whether operations of kind op change the overlay.
+func (op Op) Mutates() bool {
+	switch op {
+	case OpRead, OpStat, OpReadDir:
+		return false
+	}
+	return true
+}
+
+// AccessHook is called by WithAccessHook before an operation on a path.
+type AccessHook func(op Op, name string) error
+
+// WithAccessHook calls hook before every operation on a path, with the
+// operation's kind and the cleaned path, letting embedders veto access to
+// protected paths or log it. An error returned by hook fails the operation
+// before it has any effect, reported to the caller as an *fs.PathError
+// (*os.LinkError for Rename and Link) wrapping it. Operations that are
+// carried out through others may report those too; Walk, for example,
+// reports the Lstat and ReadDir calls it makes. The hook is called concurrently by concurrent operations.
+func WithAccessHook(hook AccessHook) Option {
+	return func(fs *FileSystem) {
+		fs.accessHook = hook
+	}
+}
+
+// access calls the access hook, if any, for op on each of names, returning
+// the first error.
+func (cfs *FileSystem) access(op Op, names ...string) error {
+	if cfs.accessHook == nil {
+		return nil
+	}
+	for _, name := range names {
+		if err := cfs.accessHook(op, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openOp returns the access operation of OpenFile with flag.
+func openOp(flag int) Op {
+	if flag&(os.O_CREATE|os.O_WRONLY|os.O_RDWR|os.O_TRUNC|os.O_APPEND) != 0 {
+		return OpWrite
+	}
+	return OpRead
+}
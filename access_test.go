@@ -0,0 +1,87 @@
+package cowfs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/absfs/memfs"
+)
+
+func TestAccessHook(t *testing.T) {
+	primary := must(memfs.NewFS())
+	secondary := must(memfs.NewFS())
+	if err := primary.Mkdir("/protected", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeMemFile(t, primary, "/protected/config", "primary")
+	writeMemFile(t, primary, "/open.txt", "primary")
+
+	errProtected := errors.New("protected path")
+	var mu sync.Mutex
+	var log []string
+	cfs := New(primary, secondary, WithAccessHook(func(op Op, name string) error {
+		mu.Lock()
+		log = append(log, string(op)+" "+name)
+		mu.Unlock()
+		if op.Mutates() && strings.HasPrefix(name, "/protected/") {
+			return errProtected
+		}
+		return nil
+	}))
+
+	if data, err := cfs.ReadFile("/protected/config"); err != nil || string(data) != "primary" {
+		t.Fatalf("ReadFile = %q, %v; want the primary contents", data, err)
+	}
+	for _, op := range []struct {
+		name, path string
+		do         func() error
+	}{
+		{"WriteFile", "/protected/config", func() error { return cfs.WriteFile("/protected/config", []byte("x"), 0o644) }},
+		{"OpenFile", "/protected/config", func() error {
+			f, err := cfs.OpenFile("/protected/config", os.O_RDWR, 0)
+			if err == nil {
+				f.Close()
+			}
+			return err
+		}},
+		{"Remove", "protected/../protected/config", func() error { return cfs.Remove("protected/../protected/config") }},
+		{"Chmod", "/protected/config", func() error { return cfs.Chmod("/protected/config", 0o600) }},
+	} {
+		err := op.do()
+		var pe *fs.PathError
+		if !errors.As(err, &pe) || !errors.Is(err, errProtected) || pe.Path != op.path {
+			t.Errorf("%s = %v; want a *fs.PathError for %s wrapping the hook error", op.name, err, op.path)
+		}
+	}
+	if err := cfs.Rename("/open.txt", "/protected/moved"); !errors.Is(err, errProtected) {
+		t.Errorf("Rename into /protected = %v; want the hook error", err)
+	}
+	if cfs.IsModified("/protected/config") || cfs.IsDeleted("/protected/config") {
+		t.Error("vetoed operations changed the overlay")
+	}
+	if _, err := cfs.Stat("/open.txt"); err != nil {
+		t.Errorf("Stat after vetoed Rename: %v", err)
+	}
+
+	if err := cfs.WriteFile("/open.txt", []byte("overlay"), 0o644); err != nil {
+		t.Fatalf("WriteFile outside /protected: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, want := range []string{"read /protected/config", "remove /protected/config", "rename /open.txt", "rename /protected/moved", "write /open.txt"} {
+		found := false
+		for _, entry := range log {
+			if entry == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("hook was not called with %q; log: %q", want, log)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package cowfs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// NewFromZip is NewFromFS over the contents of a zip archive, for patching
+// an application bundle without extracting it. The archive's files are
+// decompressed as they are read; they do not support ReadAt or Seek.
+func NewFromZip(r *zip.Reader, secondary absfs.Filer, opts ...Option) *FileSystem {
+	return NewFromFS(r, secondary, opts...)
+}
+
+// NewFromTar is NewFromFS over the contents of the uncompressed tar archive
+// at the host path name. The archive is indexed when the overlay first
+// needs it, and files are read from it in place, supporting ReadAt and
+// Seek. Directories the archive implies but has no entries for are
+// synthesized, a later entry for a path replaces an earlier one, hard links
+// share their target's contents, and symbolic links and other special
+// files are left out. The archive must not change while the overlay uses
+// it.
+//
+// NewFromTar fails if name cannot be opened or is compressed; a failure to
+// index it is reported by the operations that need the index.
+func NewFromTar(name string, secondary absfs.Filer, opts ...Option) (*FileSystem, error) {
+	t, err := openTar(name)
+	if err != nil {
+		return nil, err
+	}
+	return NewFromFS(t, secondary, opts...), nil
+}
+
+// openTar returns the tarFS of the archive at the host path name, failing
+// if it cannot be opened or is compressed.
+func openTar(name string) (*tarFS, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	magic := make([]byte, 2)
+	if _, err := io.ReadFull(f, magic); err == nil && bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		return nil, fmt.Errorf("cowfs: %s is a compressed tar archive; decompress it first", name)
+	}
+	return &tarFS{path: name}, nil
+}
+
+// tarFS is an io/fs.FS serving the files of a tar archive in place.
+type tarFS struct {
+	path string // Host path of the archive
+
+	once    sync.Once
+	err     error                // Failure to index the archive
+	entries map[string]*tarEntry // By io/fs name, "." being the root
+}
+
+// tarEntry is a file or directory of a tarFS.
+type tarEntry struct {
+	info     fs.FileInfo
+	offset   int64    // Offset of a file's contents in the archive
+	children []string // Sorted names of a directory's entries
+}
+
+// index reads the headers of the archive, once.
+func (t *tarFS) index() error {
+	t.once.Do(func() {
+		t.err = t.build()
+	})
+	return t.err
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (t *tarFS) build() error {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	t.entries = map[string]*tarEntry{
+		".": {info: tarDirInfo{name: "."}},
+	}
+	links := make(map[string]string) // Hard links to their targets
+	// archive/tar reads no further than the start of an entry's contents
+	// before returning its header, so the count of bytes read locates them
+	cr := &countingReader{r: f}
+	tr := tar.NewReader(cr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("cowfs: indexing %s: %w", t.path, err)
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "/"))
+		if name == "." || !fs.ValidPath(name) {
+			continue
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			t.add(name, &tarEntry{info: hdr.FileInfo(), offset: cr.n})
+			delete(links, name)
+		case tar.TypeDir:
+			if e, ok := t.entries[name]; ok && e.info.IsDir() {
+				e.info = hdr.FileInfo()
+				continue
+			}
+			t.add(name, &tarEntry{info: hdr.FileInfo()})
+		case tar.TypeLink:
+			links[name] = path.Clean(strings.TrimPrefix(hdr.Linkname, "/"))
+			t.add(name, &tarEntry{info: hdr.FileInfo()})
+		}
+	}
+	for name, target := range links {
+		e, ok := t.entries[target]
+		if _, chained := links[target]; !ok || chained || !e.info.Mode().IsRegular() {
+			t.remove(name)
+			continue
+		}
+		hdr := *e.info.Sys().(*tar.Header)
+		hdr.Name = name
+		t.entries[name] = &tarEntry{info: hdr.FileInfo(), offset: e.offset}
+	}
+	for _, e := range t.entries {
+		sort.Strings(e.children)
+	}
+	return nil
+}
+
+// add records e as name, creating missing parent directories and replacing
+// an earlier entry.
+func (t *tarFS) add(name string, e *tarEntry) {
+	if _, ok := t.entries[name]; ok {
+		t.remove(name)
+	}
+	dir := path.Dir(name)
+	parent, ok := t.entries[dir]
+	if !ok || !parent.info.IsDir() {
+		t.add(dir, &tarEntry{info: tarDirInfo{name: path.Base(dir)}})
+		parent = t.entries[dir]
+	}
+	parent.children = append(parent.children, path.Base(name))
+	t.entries[name] = e
+}
+
+// remove deletes name and, for a directory, the entries below it.
+func (t *tarFS) remove(name string) {
+	e, ok := t.entries[name]
+	if !ok {
+		return
+	}
+	for _, child := range e.children {
+		t.remove(path.Join(name, child))
+	}
+	delete(t.entries, name)
+	if parent, ok := t.entries[path.Dir(name)]; ok {
+		base := path.Base(name)
+		for i, child := range parent.children {
+			if child == base {
+				parent.children = append(parent.children[:i], parent.children[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// lookup returns the entry of name.
+func (t *tarFS) lookup(op, name string) (*tarEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if err := t.index(); err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	e, ok := t.entries[name]
+	if !ok {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return e, nil
+}
+
+func (t *tarFS) Open(name string) (fs.File, error) {
+	e, err := t.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if e.info.IsDir() {
+		entries, err := t.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		return &tarDir{info: e.info, entries: entries}, nil
+	}
+	f, err := os.Open(t.path)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &tarFile{SectionReader: io.NewSectionReader(f, e.offset, e.info.Size()), archive: f, info: e.info}, nil
+}
+
+func (t *tarFS) Stat(name string) (fs.FileInfo, error) {
+	e, err := t.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return e.info, nil
+}
+
+func (t *tarFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	e, err := t.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !e.info.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	entries := make([]fs.DirEntry, len(e.children))
+	for i, child := range e.children {
+		entries[i] = fs.FileInfoToDirEntry(t.entries[path.Join(name, child)].info)
+	}
+	return entries, nil
+}
+
+// tarFile is a file of a tarFS, read from the archive in place.
+type tarFile struct {
+	*io.SectionReader
+	archive *os.File
+	info    fs.FileInfo
+}
+
+func (f *tarFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *tarFile) Close() error               { return f.archive.Close() }
+
+// tarDir is a directory of a tarFS.
+type tarDir struct {
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *tarDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *tarDir) Close() error               { return nil }
+
+func (d *tarDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.Name(), Err: errors.New("is a directory")}
+}
+
+func (d *tarDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if n > 0 && len(rest) > n {
+		rest = rest[:n]
+	}
+	d.offset += len(rest)
+	if n > 0 && len(rest) == 0 {
+		return nil, io.EOF
+	}
+	return rest, nil
+}
+
+// tarDirInfo describes a directory implied by the paths in a tar archive.
+type tarDirInfo struct {
+	name string
+}
+
+func (i tarDirInfo) Name() string       { return i.name }
+func (i tarDirInfo) Size() int64        { return 0 }
+func (i tarDirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0755 }
+func (i tarDirInfo) ModTime() time.Time { return time.Time{} }
+func (i tarDirInfo) IsDir() bool        { return true }
+func (i tarDirInfo) Sys() any           { return nil }
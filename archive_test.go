@@ -0,0 +1,146 @@
+package cowfs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/absfs/memfs"
+)
+
+// writeTar writes a tar archive of entries to a file in a temporary
+// directory and returns its path.
+func writeTar(t *testing.T, entries []tar.Header, contents map[string]string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range entries {
+		data := contents[hdr.Name]
+		hdr.Size = int64(len(data))
+		if hdr.Typeflag != tar.TypeReg {
+			hdr.Size = 0
+		}
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			tw.Write([]byte(data))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(t.TempDir(), "bundle.tar")
+	if err := os.WriteFile(name, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestNewFromTar(t *testing.T) {
+	name := writeTar(t, []tar.Header{
+		{Name: "app/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "app/main.js", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "app/lib/util.js", Typeflag: tar.TypeReg, Mode: 0o644},
+		{Name: "app/alias.js", Typeflag: tar.TypeLink, Linkname: "app/lib/util.js"},
+		{Name: "app/link", Typeflag: tar.TypeSymlink, Linkname: "main.js"},
+	}, map[string]string{
+		"app/main.js":     "main()",
+		"app/lib/util.js": "util()",
+	})
+	cfs, err := NewFromTar(name, must(memfs.NewFS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{
+		"/app/main.js":     "main()",
+		"/app/lib/util.js": "util()",
+		"/app/alias.js":    "util()",
+	} {
+		if data, err := cfs.ReadFile(name); err != nil || string(data) != want {
+			t.Errorf("ReadFile(%s) = %q, %v; want %q", name, data, err, want)
+		}
+	}
+	if got := listNames(t, cfs, "/app"); len(got) != 3 || got[0] != "alias.js" || got[1] != "lib" || got[2] != "main.js" {
+		t.Errorf("ReadDir(/app) = %v; want alias.js, lib, main.js", got)
+	}
+	f, err := cfs.OpenFile("/app/main.js", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2)
+	if _, err := f.ReadAt(buf, 4); err != nil || string(buf) != "()" {
+		t.Errorf("ReadAt = %q, %v", buf, err)
+	}
+	f.Close()
+
+	// Patching leaves the archive alone
+	before, _ := os.ReadFile(name)
+	if err := cfs.WriteFile("/app/main.js", []byte("patched()"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := cfs.ReadFile("/app/main.js"); string(data) != "patched()" {
+		t.Errorf("ReadFile after patch = %q", data)
+	}
+	if after, _ := os.ReadFile(name); !bytes.Equal(before, after) {
+		t.Error("patching changed the archive")
+	}
+}
+
+func TestNewFromTarReplacedEntry(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, data := range []string{"first", "second"} {
+		tw.WriteHeader(&tar.Header{Name: "file", Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(data))})
+		tw.Write([]byte(data))
+	}
+	tw.Close()
+	name := filepath.Join(t.TempDir(), "twice.tar")
+	if err := os.WriteFile(name, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfs := must(NewFromTar(name, must(memfs.NewFS())))
+	if data, err := cfs.ReadFile("/file"); err != nil || string(data) != "second" {
+		t.Errorf("ReadFile = %q, %v; want the later entry", data, err)
+	}
+	if got := listNames(t, cfs, "/"); len(got) != 1 {
+		t.Errorf("ReadDir(/) = %v; want one entry", got)
+	}
+}
+
+func TestNewFromTarCompressed(t *testing.T) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tar.NewWriter(gw).Close()
+	gw.Close()
+	name := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	if err := os.WriteFile(name, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFromTar(name, must(memfs.NewFS())); err == nil {
+		t.Error("NewFromTar accepted a compressed archive")
+	}
+	if _, err := NewFromTar(filepath.Join(t.TempDir(), "missing.tar"), must(memfs.NewFS())); err == nil {
+		t.Error("NewFromTar accepted a missing archive")
+	}
+}
+
+func TestNewFromZip(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("app/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("<html>"))
+	zw.Close()
+	cfs := NewFromZip(must(zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))), must(memfs.NewFS()))
+	if data, err := cfs.ReadFile("/app/index.html"); err != nil || string(data) != "<html>" {
+		t.Errorf("ReadFile = %q, %v", data, err)
+	}
+}
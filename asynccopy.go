@@ -0,0 +1,348 @@
+package cowfs
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/absfs/absfs"
+)
+
+// WithAsyncCopyUp hides copy-up latency from writers: opening a primary
+// file for writing without O_TRUNC returns at once, while its contents are
+// copied to the secondary in the background. Writes through the returned
+// handle are buffered in memory, up to bufferSize bytes per handle, and
+// replayed once the copy completes; a write that would exceed the buffer,
+// and any other operation on the handle, such as a read, Seek or Stat,
+// waits for the copy to complete first.
+//
+// A copy-up that fails, including one refused by a quota, OnFirstWrite or
+// the free space check, is reported by the first operation on the handle
+// that waits for it, and by Close; the buffered writes are then discarded.
+// Other operations on the path, or on a directory above it, wait for its
+// copy to complete. A copy that panics reports a PanicError, as the tasks
+// run by Start do, and Close of the FileSystem waits for copies still in
+// progress. Copy-ups are made synchronously, as without this option, when
+// OnFirstWrite is set, since it must run on the caller's goroutine, and when
+// WithJournal is in effect, since the journal records operations as they
+// are made.
+func WithAsyncCopyUp(bufferSize int64) Option {
+	return func(fs *FileSystem) {
+		fs.asyncBuffer = bufferSize
+	}
+}
+
+// copiesAsync reports whether opening name with flag, which needs a
+// copy-up, copies it up in the background.
+func (cfs *FileSystem) copiesAsync(name string, flag int) bool {
+	if cfs.asyncBuffer <= 0 || cfs.firstWrite != nil || cfs.journal != nil {
+		return false
+	}
+	if cfs.isOpaque(path.Dir(name)) {
+		return false // Nothing to copy
+	}
+	info, err := cfs.primary.Stat(name)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// openAsync returns a handle to name that buffers writes while a background
+// task copies it up and opens it in the secondary. end is called once that
+// is done.
+func (cfs *FileSystem) openAsync(name string, flag int, perm os.FileMode, op EventOp, end func()) absfs.File {
+	f := &asyncFile{
+		name:   name,
+		limit:  cfs.asyncBuffer,
+		append: flag&os.O_APPEND != 0,
+		done:   make(chan struct{}),
+	}
+	cfs.mu.Lock()
+	if cfs.copying == nil {
+		cfs.copying = make(map[string]chan struct{})
+	}
+	cfs.copying[name] = f.done
+	cfs.mu.Unlock()
+
+	var file absfs.File
+	var err error
+	cfs.spawn("copy-up", func() {
+		file, err = cfs.finishAsync(name, flag, perm, op)
+	}, func(panicErr error) {
+		if panicErr != nil {
+			err = panicErr
+		}
+		cfs.mu.Lock()
+		delete(cfs.copying, name)
+		if panicErr != nil {
+			delete(cfs.modified, name)
+		}
+		cfs.mu.Unlock()
+		f.complete(file, err)
+		end()
+	})
+	return f
+}
+
+// finishAsync copies up name and opens it in the secondary, reverting its
+// modified mark on failure. The copy is dropped if name was deleted or
+// renamed in the meantime.
+func (cfs *FileSystem) finishAsync(name string, flag int, perm os.FileMode, op EventOp) (absfs.File, error) {
+	err := cfs.copyUp(name)
+	if err == nil {
+		var file absfs.File
+		var opened bool
+		if file, opened, err = cfs.openSecondary(name, flag, perm, op); opened {
+			if err == nil && !cfs.IsModified(name) {
+				file.Close()
+				cfs.secondary.Remove(name)
+				return nil, pathError("open", name, os.ErrNotExist)
+			}
+			return file, err
+		}
+	}
+	cfs.mu.Lock()
+	delete(cfs.modified, name)
+	cfs.mu.Unlock()
+	return nil, pathError("open", name, unwrapRefused(err))
+}
+
+// awaitCopies waits for the background copy-ups of names, and of the paths
+// beneath them, to complete, so that they are read and changed only once
+// their secondary copies are whole.
+func (cfs *FileSystem) awaitCopies(names ...string) {
+	if cfs.asyncBuffer <= 0 {
+		return
+	}
+	var pending []chan struct{}
+	cfs.mu.RLock()
+	for copied, done := range cfs.copying {
+		for _, name := range names {
+			if _, ok := relativeTo(name, copied); ok {
+				pending = append(pending, done)
+				break
+			}
+		}
+	}
+	cfs.mu.RUnlock()
+	for _, done := range pending {
+		<-done
+	}
+}
+
+// asyncWrite is a write buffered by an asyncFile.
+type asyncWrite struct {
+	data []byte
+	off  int64 // Offset to write at, unless appending
+}
+
+// asyncFile is a writable handle whose file is still being copied up. It
+// buffers writes until the copy completes, and then passes all calls to
+// the secondary file.
+type asyncFile struct {
+	name   string
+	limit  int64 // Bytes of writes to buffer at most
+	append bool  // Writes append to the file
+
+	mu       sync.Mutex
+	ready    bool // The copy completed and the buffer was replayed
+	buffered []asyncWrite
+	size     int64 // Bytes buffered
+	pos      int64 // Offset of the next Write, if not appending
+
+	done chan struct{} // Closed once ready
+	file absfs.File
+	err  error // Failure to copy up or to replay the buffer
+}
+
+// complete replays the buffered writes to file, opened after the copy-up,
+// or records the error that prevented opening it.
+func (f *asyncFile) complete(file absfs.File, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	defer close(f.done)
+	f.ready = true
+	f.file, f.err = file, err
+	if err != nil {
+		if file != nil {
+			file.Close()
+			f.file = nil
+		}
+		f.buffered = nil
+		return
+	}
+	for _, w := range f.buffered {
+		if f.append {
+			_, err = file.Write(w.data)
+		} else {
+			_, err = file.WriteAt(w.data, w.off)
+		}
+		if err != nil {
+			f.err = err
+			break
+		}
+	}
+	if f.err == nil && !f.append && f.pos > 0 {
+		_, f.err = file.Seek(f.pos, io.SeekStart)
+	}
+	f.buffered = nil
+}
+
+// wait waits for the copy-up and returns the secondary file.
+func (f *asyncFile) wait() (absfs.File, error) {
+	<-f.done
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.file, nil
+}
+
+// buffer buffers b, to be written at off, or at the current position if
+// off is negative. It reports false if b must wait for the copy instead.
+func (f *asyncFile) buffer(b []byte, off int64) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.ready || f.size+int64(len(b)) > f.limit || off >= 0 && f.append {
+		return false
+	}
+	if off < 0 {
+		off = f.pos
+		f.pos += int64(len(b))
+	}
+	f.buffered = append(f.buffered, asyncWrite{data: append([]byte(nil), b...), off: off})
+	f.size += int64(len(b))
+	return true
+}
+
+func (f *asyncFile) Name() string { return f.name }
+
+func (f *asyncFile) Write(b []byte) (int, error) {
+	if f.buffer(b, -1) {
+		return len(b), nil
+	}
+	file, err := f.wait()
+	if err != nil {
+		return 0, err
+	}
+	return file.Write(b)
+}
+
+func (f *asyncFile) WriteAt(b []byte, off int64) (int, error) {
+	if off >= 0 && f.buffer(b, off) {
+		return len(b), nil
+	}
+	file, err := f.wait()
+	if err != nil {
+		return 0, err
+	}
+	return file.WriteAt(b, off)
+}
+
+func (f *asyncFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+// ReadFrom copies r into the buffer while the copy-up is in progress, and
+// through the fast path of the secondary file, if it has one, after that.
+func (f *asyncFile) ReadFrom(r io.Reader) (int64, error) {
+	select {
+	case <-f.done:
+	default:
+		return io.Copy(writerOnly{f}, r)
+	}
+	file, err := f.wait()
+	if err != nil {
+		return 0, err
+	}
+	return readFrom(file, r)
+}
+
+func (f *asyncFile) WriteTo(w io.Writer) (int64, error) {
+	file, err := f.wait()
+	if err != nil {
+		return 0, err
+	}
+	return writeTo(file, w)
+}
+
+func (f *asyncFile) Read(b []byte) (int, error) {
+	file, err := f.wait()
+	if err != nil {
+		return 0, err
+	}
+	return file.Read(b)
+}
+
+func (f *asyncFile) ReadAt(b []byte, off int64) (int, error) {
+	file, err := f.wait()
+	if err != nil {
+		return 0, err
+	}
+	return file.ReadAt(b, off)
+}
+
+func (f *asyncFile) Seek(offset int64, whence int) (int64, error) {
+	file, err := f.wait()
+	if err != nil {
+		return 0, err
+	}
+	return file.Seek(offset, whence)
+}
+
+func (f *asyncFile) Stat() (os.FileInfo, error) {
+	file, err := f.wait()
+	if err != nil {
+		return nil, err
+	}
+	return file.Stat()
+}
+
+func (f *asyncFile) Sync() error {
+	file, err := f.wait()
+	if err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+func (f *asyncFile) Truncate(size int64) error {
+	file, err := f.wait()
+	if err != nil {
+		return err
+	}
+	return file.Truncate(size)
+}
+
+func (f *asyncFile) Readdir(n int) ([]os.FileInfo, error) {
+	file, err := f.wait()
+	if err != nil {
+		return nil, err
+	}
+	return file.Readdir(n)
+}
+
+func (f *asyncFile) Readdirnames(n int) ([]string, error) {
+	file, err := f.wait()
+	if err != nil {
+		return nil, err
+	}
+	return file.Readdirnames(n)
+}
+
+func (f *asyncFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	file, err := f.wait()
+	if err != nil {
+		return nil, err
+	}
+	return file.ReadDir(n)
+}
+
+// Close waits for the copy-up and the replay of the buffered writes, and
+// closes the secondary file.
+func (f *asyncFile) Close() error {
+	file, err := f.wait()
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,159 @@
+package cowfs
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// gatedStrategy copies up files once release is closed.
+type gatedStrategy struct {
+	release chan struct{}
+	err     error
+}
+
+func (g *gatedStrategy) CopyUp(primary, secondary absfs.Filer, name string, info os.FileInfo) error {
+	<-g.release
+	if g.err != nil {
+		return g.err
+	}
+	return FullCopy{}.CopyUp(primary, secondary, name, info)
+}
+
+func TestAsyncCopyUp(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	strategy := &gatedStrategy{release: make(chan struct{})}
+	WithCopyUpStrategy(strategy)(cfs)
+	WithAsyncCopyUp(64)(cfs)
+	writeMemFile(t, primary, "/log.txt", "first\n")
+	writeMemFile(t, primary, "/data.txt", "abcdef")
+
+	// Writes are buffered while the copy-ups wait
+	log := must(cfs.OpenFile("/log.txt", os.O_WRONLY|os.O_APPEND, 0))
+	must(log.WriteString("second\n"))
+	must(log.WriteString("third\n"))
+	data := must(cfs.OpenFile("/data.txt", os.O_RDWR, 0))
+	must(data.Write([]byte("AB")))
+	must(data.WriteAt([]byte("E"), 4))
+
+	close(strategy.release)
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2)
+	if n, _ := data.Read(buf); string(buf[:n]) != "cd" {
+		t.Errorf("Read() after buffered writes = %q, want %q", buf[:n], "cd")
+	}
+	if err := data.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := cfs.ReadFile("/log.txt"); string(got) != "first\nsecond\nthird\n" {
+		t.Errorf("log.txt = %q, want buffered appends after primary contents", got)
+	}
+	if got, _ := cfs.ReadFile("/data.txt"); string(got) != "ABcdEf" {
+		t.Errorf("data.txt = %q, want %q", got, "ABcdEf")
+	}
+	if got, _ := primary.ReadFile("/data.txt"); string(got) != "abcdef" {
+		t.Errorf("primary data.txt = %q, want it untouched", got)
+	}
+}
+
+func TestAsyncCopyUpFailure(t *testing.T) {
+	cfs, primary, secondary := newMemOverlay(t)
+	refused := errors.New("refused")
+	strategy := &gatedStrategy{release: make(chan struct{}), err: refused}
+	WithCopyUpStrategy(strategy)(cfs)
+	WithAsyncCopyUp(64)(cfs)
+	writeMemFile(t, primary, "/file.txt", "content")
+
+	f := must(cfs.OpenFile("/file.txt", os.O_WRONLY, 0))
+	must(f.WriteString("lost"))
+	close(strategy.release)
+	if err := f.Close(); !errors.Is(err, refused) {
+		t.Errorf("Close() = %v, want the copy-up error", err)
+	}
+	if err := cfs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := cfs.ReadFile("/file.txt"); string(got) != "content" {
+		t.Errorf("ReadFile() = %q, want the primary contents", got)
+	}
+	if _, err := secondary.Stat("/file.txt"); !os.IsNotExist(err) {
+		t.Errorf("secondary Stat() = %v, want not exist", err)
+	}
+}
+
+func TestAsyncCopyUpWaits(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	strategy := &gatedStrategy{release: make(chan struct{})}
+	WithCopyUpStrategy(strategy)(cfs)
+	WithAsyncCopyUp(64)(cfs)
+	writeMemFile(t, primary, "/read.txt", "whole")
+	writeMemFile(t, primary, "/gone.txt", "deleted")
+
+	// Reads of a path wait for its copy-up
+	f := must(cfs.OpenFile("/read.txt", os.O_WRONLY, 0))
+	read := make(chan string)
+	go func() {
+		data, _ := cfs.ReadFile("/read.txt")
+		read <- string(data)
+	}()
+	select {
+	case data := <-read:
+		t.Fatalf("ReadFile() = %q before the copy-up completed", data)
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(strategy.release)
+	if data := <-read; data != "whole" {
+		t.Errorf("ReadFile() = %q, want %q", data, "whole")
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A removal waits for the copy-up, which does not bring the file back
+	strategy.release = make(chan struct{})
+	f = must(cfs.OpenFile("/gone.txt", os.O_WRONLY, 0))
+	removed := make(chan error)
+	go func() { removed <- cfs.Remove("/gone.txt") }()
+	close(strategy.release)
+	if err := <-removed; err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	g := must(cfs.OpenFile("/gone.txt", os.O_CREATE|os.O_RDWR, 0644))
+	if info := must(g.Stat()); info.Size() != 0 {
+		t.Errorf("recreated file size = %d, want 0", info.Size())
+	}
+	g.Close()
+}
+
+// panicStrategy panics on every copy-up.
+type panicStrategy struct{}
+
+func (panicStrategy) CopyUp(primary, secondary absfs.Filer, name string, info os.FileInfo) error {
+	panic("copy-up failed")
+}
+
+func TestAsyncCopyUpPanic(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	WithCopyUpStrategy(panicStrategy{})(cfs)
+	WithAsyncCopyUp(64)(cfs)
+	writeMemFile(t, primary, "/file.txt", "content")
+
+	f := must(cfs.OpenFile("/file.txt", os.O_WRONLY, 0))
+	var pe *PanicError
+	if err := f.Close(); !errors.As(err, &pe) {
+		t.Errorf("Close() = %v, want a PanicError", err)
+	}
+	if cfs.IsModified("/file.txt") {
+		t.Error("file still marked modified after the copy-up panicked")
+	}
+	if err := cfs.Close(); !errors.As(err, &pe) {
+		t.Errorf("FileSystem Close() = %v, want a PanicError", err)
+	}
+}
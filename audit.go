@@ -0,0 +1,97 @@
+package cowfs
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditRecord is an entry of the audit log written by WithAuditLog.
+type AuditRecord struct {
+	Time    time.Time   `json:"time"`
+	Op      string      `json:"op"`                // Method name in lower case, such as "open" or "rename"
+	Path    string      `json:"path"`              // Path as passed by the caller
+	NewPath string      `json:"newPath,omitempty"` // New name of Rename and Link
+	Target  string      `json:"target,omitempty"`  // Target of Symlink
+	Flags   string      `json:"flags,omitempty"`   // OpenFile flags, such as "O_WRONLY|O_CREATE"
+	Mode    os.FileMode `json:"mode,omitempty"`    // Permissions of OpenFile, Mkdir, Chmod and WriteFile
+	Size    *int64      `json:"size,omitempty"`    // Size of Truncate
+	Owner   *Owner      `json:"owner,omitempty"`   // Owner of Chown and Lchown
+	Err     string      `json:"error,omitempty"`   // Error returned, if the operation failed
+}
+
+// WithAuditLog appends a record of every mutation made through the
+// overlay's filesystem methods to w, as a line of JSON encoding an
+// AuditRecord: OpenFile with write flags, WriteFile, Truncate, Mkdir,
+// Remove, Rename, Chmod, Chtimes, Chown, Lchown, Symlink and Link, whether
+// they succeed or fail, including those refused by an access hook or by
+// Freeze. Each record is written with a single call to w, after the
+// operation returns, so records of concurrent operations are not
+// interleaved. Changes made by the overlay's own maintenance, such as
+// Commit, ImportTar or GC, are not recorded. Failures to write to w do not
+// fail the operation and are counted as AuditFailures in Stats.
+func WithAuditLog(w io.Writer) Option {
+	return func(fs *FileSystem) {
+		fs.auditLog = &auditLog{w: w}
+	}
+}
+
+// auditLog serializes the records written to an audit log.
+type auditLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// audit records rec with the error err points to, once the operation has
+// returned. It is deferred first thing by mutations.
+func (cfs *FileSystem) audit(err *error, rec AuditRecord) {
+	if cfs.auditLog == nil {
+		return
+	}
+	rec.Time = time.Now()
+	if *err != nil {
+		rec.Err = (*err).Error()
+	}
+	line, jsonErr := json.Marshal(rec)
+	if jsonErr != nil {
+		cfs.counters.auditFailures.Add(1)
+		return
+	}
+	line = append(line, '\n')
+	cfs.auditLog.mu.Lock()
+	defer cfs.auditLog.mu.Unlock()
+	if _, err := cfs.auditLog.w.Write(line); err != nil {
+		cfs.counters.auditFailures.Add(1)
+	}
+}
+
+// openFlags are the OpenFile flags by name, the access mode first.
+var openFlags = []struct {
+	flag int
+	name string
+}{
+	{os.O_WRONLY, "O_WRONLY"},
+	{os.O_RDWR, "O_RDWR"},
+	{os.O_APPEND, "O_APPEND"},
+	{os.O_CREATE, "O_CREATE"},
+	{os.O_EXCL, "O_EXCL"},
+	{os.O_SYNC, "O_SYNC"},
+	{os.O_TRUNC, "O_TRUNC"},
+}
+
+// flagString formats OpenFile flags as their names joined by "|".
+func flagString(flag int) string {
+	var names []string
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		names = append(names, "O_RDONLY")
+	}
+	for _, f := range openFlags {
+		if flag&f.flag != 0 {
+			names = append(names, f.name)
+		}
+	}
+	return strings.Join(names, "|")
+}
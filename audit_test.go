@@ -0,0 +1,88 @@
+package cowfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	_, primary, secondary := newMemOverlay(t)
+	writeMemFile(t, primary, "/config", "v1")
+	var log bytes.Buffer
+	cfs := New(primary, secondary, WithAuditLog(&log))
+
+	f, err := cfs.OpenFile("/config", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err := cfs.ReadFile("/config"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Mkdir("/data", 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Rename("/config", "/data/config"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Truncate("/data/config", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Remove("/missing"); err == nil {
+		t.Fatal("Remove(/missing) succeeded")
+	}
+
+	var records []AuditRecord
+	sc := bufio.NewScanner(&log)
+	for sc.Scan() {
+		var rec AuditRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			t.Fatalf("audit line %q: %v", sc.Text(), err)
+		}
+		records = append(records, rec)
+	}
+	want := []AuditRecord{
+		{Op: "open", Path: "/config", Flags: "O_WRONLY|O_APPEND"},
+		{Op: "mkdir", Path: "/data", Mode: 0750},
+		{Op: "rename", Path: "/config", NewPath: "/data/config"},
+		{Op: "truncate", Path: "/data/config"},
+		{Op: "remove", Path: "/missing"},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("audit records = %+v; want %d", records, len(want))
+	}
+	for i, rec := range records {
+		w := want[i]
+		if rec.Op != w.Op || rec.Path != w.Path || rec.NewPath != w.NewPath || rec.Flags != w.Flags || rec.Mode != w.Mode {
+			t.Errorf("record %d = %+v; want %+v", i, rec, w)
+		}
+		if rec.Time.IsZero() {
+			t.Errorf("record %d has no time", i)
+		}
+	}
+	if records[3].Size == nil || *records[3].Size != 0 {
+		t.Errorf("truncate record size = %v; want 0", records[3].Size)
+	}
+	if records[4].Err == "" {
+		t.Error("failed Remove recorded without its error")
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("disk full") }
+
+func TestAuditLogFailures(t *testing.T) {
+	_, primary, secondary := newMemOverlay(t)
+	cfs := New(primary, secondary, WithAuditLog(failingWriter{}))
+	if err := cfs.Mkdir("/dir", 0755); err != nil {
+		t.Fatalf("Mkdir with a failing audit log = %v", err)
+	}
+	if got := cfs.Stats().AuditFailures; got != 1 {
+		t.Errorf("AuditFailures = %d; want 1", got)
+	}
+}
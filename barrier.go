@@ -0,0 +1,84 @@
+package cowfs
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// ErrEpochChanged is returned by epoch-pinned operations when the overlay has
+// been mutated since the epoch was issued by Barrier.
+var ErrEpochChanged = errors.New("cowfs: overlay changed since epoch")
+
+// Epoch identifies a settled state of the overlay. It is returned by Barrier
+// and may be passed to the ...At variants of export and diff operations to
+// ensure they observe exactly that state.
+type Epoch uint64
+
+// Barrier waits for all in-flight mutating operations, including their
+// copy-ups, to complete and returns an Epoch identifying the resulting state.
+// Mutations that start while Barrier is waiting are held back until it
+// returns, so Barrier cannot be starved by a steady stream of writes.
+//
+// Writes made through already open file handles are not tracked; close
+// writable handles before calling Barrier for a fully consistent epoch.
+func (cfs *FileSystem) Barrier(ctx context.Context) (Epoch, error) {
+	acquired := make(chan struct{})
+	go func() {
+		cfs.opMu.Lock()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		e := Epoch(cfs.gen.Load())
+		cfs.opMu.Unlock()
+		return e, nil
+	case <-ctx.Done():
+		go func() {
+			<-acquired
+			cfs.opMu.Unlock()
+		}()
+		return 0, ctx.Err()
+	}
+}
+
+// ExportTarAt is like ExportTar but fails with ErrEpochChanged unless the
+// overlay is still at epoch e. Mutations are held back for the duration of
+// the export.
+func (cfs *FileSystem) ExportTarAt(w io.Writer, e Epoch) error {
+	return cfs.pin(e, func() error {
+		return cfs.ExportTar(w)
+	})
+}
+
+// DiffAllAt is like DiffAll but fails with ErrEpochChanged unless the
+// overlay is still at epoch e. Mutations are held back while the diffs are
+// written.
+func (cfs *FileSystem) DiffAllAt(w io.Writer, e Epoch) error {
+	return cfs.pin(e, func() error {
+		return cfs.DiffAll(w)
+	})
+}
+
+// pin runs fn with mutations excluded, provided the overlay is still at e.
+func (cfs *FileSystem) pin(e Epoch, fn func() error) error {
+	cfs.opMu.Lock()
+	defer cfs.opMu.Unlock()
+	if Epoch(cfs.gen.Load()) != e {
+		return ErrEpochChanged
+	}
+	return fn()
+}
+
+// beginOp registers a mutating operation with the write barrier. The returned
+// function must be called when the operation completes; it advances the
+// overlay generation. Mutating operations must not nest calls to beginOp.
+func (cfs *FileSystem) beginOp() func() {
+	cfs.opMu.RLock()
+	return func() {
+		cfs.gen.Add(1)
+		cfs.opMu.RUnlock()
+		cfs.stateChanged()
+	}
+}
@@ -0,0 +1,92 @@
+package cowfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBarrier(t *testing.T) {
+	cfs, _, _ := newMemOverlay(t)
+
+	e1, err := cfs.Barrier(context.Background())
+	if err != nil {
+		t.Fatalf("Barrier() error = %v", err)
+	}
+	e2, _ := cfs.Barrier(context.Background())
+	if e1 != e2 {
+		t.Errorf("Barrier() epochs differ without mutation: %d != %d", e1, e2)
+	}
+
+	cfs.Mkdir("/dir", 0755)
+	e3, _ := cfs.Barrier(context.Background())
+	if e3 == e2 {
+		t.Error("Barrier() epoch did not advance after mutation")
+	}
+}
+
+func TestBarrierWaitsForInflight(t *testing.T) {
+	cfs, _, _ := newMemOverlay(t)
+
+	end := cfs.beginOp()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := cfs.Barrier(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Barrier() error = %v, want deadline exceeded", err)
+	}
+
+	done := make(chan Epoch)
+	go func() {
+		e, _ := cfs.Barrier(context.Background())
+		done <- e
+	}()
+	end()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Barrier() did not return after in-flight operation completed")
+	}
+}
+
+func TestExportTarAt(t *testing.T) {
+	cfs, _, _ := newMemOverlay(t)
+	cfs.Mkdir("/dir", 0755)
+
+	e, err := cfs.Barrier(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := cfs.ExportTarAt(&buf, e); err != nil {
+		t.Fatalf("ExportTarAt() error = %v", err)
+	}
+
+	cfs.Remove("/dir")
+	if err := cfs.ExportTarAt(&buf, e); !errors.Is(err, ErrEpochChanged) {
+		t.Errorf("ExportTarAt() error = %v, want ErrEpochChanged", err)
+	}
+}
+
+func TestDiffAllAt(t *testing.T) {
+	cfs, _, _ := newMemOverlay(t)
+	cfs.WriteFile("/a.txt", []byte("a\n"), 0644)
+
+	e, err := cfs.Barrier(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := cfs.DiffAllAt(&buf, e); err != nil {
+		t.Fatalf("DiffAllAt() error = %v", err)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("+++ b/a.txt")) {
+		t.Errorf("DiffAllAt() = %q, want the diff of a.txt", buf.String())
+	}
+
+	cfs.Remove("/a.txt")
+	if err := cfs.DiffAllAt(&buf, e); !errors.Is(err, ErrEpochChanged) {
+		t.Errorf("DiffAllAt() error = %v, want ErrEpochChanged", err)
+	}
+}
@@ -0,0 +1,440 @@
+// Package bench drives synthetic workloads against cowfs overlays, so that
+// option sets such as copy-up strategies or delta storage can be compared on
+// throughput, latency and overlay growth before choosing one.
+//
+// A Workload seeds a primary with files of a chosen size distribution and
+// runs a weighted mix of reads, first writes, rewrites and deletes over them.
+// Run executes it against one option set; Compare runs the same workload,
+// with the same random sequence, against several and WriteTable prints the
+// results side by side:
+//
+//	results, err := bench.Compare(bench.Workload{
+//		Files: 1000,
+//		Size:  bench.Uniform(4<<10, 1<<20),
+//		Ops:   10000,
+//		Mix:   bench.Mix{Reads: 80, FirstWrites: 10, Rewrites: 5, Deletes: 5},
+//	}, []bench.Config{
+//		{Name: "full"},
+//		{Name: "delta", Options: []cowfs.Option{cowfs.WithDeltaThreshold(64 << 10)}},
+//	})
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	bench.WriteTable(os.Stdout, results)
+package bench
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/cowfs"
+	"github.com/absfs/memfs"
+)
+
+// Op is a kind of workload operation.
+type Op int
+
+const (
+	// Read reads a whole file.
+	Read Op = iota
+
+	// FirstWrite writes to a file that has not been written yet, so that it
+	// is copied up from the primary.
+	FirstWrite
+
+	// Rewrite writes to a file that has already been written.
+	Rewrite
+
+	// Delete removes a file.
+	Delete
+
+	numOps
+)
+
+func (op Op) String() string {
+	switch op {
+	case Read:
+		return "read"
+	case FirstWrite:
+		return "first-write"
+	case Rewrite:
+		return "rewrite"
+	case Delete:
+		return "delete"
+	}
+	return "unknown"
+}
+
+// Mix holds the relative weights of the operations of a workload. An
+// operation with nothing to act on, such as a rewrite before any file has
+// been written, is replaced by a read.
+type Mix struct {
+	Reads       int
+	FirstWrites int
+	Rewrites    int
+	Deletes     int
+}
+
+func (m Mix) weights() [numOps]int {
+	return [numOps]int{m.Reads, m.FirstWrites, m.Rewrites, m.Deletes}
+}
+
+// SizeDistribution returns the size of a seeded file.
+type SizeDistribution func(r *rand.Rand) int64
+
+// Fixed returns a distribution of files of exactly n bytes.
+func Fixed(n int64) SizeDistribution {
+	return func(*rand.Rand) int64 { return n }
+}
+
+// Uniform returns a distribution of file sizes uniform in [min, max].
+func Uniform(min, max int64) SizeDistribution {
+	return func(r *rand.Rand) int64 { return min + r.Int63n(max-min+1) }
+}
+
+// Workload describes the files and operations of a benchmark run.
+type Workload struct {
+	Files     int              // Files seeded in the primary
+	Size      SizeDistribution // Sizes of the seeded files; default Fixed(4096)
+	Ops       int              // Operations to run
+	Mix       Mix              // Operation weights; default all reads
+	WriteSize int              // Bytes written by each write; default 4096
+	Seed      int64            // Seed of the random sequence
+
+	// Layers returns the primary and secondary to run against. The primary
+	// is seeded by Run. The default is a pair of empty memfs filesystems.
+	Layers func() (primary, secondary absfs.Filer, err error)
+}
+
+// Config is an option set to benchmark.
+type Config struct {
+	Name    string
+	Options []cowfs.Option
+}
+
+// Latency summarizes the latencies of one kind of operation.
+type Latency struct {
+	Count int
+	Mean  time.Duration
+	P50   time.Duration
+	P99   time.Duration
+	Max   time.Duration
+}
+
+// Result reports a benchmark run.
+type Result struct {
+	Name    string
+	Ops     int            // Operations run
+	Elapsed time.Duration  // Time spent running operations, excluding seeding
+	Latency map[Op]Latency // Latencies by operation kind
+	Growth  int64          // Bytes of regular files in the secondary afterwards
+	Stats   cowfs.Stats    // Overlay counters afterwards
+}
+
+// Throughput returns the operations run per second.
+func (r Result) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Ops) / r.Elapsed.Seconds()
+}
+
+// Run seeds a primary as described by w and runs its operations through an
+// overlay created with opts.
+func Run(w Workload, opts ...cowfs.Option) (Result, error) {
+	w = w.withDefaults()
+	primary, secondary, err := w.Layers()
+	if err != nil {
+		return Result{}, err
+	}
+	r := rand.New(rand.NewSource(w.Seed))
+	names, err := seed(primary, w, r)
+	if err != nil {
+		return Result{}, fmt.Errorf("bench: seeding primary: %w", err)
+	}
+
+	cfs := cowfs.New(primary, secondary, opts...)
+	defer cfs.Close()
+	d := &driver{
+		cfs:      cfs,
+		r:        r,
+		pristine: names,
+		data:     make([]byte, w.WriteSize),
+	}
+	r.Read(d.data)
+
+	weights := w.Mix.weights()
+	var total int
+	for _, wt := range weights {
+		total += wt
+	}
+	samples := make(map[Op][]time.Duration)
+	var elapsed time.Duration
+	for i := 0; i < w.Ops; i++ {
+		op := d.choose(pick(r, weights, total))
+		start := time.Now()
+		if err := d.run(op); err != nil {
+			return Result{}, fmt.Errorf("bench: %v: %w", op, err)
+		}
+		took := time.Since(start)
+		elapsed += took
+		samples[op] = append(samples[op], took)
+	}
+
+	res := Result{
+		Ops:     w.Ops,
+		Elapsed: elapsed,
+		Latency: make(map[Op]Latency, len(samples)),
+		Growth:  treeSize(secondary, "/"),
+		Stats:   cfs.Stats(),
+	}
+	for op, s := range samples {
+		res.Latency[op] = summarize(s)
+	}
+	return res, nil
+}
+
+// Compare runs w once for each of configs.
+func Compare(w Workload, configs []Config) ([]Result, error) {
+	results := make([]Result, 0, len(configs))
+	for _, c := range configs {
+		res, err := Run(w, c.Options...)
+		if err != nil {
+			return results, fmt.Errorf("%s: %w", c.Name, err)
+		}
+		res.Name = c.Name
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// WriteTable writes results to w as an aligned text table with one row per
+// result.
+func WriteTable(w io.Writer, results []Result) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprint(tw, "config\tops/s")
+	for op := Op(0); op < numOps; op++ {
+		fmt.Fprintf(tw, "\t%v p50\t%v p99", op, op)
+	}
+	fmt.Fprint(tw, "\tcopy-ups\tgrowth\n")
+	for _, res := range results {
+		fmt.Fprintf(tw, "%s\t%.0f", res.Name, res.Throughput())
+		for op := Op(0); op < numOps; op++ {
+			l, ok := res.Latency[op]
+			if !ok {
+				fmt.Fprint(tw, "\t-\t-")
+				continue
+			}
+			fmt.Fprintf(tw, "\t%v\t%v", l.P50, l.P99)
+		}
+		fmt.Fprintf(tw, "\t%d\t%d\n", res.Stats.CopyUps, res.Growth)
+	}
+	return tw.Flush()
+}
+
+func (w Workload) withDefaults() Workload {
+	if w.Size == nil {
+		w.Size = Fixed(4096)
+	}
+	if w.Mix == (Mix{}) {
+		w.Mix = Mix{Reads: 1}
+	}
+	if w.WriteSize <= 0 {
+		w.WriteSize = 4096
+	}
+	if w.Layers == nil {
+		w.Layers = memLayers
+	}
+	return w
+}
+
+func memLayers() (absfs.Filer, absfs.Filer, error) {
+	primary, err := memfs.NewFS()
+	if err != nil {
+		return nil, nil, err
+	}
+	secondary, err := memfs.NewFS()
+	if err != nil {
+		return nil, nil, err
+	}
+	return primary, secondary, nil
+}
+
+// seed writes the workload's files to the primary, spread over directories
+// of at most 256 files, and returns their names.
+func seed(primary absfs.Filer, w Workload, r *rand.Rand) ([]string, error) {
+	names := make([]string, w.Files)
+	buf := make([]byte, 32<<10)
+	r.Read(buf)
+	for i := range names {
+		dir := fmt.Sprintf("/d%03d", i/256)
+		if i%256 == 0 {
+			if err := primary.Mkdir(dir, 0755); err != nil && !errors.Is(err, os.ErrExist) {
+				return nil, err
+			}
+		}
+		names[i] = path.Join(dir, fmt.Sprintf("f%05d", i))
+		f, err := primary.OpenFile(names[i], os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			return nil, err
+		}
+		for left := w.Size(r); left > 0 && err == nil; {
+			n := int64(len(buf))
+			if left < n {
+				n = left
+			}
+			_, err = f.Write(buf[:n])
+			left -= n
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return names, nil
+}
+
+// driver runs operations and tracks which files they can act on.
+type driver struct {
+	cfs      *cowfs.FileSystem
+	r        *rand.Rand
+	pristine []string // Files not written yet
+	written  []string // Files written at least once
+	data     []byte
+}
+
+// pick returns an operation chosen at random by weight.
+func pick(r *rand.Rand, weights [numOps]int, total int) Op {
+	n := r.Intn(total)
+	for op, wt := range weights {
+		if n < wt {
+			return Op(op)
+		}
+		n -= wt
+	}
+	return Read
+}
+
+// choose replaces op by a read if there is no file for it to act on.
+func (d *driver) choose(op Op) Op {
+	switch {
+	case op == FirstWrite && len(d.pristine) == 0,
+		op == Rewrite && len(d.written) == 0,
+		len(d.pristine)+len(d.written) == 0:
+		return Read
+	}
+	return op
+}
+
+// live returns the index of a random existing file, in pristine if it is
+// below len(pristine) and in written otherwise.
+func (d *driver) live() int {
+	return d.r.Intn(len(d.pristine) + len(d.written))
+}
+
+func (d *driver) name(i int) string {
+	if i < len(d.pristine) {
+		return d.pristine[i]
+	}
+	return d.written[i-len(d.pristine)]
+}
+
+// forget drops the file at index i, as returned by live.
+func (d *driver) forget(i int) {
+	if i < len(d.pristine) {
+		d.pristine = remove(d.pristine, i)
+	} else {
+		d.written = remove(d.written, i-len(d.pristine))
+	}
+}
+
+func (d *driver) run(op Op) error {
+	if len(d.pristine)+len(d.written) == 0 {
+		return nil // Everything deleted; reads have nothing to do
+	}
+	switch op {
+	case FirstWrite:
+		i := d.r.Intn(len(d.pristine))
+		name := d.pristine[i]
+		d.pristine = remove(d.pristine, i)
+		d.written = append(d.written, name)
+		return d.write(name)
+	case Rewrite:
+		return d.write(d.written[d.r.Intn(len(d.written))])
+	case Delete:
+		i := d.live()
+		name := d.name(i)
+		d.forget(i)
+		return d.cfs.Remove(name)
+	}
+	_, err := d.cfs.ReadFile(d.name(d.live()))
+	return err
+}
+
+// write overwrites the start of name.
+func (d *driver) write(name string) error {
+	f, err := d.cfs.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(d.data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// remove removes element i of s, not preserving order.
+func remove(s []string, i int) []string {
+	s[i] = s[len(s)-1]
+	return s[:len(s)-1]
+}
+
+func summarize(samples []time.Duration) Latency {
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	var sum time.Duration
+	for _, s := range samples {
+		sum += s
+	}
+	n := len(samples)
+	return Latency{
+		Count: n,
+		Mean:  sum / time.Duration(n),
+		P50:   samples[n/2],
+		P99:   samples[(n*99)/100],
+		Max:   samples[n-1],
+	}
+}
+
+// treeSize returns the total size of the regular files at or below name.
+func treeSize(filer absfs.Filer, name string) int64 {
+	info, err := filer.Stat(name)
+	if err != nil {
+		return 0
+	}
+	if info.Mode().IsRegular() {
+		return info.Size()
+	}
+	if !info.IsDir() {
+		return 0
+	}
+	entries, err := filer.ReadDir(name)
+	if err != nil {
+		return 0
+	}
+	var total int64
+	for _, entry := range entries {
+		total += treeSize(filer, path.Join(name, entry.Name()))
+	}
+	return total
+}
@@ -0,0 +1,66 @@
+package bench
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/absfs/cowfs"
+)
+
+func TestCompare(t *testing.T) {
+	w := Workload{
+		Files: 100,
+		Size:  Uniform(128<<10, 256<<10),
+		Ops:   500,
+		Mix:   Mix{Reads: 6, FirstWrites: 2, Rewrites: 1, Deletes: 1},
+		Seed:  1,
+	}
+	results, err := Compare(w, []Config{
+		{Name: "full"},
+		{Name: "delta", Options: []cowfs.Option{cowfs.WithDeltaThreshold(64 << 10)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("Compare() returned %d results, want 2", len(results))
+	}
+
+	full, delta := results[0], results[1]
+	var ops int
+	for _, l := range full.Latency {
+		ops += l.Count
+	}
+	if full.Ops != w.Ops || ops != w.Ops {
+		t.Errorf("ran %d ops with %d latency samples, want %d", full.Ops, ops, w.Ops)
+	}
+	if full.Latency[FirstWrite].Count == 0 || full.Latency[Delete].Count == 0 {
+		t.Error("workload mix not applied")
+	}
+	// The same seed drives the same operations
+	if full.Stats.CopyUps != delta.Stats.CopyUps || full.Stats.CopyUps == 0 {
+		t.Errorf("copy-ups = %d and %d, want the same nonzero count", full.Stats.CopyUps, delta.Stats.CopyUps)
+	}
+	if delta.Growth >= full.Growth {
+		t.Errorf("delta growth %d not below full copy growth %d", delta.Growth, full.Growth)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteTable(&buf, results); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != 3 {
+		t.Errorf("WriteTable() wrote %d lines, want 3:\n%s", len(lines), buf.String())
+	}
+}
+
+func TestRunAllDeleted(t *testing.T) {
+	res, err := Run(Workload{Files: 5, Ops: 50, Mix: Mix{Reads: 1, Deletes: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Stats.Deleted != 5 {
+		t.Errorf("Deleted = %d, want 5", res.Stats.Deleted)
+	}
+}
@@ -0,0 +1,621 @@
+package cowfs
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"reflect"
+	"sync"
+
+	"github.com/absfs/absfs"
+)
+
+// casDir holds the content index of a content-addressed secondary, and its
+// objects unless they are kept in a separate store.
+const casDir = "/.cowfs-objects~"
+
+// casIndexName is the path of the content index in the secondary.
+const casIndexName = casDir + "/index.json"
+
+// WithContentStore stores the contents of the secondary's regular files by
+// their hash, SHA-256 unless set with WithHasher, keeping each distinct
+// content once, so that copy-ups of many files that end up with the same
+// contents, such as a tree of primary files that are only chmod'd, take the
+// space of one copy. A file's mode, modification time and place in the
+// tree stay in the secondary, as an empty placeholder, and an index in the
+// secondary maps its path to the hash of its contents.
+//
+// objects is where the contents are kept. If it is nil they are kept in the
+// secondary, and removed when no file refers to them any more. A separate
+// store can be shared by several overlays, which makes Clone between
+// overlays using the same store cheap: the clone refers to the stored
+// contents instead of copying them. Contents in a shared store are never
+// removed, since other overlays may refer to them.
+//
+// Files are stored when a writable handle to them is closed; a file being
+// written is kept in full in the secondary until then, and stored contents
+// are copied back into the secondary before a file is written in place.
+// Delta storage is disabled, Quotas count the size of every file, however
+// much of it is shared, and ownership set in the secondary is not kept when
+// a file is stored. Optional interfaces of the secondary besides symbolic
+// links, such as Linker, are not available in this mode.
+func WithContentStore(objects absfs.Filer) Option {
+	return func(fs *FileSystem) {
+		fs.secondary = newCASFiler(fs.secondary, objects, fs.newHash)
+		fs.links = supportsLinks(fs.primary, fs.secondary)
+	}
+}
+
+// ContentStoreStats reports the files of a content-addressed secondary.
+type ContentStoreStats struct {
+	Files       int   // Files whose contents are stored by hash
+	Objects     int   // Distinct contents they refer to
+	Bytes       int64 // Total size of the files
+	StoredBytes int64 // Total size of the distinct contents
+}
+
+// ContentStoreStats returns the content store counters. It returns the zero
+// value if WithContentStore is not in effect.
+func (cfs *FileSystem) ContentStoreStats() ContentStoreStats {
+	c := asCAS(cfs.secondary)
+	if c == nil {
+		return ContentStoreStats{}
+	}
+	return c.stats()
+}
+
+// casEntry is the stored contents of a file.
+type casEntry struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// casFiler is an absfs.Filer keeping the contents of the files of the Filer
+// it wraps by hash.
+type casFiler struct {
+	absfs.Filer
+	objects absfs.Filer // Where contents are kept
+	root    string      // Directory of the contents in objects
+	shared  bool        // objects is a store separate from the secondary
+	newHash func() hash.Hash
+
+	mu    sync.Mutex
+	err   error               // Failure to load the index
+	index map[string]casEntry // Stored files by path
+	refs  map[string]int      // Files referring to each hash
+}
+
+// newCASFiler wraps filer in a casFiler keeping contents in objects, or in
+// filer if objects is nil, by their newHash hash, and keeping its support
+// for symbolic links.
+func newCASFiler(filer, objects absfs.Filer, newHash func() hash.Hash) absfs.Filer {
+	var wrapped absfs.Filer
+	var c *casFiler
+	if _, ok := filer.(absfs.SymLinker); ok {
+		s := &casSymFiler{}
+		wrapped, c = s, &s.casFiler
+	} else {
+		c = &casFiler{}
+		wrapped = c
+	}
+	c.Filer, c.objects, c.shared, c.newHash = filer, objects, objects != nil, newHash
+	c.index = make(map[string]casEntry)
+	c.refs = make(map[string]int)
+	if objects == nil {
+		c.objects, c.root = filer, casDir
+	}
+	c.err = c.load()
+	return wrapped
+}
+
+// asCAS returns the casFiler of a secondary, or nil if it is not one.
+func asCAS(filer absfs.Filer) *casFiler {
+	switch c := filer.(type) {
+	case *casFiler:
+		return c
+	case *casSymFiler:
+		return &c.casFiler
+	}
+	return nil
+}
+
+// load reads the index kept in the secondary.
+func (c *casFiler) load() error {
+	data, err := c.Filer.ReadFile(casIndexName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &c.index); err != nil {
+		return &os.PathError{Op: "load", Path: casIndexName, Err: err}
+	}
+	for _, e := range c.index {
+		c.refs[e.Hash]++
+	}
+	return nil
+}
+
+// save writes the index to the secondary. c.mu must be held.
+func (c *casFiler) save() error {
+	data, err := json.Marshal(c.index)
+	if err != nil {
+		return err
+	}
+	if err := c.Filer.Mkdir(casDir, 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	tmp := casIndexName + ".tmp"
+	f, err := c.Filer.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = replaceFile(c.Filer, tmp, casIndexName)
+	}
+	return err
+}
+
+func (c *casFiler) objectPath(hash string) string {
+	return path.Join("/", c.root, hash[:2], hash)
+}
+
+// lookup returns the stored contents of name.
+func (c *casFiler) lookup(name string) (casEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.index[path.Clean("/"+name)]
+	return e, ok
+}
+
+// set records the stored contents of name, releasing those it had before.
+// c.mu must be held.
+func (c *casFiler) set(name string, e casEntry) {
+	if old, ok := c.index[name]; ok {
+		c.release(old.Hash)
+	}
+	c.index[name] = e
+	c.refs[e.Hash]++
+}
+
+// drop forgets the stored contents of name. c.mu must be held.
+func (c *casFiler) drop(name string) {
+	if old, ok := c.index[name]; ok {
+		delete(c.index, name)
+		c.release(old.Hash)
+	}
+}
+
+// release removes a reference to hash, removing unreferenced contents from
+// a store of their own. c.mu must be held.
+func (c *casFiler) release(hash string) {
+	c.refs[hash]--
+	if c.refs[hash] > 0 {
+		return
+	}
+	delete(c.refs, hash)
+	if !c.shared {
+		c.objects.Remove(c.objectPath(hash))
+	}
+}
+
+func (c *casFiler) stats() ContentStoreStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := ContentStoreStats{Files: len(c.index), Objects: len(c.refs)}
+	sizes := make(map[string]int64)
+	for _, e := range c.index {
+		s.Bytes += e.Size
+		sizes[e.Hash] = e.Size
+	}
+	for _, size := range sizes {
+		s.StoredBytes += size
+	}
+	return s
+}
+
+// intern moves the contents of the regular file name into the store,
+// replacing the file with a placeholder. Failures leave the file in place.
+func (c *casFiler) intern(name string) {
+	name = path.Clean("/" + name)
+	info, err := c.Filer.Stat(name)
+	if err != nil || !info.Mode().IsRegular() || info.Size() == 0 {
+		return
+	}
+	// Replacing the file with a placeholder would break its hard links
+	if _, nlink, ok := fileIDOf(info); ok && nlink > 1 {
+		return
+	}
+	hash, err := c.hash(name)
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	obj := c.objectPath(hash)
+	if _, err := c.objects.Stat(obj); err != nil {
+		if err := c.store(name, obj); err != nil {
+			return
+		}
+	}
+	if err := c.replace(name, info, nil); err != nil {
+		return
+	}
+	c.set(name, casEntry{Hash: hash, Size: info.Size()})
+	c.save()
+}
+
+// hash returns the hash of the contents of the file name.
+func (c *casFiler) hash(name string) (string, error) {
+	f, err := c.Filer.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := c.newHash()
+	if _, err := defaultBuffers.copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// store copies the contents of the file name into the store as obj.
+func (c *casFiler) store(name, obj string) error {
+	dir := path.Dir(obj)
+	if err := mkdirAllLayer(c.objects, dir); err != nil {
+		return err
+	}
+	tmp := obj + ".tmp"
+	if err := copyFile(c.objects, tmp, c.Filer, name, 0644, false, defaultBuffers); err != nil {
+		c.objects.Remove(tmp)
+		return err
+	}
+	if err := replaceFile(c.objects, tmp, obj); err != nil {
+		c.objects.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// replace replaces the file name, described by info, with a file of the
+// same mode and modification time holding the contents of src, or nothing
+// if src is nil.
+func (c *casFiler) replace(name string, info os.FileInfo, src io.Reader) error {
+	tmp := name + ".cowfs-cas~"
+	f, err := c.Filer.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if src != nil {
+		_, err = defaultBuffers.copy(f, src)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		c.Filer.Chmod(tmp, info.Mode())
+		c.Filer.Chtimes(tmp, info.ModTime(), info.ModTime())
+		err = replaceFile(c.Filer, tmp, name)
+	}
+	if err != nil {
+		c.Filer.Remove(tmp)
+	}
+	return err
+}
+
+// materialize copies the stored contents of name back into the secondary,
+// so that it can be written in place.
+func (c *casFiler) materialize(name string, e casEntry) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cur, ok := c.index[name]; !ok || cur != e {
+		return nil // Materialized meanwhile
+	}
+	info, err := c.Filer.Stat(name)
+	if err != nil {
+		return err
+	}
+	obj, err := c.objects.OpenFile(c.objectPath(e.Hash), os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	if err := c.replace(name, info, obj); err != nil {
+		return err
+	}
+	c.drop(name)
+	return c.save()
+}
+
+// link records that dstName in c has the stored contents e, creating its
+// placeholder with perm.
+func (c *casFiler) link(dstName string, e casEntry, perm os.FileMode) error {
+	f, err := c.Filer.OpenFile(dstName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.set(path.Clean("/"+dstName), e)
+	return c.save()
+}
+
+// shareContent gives the file dstName in dst the stored contents of
+// srcName in src, without copying them, if both use the same shared store.
+// It reports whether it did.
+func shareContent(src absfs.Filer, srcName string, dst absfs.Filer, dstName string, perm os.FileMode) (bool, error) {
+	s, d := asCAS(src), asCAS(dst)
+	if s == nil || d == nil || !s.shared || !d.shared || !sameFiler(s.objects, d.objects) {
+		return false, nil
+	}
+	e, ok := s.lookup(srcName)
+	if !ok {
+		return false, nil
+	}
+	return true, d.link(dstName, e, perm)
+}
+
+// sameFiler reports whether a and b are the same Filer.
+func sameFiler(a, b absfs.Filer) bool {
+	return reflect.TypeOf(a) == reflect.TypeOf(b) && reflect.TypeOf(a).Comparable() && a == b
+}
+
+// mkdirAllLayer creates dir and its missing parents in filer.
+func mkdirAllLayer(filer absfs.Filer, dir string) error {
+	if _, err := filer.Stat(dir); err == nil {
+		return nil
+	}
+	if parent := path.Dir(dir); parent != dir {
+		if err := mkdirAllLayer(filer, parent); err != nil {
+			return err
+		}
+	}
+	if err := filer.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+// sized reports info with the size of the stored contents of name, if any.
+func (c *casFiler) sized(name string, info os.FileInfo) os.FileInfo {
+	if e, ok := c.lookup(name); ok && info.Mode().IsRegular() {
+		return casInfo{FileInfo: info, size: e.Size}
+	}
+	return info
+}
+
+// sizedEntries reports the entries of directory dir with the sizes of their
+// stored contents.
+func (c *casFiler) sizedEntries(dir string, entries []fs.DirEntry) []fs.DirEntry {
+	for i, e := range entries {
+		name := path.Join("/", dir, e.Name())
+		if _, ok := c.lookup(name); !ok {
+			continue
+		}
+		if info, err := e.Info(); err == nil {
+			entries[i] = fs.FileInfoToDirEntry(c.sized(name, info))
+		}
+	}
+	return entries
+}
+
+func (c *casFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	clean := path.Clean("/" + name)
+	e, stored := c.lookup(clean)
+	write := openOp(flag) == OpWrite
+	if stored && !write {
+		info, err := c.Filer.Stat(clean)
+		if err != nil {
+			return nil, err
+		}
+		f, err := c.objects.OpenFile(c.objectPath(e.Hash), os.O_RDONLY, 0)
+		if err != nil {
+			return nil, err
+		}
+		return &casFile{File: f, name: name, info: casInfo{FileInfo: info, size: e.Size}}, nil
+	}
+	if stored && flag&os.O_EXCL == 0 {
+		if flag&os.O_TRUNC != 0 {
+			c.mu.Lock()
+			c.drop(clean)
+			c.save()
+			c.mu.Unlock()
+		} else if err := c.materialize(clean, e); err != nil {
+			return nil, err
+		}
+	}
+	f, err := c.Filer.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if write {
+		return &casWriter{File: f, c: c, name: clean}, nil
+	}
+	return &casDirFile{File: f, c: c, name: clean}, nil
+}
+
+func (c *casFiler) Remove(name string) error {
+	if err := c.Filer.Remove(name); err != nil {
+		return err
+	}
+	name = path.Clean("/" + name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.index[name]; ok {
+		c.drop(name)
+		return c.save()
+	}
+	return nil
+}
+
+// Rename renames oldpath, carrying the stored contents of it and the files
+// below it along.
+func (c *casFiler) Rename(oldpath, newpath string) error {
+	if err := c.Filer.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	oldpath, newpath = path.Clean("/"+oldpath), path.Clean("/"+newpath)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	changed := false
+	if _, ok := c.index[newpath]; ok {
+		c.drop(newpath)
+		changed = true
+	}
+	for name, e := range c.index {
+		rel, ok := relativeTo(oldpath, name)
+		if !ok {
+			continue
+		}
+		delete(c.index, name)
+		c.index[path.Join(newpath, rel)] = e
+		changed = true
+	}
+	if changed {
+		return c.save()
+	}
+	return nil
+}
+
+func (c *casFiler) Stat(name string) (os.FileInfo, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	info, err := c.Filer.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return c.sized(name, info), nil
+}
+
+func (c *casFiler) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := c.Filer.ReadDir(name)
+	return c.sizedEntries(name, entries), err
+}
+
+func (c *casFiler) ReadFile(name string) ([]byte, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	if e, ok := c.lookup(name); ok {
+		return c.objects.ReadFile(c.objectPath(e.Hash))
+	}
+	return c.Filer.ReadFile(name)
+}
+
+func (c *casFiler) Sub(dir string) (fs.FS, error) {
+	return absfs.FilerToFS(c, dir)
+}
+
+// casSymFiler is a casFiler over a Filer that supports symbolic links.
+type casSymFiler struct {
+	casFiler
+}
+
+func (c *casSymFiler) sl() absfs.SymLinker {
+	return c.Filer.(absfs.SymLinker)
+}
+
+func (c *casSymFiler) Symlink(oldname, newname string) error {
+	return c.sl().Symlink(oldname, newname)
+}
+
+func (c *casSymFiler) Readlink(name string) (string, error) {
+	return c.sl().Readlink(name)
+}
+
+func (c *casSymFiler) Lstat(name string) (os.FileInfo, error) {
+	info, err := c.sl().Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	return c.sized(name, info), nil
+}
+
+func (c *casSymFiler) Lchown(name string, uid, gid int) error {
+	return c.sl().Lchown(name, uid, gid)
+}
+
+// casInfo reports the size of a file's stored contents instead of that of
+// its placeholder.
+type casInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (i casInfo) Size() int64 { return i.size }
+
+// casFile is a read-only handle to the stored contents of a file.
+type casFile struct {
+	absfs.File
+	name string
+	info casInfo
+}
+
+func (f *casFile) Name() string                { return f.name }
+func (f *casFile) Stat() (os.FileInfo, error)  { return f.info, nil }
+func (f *casFile) Sync() error                 { return nil }
+func (f *casFile) Write(b []byte) (int, error) { return 0, f.readOnly("write") }
+func (f *casFile) WriteString(string) (int, error) {
+	return 0, f.readOnly("write")
+}
+func (f *casFile) WriteAt([]byte, int64) (int, error) { return 0, f.readOnly("write") }
+func (f *casFile) Truncate(int64) error               { return f.readOnly("truncate") }
+
+func (f *casFile) readOnly(op string) error {
+	return &os.PathError{Op: op, Path: f.name, Err: os.ErrPermission}
+}
+
+// casWriter is a writable handle to a file of a casFiler, storing its
+// contents when closed.
+type casWriter struct {
+	absfs.File
+	c    *casFiler
+	name string
+}
+
+func (f *casWriter) Close() error {
+	err := f.File.Close()
+	if err == nil {
+		f.c.intern(f.name)
+	}
+	return err
+}
+
+// casDirFile is a read-only handle to a file of a casFiler that lists
+// directories with the sizes of stored contents.
+type casDirFile struct {
+	absfs.File
+	c    *casFiler
+	name string
+}
+
+func (d *casDirFile) Readdir(n int) ([]os.FileInfo, error) {
+	infos, err := d.File.Readdir(n)
+	for i, info := range infos {
+		infos[i] = d.c.sized(path.Join(d.name, info.Name()), info)
+	}
+	return infos, err
+}
+
+func (d *casDirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries, err := d.File.ReadDir(n)
+	return d.c.sizedEntries(d.name, entries), err
+}
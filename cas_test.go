@@ -0,0 +1,107 @@
+package cowfs
+
+import (
+	"os"
+	"testing"
+
+	"github.com/absfs/memfs"
+)
+
+func TestContentStore(t *testing.T) {
+	primary := must(memfs.NewFS())
+	secondary := must(memfs.NewFS())
+	primary.Mkdir("/lib", 0755)
+	for _, name := range []string{"/lib/a.so", "/lib/b.so", "/lib/c.so"} {
+		writeMemFile(t, primary, name, "shared library")
+	}
+	cfs := New(primary, secondary, WithContentStore(nil))
+
+	for _, name := range []string{"/lib/a.so", "/lib/b.so", "/lib/c.so"} {
+		if err := cfs.Chmod(name, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cfs.WriteFile("/lib/d.so", []byte("shared library"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	want := ContentStoreStats{Files: 4, Objects: 1, Bytes: 4 * 14, StoredBytes: 14}
+	if got := cfs.ContentStoreStats(); got != want {
+		t.Errorf("ContentStoreStats = %+v; want %+v", got, want)
+	}
+	info, err := cfs.Stat("/lib/b.so")
+	if err != nil || info.Size() != 14 || info.Mode().Perm() != 0600 {
+		t.Fatalf("Stat(/lib/b.so) = %v, %v; want 14 bytes, mode 0600", info, err)
+	}
+	if data, err := cfs.ReadFile("/lib/c.so"); err != nil || string(data) != "shared library" {
+		t.Errorf("ReadFile(/lib/c.so) = %q, %v", data, err)
+	}
+
+	// Writing a file in place gives it contents of its own
+	f, err := cfs.OpenFile("/lib/a.so", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(" v2"))
+	f.Close()
+	if data, _ := cfs.ReadFile("/lib/a.so"); string(data) != "shared library v2" {
+		t.Errorf("ReadFile(/lib/a.so) after append = %q", data)
+	}
+	if data, _ := cfs.ReadFile("/lib/b.so"); string(data) != "shared library" {
+		t.Errorf("ReadFile(/lib/b.so) after appending to a.so = %q", data)
+	}
+	if got := cfs.ContentStoreStats(); got.Files != 4 || got.Objects != 2 {
+		t.Errorf("ContentStoreStats after append = %+v; want 4 files, 2 objects", got)
+	}
+
+	// Contents no file refers to are removed
+	for _, name := range []string{"/lib/b.so", "/lib/c.so", "/lib/d.so"} {
+		if err := cfs.Remove(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := cfs.ContentStoreStats(); got.Objects != 1 || got.StoredBytes != 17 {
+		t.Errorf("ContentStoreStats after Remove = %+v; want only a.so's contents", got)
+	}
+	if err := cfs.Rename("/lib", "/lib64"); err != nil {
+		t.Fatal(err)
+	}
+	if got := listNames(t, cfs, "/lib64"); len(got) != 1 || got[0] != "a.so" {
+		t.Errorf("ReadDir(/lib64) = %v", got)
+	}
+
+	// The index in the secondary survives the overlay
+	reopened := New(primary, secondary, WithContentStore(nil))
+	if data, err := reopened.ReadFile("/lib64/a.so"); err != nil || string(data) != "shared library v2" {
+		t.Errorf("ReadFile(/lib64/a.so) after reopening = %q, %v", data, err)
+	}
+}
+
+func TestContentStoreClone(t *testing.T) {
+	primary := must(memfs.NewFS())
+	writeMemFile(t, primary, "/big.bin", "large contents")
+	objects := must(memfs.NewFS())
+	cfs := New(primary, must(memfs.NewFS()), WithContentStore(objects))
+	if err := cfs.Chmod("/big.bin", 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	secondary := must(memfs.NewFS())
+	clone, err := cfs.Clone(secondary, true, WithContentStore(objects))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The clone's secondary holds a placeholder, not the contents
+	if info, err := secondary.Stat("/big.bin"); err != nil || info.Size() != 0 {
+		t.Errorf("clone secondary Stat(/big.bin) = %v, %v; want an empty placeholder", info, err)
+	}
+	if data, err := clone.ReadFile("/big.bin"); err != nil || string(data) != "large contents" {
+		t.Errorf("clone ReadFile(/big.bin) = %q, %v", data, err)
+	}
+
+	if err := clone.WriteFile("/big.bin", []byte("changed"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := cfs.ReadFile("/big.bin"); string(data) != "large contents" {
+		t.Errorf("original ReadFile(/big.bin) after changing the clone = %q", data)
+	}
+}
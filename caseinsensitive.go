@@ -0,0 +1,148 @@
+package cowfs
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// WithCaseInsensitive makes the overlay case-insensitive over layers that
+// need not be, such as a primary on a macOS or Windows host directory with
+// a case-sensitive memfs secondary. Paths are tracked as by WithCaseFolding,
+// and each layer resolves a path to the spelling it already holds, matching
+// every element case-insensitively, so "/Docs/README.md" in the primary is
+// found as "/docs/readme.md". Names the secondary does not hold yet,
+// including copies up from the primary, are created there in lower case.
+//
+// Resolving a path lists each of its parent directories, which makes every
+// layer operation slower. Hard links, reflinks and other optional layer
+// interfaces besides symbolic links are not available in this mode.
+func WithCaseInsensitive() Option {
+	return func(fs *FileSystem) {
+		fs.foldCase = true
+		fs.primary = newCaseFiler(fs.primary)
+		fs.secondary = newCaseFiler(fs.secondary)
+		fs.links = supportsLinks(fs.primary, fs.secondary)
+	}
+}
+
+// newCaseFiler wraps filer in a caseFiler, keeping its support for
+// symbolic links.
+func newCaseFiler(filer absfs.Filer) absfs.Filer {
+	if _, ok := filer.(absfs.SymLinker); ok {
+		return &caseSymFiler{caseFiler{filer}}
+	}
+	return &caseFiler{filer}
+}
+
+// caseFiler is an absfs.Filer that looks up the paths it is given
+// case-insensitively in the Filer it wraps.
+type caseFiler struct {
+	absfs.Filer
+}
+
+// resolve returns name as spelled in the wrapped Filer, matching each
+// element case-insensitively. An exact match is preferred, and elements
+// from the first unmatched one on are kept as given.
+func (c *caseFiler) resolve(name string) string {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return name
+	}
+	resolved := "/"
+	elems := strings.Split(name[1:], "/")
+	for i, elem := range elems {
+		entries, err := c.Filer.ReadDir(resolved)
+		if err != nil {
+			return path.Join(append([]string{resolved}, elems[i:]...)...)
+		}
+		match := ""
+		for _, e := range entries {
+			if e.Name() == elem {
+				match = elem
+				break
+			}
+			if match == "" && strings.EqualFold(e.Name(), elem) {
+				match = e.Name()
+			}
+		}
+		if match == "" {
+			return path.Join(append([]string{resolved}, elems[i:]...)...)
+		}
+		resolved = path.Join(resolved, match)
+	}
+	return resolved
+}
+
+func (c *caseFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	return c.Filer.OpenFile(c.resolve(name), flag, perm)
+}
+
+func (c *caseFiler) Mkdir(name string, perm os.FileMode) error {
+	return c.Filer.Mkdir(c.resolve(name), perm)
+}
+
+func (c *caseFiler) Remove(name string) error {
+	return c.Filer.Remove(c.resolve(name))
+}
+
+func (c *caseFiler) Rename(oldpath, newpath string) error {
+	return c.Filer.Rename(c.resolve(oldpath), c.resolve(newpath))
+}
+
+func (c *caseFiler) Stat(name string) (os.FileInfo, error) {
+	return c.Filer.Stat(c.resolve(name))
+}
+
+func (c *caseFiler) Chmod(name string, mode os.FileMode) error {
+	return c.Filer.Chmod(c.resolve(name), mode)
+}
+
+func (c *caseFiler) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return c.Filer.Chtimes(c.resolve(name), atime, mtime)
+}
+
+func (c *caseFiler) Chown(name string, uid, gid int) error {
+	return c.Filer.Chown(c.resolve(name), uid, gid)
+}
+
+func (c *caseFiler) ReadDir(name string) ([]fs.DirEntry, error) {
+	return c.Filer.ReadDir(c.resolve(name))
+}
+
+func (c *caseFiler) ReadFile(name string) ([]byte, error) {
+	return c.Filer.ReadFile(c.resolve(name))
+}
+
+func (c *caseFiler) Sub(dir string) (fs.FS, error) {
+	return absfs.FilerToFS(c, dir)
+}
+
+// caseSymFiler is a caseFiler over a Filer that supports symbolic links.
+type caseSymFiler struct {
+	caseFiler
+}
+
+func (c *caseSymFiler) sl() absfs.SymLinker {
+	return c.Filer.(absfs.SymLinker)
+}
+
+func (c *caseSymFiler) Symlink(oldname, newname string) error {
+	return c.sl().Symlink(oldname, c.resolve(newname))
+}
+
+func (c *caseSymFiler) Readlink(name string) (string, error) {
+	return c.sl().Readlink(c.resolve(name))
+}
+
+func (c *caseSymFiler) Lstat(name string) (os.FileInfo, error) {
+	return c.sl().Lstat(c.resolve(name))
+}
+
+func (c *caseSymFiler) Lchown(name string, uid, gid int) error {
+	return c.sl().Lchown(c.resolve(name), uid, gid)
+}
@@ -0,0 +1,44 @@
+package cowfs
+
+import (
+	"errors"
+	"io/fs"
+	"reflect"
+	"testing"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/memfs"
+)
+
+func TestCaseInsensitive(t *testing.T) {
+	primary := must(memfs.NewFS())
+	primary.Mkdir("/Docs", 0755)
+	writeMemFile(t, primary, "/Docs/README.md", "read me")
+	writeMemFile(t, primary, "/Docs/Guide.md", "guide")
+	cfs := New(primary, must(memfs.NewFS()), WithCaseInsensitive())
+
+	if data, err := cfs.ReadFile("/docs/readme.md"); err != nil || string(data) != "read me" {
+		t.Errorf("ReadFile(/docs/readme.md) = %q, %v, want read me", data, err)
+	}
+	if err := cfs.WriteFile("/DOCS/Readme.md", []byte("edited"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := cfs.ReadFile("/Docs/README.md"); err != nil || string(data) != "edited" {
+		t.Errorf("ReadFile(/Docs/README.md) = %q, %v, want edited", data, err)
+	}
+	if err := cfs.Remove("/docs/GUIDE.md"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfs.Stat("/Docs/Guide.md"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat(/Docs/Guide.md) error = %v, want not exist", err)
+	}
+	if names := listNames(t, cfs, "/docs"); !reflect.DeepEqual(names, []string{"readme.md"}) {
+		t.Errorf("ReadDir(/docs) = %v, want one readme", names)
+	}
+}
+
+func TestCaseInsensitiveKeys(t *testing.T) {
+	testMixedCaseKeys(t, func(primary absfs.Filer) *FileSystem {
+		return New(primary, must(memfs.NewFS()), WithCaseInsensitive())
+	})
+}
@@ -0,0 +1,295 @@
+package cowfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// NewLayered is like New over a chain of read-only primaries, checked in
+// order before falling back to the next, so that defaults can be layered
+// without nesting overlays:
+//
+//	cfs := cowfs.NewLayered([]absfs.Filer{user, site, machine}, secondary)
+//
+// A path is provided by the first primary holding it. Directories held by
+// several primaries list the entries of all of them, the earlier primary
+// winning for a name held by more than one, down to the first primary
+// holding something other than a directory there, which hides the
+// directories of the primaries after it. The secondary takes precedence
+// over all primaries as with New.
+//
+// The chain cannot be changed through the overlay: operations that would
+// write to the primary, such as Commit, WithWriteBack and write-through
+// zones, fail with syscall.EROFS. Symbolic links are supported when every
+// primary and the secondary support them. Looking a path up takes a Stat
+// per primary for each of its parent directories.
+func NewLayered(primaries []absfs.Filer, secondary absfs.Filer, opts ...Option) *FileSystem {
+	var primary absfs.Filer
+	switch len(primaries) {
+	case 0:
+		primary = &emptyFiler{}
+	case 1:
+		primary = primaries[0]
+	default:
+		primary = newChainFiler(primaries)
+	}
+	return New(primary, secondary, opts...)
+}
+
+// newChainFiler returns a chainFiler over layers, keeping their support for
+// symbolic links if all of them have it.
+func newChainFiler(layers []absfs.Filer) absfs.Filer {
+	c := chainFiler{layers: append([]absfs.Filer(nil), layers...)}
+	for _, l := range layers {
+		if _, ok := l.(absfs.SymLinker); !ok {
+			return &c
+		}
+	}
+	return &chainSymFiler{c}
+}
+
+// chainFiler is a read-only absfs.Filer merging several layers, the first
+// layer holding a path providing it.
+type chainFiler struct {
+	layers []absfs.Filer
+}
+
+// dirLayers returns the layers whose entries make up the merged directory
+// dir: those holding dir as a directory, up to the first holding it as
+// something else.
+func (c *chainFiler) dirLayers(dir string) ([]absfs.Filer, error) {
+	parents := c.layers
+	if dir != "/" {
+		var err error
+		if parents, err = c.dirLayers(path.Dir(dir)); err != nil {
+			return nil, err
+		}
+	}
+	var layers []absfs.Filer
+	for _, l := range parents {
+		info, err := l.Stat(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			if len(layers) == 0 {
+				return nil, syscall.ENOTDIR
+			}
+			break
+		}
+		layers = append(layers, l)
+	}
+	if len(layers) == 0 {
+		return nil, fs.ErrNotExist
+	}
+	return layers, nil
+}
+
+// find returns the layer providing name and its FileInfo, as reported by
+// stat.
+func (c *chainFiler) find(op, name string, stat func(absfs.Filer, string) (os.FileInfo, error)) (absfs.Filer, os.FileInfo, error) {
+	name = path.Clean("/" + name)
+	layers, err := c.dirLayers(path.Dir(name))
+	if err != nil {
+		return nil, nil, &os.PathError{Op: op, Path: name, Err: err}
+	}
+	for _, l := range layers {
+		info, err := stat(l, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return l, info, nil
+	}
+	return nil, nil, &os.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+// list returns the merged entries of directory name, sorted by name.
+func (c *chainFiler) list(name string) ([]os.FileInfo, error) {
+	name = path.Clean("/" + name)
+	layers, err := c.dirLayers(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	seen := make(map[string]bool)
+	var infos []os.FileInfo
+	for _, l := range layers {
+		entries, err := l.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if seen[e.Name()] {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			seen[e.Name()] = true
+			infos = append(infos, info)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+// readOnly returns the error of a change to the chain.
+func readOnly(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: syscall.EROFS}
+}
+
+func (c *chainFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	if openOp(flag) == OpWrite {
+		return nil, readOnly("open", name)
+	}
+	l, info, err := c.find("open", name, absfs.Filer.Stat)
+	if err != nil {
+		return nil, err
+	}
+	f, err := l.OpenFile(name, flag, perm)
+	if err != nil || !info.IsDir() {
+		return f, err
+	}
+	return &chainDir{File: f, c: c, name: name}, nil
+}
+
+func (c *chainFiler) Mkdir(name string, perm os.FileMode) error {
+	return readOnly("mkdir", name)
+}
+
+func (c *chainFiler) Remove(name string) error {
+	return readOnly("remove", name)
+}
+
+func (c *chainFiler) Rename(oldpath, newpath string) error {
+	return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EROFS}
+}
+
+func (c *chainFiler) Stat(name string) (os.FileInfo, error) {
+	_, info, err := c.find("stat", name, absfs.Filer.Stat)
+	return info, err
+}
+
+func (c *chainFiler) Chmod(name string, mode os.FileMode) error {
+	return readOnly("chmod", name)
+}
+
+func (c *chainFiler) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return readOnly("chtimes", name)
+}
+
+func (c *chainFiler) Chown(name string, uid, gid int) error {
+	return readOnly("chown", name)
+}
+
+func (c *chainFiler) ReadDir(name string) ([]fs.DirEntry, error) {
+	infos, err := c.list(name)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]fs.DirEntry, len(infos))
+	for i, info := range infos {
+		entries[i] = fs.FileInfoToDirEntry(info)
+	}
+	return entries, nil
+}
+
+func (c *chainFiler) ReadFile(name string) ([]byte, error) {
+	l, _, err := c.find("readfile", name, absfs.Filer.Stat)
+	if err != nil {
+		return nil, err
+	}
+	return l.ReadFile(name)
+}
+
+func (c *chainFiler) Sub(dir string) (fs.FS, error) {
+	return absfs.FilerToFS(c, dir)
+}
+
+// chainSymFiler is a chainFiler over layers that support symbolic links.
+type chainSymFiler struct {
+	chainFiler
+}
+
+func (c *chainSymFiler) Symlink(oldname, newname string) error {
+	return readOnly("symlink", newname)
+}
+
+func (c *chainSymFiler) Readlink(name string) (string, error) {
+	l, _, err := c.find("readlink", name, lstatLayer)
+	if err != nil {
+		return "", err
+	}
+	return l.(absfs.SymLinker).Readlink(name)
+}
+
+func (c *chainSymFiler) Lstat(name string) (os.FileInfo, error) {
+	_, info, err := c.find("lstat", name, lstatLayer)
+	return info, err
+}
+
+func (c *chainSymFiler) Lchown(name string, uid, gid int) error {
+	return readOnly("lchown", name)
+}
+
+// chainDir wraps a directory handle of the layer providing a directory to
+// list the merged entries of all layers.
+type chainDir struct {
+	absfs.File
+	c      *chainFiler
+	name   string
+	infos  []os.FileInfo // Merged entries, once listed
+	listed bool
+	offset int
+}
+
+func (d *chainDir) Readdir(n int) ([]os.FileInfo, error) {
+	if !d.listed {
+		infos, err := d.c.list(d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.infos, d.listed = infos, true
+	}
+	rest := d.infos[d.offset:]
+	if n > 0 && len(rest) > n {
+		rest = rest[:n]
+	}
+	d.offset += len(rest)
+	if n > 0 && len(rest) == 0 {
+		return nil, io.EOF
+	}
+	return rest, nil
+}
+
+func (d *chainDir) Readdirnames(n int) ([]string, error) {
+	infos, err := d.Readdir(n)
+	names := make([]string, len(infos))
+	for i, info := range infos {
+		names[i] = info.Name()
+	}
+	return names, err
+}
+
+func (d *chainDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	infos, err := d.Readdir(n)
+	entries := make([]fs.DirEntry, len(infos))
+	for i, info := range infos {
+		entries[i] = fs.FileInfoToDirEntry(info)
+	}
+	return entries, err
+}
@@ -0,0 +1,67 @@
+package cowfs
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"testing"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/memfs"
+)
+
+func TestNewLayered(t *testing.T) {
+	machine, site, user := must(memfs.NewFS()), must(memfs.NewFS()), must(memfs.NewFS())
+	for _, l := range []*memfs.FileSystem{machine, site, user} {
+		if err := l.Mkdir("/etc", 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeMemFile(t, machine, "/etc/editor", "ed")
+	writeMemFile(t, machine, "/etc/shell", "sh")
+	writeMemFile(t, site, "/etc/shell", "bash")
+	writeMemFile(t, site, "/etc/proxy", "proxy.example")
+	writeMemFile(t, user, "/etc/editor", "vi")
+	// A file in an earlier primary hides a directory in a later one
+	if err := machine.Mkdir("/opt", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeMemFile(t, machine, "/opt/tool", "tool")
+	writeMemFile(t, site, "/opt", "not a directory")
+
+	cfs := NewLayered([]absfs.Filer{user, site, machine}, must(memfs.NewFS()))
+
+	for name, want := range map[string]string{
+		"/etc/editor": "vi",
+		"/etc/shell":  "bash",
+		"/etc/proxy":  "proxy.example",
+		"/opt":        "not a directory",
+	} {
+		if data, err := cfs.ReadFile(name); err != nil || string(data) != want {
+			t.Errorf("ReadFile(%s) = %q, %v; want %q", name, data, err, want)
+		}
+	}
+	if got := listNames(t, cfs, "/etc"); len(got) != 3 || got[0] != "editor" || got[1] != "proxy" || got[2] != "shell" {
+		t.Errorf("ReadDir(/etc) = %v; want editor, proxy, shell", got)
+	}
+	if _, err := cfs.Stat("/opt/tool"); err == nil {
+		t.Error("Stat(/opt/tool) found a file below a file of an earlier primary")
+	}
+
+	// Changes go to the secondary, leaving the chain alone
+	if err := cfs.WriteFile("/etc/shell", []byte("zsh"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Remove("/etc/editor"); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := cfs.ReadFile("/etc/shell"); string(data) != "zsh" {
+		t.Errorf("ReadFile(/etc/shell) after write = %q", data)
+	}
+	if _, err := user.Stat("/etc/editor"); err != nil {
+		t.Errorf("Remove reached a primary: %v", err)
+	}
+	if err := cfs.Commit(context.Background()); !errors.Is(err, syscall.EROFS) {
+		t.Errorf("Commit = %v; want EROFS", err)
+	}
+}
@@ -0,0 +1,296 @@
+package cowfs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// ErrEscapesRoot is returned, wrapped in an *fs.PathError, for paths that
+// would leave the root of a ChrootFS.
+var ErrEscapesRoot = errors.New("cowfs: path escapes root")
+
+// ChrootFS is a view of an overlay confined to one of its directories; see
+// Chroot.
+type ChrootFS struct {
+	cfs  *FileSystem
+	root string
+	p    prefixFiler
+
+	// mu is held exclusively by operations that can put symbolic links in
+	// place, and shared by the others from the check of their paths on.
+	mu sync.RWMutex
+}
+
+// Chroot returns a view of the overlay confined to the directory dir, for
+// exposing a slice of the primary to untrusted code. Paths used with the
+// view are relative to dir. Unlike Namespace, which clamps them, paths
+// whose ".." elements would climb above dir are rejected with
+// ErrEscapesRoot, as are paths leading through symbolic links that resolve
+// outside dir. Operations on a link itself, such as Lstat, Readlink and
+// Remove, are allowed wherever it points.
+//
+// Changes made through the view are changes to this overlay. Every
+// operation checks each element of its path for symbolic links first, and
+// then works on the path the links resolved to. Operations through the view
+// that can put links in place, Symlink and Rename, do not run concurrently
+// with the others, so code confined to the view cannot swap a link in
+// between the check and its use. Changes made outside the view, through
+// the overlay or to its layers, are not held back this way: the view is not
+// a boundary against untrusted writers of the rest of the overlay.
+func (cfs *FileSystem) Chroot(dir string) (*ChrootFS, error) {
+	root := cfs.normalize(dir)
+	info, err := cfs.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &fs.PathError{Op: "chroot", Path: dir, Err: syscall.ENOTDIR}
+	}
+	return &ChrootFS{cfs: cfs, root: root, p: prefixFiler{fs: cfs, prefix: root}}, nil
+}
+
+// confine returns the overlay path name resolves to, reporting an error if
+// it escapes the root, lexically or through symbolic links. The final
+// element is not followed unless followLast is set.
+func (c *ChrootFS) confine(op, name string, followLast bool) (string, error) {
+	if escapes(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: ErrEscapesRoot}
+	}
+	elems := strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/")
+	cur := c.root
+	for i, elem := range elems {
+		if elem == "" {
+			continue
+		}
+		cur = path.Join(cur, elem)
+		if i == len(elems)-1 && !followLast {
+			break
+		}
+		for hops := 0; ; hops++ {
+			info, err := c.cfs.Lstat(cur)
+			if err != nil || info.Mode()&os.ModeSymlink == 0 {
+				break
+			}
+			if hops == maxLinkHops {
+				return "", &fs.PathError{Op: op, Path: name, Err: syscall.ELOOP}
+			}
+			target, err := c.cfs.Readlink(cur)
+			if err != nil {
+				return "", pathError(op, name, err)
+			}
+			if !path.IsAbs(target) {
+				target = path.Join(path.Dir(cur), target)
+			}
+			if _, ok := relativeTo(c.root, path.Clean(target)); !ok {
+				return "", &fs.PathError{Op: op, Path: name, Err: ErrEscapesRoot}
+			}
+			cur = path.Clean(target)
+		}
+	}
+	return cur, nil
+}
+
+// escapes reports whether the ".." elements of name climb above its root.
+func escapes(name string) bool {
+	depth := 0
+	for _, elem := range strings.Split(name, "/") {
+		switch elem {
+		case "", ".":
+		case "..":
+			if depth--; depth < 0 {
+				return true
+			}
+		default:
+			depth++
+		}
+	}
+	return false
+}
+
+// OpenFile opens the named file.
+func (c *ChrootFS) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	resolved, err := c.confine("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	f, err := c.cfs.OpenFile(resolved, flag, perm)
+	if err != nil {
+		return nil, c.p.fixErr(err, name)
+	}
+	return &prefixFile{File: f, name: name}, nil
+}
+
+// Mkdir creates the named directory.
+func (c *ChrootFS) Mkdir(name string, perm os.FileMode) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	resolved, err := c.confine("mkdir", name, true)
+	if err != nil {
+		return err
+	}
+	return c.p.fixErr(c.cfs.Mkdir(resolved, perm), name)
+}
+
+// Remove removes the named file or directory.
+func (c *ChrootFS) Remove(name string) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	resolved, err := c.confine("remove", name, false)
+	if err != nil {
+		return err
+	}
+	return c.p.fixErr(c.cfs.Remove(resolved), name)
+}
+
+// Rename renames oldpath to newpath.
+func (c *ChrootFS) Rename(oldpath, newpath string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var resolved [2]string
+	for i, name := range []string{oldpath, newpath} {
+		var err error
+		if resolved[i], err = c.confine("rename", name, false); err != nil {
+			pe := err.(*fs.PathError)
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: pe.Err}
+		}
+	}
+	err := c.cfs.Rename(resolved[0], resolved[1])
+	var le *os.LinkError
+	if errors.As(err, &le) {
+		return &os.LinkError{Op: le.Op, Old: oldpath, New: newpath, Err: le.Err}
+	}
+	return c.p.fixErr(err, oldpath)
+}
+
+// Stat returns file info for the named file.
+func (c *ChrootFS) Stat(name string) (os.FileInfo, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	resolved, err := c.confine("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	info, err := c.cfs.Stat(resolved)
+	return info, c.p.fixErr(err, name)
+}
+
+// Chmod changes the mode of the named file.
+func (c *ChrootFS) Chmod(name string, mode os.FileMode) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	resolved, err := c.confine("chmod", name, true)
+	if err != nil {
+		return err
+	}
+	return c.p.fixErr(c.cfs.Chmod(resolved, mode), name)
+}
+
+// Chtimes changes the access and modification times of the named file.
+func (c *ChrootFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	resolved, err := c.confine("chtimes", name, true)
+	if err != nil {
+		return err
+	}
+	return c.p.fixErr(c.cfs.Chtimes(resolved, atime, mtime), name)
+}
+
+// Chown changes the owner and group of the named file.
+func (c *ChrootFS) Chown(name string, uid, gid int) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	resolved, err := c.confine("chown", name, true)
+	if err != nil {
+		return err
+	}
+	return c.p.fixErr(c.cfs.Chown(resolved, uid, gid), name)
+}
+
+// ReadDir reads the named directory.
+func (c *ChrootFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	resolved, err := c.confine("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := c.cfs.ReadDir(resolved)
+	return entries, c.p.fixErr(err, name)
+}
+
+// ReadFile reads the named file and returns its contents.
+func (c *ChrootFS) ReadFile(name string) ([]byte, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	resolved, err := c.confine("readfile", name, true)
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.cfs.ReadFile(resolved)
+	return data, c.p.fixErr(err, name)
+}
+
+// Sub returns an fs.FS corresponding to the subtree rooted at dir.
+func (c *ChrootFS) Sub(dir string) (fs.FS, error) {
+	return absfs.FilerToFS(c, dir)
+}
+
+// Symlink creates newname as a symbolic link to oldname. Links are not
+// checked when created, only when followed.
+func (c *ChrootFS) Symlink(oldname, newname string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	resolved, err := c.confine("symlink", newname, false)
+	if err != nil {
+		return err
+	}
+	return c.p.fixErr(c.cfs.Symlink(oldname, resolved), newname)
+}
+
+// Readlink returns the target of the named symbolic link.
+func (c *ChrootFS) Readlink(name string) (string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	resolved, err := c.confine("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	target, err := c.cfs.Readlink(resolved)
+	return target, c.p.fixErr(err, name)
+}
+
+// Lstat returns file info for the named file without following a final
+// symbolic link.
+func (c *ChrootFS) Lstat(name string) (os.FileInfo, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	resolved, err := c.confine("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	info, err := c.cfs.Lstat(resolved)
+	return info, c.p.fixErr(err, name)
+}
+
+// Lchown changes the owner and group of the named file without following a
+// final symbolic link.
+func (c *ChrootFS) Lchown(name string, uid, gid int) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	resolved, err := c.confine("lchown", name, false)
+	if err != nil {
+		return err
+	}
+	return c.p.fixErr(c.cfs.Lchown(resolved, uid, gid), name)
+}
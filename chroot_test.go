@@ -0,0 +1,74 @@
+package cowfs
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestChroot(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	primary.Mkdir("/plugin", 0755)
+	writeMemFile(t, primary, "/plugin/config", "config")
+	writeMemFile(t, primary, "/secret", "secret")
+	primary.Symlink("/secret", "/plugin/out")
+	primary.Symlink("config", "/plugin/in")
+
+	c, err := cfs.Chroot("/plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfs.Chroot("/secret"); err == nil {
+		t.Error("Chroot to a file succeeded")
+	}
+
+	if data, err := c.ReadFile("/config"); err != nil || string(data) != "config" {
+		t.Errorf("ReadFile(/config) = %q, %v", data, err)
+	}
+	if data, err := c.ReadFile("in"); err != nil || string(data) != "config" {
+		t.Errorf("ReadFile(in) through an inside link = %q, %v", data, err)
+	}
+	f, err := c.OpenFile("/sub/../new", os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("create through a contained .. failed: %v", err)
+	}
+	f.Close()
+	if !cfs.IsModified("/plugin/new") {
+		t.Error("write through the chroot not recorded in the overlay")
+	}
+
+	for _, name := range []string{"../secret", "/../secret", "a/../../secret", "out"} {
+		if _, err := c.ReadFile(name); !errors.Is(err, ErrEscapesRoot) {
+			t.Errorf("ReadFile(%q) error = %v, want ErrEscapesRoot", name, err)
+		}
+	}
+	if err := c.Rename("config", "../config"); !errors.Is(err, ErrEscapesRoot) {
+		t.Errorf("Rename out of the root error = %v, want ErrEscapesRoot", err)
+	}
+	if info, err := c.Lstat("out"); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("Lstat(out) = %v, %v, want the link itself", info, err)
+	}
+	if err := c.Remove("out"); err != nil {
+		t.Errorf("Remove(out) error = %v", err)
+	}
+
+	// Operations work on the path the links resolved to, and report errors
+	// with the name they were given.
+	must(t, c.Mkdir("/sub", 0755))
+	must(t, c.Symlink("sub", "/dir"))
+	f, err = c.OpenFile("/dir/file", os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("create through a directory link failed: %v", err)
+	}
+	if f.Name() != "/dir/file" {
+		t.Errorf("Name() = %q, want /dir/file", f.Name())
+	}
+	f.Close()
+	if !cfs.IsModified("/plugin/sub/file") {
+		t.Error("write through a directory link not made to its target")
+	}
+	var pe *os.PathError
+	if _, err := c.Stat("/dir/missing"); !errors.As(err, &pe) || pe.Path != "/dir/missing" {
+		t.Errorf("Stat(/dir/missing) error = %v, want the name given", err)
+	}
+}
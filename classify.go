@@ -0,0 +1,105 @@
+package cowfs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"syscall"
+	"unicode/utf8"
+)
+
+// classifySample is the number of leading bytes of a file examined by
+// Classify.
+const classifySample = 8 << 10
+
+// ContentKind is the kind of content held by a file.
+type ContentKind int
+
+const (
+	// KindText is content that can be treated as text: UTF-8, or text with
+	// a Unicode byte order mark.
+	KindText ContentKind = iota
+
+	// KindBinary is any other content.
+	KindBinary
+)
+
+func (k ContentKind) String() string {
+	switch k {
+	case KindText:
+		return "text"
+	case KindBinary:
+		return "binary"
+	}
+	return "unknown"
+}
+
+// Classify reports whether the merged version of the regular file name holds
+// text or binary content. Only the first 8 KiB are examined: content starting
+// with a Unicode byte order mark is text, content containing a NUL byte is
+// binary, and otherwise content is text if it is valid UTF-8. Empty files are
+// text.
+//
+// Classify is the classifier cowfs itself uses to decide whether content can
+// be handled line by line, so tools built on cowfs can use it to make the
+// same decisions.
+func (cfs *FileSystem) Classify(name string) (kind ContentKind, err error) {
+	defer wrapErr(&err, "classify", name)
+	f, err := cfs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return KindBinary, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return KindBinary, err
+	}
+	if info.IsDir() {
+		return KindBinary, syscall.EISDIR
+	}
+	buf := make([]byte, classifySample)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return KindBinary, err
+	}
+	return classifyContent(buf[:n], n < classifySample), nil
+}
+
+// Byte order marks that identify text in a Unicode encoding. UTF-32 marks
+// come first since the UTF-32LE mark starts with the UTF-16LE one.
+var byteOrderMarks = [][]byte{
+	{0x00, 0x00, 0xFE, 0xFF}, // UTF-32BE
+	{0xFF, 0xFE, 0x00, 0x00}, // UTF-32LE
+	{0xEF, 0xBB, 0xBF},       // UTF-8
+	{0xFE, 0xFF},             // UTF-16BE
+	{0xFF, 0xFE},             // UTF-16LE
+}
+
+// classifyContent classifies the leading bytes data of a file. complete is
+// set when data is the whole file, so a multi-byte sequence cut short at the
+// end of data is only tolerated when it is not.
+func classifyContent(data []byte, complete bool) ContentKind {
+	for _, bom := range byteOrderMarks {
+		if bytes.HasPrefix(data, bom) {
+			return KindText
+		}
+	}
+	if bytes.IndexByte(data, 0) >= 0 {
+		return KindBinary
+	}
+	if !complete {
+		// Drop a rune split by the end of the sample
+		for i := 1; i < utf8.UTFMax && i <= len(data); i++ {
+			if utf8.RuneStart(data[len(data)-i]) {
+				if !utf8.FullRune(data[len(data)-i:]) {
+					data = data[:len(data)-i]
+				}
+				break
+			}
+		}
+	}
+	if !utf8.Valid(data) {
+		return KindBinary
+	}
+	return KindText
+}
@@ -0,0 +1,56 @@
+package cowfs
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	writeMemFile(t, primary, "/text.txt", "hello, wörld\n")
+	writeMemFile(t, primary, "/image.bin", "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	writeMemFile(t, primary, "/utf16.txt", "\xff\xfeh\x00i\x00")
+	writeMemFile(t, primary, "/latin1.txt", "caf\xe9")
+	writeMemFile(t, primary, "/empty", "")
+	// A multi-byte rune straddling the end of the sample
+	writeMemFile(t, primary, "/long.txt", strings.Repeat("a", classifySample-1)+"é")
+	primary.Mkdir("/dir", 0755)
+
+	tests := []struct {
+		name string
+		want ContentKind
+	}{
+		{"/text.txt", KindText},
+		{"/image.bin", KindBinary},
+		{"/utf16.txt", KindText},
+		{"/latin1.txt", KindBinary},
+		{"/empty", KindText},
+		{"/long.txt", KindText},
+	}
+	for _, tt := range tests {
+		got, err := cfs.Classify(tt.name)
+		if err != nil {
+			t.Errorf("Classify(%s) error = %v", tt.name, err)
+		} else if got != tt.want {
+			t.Errorf("Classify(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// The merged version is classified
+	if err := cfs.WriteFile("/text.txt", []byte{0, 1, 2}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := cfs.Classify("/text.txt"); got != KindBinary {
+		t.Errorf("Classify() of modified file = %v, want binary", got)
+	}
+
+	cfs.Remove("/image.bin")
+	if _, err := cfs.Classify("/image.bin"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Classify() of deleted file error = %v, want ErrNotExist", err)
+	}
+	if _, err := cfs.Classify("/dir"); err == nil {
+		t.Error("Classify() of directory succeeded")
+	}
+}
@@ -0,0 +1,75 @@
+package cowfs
+
+import "github.com/absfs/absfs"
+
+// Clone returns a new overlay over the same primary as this one, with
+// secondary as its secondary and a copy of this overlay's state: its
+// modified and deleted paths, hidden directories, deferred ownership and
+// recorded conflict bases. The clone and this overlay change independently
+// from then on, so one prepared overlay can be fanned out into many
+// variants.
+//
+// If copyContents is true, the secondary copies are copied into secondary,
+// which should be empty, with delta-encoded files expanded to their full
+// contents. Otherwise secondary is expected to hold them already, for
+// example as a snapshot or reflinked copy of this overlay's secondary made
+// by the caller; an empty secondary leaves the modified paths without
+// contents. Contents kept by WithContentStore in a store the clone is given
+// as well are never copied, so such clones cost little more than their
+// directory tree.
+//
+// opts configure the clone. Clone works on frozen overlays, and mutations
+// of this overlay are held back while it runs.
+func (cfs *FileSystem) Clone(secondary absfs.Filer, copyContents bool, opts ...Option) (*FileSystem, error) {
+	cfs.opMu.Lock()
+	defer cfs.opMu.Unlock()
+	cfs.flushDeletions()
+
+	clone := New(cfs.primary, secondary, opts...)
+	if copyContents {
+		if _, err := cfs.secondary.Stat("/"); err == nil {
+			if err := cfs.copyTree(clone.secondary, "/", "/"); err != nil {
+				return nil, err
+			}
+		}
+		if clone.quota != nil {
+			clone.quota.used.Store(treeSize(clone.secondary, "/"))
+		}
+	}
+
+	cfs.mu.RLock()
+	for name := range cfs.modified {
+		clone.modified[name] = true
+	}
+	for name := range cfs.deleted {
+		clone.deleted[name] = true
+	}
+	for dir := range cfs.opaque {
+		clone.setOpaque(dir)
+	}
+	for name, o := range cfs.owners {
+		if clone.owners == nil {
+			clone.owners = make(map[string]Owner)
+		}
+		clone.owners[name] = o
+	}
+	if !copyContents && len(cfs.deltas) > 0 {
+		if clone.deltas == nil {
+			clone.deltas = make(map[string]bool)
+		}
+		for name := range cfs.deltas {
+			clone.deltas[name] = true
+		}
+	}
+	cfs.mu.RUnlock()
+	if c, cc := cfs.conflicts, clone.conflicts; c != nil && cc != nil {
+		for name, v := range c.snapshot() {
+			cc.bases[name] = v
+		}
+	}
+
+	clone.gen.Add(1)
+	clone.stateChanged()
+	cfs.debug("cowfs: cloned", "copy", copyContents)
+	return clone, nil
+}
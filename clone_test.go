@@ -0,0 +1,55 @@
+package cowfs
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+
+	"github.com/absfs/memfs"
+)
+
+func TestClone(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	writeMemFile(t, primary, "/a.txt", "base a")
+	writeMemFile(t, primary, "/b.txt", "base b")
+	cfs.WriteFile("/a.txt", []byte("prepared"), 0644)
+	cfs.Remove("/b.txt")
+	cfs.Freeze()
+
+	clone, err := cfs.Clone(must(memfs.NewFS()), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := clone.ReadFile("/a.txt"); err != nil || string(data) != "prepared" {
+		t.Errorf("clone ReadFile(/a.txt) = %q, %v, want prepared", data, err)
+	}
+	if _, err := clone.Stat("/b.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("clone Stat(/b.txt) error = %v, want not exist", err)
+	}
+
+	// Changes to the clone do not reach the original
+	if err := clone.WriteFile("/a.txt", []byte("variant"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := clone.WriteFile("/b.txt", []byte("again"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := cfs.ReadFile("/a.txt"); string(data) != "prepared" {
+		t.Errorf("original ReadFile(/a.txt) = %q, want prepared", data)
+	}
+	if _, err := cfs.Stat("/b.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("original Stat(/b.txt) error = %v, want not exist", err)
+	}
+
+	// Without copying contents only the state is carried over
+	empty, err := cfs.Clone(must(memfs.NewFS()), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := empty.Stat("/b.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("state-only clone Stat(/b.txt) error = %v, want not exist", err)
+	}
+	if entries, _ := empty.secondary.ReadDir("/"); len(entries) != 0 {
+		t.Errorf("state-only clone secondary holds %d entries, want none", len(entries))
+	}
+}
@@ -0,0 +1,215 @@
+// Command cowfs inspects and applies overlays kept in two host directories,
+// a primary tree and a secondary directory holding the changes made to it
+// through a cowfs overlay.
+//
+// Usage:
+//
+//	cowfs [-state file] command primary secondary [args]
+//
+// The commands are:
+//
+//	status   list the changed paths, marked A (created), M (modified) or
+//	         D (deleted)
+//	diff     print unified diffs of the changed files against the primary
+//	commit   apply the changes to the primary and empty the secondary
+//	export   write the changes as a layer tarball to the file named by the
+//	         argument, or to standard output
+//
+// With -state, the overlay state is read from the JSON file saved by a
+// cowfs.JSONFile state store, which records deletions. Without it, the state
+// is reconstructed from the secondary: every path in it counts as changed,
+// and no deletions are known.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/absfs/cowfs"
+	"github.com/absfs/cowfs/dirfs"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run runs the command line args, returning the exit status.
+func run(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("cowfs", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	stateFile := flags.String("state", "", "JSON `file` holding the overlay state")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "usage: cowfs [-state file] status|diff|commit|export primary secondary [args]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() < 3 {
+		flags.Usage()
+		return 2
+	}
+	cmd, rest := flags.Arg(0), flags.Args()[3:]
+
+	o, err := openOverlay(flags.Arg(1), flags.Arg(2), *stateFile)
+	if err == nil {
+		switch cmd {
+		case "status":
+			err = o.status(stdout)
+		case "diff":
+			err = o.diff(stdout)
+		case "commit":
+			err = o.commit()
+		case "export":
+			err = o.export(stdout, rest)
+		default:
+			fmt.Fprintf(stderr, "cowfs: unknown command %q\n", cmd)
+			flags.Usage()
+			return 2
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "cowfs %s: %v\n", cmd, err)
+		return 1
+	}
+	return 0
+}
+
+// overlay is an overlay over two host directories along with its state.
+type overlay struct {
+	cfs       *cowfs.FileSystem
+	primary   *dirfs.FileSystem
+	secondary *dirfs.FileSystem
+	state     cowfs.State
+	stateFile string
+}
+
+// openOverlay opens the overlay of the host directories primary and
+// secondary, with its state read from stateFile or, if that is empty,
+// reconstructed from the secondary.
+func openOverlay(primary, secondary, stateFile string) (*overlay, error) {
+	o := &overlay{stateFile: stateFile}
+	var err error
+	if o.primary, err = dirfs.New(primary); err != nil {
+		return nil, err
+	}
+	if o.secondary, err = dirfs.New(secondary); err != nil {
+		return nil, err
+	}
+	if stateFile != "" {
+		o.state, err = cowfs.JSONFile(stateFile).Load()
+	} else {
+		o.state, err = scanState(o.secondary)
+	}
+	if err != nil {
+		return nil, err
+	}
+	o.cfs = cowfs.New(o.primary, o.secondary, cowfs.WithStateStore(fixedState(o.state)))
+	return o, nil
+}
+
+// fixedState is a StateStore holding a state that is not saved back.
+type fixedState cowfs.State
+
+func (s fixedState) Load() (cowfs.State, error) { return cowfs.State(s), nil }
+func (s fixedState) Save(cowfs.State) error     { return nil }
+
+// scanState reconstructs the state of an overlay from its secondary, where
+// every path is one changed through the overlay.
+func scanState(secondary *dirfs.FileSystem) (cowfs.State, error) {
+	var s cowfs.State
+	err := fs.WalkDir(os.DirFS(secondary.Root()), ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			return nil
+		}
+		if internal(name) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		s.Modified = append(s.Modified, "/"+name)
+		return nil
+	})
+	return s, err
+}
+
+// internal reports whether the secondary path name, relative to its root,
+// is one of the overlay's own files.
+func internal(name string) bool {
+	return !strings.Contains(name, "/") && strings.HasPrefix(name, ".cowfs-") && strings.HasSuffix(name, "~")
+}
+
+// changes returns the changed paths in name order.
+func (o *overlay) changes() []string {
+	names := append(append([]string(nil), o.state.Modified...), o.state.Deleted...)
+	sort.Strings(names)
+	return names
+}
+
+// status lists the changed paths with their kind of change.
+func (o *overlay) status(w io.Writer) error {
+	for _, name := range o.changes() {
+		var mark string
+		switch o.cfs.Status(name) {
+		case cowfs.StatusCreated:
+			mark = "A"
+		case cowfs.StatusModified:
+			mark = "M"
+		case cowfs.StatusDeleted:
+			mark = "D"
+		default:
+			continue
+		}
+		if info, err := o.cfs.Stat(name); err == nil && info.IsDir() {
+			name += "/"
+		}
+		if _, err := fmt.Fprintf(w, "%s %s\n", mark, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diff prints unified diffs of the changed files.
+func (o *overlay) diff(w io.Writer) error {
+	return o.cfs.DiffAll(w)
+}
+
+// commit applies the changes to the primary directory, then empties the
+// secondary and the saved state.
+func (o *overlay) commit() error {
+	if err := o.cfs.Commit(context.Background()); err != nil {
+		return err
+	}
+	if o.stateFile != "" {
+		return cowfs.JSONFile(o.stateFile).Save(cowfs.State{})
+	}
+	return nil
+}
+
+// export writes the changes as a layer tarball to the file named by args,
+// or to w.
+func (o *overlay) export(w io.Writer, args []string) error {
+	if len(args) == 0 {
+		return o.cfs.ExportTar(w)
+	}
+	f, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+	err = o.cfs.ExportTar(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
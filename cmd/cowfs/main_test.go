@@ -0,0 +1,141 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/absfs/cowfs"
+	"github.com/absfs/cowfs/dirfs"
+)
+
+// newOverlay builds primary and secondary directories with a created, a
+// modified and a deleted file, returning them and the state file.
+func newOverlay(t *testing.T) (primary, secondary, state string) {
+	t.Helper()
+	primary, secondary = t.TempDir(), t.TempDir()
+	state = filepath.Join(t.TempDir(), "state.json")
+	os.WriteFile(filepath.Join(primary, "keep.txt"), []byte("keep\n"), 0644)
+	os.WriteFile(filepath.Join(primary, "edit.txt"), []byte("one\ntwo\nthree\n"), 0644)
+	os.WriteFile(filepath.Join(primary, "gone.txt"), []byte("gone\n"), 0644)
+
+	p, _ := dirfs.New(primary)
+	s, _ := dirfs.New(secondary)
+	cfs := cowfs.New(p, s, cowfs.WithStateStore(cowfs.JSONFile(state)))
+	cfs.WriteFile("/edit.txt", []byte("one\n2\nthree\n"), 0644)
+	cfs.WriteFile("/new.txt", []byte("new\n"), 0644)
+	cfs.Remove("/gone.txt")
+	if err := cfs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return primary, secondary, state
+}
+
+func runCmd(t *testing.T, args ...string) string {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	if code := run(args, &stdout, &stderr); code != 0 {
+		t.Fatalf("cowfs %v exited %d: %s", args, code, stderr.String())
+	}
+	return stdout.String()
+}
+
+func TestStatus(t *testing.T) {
+	primary, secondary, state := newOverlay(t)
+	got := runCmd(t, "-state", state, "status", primary, secondary)
+	if want := "M /edit.txt\nD /gone.txt\nA /new.txt\n"; got != want {
+		t.Errorf("status = %q, want %q", got, want)
+	}
+
+	// Without the state file, deletions are unknown
+	got = runCmd(t, "status", primary, secondary)
+	if want := "M /edit.txt\nA /new.txt\n"; got != want {
+		t.Errorf("reconstructed status = %q, want %q", got, want)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	primary, secondary, state := newOverlay(t)
+	got := runCmd(t, "-state", state, "diff", primary, secondary)
+	want := strings.Join([]string{
+		"--- a/edit.txt",
+		"+++ b/edit.txt",
+		"@@ -1,3 +1,3 @@",
+		" one",
+		"-two",
+		"+2",
+		" three",
+		"--- a/gone.txt",
+		"+++ /dev/null",
+		"@@ -1 +0,0 @@",
+		"-gone",
+		"--- /dev/null",
+		"+++ b/new.txt",
+		"@@ -0,0 +1 @@",
+		"+new",
+		"",
+	}, "\n")
+	if got != want {
+		t.Errorf("diff =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestCommit(t *testing.T) {
+	primary, secondary, state := newOverlay(t)
+	runCmd(t, "-state", state, "commit", primary, secondary)
+
+	for name, want := range map[string]string{"keep.txt": "keep\n", "edit.txt": "one\n2\nthree\n", "new.txt": "new\n"} {
+		if data, err := os.ReadFile(filepath.Join(primary, name)); err != nil || string(data) != want {
+			t.Errorf("primary %s = %q, %v, want %q", name, data, err, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(primary, "gone.txt")); !os.IsNotExist(err) {
+		t.Errorf("deleted file still in primary: %v", err)
+	}
+	if entries, _ := os.ReadDir(secondary); len(entries) != 0 {
+		t.Errorf("secondary not emptied: %v", entries)
+	}
+	if got := runCmd(t, "-state", state, "status", primary, secondary); got != "" {
+		t.Errorf("status after commit = %q, want nothing", got)
+	}
+}
+
+func TestExport(t *testing.T) {
+	primary, secondary, state := newOverlay(t)
+	out := filepath.Join(t.TempDir(), "layer.tar")
+	runCmd(t, "-state", state, "export", primary, secondary, out)
+
+	f, err := os.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	names := map[string]bool{}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names[hdr.Name] = true
+	}
+	for _, want := range []string{"edit.txt", "new.txt", ".wh.gone.txt"} {
+		if !names[want] {
+			t.Errorf("export entries = %v, missing %s", names, want)
+		}
+	}
+}
+
+func TestUsage(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"status"}, &stdout, &stderr); code != 2 {
+		t.Errorf("run() with missing arguments exited %d, want 2", code)
+	}
+	dir := t.TempDir()
+	if code := run([]string{"frob", dir, dir}, &stdout, &stderr); code != 2 {
+		t.Errorf("run() with unknown command exited %d, want 2", code)
+	}
+}
@@ -0,0 +1,559 @@
+package cowfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/absfs/absfs"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// MergeFunc resolves a conflict found by Commit between the overlay's and
+// the primary's changes to the file name. base reads the primary version the
+// overlay's change started from, ours the overlay's version and theirs the
+// primary's current version; each is nil where that version is missing:
+// ours if the overlay deleted the file, theirs if the primary no longer has
+// it, and base if its contents were not kept. The returned reader supplies
+// the merged contents to write to the primary. Returning a nil reader
+// removes the file, and returning an error aborts the commit.
+type MergeFunc func(name string, base, ours, theirs io.Reader) (io.Reader, error)
+
+// ConflictError is returned by Commit when paths conflict and no MergeFunc
+// was given. Nothing has been written to the primary.
+type ConflictError struct {
+	Conflicts []Conflict
+}
+
+func (e *ConflictError) Error() string {
+	if len(e.Conflicts) == 1 {
+		return "cowfs: commit conflict on " + e.Conflicts[0].Path
+	}
+	return fmt.Sprintf("cowfs: commit conflicts on %s and %d other paths", e.Conflicts[0].Path, len(e.Conflicts)-1)
+}
+
+// CommitOption configures Commit.
+type CommitOption func(*commitConfig)
+
+type commitConfig struct {
+	merge MergeFunc
+	paths []string // Patterns selecting the changes to commit
+	plan  *Plan    // Receives the plan instead of committing, if set
+}
+
+// selects reports whether the commit includes the change to name.
+func (c *commitConfig) selects(name string) bool {
+	if len(c.paths) == 0 {
+		return true
+	}
+	for _, pattern := range c.paths {
+		if matchPattern(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// DryRun makes Commit store the changes it would make to the primary in
+// plan instead of making them. Conflicts are still reported as a
+// *ConflictError, but a MergeFunc is not called; the plan lists the
+// conflicting paths with PlanMerge.
+func DryRun(plan *Plan) CommitOption {
+	return func(c *commitConfig) {
+		c.plan = plan
+	}
+}
+
+// WithPaths limits a commit to the changed paths matching any of patterns,
+// leaving the other changes in the overlay, so that a large set of changes
+// can be committed piece by piece. Patterns use the syntax of path.Match on
+// slash-separated paths, relative to the root or absolute, with "**"
+// matching any number of path elements: "configs/**" selects everything
+// below configs, and "**/*.yaml" every YAML file.
+//
+// Changes inside a recreated directory are only committed along with the
+// directory.
+func WithPaths(patterns ...string) CommitOption {
+	return func(c *commitConfig) {
+		c.paths = append(c.paths, patterns...)
+	}
+}
+
+// validPattern checks the syntax of a WithPaths or Rule pattern.
+func validPattern(pattern string) error {
+	for _, elem := range strings.Split(strings.TrimPrefix(pattern, "/"), "/") {
+		if _, err := path.Match(elem, ""); err != nil {
+			return fmt.Errorf("cowfs: pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// matchPattern reports whether the overlay path name matches a WithPaths
+// or Rule pattern.
+func matchPattern(pattern, name string) bool {
+	return matchElems(strings.Split(strings.TrimPrefix(pattern, "/"), "/"), strings.Split(strings.TrimPrefix(name, "/"), "/"))
+}
+
+// matchElems matches path elements against pattern elements, where "**"
+// matches any number of elements.
+func matchElems(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchElems(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// WithMergeFunc resolves conflicting paths with merge instead of failing
+// the commit with a ConflictError.
+func WithMergeFunc(merge MergeFunc) CommitOption {
+	return func(c *commitConfig) {
+		c.merge = merge
+	}
+}
+
+// Commit merges the overlay's changes into the primary, which must be
+// writable, and then empties the overlay: deleted paths and the primary
+// contents of recreated directories are removed from the primary, and the
+// merged versions of modified and created paths are written to it, each
+// file through a temporary file renamed into place. Ownership recorded by
+// DeferredOwners is applied where the primary supports it.
+//
+// WithPaths limits the commit to some of the changes; the others stay in
+// the overlay.
+//
+// With WithConflictDetection, paths whose primary version changed since the
+// overlay took them over are conflicts. Commit fails with a *ConflictError
+// before writing anything unless WithMergeFunc supplies a MergeFunc, whose
+// results are written instead of the overlay's versions.
+//
+// Commit fails with ErrTxInProgress while a transaction is open. Mutations
+// are held back while Commit runs. If it fails part way, for example
+// because ctx is cancelled, the overlay keeps all of its changes, and Commit
+// can be called again to finish.
+func (cfs *FileSystem) Commit(ctx context.Context, opts ...CommitOption) (err error) {
+	span := cfs.startSpan("cowfs.Commit")
+	defer func() { endSpan(span, err) }()
+
+	var c commitConfig
+	for _, opt := range opts {
+		opt(&c)
+	}
+	for _, pattern := range c.paths {
+		if err := validPattern(pattern); err != nil {
+			return err
+		}
+	}
+	cfs.opMu.Lock()
+	defer cfs.opMu.Unlock()
+	if cfs.frozen.Load() {
+		return ErrFrozen
+	}
+	cfs.txMu.Lock()
+	inTx := cfs.tx != nil
+	cfs.txMu.Unlock()
+	if inTx {
+		return ErrTxInProgress
+	}
+	cfs.flushDeletions()
+
+	ch := cfs.commitChanges(&c)
+	span.SetAttributes(
+		attribute.Int("cowfs.modified", len(ch.modified)),
+		attribute.Int("cowfs.deleted", len(ch.deleted)))
+	conflicts, err := cfs.commitConflicts(ch)
+	if err != nil {
+		return err
+	}
+	span.SetAttributes(attribute.Int("cowfs.conflicts", len(conflicts)))
+	if len(conflicts) > 0 && c.merge == nil {
+		return &ConflictError{Conflicts: conflicts}
+	}
+	if c.plan != nil {
+		*c.plan = cfs.planCommit(ch, conflicts)
+		return nil
+	}
+	merged, err := cfs.mergeConflicts(c.merge, conflicts)
+	if err != nil {
+		return err
+	}
+
+	// Removals go first, so that created paths can take their place
+	for _, name := range append(append([]string(nil), ch.deleted...), ch.opaque...) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, ok := merged[name]; ok {
+			continue
+		}
+		if err := removeTree(cfs.primary, name); err != nil {
+			return pathError("commit", name, err)
+		}
+	}
+	// Parents sort before their children
+	for _, name := range ch.modified {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, ok := merged[name]; ok {
+			continue
+		}
+		if err := cfs.commitPath(name); err != nil {
+			return pathError("commit", name, err)
+		}
+	}
+	names := make([]string, 0, len(merged))
+	for name := range merged {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := cfs.commitMerged(name, merged[name]); err != nil {
+			return pathError("commit", name, err)
+		}
+	}
+	for name, o := range ch.owners {
+		if err := cfs.primary.Chown(name, o.UID, o.GID); err != nil {
+			return pathError("commit", name, err)
+		}
+	}
+
+	if len(c.paths) == 0 {
+		cfs.clearOverlay()
+	} else {
+		cfs.releaseCommitted(ch)
+	}
+	cfs.gen.Add(1)
+	cfs.stateChanged()
+	cfs.debug("cowfs: committed", "modified", len(ch.modified), "deleted", len(ch.deleted), "merged", len(merged))
+	return nil
+}
+
+// commitChanges are the changes selected for a commit, with sorted paths.
+type commitChanges struct {
+	modified []string
+	deleted  []string
+	opaque   []string
+	owners   map[string]Owner
+}
+
+// has reports whether name is among the selected changes.
+func (ch *commitChanges) has(name string) bool {
+	for _, names := range [][]string{ch.modified, ch.deleted} {
+		if i := sort.SearchStrings(names, name); i < len(names) && names[i] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// commitChanges returns the changes selected by c. Changes inside
+// recreated directories are only selected along with the directory, since
+// without it they would be hidden again.
+func (cfs *FileSystem) commitChanges(c *commitConfig) *commitChanges {
+	modified, deleted := cfs.state()
+	ch := &commitChanges{owners: make(map[string]Owner)}
+	cfs.mu.RLock()
+	defer cfs.mu.RUnlock()
+	for dir := range cfs.opaque {
+		if c.selects(dir) {
+			ch.opaque = append(ch.opaque, dir)
+		}
+	}
+	sort.Strings(ch.opaque)
+	selected := func(name string) bool {
+		if !c.selects(name) {
+			return false
+		}
+		for dir := path.Dir(name); dir != name; name, dir = dir, path.Dir(dir) {
+			if cfs.opaque[dir] && !c.selects(dir) {
+				return false
+			}
+		}
+		return true
+	}
+	for _, name := range modified {
+		if selected(name) {
+			ch.modified = append(ch.modified, name)
+			if o, ok := cfs.owners[name]; ok {
+				ch.owners[name] = o
+			}
+		}
+	}
+	for _, name := range deleted {
+		if selected(name) {
+			ch.deleted = append(ch.deleted, name)
+		}
+	}
+	return ch
+}
+
+// releaseCommitted removes the committed changes ch from the overlay,
+// leaving the others. cfs.opMu must be held exclusively.
+func (cfs *FileSystem) releaseCommitted(ch *commitChanges) {
+	// Children go before their parents, whose secondary copies are only
+	// removed once empty
+	for i := len(ch.modified) - 1; i >= 0; i-- {
+		name := ch.modified[i]
+		size := cfs.secondarySize(name)
+		if err := cfs.secondary.Remove(name); err == nil {
+			cfs.adjustQuota("commit", name, -size)
+		}
+		cfs.mu.Lock()
+		delete(cfs.modified, name)
+		delete(cfs.owners, name)
+		cfs.mu.Unlock()
+		cfs.setDelta(name, false)
+		cfs.dropBase(name)
+		cfs.pruneParents(name)
+	}
+	cfs.mu.Lock()
+	for _, name := range ch.deleted {
+		delete(cfs.deleted, name)
+	}
+	for _, dir := range ch.opaque {
+		delete(cfs.opaque, dir)
+	}
+	cfs.mu.Unlock()
+	for _, name := range ch.deleted {
+		cfs.dropBase(name)
+	}
+}
+
+// pruneParents removes the secondary copies of the parent directories of
+// name that were only created to hold copies below them, once empty.
+func (cfs *FileSystem) pruneParents(name string) {
+	for dir := path.Dir(name); dir != "/"; dir = path.Dir(dir) {
+		if cfs.IsModified(dir) || cfs.secondary.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+// commitConflicts returns the conflicting paths among the changes ch.
+func (cfs *FileSystem) commitConflicts(ch *commitChanges) ([]Conflict, error) {
+	if cfs.conflicts == nil {
+		return nil, nil
+	}
+	all, err := cfs.DetectConflicts()
+	if err != nil {
+		return nil, err
+	}
+	var conflicts []Conflict
+	for _, conflict := range all {
+		if ch.has(conflict.Path) {
+			conflicts = append(conflicts, conflict)
+		}
+	}
+	return conflicts, nil
+}
+
+// mergeConflicts resolves conflicts with merge, returning the merged
+// contents of each path, nil for paths to remove.
+func (cfs *FileSystem) mergeConflicts(merge MergeFunc, conflicts []Conflict) (map[string][]byte, error) {
+	merged := make(map[string][]byte, len(conflicts))
+	for _, conflict := range conflicts {
+		data, err := cfs.mergeConflict(merge, conflict)
+		if err != nil {
+			return nil, pathError("merge", conflict.Path, err)
+		}
+		merged[conflict.Path] = data
+	}
+	return merged, nil
+}
+
+// mergeConflict runs merge on the versions of one conflicting path.
+func (cfs *FileSystem) mergeConflict(merge MergeFunc, conflict Conflict) ([]byte, error) {
+	var base, ours, theirs io.Reader
+	if f, err := cfs.openBase(conflict.Base); err == nil {
+		defer f.Close()
+		base = f
+	}
+	if !conflict.Deleted {
+		f, err := cfs.OpenFile(conflict.Path, os.O_RDONLY, 0)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		ours = f
+	}
+	if conflict.Primary != (FileVersion{}) {
+		f, err := cfs.primary.OpenFile(conflict.Path, os.O_RDONLY, 0)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		theirs = f
+	}
+
+	r, err := merge(conflict.Path, base, ours, theirs)
+	if err != nil || r == nil {
+		return nil, err
+	}
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+	data, err := io.ReadAll(r)
+	if data == nil {
+		data = []byte{}
+	}
+	return data, err
+}
+
+// commitPath writes the merged version of the modified path name to the
+// primary.
+func (cfs *FileSystem) commitPath(name string) error {
+	stat := cfs.Stat
+	if cfs.links {
+		stat = cfs.Lstat
+	}
+	info, err := stat(name)
+	if os.IsNotExist(err) {
+		return nil // Below a deleted directory
+	}
+	if err != nil {
+		return err
+	}
+	if err := cfs.ensurePrimaryDir(path.Dir(name)); err != nil {
+		return err
+	}
+	switch {
+	case info.IsDir():
+		if existing, err := cfs.primary.Stat(name); err != nil || !existing.IsDir() {
+			if err := removeTree(cfs.primary, name); err != nil {
+				return err
+			}
+			if err := cfs.primary.Mkdir(name, info.Mode().Perm()); err != nil {
+				return err
+			}
+		}
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := cfs.Readlink(name)
+		if err != nil {
+			return err
+		}
+		if err := removeTree(cfs.primary, name); err != nil {
+			return err
+		}
+		return cfs.primary.(absfs.SymLinker).Symlink(target, name)
+	case info.Mode().IsRegular():
+		f, err := cfs.OpenFile(name, os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := cfs.writePrimary(name, f, info.Mode().Perm()); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+	if err := cfs.primary.Chmod(name, info.Mode()); err != nil {
+		return err
+	}
+	return cfs.primary.Chtimes(name, info.ModTime(), info.ModTime())
+}
+
+// commitMerged writes the merged contents data of name to the primary, or
+// removes name from it if data is nil.
+func (cfs *FileSystem) commitMerged(name string, data []byte) error {
+	if data == nil {
+		return removeTree(cfs.primary, name)
+	}
+	perm := os.FileMode(0644)
+	if info, err := cfs.Stat(name); err == nil {
+		perm = info.Mode().Perm()
+	} else if info, err := cfs.primary.Stat(name); err == nil {
+		perm = info.Mode().Perm()
+	}
+	if err := cfs.ensurePrimaryDir(path.Dir(name)); err != nil {
+		return err
+	}
+	return cfs.writePrimary(name, bytes.NewReader(data), perm)
+}
+
+// ensurePrimaryDir creates dir and its parents in the primary if missing.
+func (cfs *FileSystem) ensurePrimaryDir(dir string) error {
+	if _, err := cfs.primary.Stat(dir); err == nil {
+		return nil
+	}
+	if parent := path.Dir(dir); parent != dir {
+		if err := cfs.ensurePrimaryDir(parent); err != nil {
+			return err
+		}
+	}
+	if err := cfs.primary.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+// writePrimary replaces the primary file name with the contents of r,
+// through a temporary file renamed into place.
+func (cfs *FileSystem) writePrimary(name string, r io.Reader, perm os.FileMode) error {
+	tmp := name + ".cowfs-commit~"
+	f, err := cfs.primary.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	n, err := cfs.copyBuffers().copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = replaceFile(cfs.primary, tmp, name)
+	}
+	if err != nil {
+		cfs.primary.Remove(tmp)
+		return err
+	}
+	cfs.counters.primary.write(n)
+	return nil
+}
+
+// clearOverlay removes every change from the overlay after a commit.
+// cfs.opMu must be held exclusively.
+func (cfs *FileSystem) clearOverlay() {
+	entries, _ := cfs.secondary.ReadDir("/")
+	for _, e := range entries {
+		if name := "/" + e.Name(); !internalDir("/", e.Name()) || name == basesDir || name == writeDir {
+			removeAll(cfs.secondary, name)
+		}
+	}
+	cfs.mu.Lock()
+	cfs.modified = make(map[string]bool)
+	cfs.deleted = make(map[string]bool)
+	cfs.opaque = nil
+	cfs.owners = nil
+	if cfs.deltas != nil {
+		cfs.deltas = make(map[string]bool)
+	}
+	cfs.mu.Unlock()
+	if c := cfs.conflicts; c != nil {
+		c.mu.Lock()
+		c.bases = make(map[string]FileVersion)
+		c.mu.Unlock()
+	}
+	if cfs.quota != nil {
+		cfs.quota.used.Store(0)
+	}
+}
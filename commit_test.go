@@ -0,0 +1,185 @@
+package cowfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestCommit(t *testing.T) {
+	cfs, primary, secondary := newMemOverlay(t)
+	primary.Mkdir("/dir", 0755)
+	writeMemFile(t, primary, "/dir/edit.txt", "primary")
+	writeMemFile(t, primary, "/gone.txt", "gone")
+	writeMemFile(t, primary, "/keep.txt", "keep")
+	cfs.WriteFile("/dir/edit.txt", []byte("overlay"), 0644)
+	cfs.Mkdir("/new", 0700)
+	cfs.WriteFile("/new/file.txt", []byte("new"), 0600)
+	cfs.Remove("/gone.txt")
+
+	if err := cfs.Commit(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"/dir/edit.txt": "overlay", "/new/file.txt": "new", "/keep.txt": "keep"} {
+		if data, err := primary.ReadFile(name); err != nil || string(data) != want {
+			t.Errorf("primary %s = %q, %v, want %q", name, data, err, want)
+		}
+	}
+	if info, err := primary.Stat("/new"); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("primary /new = %v, %v, want a 0700 directory", info, err)
+	}
+	if _, err := primary.Stat("/gone.txt"); !os.IsNotExist(err) {
+		t.Errorf("deleted file still in primary: %v", err)
+	}
+	if names := listNames(t, cfs, "/"); len(names) != 3 {
+		t.Errorf("ReadDir() after Commit() = %v, want dir, keep.txt and new", names)
+	}
+	if entries, _ := secondary.ReadDir("/"); len(entries) != 0 {
+		t.Errorf("secondary not emptied: %v", entries)
+	}
+	if cfs.IsModified("/dir/edit.txt") || cfs.IsDeleted("/gone.txt") {
+		t.Error("overlay markers not cleared")
+	}
+}
+
+func TestCommitRemoveFailure(t *testing.T) {
+	_, primary, secondary := newMemOverlay(t)
+	writeMemFile(t, primary, "/gone.txt", "gone")
+	cfs := New(failingRemoveFiler{primary}, secondary)
+	if err := cfs.Remove("/gone.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cfs.Commit(context.Background()); !errors.Is(err, syscall.EIO) {
+		t.Fatalf("Commit() = %v, want the primary removal error", err)
+	}
+	if !cfs.IsDeleted("/gone.txt") {
+		t.Error("deletion marker dropped by the failed Commit")
+	}
+	if _, err := cfs.Stat("/gone.txt"); !os.IsNotExist(err) {
+		t.Errorf("Stat() after the failed Commit = %v, want not exist", err)
+	}
+}
+
+func TestCommitConflicts(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	WithConflictDetection()(cfs)
+	writeMemFile(t, primary, "/conf.txt", "a\nb\nc\n")
+	cfs.WriteFile("/conf.txt", []byte("A\nb\nc\n"), 0644)
+	writeMemFile(t, primary, "/conf.txt", "a\nb\nCC\n")
+
+	var conflictErr *ConflictError
+	if err := cfs.Commit(context.Background()); !errors.As(err, &conflictErr) || len(conflictErr.Conflicts) != 1 {
+		t.Fatalf("Commit() error = %v, want a conflict on /conf.txt", err)
+	}
+	if data, _ := primary.ReadFile("/conf.txt"); string(data) != "a\nb\nCC\n" {
+		t.Errorf("primary written despite the conflict: %q", data)
+	}
+
+	// Take the first line from ours and the rest from theirs
+	merge := func(name string, base, ours, theirs io.Reader) (io.Reader, error) {
+		b, _ := io.ReadAll(base)
+		o, _ := io.ReadAll(ours)
+		th, _ := io.ReadAll(theirs)
+		if string(b) != "a\nb\nc\n" {
+			t.Errorf("base = %q, want the version copied up", b)
+		}
+		first := strings.SplitAfter(string(o), "\n")[0]
+		rest := strings.SplitAfterN(string(th), "\n", 2)[1]
+		return strings.NewReader(first + rest), nil
+	}
+	if err := cfs.Commit(context.Background(), WithMergeFunc(merge)); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := primary.ReadFile("/conf.txt"); string(data) != "A\nb\nCC\n" {
+		t.Errorf("primary = %q, want the merged contents", data)
+	}
+
+	// A failed merge aborts the commit
+	cfs.WriteFile("/conf.txt", []byte("x"), 0644)
+	writeMemFile(t, primary, "/conf.txt", "yy")
+	failing := func(string, io.Reader, io.Reader, io.Reader) (io.Reader, error) {
+		return nil, errors.New("cannot merge")
+	}
+	if err := cfs.Commit(context.Background(), WithMergeFunc(failing)); err == nil {
+		t.Error("Commit() succeeded despite the failed merge")
+	}
+	if data, _ := cfs.ReadFile("/conf.txt"); !bytes.Equal(data, []byte("x")) {
+		t.Errorf("overlay version = %q, want it kept", data)
+	}
+}
+
+func TestCommitPaths(t *testing.T) {
+	cfs, primary, secondary := newMemOverlay(t)
+	primary.Mkdir("/configs", 0755)
+	writeMemFile(t, primary, "/configs/app.yaml", "old")
+	writeMemFile(t, primary, "/configs/gone.yaml", "gone")
+	writeMemFile(t, primary, "/readme.txt", "old")
+	cfs.WriteFile("/configs/app.yaml", []byte("new"), 0644)
+	cfs.Remove("/configs/gone.yaml")
+	cfs.Mkdir("/configs/extra", 0755)
+	cfs.Mkdir("/configs/extra/deep", 0755)
+	cfs.WriteFile("/configs/extra/deep/x.yaml", []byte("x"), 0644)
+	cfs.WriteFile("/readme.txt", []byte("new"), 0644)
+	cfs.Mkdir("/data", 0755)
+	cfs.WriteFile("/data/db.yaml", []byte("db"), 0644)
+
+	if err := cfs.Commit(context.Background(), WithPaths("configs/**", "/data/*.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"/configs/app.yaml": "new", "/configs/extra/deep/x.yaml": "x", "/data/db.yaml": "db", "/readme.txt": "old"} {
+		if data, err := primary.ReadFile(name); err != nil || string(data) != want {
+			t.Errorf("primary %s = %q, %v, want %q", name, data, err, want)
+		}
+	}
+	if _, err := primary.Stat("/configs/gone.yaml"); !os.IsNotExist(err) {
+		t.Errorf("deleted file still in primary: %v", err)
+	}
+
+	// The rest stays in the overlay
+	if !cfs.IsModified("/readme.txt") || !cfs.IsModified("/data") {
+		t.Error("uncommitted changes left the overlay")
+	}
+	if cfs.IsModified("/configs/app.yaml") || cfs.IsDeleted("/configs/gone.yaml") || cfs.IsModified("/data/db.yaml") {
+		t.Error("committed changes still in the overlay")
+	}
+	if _, err := secondary.Stat("/configs"); !os.IsNotExist(err) {
+		t.Errorf("committed directory still in the secondary: %v", err)
+	}
+	if data, _ := cfs.ReadFile("/readme.txt"); string(data) != "new" {
+		t.Errorf("ReadFile(/readme.txt) = %q, want the uncommitted version", data)
+	}
+	if names := listNames(t, cfs, "/data"); len(names) != 1 {
+		t.Errorf("ReadDir(/data) = %v, want db.yaml", names)
+	}
+
+	if err := cfs.Commit(context.Background(), WithPaths("[")); err == nil {
+		t.Error("Commit() accepted a malformed pattern")
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	for _, tt := range []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"configs/**", "/configs", true},
+		{"configs/**", "/configs/a/b.yaml", true},
+		{"configs/**", "/configsx/a", false},
+		{"**/*.yaml", "/a.yaml", true},
+		{"**/*.yaml", "/a/b/c.yaml", true},
+		{"**/*.yaml", "/a/b/c.yml", false},
+		{"/a/*/c", "/a/b/c", true},
+		{"a/*/c", "/a/b/d/c", false},
+		{"a/**/c", "/a/c", true},
+	} {
+		if got := matchPattern(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("matchPattern(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
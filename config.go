@@ -0,0 +1,290 @@
+package cowfs
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/cowfs/dirfs"
+	"github.com/absfs/memfs"
+	"gopkg.in/yaml.v3"
+)
+
+// Config declaratively describes an overlay: the filesystems used as its
+// layers and the optional behavior to enable. It can be decoded from YAML or
+// JSON with LoadConfig and turned into a FileSystem with FromConfig.
+//
+// Mounts of further filesystems below the root are not configurable: an
+// overlay has exactly two layers, and composing filesystems at mount points
+// is left to the absfs packages that implement it.
+type Config struct {
+	Primary   LayerConfig   `json:"primary" yaml:"primary"`
+	Secondary LayerConfig   `json:"secondary" yaml:"secondary"`
+	Options   OptionsConfig `json:"options" yaml:"options"`
+
+	// Labels are attached to the overlay. See SetLabel.
+	Labels map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+}
+
+// LayerConfig describes one layer of an overlay.
+type LayerConfig struct {
+	// Type selects the filesystem implementation. "memfs" is an empty
+	// in-memory filesystem, "dir" is a host directory and "archive" is the
+	// read-only contents of a tar or zip archive, served as by NewFromTar and
+	// NewFromZip, which can only be the primary; additional types can be
+	// added with RegisterLayerType.
+	Type string `json:"type" yaml:"type"`
+
+	// Path locates the layer's backing storage, such as the host directory
+	// of a "dir" layer or the archive file of an "archive" layer. Archives
+	// ending in ".zip" are zip archives, and are kept open for the life of
+	// the process; others are uncompressed tar archives.
+	Path string `json:"path,omitempty" yaml:"path,omitempty"`
+}
+
+// OptionsConfig describes the optional behavior of an overlay. The zero
+// value enables nothing.
+type OptionsConfig struct {
+	// CopyUpStrategy is "full" (the default), "reflink" or "hardlink". The
+	// hardlink strategy requires both layers to be "dir" layers.
+	CopyUpStrategy string `json:"copyUpStrategy,omitempty" yaml:"copyUpStrategy,omitempty"`
+
+	// ContentCache enables the content cache for small primary files.
+	ContentCache *ContentCacheConfig `json:"contentCache,omitempty" yaml:"contentCache,omitempty"`
+
+	// DeltaThreshold enables delta storage for files at least this large.
+	DeltaThreshold int64 `json:"deltaThreshold,omitempty" yaml:"deltaThreshold,omitempty"`
+
+	// ReserveSpace enables the free space check before copy-ups, keeping
+	// this many bytes free in the secondary. Free space is measured on the
+	// host for "dir" secondaries.
+	ReserveSpace int64 `json:"reserveSpace,omitempty" yaml:"reserveSpace,omitempty"`
+
+	// MaxSecondaryBytes limits the total size of files in the secondary.
+	MaxSecondaryBytes int64 `json:"maxSecondaryBytes,omitempty" yaml:"maxSecondaryBytes,omitempty"`
+
+	// Rules place paths in zones outside the overlay. See WithRules.
+	Rules []RuleConfig `json:"rules,omitempty" yaml:"rules,omitempty"`
+
+	// StateFile persists the overlay's state in this host file, as a
+	// JSONFile state store. See WithStateStore.
+	StateFile string `json:"stateFile,omitempty" yaml:"stateFile,omitempty"`
+
+	// Journal enables the write-ahead journal. See WithJournal.
+	Journal bool `json:"journal,omitempty" yaml:"journal,omitempty"`
+}
+
+// RuleConfig configures one Rule.
+type RuleConfig struct {
+	Pattern string `json:"pattern" yaml:"pattern"`
+
+	// Zone is "overlay", "pass-through" or "write-through".
+	Zone string `json:"zone" yaml:"zone"`
+}
+
+// ContentCacheConfig configures the content cache. See WithContentCache.
+type ContentCacheConfig struct {
+	MaxBytes    int64 `json:"maxBytes" yaml:"maxBytes"`
+	MaxFileSize int64 `json:"maxFileSize" yaml:"maxFileSize"`
+}
+
+// ConfigError reports an invalid configuration value.
+type ConfigError struct {
+	Field string // Dotted path of the offending field, e.g. "primary.path"
+	Err   error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("cowfs: config field %s: %v", e.Field, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error { return e.Err }
+
+// LayerFactory builds a layer filesystem from its configuration.
+type LayerFactory func(cfg LayerConfig) (absfs.Filer, error)
+
+var layerTypes = map[string]LayerFactory{
+	"memfs": func(cfg LayerConfig) (absfs.Filer, error) {
+		return memfs.NewFS()
+	},
+	"dir": func(cfg LayerConfig) (absfs.Filer, error) {
+		if cfg.Path == "" {
+			return nil, &ConfigError{Field: "path", Err: errors.New("required for dir layers")}
+		}
+		return dirfs.New(cfg.Path)
+	},
+	"archive": func(cfg LayerConfig) (absfs.Filer, error) {
+		if cfg.Path == "" {
+			return nil, &ConfigError{Field: "path", Err: errors.New("required for archive layers")}
+		}
+		if strings.EqualFold(filepath.Ext(cfg.Path), ".zip") {
+			r, err := zip.OpenReader(cfg.Path)
+			if err != nil {
+				return nil, &ConfigError{Field: "path", Err: err}
+			}
+			return &fsFiler{fsys: &r.Reader}, nil
+		}
+		t, err := openTar(cfg.Path)
+		if err != nil {
+			return nil, &ConfigError{Field: "path", Err: err}
+		}
+		return &fsFiler{fsys: t}, nil
+	},
+}
+
+// RegisterLayerType makes a layer type available to FromConfig. It is not
+// safe to call concurrently with FromConfig and is intended to be called
+// from init functions.
+func RegisterLayerType(name string, factory LayerFactory) {
+	layerTypes[name] = factory
+}
+
+// LoadConfig decodes a YAML or JSON overlay configuration from r. Unknown
+// fields are rejected.
+func LoadConfig(r io.Reader) (Config, error) {
+	var cfg Config
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil {
+		return Config{}, fmt.Errorf("cowfs: decoding config: %w", err)
+	}
+	return cfg, nil
+}
+
+// FromConfig builds an overlay from cfg. Validation errors are returned as
+// *ConfigError naming the offending field.
+func FromConfig(cfg Config) (*FileSystem, error) {
+	primary, err := buildLayer("primary", cfg.Primary)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Secondary.Type == "archive" {
+		return nil, &ConfigError{Field: "secondary.type", Err: errors.New("archive layers are read-only")}
+	}
+	secondary, err := buildLayer("secondary", cfg.Secondary)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := cfg.Options.options(primary, secondary)
+	if err != nil {
+		return nil, err
+	}
+	for k := range cfg.Labels {
+		if !validLabelKey(k) {
+			return nil, &ConfigError{Field: "labels", Err: fmt.Errorf("invalid key %q", k)}
+		}
+	}
+	if len(cfg.Labels) > 0 {
+		opts = append(opts, WithLabels(cfg.Labels))
+	}
+	return New(primary, secondary, opts...), nil
+}
+
+func buildLayer(field string, cfg LayerConfig) (absfs.Filer, error) {
+	if cfg.Type == "" {
+		return nil, &ConfigError{Field: field + ".type", Err: errors.New("required")}
+	}
+	factory, ok := layerTypes[cfg.Type]
+	if !ok {
+		return nil, &ConfigError{Field: field + ".type", Err: fmt.Errorf("unknown layer type %q (known: %v)", cfg.Type, knownLayerTypes())}
+	}
+	filer, err := factory(cfg)
+	if err != nil {
+		var cerr *ConfigError
+		if errors.As(err, &cerr) {
+			return nil, &ConfigError{Field: field + "." + cerr.Field, Err: cerr.Err}
+		}
+		return nil, &ConfigError{Field: field, Err: err}
+	}
+	return filer, nil
+}
+
+func knownLayerTypes() []string {
+	names := make([]string, 0, len(layerTypes))
+	for name := range layerTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (c OptionsConfig) options(primary, secondary absfs.Filer) ([]Option, error) {
+	var opts []Option
+
+	switch c.CopyUpStrategy {
+	case "", "full":
+	case "reflink":
+		opts = append(opts, WithCopyUpStrategy(Reflink{}))
+	case "hardlink":
+		p, pok := primary.(*dirfs.FileSystem)
+		s, sok := secondary.(*dirfs.FileSystem)
+		if !pok || !sok {
+			return nil, &ConfigError{Field: "options.copyUpStrategy", Err: errors.New("hardlink requires dir layers")}
+		}
+		opts = append(opts, WithCopyUpStrategy(Hardlink{PrimaryDir: p.Root(), SecondaryDir: s.Root()}))
+	default:
+		return nil, &ConfigError{Field: "options.copyUpStrategy", Err: fmt.Errorf("unknown strategy %q", c.CopyUpStrategy)}
+	}
+
+	if cc := c.ContentCache; cc != nil {
+		if cc.MaxBytes <= 0 {
+			return nil, &ConfigError{Field: "options.contentCache.maxBytes", Err: errors.New("must be positive")}
+		}
+		if cc.MaxFileSize <= 0 {
+			return nil, &ConfigError{Field: "options.contentCache.maxFileSize", Err: errors.New("must be positive")}
+		}
+		opts = append(opts, WithContentCache(cc.MaxBytes, cc.MaxFileSize))
+	}
+
+	if c.DeltaThreshold < 0 {
+		return nil, &ConfigError{Field: "options.deltaThreshold", Err: errors.New("must not be negative")}
+	} else if c.DeltaThreshold > 0 {
+		opts = append(opts, WithDeltaThreshold(c.DeltaThreshold))
+	}
+
+	if c.ReserveSpace < 0 {
+		return nil, &ConfigError{Field: "options.reserveSpace", Err: errors.New("must not be negative")}
+	} else if c.ReserveSpace > 0 {
+		var probe SpaceProbe
+		if d, ok := secondary.(*dirfs.FileSystem); ok {
+			probe = DiskSpaceProbe(d.Root())
+		}
+		opts = append(opts, WithSpaceCheck(c.ReserveSpace, probe))
+	}
+
+	if c.MaxSecondaryBytes < 0 {
+		return nil, &ConfigError{Field: "options.maxSecondaryBytes", Err: errors.New("must not be negative")}
+	} else if c.MaxSecondaryBytes > 0 {
+		opts = append(opts, WithMaxSecondaryBytes(c.MaxSecondaryBytes))
+	}
+
+	if len(c.Rules) > 0 {
+		rules := make([]Rule, len(c.Rules))
+		for i, rc := range c.Rules {
+			field := fmt.Sprintf("options.rules[%d]", i)
+			if err := validPattern(rc.Pattern); err != nil {
+				return nil, &ConfigError{Field: field + ".pattern", Err: err}
+			}
+			zone, err := parseZone(rc.Zone)
+			if err != nil {
+				return nil, &ConfigError{Field: field + ".zone", Err: err}
+			}
+			rules[i] = Rule{Pattern: rc.Pattern, Zone: zone}
+		}
+		opts = append(opts, WithRules(rules...))
+	}
+
+	if c.StateFile != "" {
+		opts = append(opts, WithStateStore(JSONFile(c.StateFile)))
+	}
+	if c.Journal {
+		opts = append(opts, WithJournal())
+	}
+
+	return opts, nil
+}
@@ -0,0 +1,182 @@
+package cowfs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/absfs/cowfs/dirfs"
+)
+
+func TestLoadConfig(t *testing.T) {
+	primaryDir := t.TempDir()
+	os.WriteFile(filepath.Join(primaryDir, "base.txt"), []byte("base"), 0644)
+
+	src := `
+primary:
+  type: dir
+  path: ` + primaryDir + `
+secondary:
+  type: memfs
+options:
+  copyUpStrategy: reflink
+  contentCache:
+    maxBytes: 4096
+    maxFileSize: 512
+`
+	cfg, err := LoadConfig(strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	cfs, err := FromConfig(cfg)
+	if err != nil {
+		t.Fatalf("FromConfig() error = %v", err)
+	}
+	if _, ok := cfs.primary.(*dirfs.FileSystem); !ok {
+		t.Errorf("primary is %T, want *dirfs.FileSystem", cfs.primary)
+	}
+	if _, ok := cfs.strategy.(Reflink); !ok {
+		t.Errorf("strategy is %T, want Reflink", cfs.strategy)
+	}
+	if cfs.cache == nil {
+		t.Error("content cache not enabled")
+	}
+
+	if err := cfs.Chmod("/base.txt", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := cfs.ReadFile("/base.txt"); string(data) != "base" {
+		t.Errorf("ReadFile() = %q", data)
+	}
+	if info, _ := os.Stat(filepath.Join(primaryDir, "base.txt")); info.Mode().Perm() != 0644 {
+		t.Error("primary directory was modified")
+	}
+}
+
+func TestLoadConfigJSON(t *testing.T) {
+	cfg, err := LoadConfig(strings.NewReader(`{"primary": {"type": "memfs"}, "secondary": {"type": "memfs"}, "options": {"deltaThreshold": 1024, "maxSecondaryBytes": 4096}}`))
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	cfs, err := FromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfs.deltaThreshold != 1024 {
+		t.Errorf("deltaThreshold = %d, want 1024", cfs.deltaThreshold)
+	}
+	if cfs.quota == nil || cfs.quota.max != 4096 {
+		t.Errorf("quota = %+v, want max 4096", cfs.quota)
+	}
+}
+
+func TestLoadConfigArchive(t *testing.T) {
+	tarName := writeTar(t, []tar.Header{
+		{Name: "app/main.js", Typeflag: tar.TypeReg, Mode: 0o644},
+	}, map[string]string{"app/main.js": "main()"})
+
+	zipName := filepath.Join(t.TempDir(), "bundle.zip")
+	f, err := os.Create(zipName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	w, _ := zw.Create("app/main.js")
+	w.Write([]byte("main()"))
+	zw.Close()
+	f.Close()
+
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	for _, archive := range []string{tarName, zipName} {
+		src := `
+primary:
+  type: archive
+  path: ` + archive + `
+secondary:
+  type: memfs
+options:
+  stateFile: ` + stateFile + `
+  journal: true
+`
+		cfg, err := LoadConfig(strings.NewReader(src))
+		if err != nil {
+			t.Fatalf("LoadConfig() error = %v", err)
+		}
+		cfs, err := FromConfig(cfg)
+		if err != nil {
+			t.Fatalf("FromConfig(%s) error = %v", archive, err)
+		}
+		if data, err := cfs.ReadFile("/app/main.js"); err != nil || string(data) != "main()" {
+			t.Errorf("%s: ReadFile() = %q, %v, want main()", archive, data, err)
+		}
+		if err := cfs.Remove("/app/main.js"); err != nil {
+			t.Fatal(err)
+		}
+		if cfs.store == nil || cfs.journal == nil {
+			t.Errorf("%s: state store or journal not enabled", archive)
+		}
+		if err := cfs.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if s, err := JSONFile(stateFile).Load(); err != nil || len(s.Deleted) != 1 {
+			t.Errorf("%s: saved state = %+v, %v, want the deletion", archive, s, err)
+		}
+		os.Remove(stateFile)
+	}
+}
+
+func TestLoadConfigUnknownField(t *testing.T) {
+	_, err := LoadConfig(strings.NewReader("primary:\n  type: memfs\n  colour: blue\n"))
+	if err == nil || !strings.Contains(err.Error(), "colour") {
+		t.Errorf("LoadConfig() error = %v, want it to name the unknown field", err)
+	}
+}
+
+func TestFromConfigErrors(t *testing.T) {
+	tests := []struct {
+		cfg   Config
+		field string
+	}{
+		{Config{Secondary: LayerConfig{Type: "memfs"}}, "primary.type"},
+		{Config{Primary: LayerConfig{Type: "memfs"}, Secondary: LayerConfig{Type: "floppy"}}, "secondary.type"},
+		{Config{Primary: LayerConfig{Type: "dir"}, Secondary: LayerConfig{Type: "memfs"}}, "primary.path"},
+		{Config{Primary: LayerConfig{Type: "archive"}, Secondary: LayerConfig{Type: "memfs"}}, "primary.path"},
+		{Config{Primary: LayerConfig{Type: "archive", Path: "missing.tar"}, Secondary: LayerConfig{Type: "memfs"}}, "primary.path"},
+		{Config{Primary: LayerConfig{Type: "memfs"}, Secondary: LayerConfig{Type: "archive", Path: "bundle.zip"}}, "secondary.type"},
+		{Config{
+			Primary:   LayerConfig{Type: "memfs"},
+			Secondary: LayerConfig{Type: "memfs"},
+			Options:   OptionsConfig{CopyUpStrategy: "hardlink"},
+		}, "options.copyUpStrategy"},
+		{Config{
+			Primary:   LayerConfig{Type: "memfs"},
+			Secondary: LayerConfig{Type: "memfs"},
+			Options:   OptionsConfig{ContentCache: &ContentCacheConfig{MaxBytes: 10}},
+		}, "options.contentCache.maxFileSize"},
+		{Config{
+			Primary:   LayerConfig{Type: "memfs"},
+			Secondary: LayerConfig{Type: "memfs"},
+			Options:   OptionsConfig{Rules: []RuleConfig{{Pattern: "usr/**", Zone: "pass-through"}, {Pattern: "var/**", Zone: "writable"}}},
+		}, "options.rules[1].zone"},
+		{Config{
+			Primary:   LayerConfig{Type: "memfs"},
+			Secondary: LayerConfig{Type: "memfs"},
+			Options:   OptionsConfig{Rules: []RuleConfig{{Pattern: "usr/[", Zone: "pass-through"}}},
+		}, "options.rules[0].pattern"},
+	}
+	for _, tt := range tests {
+		_, err := FromConfig(tt.cfg)
+		var cerr *ConfigError
+		if !errors.As(err, &cerr) {
+			t.Errorf("FromConfig() error = %v, want *ConfigError", err)
+			continue
+		}
+		if cerr.Field != tt.field {
+			t.Errorf("ConfigError.Field = %q, want %q", cerr.Field, tt.field)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package cowfs
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// basesDir is the secondary directory keeping the contents of the primary
+// versions recorded by conflict detection.
+const basesDir = "/.cowfs-bases~"
+
+// ErrNoConflictDetection is returned by DetectConflicts on a FileSystem
+// created without WithConflictDetection.
+var ErrNoConflictDetection = errors.New("cowfs: conflict detection not enabled")
+
+// FileVersion identifies a version of a primary file by its size,
+// modification time and hash, SHA-256 unless set with WithHasher.
+type FileVersion struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	SHA256  string    `json:"sha256"` // Hex encoded
+}
+
+// Conflict is a path that the overlay changed and whose primary version has
+// changed since. Committing the overlay's version would silently discard
+// the primary's change.
+type Conflict struct {
+	Path    string
+	Base    FileVersion // Primary version the overlay's change started from
+	Primary FileVersion // Primary version now; zero if it has been removed
+	Deleted bool        // The overlay deleted the path
+}
+
+// WithConflictDetection records the primary version of each file when the
+// overlay takes it over, by copying it up, replacing it or deleting it, so
+// that DetectConflicts can report files whose primary has changed since.
+// Recording costs a read of the primary file to hash it, and a copy of its
+// contents is kept in the secondary as the base of three-way merges by
+// Commit. The recorded versions are persisted along with the rest of the
+// state by WithStateStore.
+func WithConflictDetection() Option {
+	return func(fs *FileSystem) {
+		fs.conflicts = &conflictTracker{bases: make(map[string]FileVersion)}
+	}
+}
+
+// conflictTracker holds the primary versions changed paths are based on.
+type conflictTracker struct {
+	mu    sync.Mutex
+	bases map[string]FileVersion
+}
+
+// snapshot returns a copy of the recorded versions.
+func (c *conflictTracker) snapshot() map[string]FileVersion {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	bases := make(map[string]FileVersion, len(c.bases))
+	for name, v := range c.bases {
+		bases[name] = v
+	}
+	return bases
+}
+
+// recordTakeover records the primary version of name before the overlay
+// first changes it. Paths already changed keep the version their first
+// change started from, and created paths have none.
+func (cfs *FileSystem) recordTakeover(name string) {
+	if cfs.conflicts != nil && !cfs.IsModified(name) && !cfs.IsDeleted(name) {
+		cfs.recordBase(name)
+	}
+}
+
+// recordBase records the current primary version of name, unless a version
+// is already recorded or name is not a visible regular file in the primary.
+func (cfs *FileSystem) recordBase(name string) {
+	c := cfs.conflicts
+	if c == nil || cfs.isOpaque(path.Dir(name)) {
+		return
+	}
+	c.mu.Lock()
+	_, ok := c.bases[name]
+	c.mu.Unlock()
+	if ok {
+		return
+	}
+	v, err := cfs.storeBase(name)
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	if _, ok := c.bases[name]; !ok {
+		c.bases[name] = v
+	}
+	c.mu.Unlock()
+}
+
+// dropBase forgets the recorded primary version of name, removing its
+// stored contents unless another path's version shares them.
+func (cfs *FileSystem) dropBase(name string) {
+	c := cfs.conflicts
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	v, ok := c.bases[name]
+	delete(c.bases, name)
+	shared := false
+	for _, other := range c.bases {
+		shared = shared || other.SHA256 == v.SHA256
+	}
+	c.mu.Unlock()
+	if ok && !shared {
+		cfs.secondary.Remove(baseKey(v))
+	}
+}
+
+// baseKey returns the secondary path storing the contents of version v.
+func baseKey(v FileVersion) string {
+	return basesDir + "/" + v.SHA256
+}
+
+// storeBase returns the version of the regular primary file name, keeping a
+// copy of its contents for openBase.
+func (cfs *FileSystem) storeBase(name string) (FileVersion, error) {
+	if err := cfs.secondary.Mkdir(basesDir, 0700); err != nil && !os.IsExist(err) {
+		return FileVersion{}, err
+	}
+	tmp := fmt.Sprintf("%s/%d~", basesDir, cfs.spillSeq.Add(1))
+	f, err := cfs.secondary.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return FileVersion{}, err
+	}
+	v, err := cfs.hashPrimary(name, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = replaceFile(cfs.secondary, tmp, baseKey(v))
+	}
+	if err != nil {
+		cfs.secondary.Remove(tmp)
+	}
+	return v, err
+}
+
+// openBase opens the stored contents of version v.
+func (cfs *FileSystem) openBase(v FileVersion) (absfs.File, error) {
+	return cfs.secondary.OpenFile(baseKey(v), os.O_RDONLY, 0)
+}
+
+// primaryVersion returns the version of the regular primary file name.
+func (cfs *FileSystem) primaryVersion(name string) (FileVersion, error) {
+	return cfs.hashPrimary(name, io.Discard)
+}
+
+// hashPrimary returns the version of the regular primary file name, copying
+// its contents to w while hashing them.
+func (cfs *FileSystem) hashPrimary(name string, w io.Writer) (FileVersion, error) {
+	info, err := cfs.primary.Stat(name)
+	if err != nil {
+		return FileVersion{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return FileVersion{}, &os.PathError{Op: "hash", Path: name, Err: os.ErrInvalid}
+	}
+	f, err := cfs.primary.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return FileVersion{}, err
+	}
+	defer f.Close()
+	h := cfs.newHash()
+	n, err := cfs.copyBuffers().copy(io.MultiWriter(h, w), f)
+	cfs.counters.primary.read(n)
+	if err != nil {
+		return FileVersion{}, err
+	}
+	return FileVersion{
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		SHA256:  hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+// DetectConflicts reports the paths modified or deleted through the overlay
+// whose primary version has changed or been removed since the overlay took
+// them over, in path order. A primary file whose size and modification time
+// changed but whose contents did not is no conflict.
+//
+// Sync tools can use the result to surface three-way conflicts between the
+// recorded base version, the primary and the overlay rather than silently
+// overwriting the primary's changes.
+func (cfs *FileSystem) DetectConflicts() ([]Conflict, error) {
+	c := cfs.conflicts
+	if c == nil {
+		return nil, ErrNoConflictDetection
+	}
+	bases := c.snapshot()
+	names := make([]string, 0, len(bases))
+	for name := range bases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var conflicts []Conflict
+	for _, name := range names {
+		base := bases[name]
+		deleted := cfs.IsDeleted(name)
+		if !deleted && !cfs.IsModified(name) {
+			continue // No longer changed through the overlay
+		}
+		current := FileVersion{}
+		info, err := cfs.primary.Stat(name)
+		switch {
+		case err == nil && !info.Mode().IsRegular():
+			// Replaced by something other than a file
+		case err == nil && info.Size() == base.Size && info.ModTime().Equal(base.ModTime):
+			continue
+		case err == nil:
+			if current, err = cfs.primaryVersion(name); err != nil && !os.IsNotExist(err) {
+				return conflicts, pathError("detectconflicts", name, err)
+			}
+			if current.SHA256 == base.SHA256 {
+				continue
+			}
+		case !os.IsNotExist(err):
+			return conflicts, pathError("detectconflicts", name, err)
+		}
+		conflicts = append(conflicts, Conflict{Path: name, Base: base, Primary: current, Deleted: deleted})
+	}
+	return conflicts, nil
+}
@@ -0,0 +1,59 @@
+package cowfs
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDetectConflicts(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	WithConflictDetection()(cfs)
+	for _, name := range []string{"/edit.txt", "/replace.txt", "/gone.txt", "/touched.txt", "/quiet.txt"} {
+		writeMemFile(t, primary, name, "base "+name)
+	}
+
+	// Copied up, replaced without a copy-up, and deleted
+	if err := cfs.Chmod("/edit.txt", 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfs.WriteFile("/replace.txt", []byte("overlay"), 0644)
+	cfs.Remove("/gone.txt")
+	cfs.Chmod("/touched.txt", 0600)
+	cfs.Chmod("/quiet.txt", 0600)
+	cfs.WriteFile("/created.txt", []byte("overlay"), 0644)
+
+	// The primary changes underneath
+	writeMemFile(t, primary, "/edit.txt", "primary edit")
+	writeMemFile(t, primary, "/gone.txt", "primary edit")
+	primary.Remove("/replace.txt")
+	later := time.Now().Add(time.Hour)
+	primary.Chtimes("/touched.txt", later, later) // Same contents
+	writeMemFile(t, primary, "/created.txt", "primary")
+
+	conflicts, err := cfs.DetectConflicts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 3 {
+		t.Fatalf("DetectConflicts() = %+v, want 3 conflicts", conflicts)
+	}
+	edit, gone, replace := conflicts[0], conflicts[1], conflicts[2]
+	if edit.Path != "/edit.txt" || edit.Deleted || edit.Base.Size != int64(len("base /edit.txt")) || edit.Primary.Size != int64(len("primary edit")) {
+		t.Errorf("conflict = %+v, want /edit.txt with both versions", edit)
+	}
+	if edit.Base.SHA256 == "" || edit.Base.SHA256 == edit.Primary.SHA256 {
+		t.Errorf("conflict hashes = %q and %q, want distinct hashes", edit.Base.SHA256, edit.Primary.SHA256)
+	}
+	if gone.Path != "/gone.txt" || !gone.Deleted {
+		t.Errorf("conflict = %+v, want deleted /gone.txt", gone)
+	}
+	if replace.Path != "/replace.txt" || replace.Primary != (FileVersion{}) {
+		t.Errorf("conflict = %+v, want /replace.txt removed from the primary", replace)
+	}
+
+	plain, _, _ := newMemOverlay(t)
+	if _, err := plain.DetectConflicts(); !errors.Is(err, ErrNoConflictDetection) {
+		t.Errorf("DetectConflicts() error = %v, want ErrNoConflictDetection", err)
+	}
+}
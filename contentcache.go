@@ -0,0 +1,177 @@
+package cowfs
+
+import (
+	"container/list"
+	"os"
+	"sync"
+)
+
+// WithContentCache enables an in-memory LRU cache for the contents of small
+// primary files read through ReadFile. Files larger than maxFileSize are never
+// cached, and the cache holds at most maxBytes of file data in total.
+//
+// Entries are keyed by path and validated against the primary file's size and
+// modification time on every read, so a changed primary file is detected and
+// its stale entry dropped.
+func WithContentCache(maxBytes, maxFileSize int64) Option {
+	return func(fs *FileSystem) {
+		fs.cache = newContentCache(maxBytes, maxFileSize)
+	}
+}
+
+// ContentCacheStats reports the activity of the content cache.
+type ContentCacheStats struct {
+	Hits          uint64 // Reads served from the cache
+	Misses        uint64 // Reads that had to go to the primary
+	Invalidations uint64 // Entries dropped because they became stale
+	Evictions     uint64 // Entries dropped to stay within the size bound
+	Entries       int    // Number of cached files
+	Bytes         int64  // Total size of cached file data
+}
+
+// ContentCacheStats returns the content cache counters. It returns the zero
+// value if the cache is not enabled.
+func (cfs *FileSystem) ContentCacheStats() ContentCacheStats {
+	if cfs.cache == nil {
+		return ContentCacheStats{}
+	}
+	return cfs.cache.stats()
+}
+
+// InvalidateContentCache drops any cached content for name. It is a no-op if
+// the cache is not enabled.
+func (cfs *FileSystem) InvalidateContentCache(name string) {
+	name = cfs.normalize(name)
+	if cfs.cache != nil {
+		cfs.cache.invalidate(name)
+	}
+}
+
+// fingerprint identifies a particular version of a primary file.
+type fingerprint struct {
+	size    int64
+	modTime int64 // Modification time in Unix nanoseconds
+}
+
+func fingerprintOf(info os.FileInfo) fingerprint {
+	return fingerprint{size: info.Size(), modTime: info.ModTime().UnixNano()}
+}
+
+type cacheEntry struct {
+	name string
+	fp   fingerprint
+	data []byte
+}
+
+// contentCache is a size-bounded LRU of primary file contents.
+type contentCache struct {
+	mu          sync.Mutex
+	maxBytes    int64
+	maxFileSize int64
+	lru         *list.List // Front is most recently used
+	entries     map[string]*list.Element
+	counters    ContentCacheStats
+}
+
+func newContentCache(maxBytes, maxFileSize int64) *contentCache {
+	return &contentCache{
+		maxBytes:    maxBytes,
+		maxFileSize: maxFileSize,
+		lru:         list.New(),
+		entries:     make(map[string]*list.Element),
+	}
+}
+
+// get returns the cached data for name if it matches fp. A mismatching entry
+// is stale and is removed.
+func (c *contentCache) get(name string, fp fingerprint) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[name]
+	if !ok {
+		c.counters.Misses++
+		return nil, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if entry.fp != fp {
+		c.remove(el)
+		c.counters.Invalidations++
+		c.counters.Misses++
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	c.counters.Hits++
+	return entry.data, true
+}
+
+// put stores data for name, evicting least recently used entries as needed.
+func (c *contentCache) put(name string, fp fingerprint, data []byte) {
+	size := int64(len(data))
+	if size > c.maxFileSize || size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[name]; ok {
+		c.remove(el)
+	}
+	for c.counters.Bytes+size > c.maxBytes {
+		c.remove(c.lru.Back())
+		c.counters.Evictions++
+	}
+	c.entries[name] = c.lru.PushFront(&cacheEntry{name: name, fp: fp, data: data})
+	c.counters.Entries++
+	c.counters.Bytes += size
+}
+
+func (c *contentCache) invalidate(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[name]; ok {
+		c.remove(el)
+		c.counters.Invalidations++
+	}
+}
+
+func (c *contentCache) remove(el *list.Element) {
+	entry := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, entry.name)
+	c.counters.Entries--
+	c.counters.Bytes -= int64(len(entry.data))
+}
+
+func (c *contentCache) stats() ContentCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counters
+}
+
+// readPrimaryCached reads name from the primary, serving it from the content
+// cache when an up-to-date copy is available.
+func (cfs *FileSystem) readPrimaryCached(name string) ([]byte, error) {
+	cfs.counters.primary.meta()
+	info, err := cfs.primary.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() || info.Size() > cfs.cache.maxFileSize {
+		data, err := cfs.primary.ReadFile(name)
+		cfs.counters.primary.read(int64(len(data)))
+		return data, err
+	}
+
+	fp := fingerprintOf(info)
+	if data, ok := cfs.cache.get(name, fp); ok {
+		return append([]byte(nil), data...), nil
+	}
+	data, err := cfs.primary.ReadFile(name)
+	cfs.counters.primary.read(int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	cfs.cache.put(name, fp, append([]byte(nil), data...))
+	return data, nil
+}
@@ -0,0 +1,98 @@
+package cowfs
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestContentCache(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	WithContentCache(1024, 16)(cfs)
+	writeMemFile(t, primary, "/small.txt", "small")
+	writeMemFile(t, primary, "/large.txt", "this file is too large to cache")
+
+	for i := 0; i < 3; i++ {
+		data, err := cfs.ReadFile("/small.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "small" {
+			t.Fatalf("ReadFile() = %q, want %q", data, "small")
+		}
+		cfs.ReadFile("/large.txt")
+	}
+
+	stats := cfs.ContentCacheStats()
+	if stats.Hits != 2 || stats.Misses != 1 {
+		t.Errorf("stats = %+v, want 2 hits and 1 miss", stats)
+	}
+	if stats.Entries != 1 || stats.Bytes != 5 {
+		t.Errorf("stats = %+v, want 1 entry of 5 bytes", stats)
+	}
+}
+
+func TestContentCacheStaleness(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	WithContentCache(1024, 1024)(cfs)
+	writeMemFile(t, primary, "/config", "v1")
+	cfs.ReadFile("/config")
+
+	writeMemFile(t, primary, "/config", "v2-updated")
+	primary.Chtimes("/config", time.Now(), time.Now().Add(time.Hour))
+	data, err := cfs.ReadFile("/config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "v2-updated" {
+		t.Errorf("ReadFile() = %q, want updated primary content", data)
+	}
+	if stats := cfs.ContentCacheStats(); stats.Invalidations != 1 {
+		t.Errorf("Invalidations = %d, want 1", stats.Invalidations)
+	}
+
+	cfs.InvalidateContentCache("/config")
+	if stats := cfs.ContentCacheStats(); stats.Entries != 0 {
+		t.Errorf("Entries = %d after InvalidateContentCache, want 0", stats.Entries)
+	}
+}
+
+func TestContentCacheEviction(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	WithContentCache(8, 8)(cfs)
+	writeMemFile(t, primary, "/a", "aaaa")
+	writeMemFile(t, primary, "/b", "bbbb")
+	writeMemFile(t, primary, "/c", "cccc")
+
+	cfs.ReadFile("/a")
+	cfs.ReadFile("/b")
+	cfs.ReadFile("/a")
+	cfs.ReadFile("/c")
+
+	stats := cfs.ContentCacheStats()
+	if stats.Evictions != 1 || stats.Bytes != 8 {
+		t.Fatalf("stats = %+v, want 1 eviction and 8 bytes", stats)
+	}
+	if _, ok := cfs.cache.entries["/b"]; ok {
+		t.Error("least recently used entry /b was not evicted")
+	}
+}
+
+func TestContentCacheSkipsModified(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	WithContentCache(1024, 1024)(cfs)
+	writeMemFile(t, primary, "/f", "primary")
+	cfs.ReadFile("/f")
+
+	f, err := cfs.OpenFile("/f", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("secondary"))
+	f.Close()
+
+	data, _ := cfs.ReadFile("/f")
+	if string(data) != "secondary" {
+		t.Errorf("ReadFile() = %q, want secondary content", data)
+	}
+}
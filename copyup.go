@@ -0,0 +1,529 @@
+package cowfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/absfs/absfs"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// CopyUpStrategy copies a regular file from the primary filesystem into the
+// secondary filesystem when it is first modified through the overlay. The
+// parent directory of name already exists in the secondary when CopyUp is
+// called, and info describes the primary file.
+type CopyUpStrategy interface {
+	CopyUp(primary, secondary absfs.Filer, name string, info os.FileInfo) error
+}
+
+// WithCopyUpStrategy selects how primary files are copied into the secondary.
+// The default is FullCopy.
+func WithCopyUpStrategy(s CopyUpStrategy) Option {
+	return func(fs *FileSystem) {
+		fs.strategy = s
+	}
+}
+
+// OnFirstWrite registers fn to be called before a file is copied up from the
+// primary, with the path and the size of the primary file. If fn returns an
+// error the copy-up does not happen and the operation that needed it fails
+// with that error, leaving the overlay unchanged. fn runs synchronously on
+// the calling goroutine, so it can ask a user for confirmation before an
+// expensive copy.
+//
+// Writes that truncate the file, and so never copy it, do not call fn.
+func OnFirstWrite(fn func(name string, size int64) error) Option {
+	return func(fs *FileSystem) {
+		fs.firstWrite = fn
+	}
+}
+
+// WithMaxConcurrentCopyUps limits the number of copy-ups in progress at any
+// time to n. Operations that need a copy-up while n are running wait for
+// one of them to finish, so that bursts of first writes do not saturate the
+// layers with simultaneous copies. Stats reports the copy-ups running and
+// waiting as CopyUpsInFlight and CopyUpsWaiting.
+func WithMaxConcurrentCopyUps(n int) Option {
+	return func(fs *FileSystem) {
+		if n > 0 {
+			fs.copySlots = make(chan struct{}, n)
+		} else {
+			fs.copySlots = nil
+		}
+	}
+}
+
+// WithCopyUpRateLimit limits the rate at which copy-ups read primary file
+// contents to bytesPerSec, shared by all copy-ups in progress, so that
+// copy-ups of huge primary files do not starve foreground I/O on shared
+// disks or saturate a network-backed secondary. The limit is a token bucket
+// holding one second's worth of bytes, so short copy-ups after a quiet
+// period run at full speed. Copy-ups made without reading the primary, by
+// reflinks or hard links, are not limited, and neither are reads through
+// the overlay. A limit of zero or less removes it.
+func WithCopyUpRateLimit(bytesPerSec int64) Option {
+	return func(fs *FileSystem) {
+		if bytesPerSec > 0 {
+			fs.copyRate = newRateLimiter(bytesPerSec)
+		} else {
+			fs.copyRate = nil
+		}
+	}
+}
+
+// copySource returns the primary as copy-ups read it, limited to the
+// copy-up rate if one is set.
+func (cfs *FileSystem) copySource() absfs.Filer {
+	if cfs.copyRate == nil {
+		return cfs.primary
+	}
+	return &throttledFiler{Filer: cfs.primary, limit: cfs.copyRate}
+}
+
+// rateLimiter is a token bucket of bytes.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // Bytes added per second
+	tokens float64 // Bytes available; negative while in debt
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSec int64) *rateLimiter {
+	return &rateLimiter{rate: float64(bytesPerSec), tokens: float64(bytesPerSec), last: time.Now()}
+}
+
+// wait takes n bytes from the bucket, sleeping until the bucket has paid
+// them off if it runs into debt.
+func (l *rateLimiter) wait(n int) {
+	if n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	var d time.Duration
+	if l.tokens < 0 {
+		d = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	time.Sleep(d)
+}
+
+// throttledFiler is the primary as read by rate-limited copy-ups.
+type throttledFiler struct {
+	absfs.Filer
+	limit *rateLimiter
+}
+
+func (t *throttledFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	f, err := t.Filer.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := f.(fder); ok {
+		return &throttledFdFile{throttledFile{File: f, limit: t.limit}}, nil
+	}
+	return &throttledFile{File: f, limit: t.limit}, nil
+}
+
+// throttledFile charges the bytes read from it to a rateLimiter.
+type throttledFile struct {
+	absfs.File
+	limit *rateLimiter
+}
+
+func (f *throttledFile) Read(b []byte) (int, error) {
+	n, err := f.File.Read(b)
+	f.limit.wait(n)
+	return n, err
+}
+
+func (f *throttledFile) ReadAt(b []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(b, off)
+	f.limit.wait(n)
+	return n, err
+}
+
+// throttledFdFile is a throttledFile over a file descriptor, which reflinks
+// can clone without reading.
+type throttledFdFile struct {
+	throttledFile
+}
+
+func (f *throttledFdFile) Fd() uintptr { return f.File.(fder).Fd() }
+
+// copyBuffers returns the pool of copy-up buffers.
+func (cfs *FileSystem) copyBuffers() *bufferPool {
+	if cfs.buffers != nil {
+		return cfs.buffers
+	}
+	return defaultBuffers
+}
+
+// acquireCopySlot waits until a copy-up may start and returns the function
+// to call when it is done.
+func (cfs *FileSystem) acquireCopySlot() func() {
+	if cfs.copySlots != nil {
+		cfs.counters.copyUpsWaiting.Add(1)
+		cfs.copySlots <- struct{}{}
+		cfs.counters.copyUpsWaiting.Add(-1)
+	}
+	cfs.counters.copyUpsInFlight.Add(1)
+	return func() {
+		cfs.counters.copyUpsInFlight.Add(-1)
+		if cfs.copySlots != nil {
+			<-cfs.copySlots
+		}
+	}
+}
+
+// defaultCopyBufferSize is the size of copy-up buffers unless set with
+// WithCopyBufferSize.
+const defaultCopyBufferSize = 32 << 10
+
+// WithCopyBufferSize sets the size of the buffers the built-in copy-up
+// strategies copy file contents through. Buffers are pooled and reused
+// across copy-ups. Larger buffers mean fewer, larger requests to the layers,
+// which helps backends with a high per-request cost. The default is 32 KiB.
+func WithCopyBufferSize(size int) Option {
+	return func(fs *FileSystem) {
+		if size > 0 {
+			fs.buffers = newBufferPool(size)
+		}
+	}
+}
+
+// bufferPool hands out reusable copy buffers of one size.
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	p := &bufferPool{size: size}
+	p.pool.New = func() any {
+		buf := make([]byte, size)
+		return &buf
+	}
+	return p
+}
+
+// defaultBuffers serves overlays without WithCopyBufferSize and strategies
+// called directly.
+var defaultBuffers = newBufferPool(defaultCopyBufferSize)
+
+// copy copies src to dst through a pooled buffer.
+func (p *bufferPool) copy(dst io.Writer, src io.Reader) (int64, error) {
+	buf := p.pool.Get().(*[]byte)
+	defer p.pool.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
+
+// bufferedStrategy is implemented by the built-in strategies, which copy
+// through the overlay's buffer pool.
+type bufferedStrategy interface {
+	copyUpBuffered(primary, secondary absfs.Filer, name string, info os.FileInfo, buffers *bufferPool) error
+}
+
+// FullCopy copies file contents byte for byte. It works with any pair of
+// filesystems.
+type FullCopy struct{}
+
+// CopyUp implements CopyUpStrategy.
+func (c FullCopy) CopyUp(primary, secondary absfs.Filer, name string, info os.FileInfo) error {
+	return c.copyUpBuffered(primary, secondary, name, info, defaultBuffers)
+}
+
+func (FullCopy) copyUpBuffered(primary, secondary absfs.Filer, name string, info os.FileInfo, buffers *bufferPool) error {
+	return copyFile(secondary, name, primary, name, info.Mode().Perm(), false, buffers)
+}
+
+// Reflink clones file contents with a copy-on-write reflink (FICLONE on
+// Linux) when both layers hand out files backed by operating system file
+// descriptors on the same reflink-capable filesystem, such as btrfs or XFS.
+// Cloning costs almost nothing regardless of file size. When cloning is not
+// possible Reflink falls back to a full copy.
+type Reflink struct{}
+
+// fder is implemented by files backed by an operating system file descriptor,
+// such as *os.File.
+type fder interface {
+	Fd() uintptr
+}
+
+// CopyUp implements CopyUpStrategy.
+func (r Reflink) CopyUp(primary, secondary absfs.Filer, name string, info os.FileInfo) error {
+	return r.copyUpBuffered(primary, secondary, name, info, defaultBuffers)
+}
+
+func (Reflink) copyUpBuffered(primary, secondary absfs.Filer, name string, info os.FileInfo, buffers *bufferPool) error {
+	return copyFile(secondary, name, primary, name, info.Mode().Perm(), true, buffers)
+}
+
+// copyFile copies srcName in src to dstName in dst through buffers, creating
+// or truncating it with perm. If clone is set it tries a reflink first. The
+// holes of a sparse source backed by a file descriptor are left as holes in
+// dst, where it supports them.
+func copyFile(dst absfs.Filer, dstName string, src absfs.Filer, srcName string, perm os.FileMode, clone bool, buffers *bufferPool) error {
+	sf, err := src.OpenFile(srcName, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer sf.Close()
+	df, err := dst.OpenFile(dstName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	srcFd, srcOk := sf.(fder)
+	copied := false
+	if clone {
+		dstFd, dstOk := df.(fder)
+		copied = srcOk && dstOk && reflink(dstFd.Fd(), srcFd.Fd()) == nil
+	}
+	if !copied && srcOk {
+		copied, err = copySparse(df, sf, buffers)
+	}
+	if !copied && err == nil {
+		_, err = buffers.copy(df, sf)
+	}
+	if closeErr := df.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// copySparse copies the data of src, a sparse file, to dst, skipping its
+// holes and extending dst to the size of src. It reports false, copying
+// nothing, if src has no holes or cannot report where they are.
+func copySparse(dst, src absfs.File, buffers *bufferPool) (bool, error) {
+	info, err := src.Stat()
+	if err != nil {
+		return false, nil
+	}
+	size := info.Size()
+	start, end, err := nextData(src, 0)
+	switch {
+	case errors.Is(err, io.EOF):
+		start, end = size, size // All hole
+	case err != nil:
+		return false, nil
+	case start == 0 && end >= size:
+		_, err = src.Seek(0, io.SeekStart) // No holes
+		return false, err
+	}
+	for start < size {
+		if _, err := src.Seek(start, io.SeekStart); err != nil {
+			return true, err
+		}
+		if _, err := dst.Seek(start, io.SeekStart); err != nil {
+			return true, err
+		}
+		if _, err := buffers.copy(dst, io.LimitReader(src, end-start)); err != nil {
+			return true, err
+		}
+		start, end, err = nextData(src, end)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return true, err
+		}
+	}
+	return true, dst.Truncate(size)
+}
+
+// Hardlink hard links the secondary copy to the primary file using the
+// directories the two layers are rooted at on the host filesystem. Both
+// directories must be on the same host filesystem; otherwise, or if linking
+// fails for any other reason, Hardlink falls back to a full copy.
+//
+// A hard link shares data and metadata with the primary, so writing to the
+// copy in place or changing its mode also changes the primary. Hardlink is
+// only appropriate when files in the overlay are replaced rather than edited,
+// for example when writers always use WriteFile-style temp-and-rename.
+type Hardlink struct {
+	PrimaryDir   string // Host directory backing the primary filesystem
+	SecondaryDir string // Host directory backing the secondary filesystem
+}
+
+// CopyUp implements CopyUpStrategy.
+func (h Hardlink) CopyUp(primary, secondary absfs.Filer, name string, info os.FileInfo) error {
+	return h.copyUpBuffered(primary, secondary, name, info, defaultBuffers)
+}
+
+func (h Hardlink) copyUpBuffered(primary, secondary absfs.Filer, name string, info os.FileInfo, buffers *bufferPool) error {
+	rel := filepath.FromSlash(path.Clean("/" + name))
+	dst := filepath.Join(h.SecondaryDir, rel)
+	os.Remove(dst)
+	if err := os.Link(filepath.Join(h.PrimaryDir, rel), dst); err == nil {
+		return nil
+	}
+	return FullCopy{}.copyUpBuffered(primary, secondary, name, info, buffers)
+}
+
+// refusedError wraps an error that prevented a copy-up from starting, or
+// that rejected the copy made, as WithVerifyCopyUp does. Unlike failures
+// during the copy itself, refusals are always reported to callers.
+type refusedError struct {
+	err error
+}
+
+func (e *refusedError) Error() string { return e.err.Error() }
+func (e *refusedError) Unwrap() error { return e.err }
+
+func isRefused(err error) bool {
+	var r *refusedError
+	return errors.As(err, &r)
+}
+
+// unwrapRefused strips the refusedError wrapper, if any, from err.
+func unwrapRefused(err error) error {
+	if r, ok := err.(*refusedError); ok {
+		return r.err
+	}
+	return err
+}
+
+// copyUp copies the primary version of name into the secondary filesystem
+// using the configured strategy, creating missing parent directories first.
+// Directories are created in the secondary without their contents; other
+// names that are not regular files in the primary are left alone. Errors
+// that prevented the copy from starting are wrapped in refusedError.
+func (cfs *FileSystem) copyUp(name string) (err error) {
+	if cfs.isOpaque(path.Dir(name)) {
+		return nil // The primary version is hidden
+	}
+	if cfs.links {
+		if info, err := lstatLayer(cfs.primary, name); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return cfs.copyUpLink(name)
+		}
+	}
+	info, err := cfs.primary.Stat(name)
+	if err == nil && info.IsDir() {
+		return cfs.copyUpDir(name, info)
+	}
+	if err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+	span := cfs.startSpan("cowfs.CopyUp",
+		attribute.String("cowfs.path", name),
+		attribute.Int64("cowfs.size", info.Size()))
+	defer func() { endSpan(span, err) }()
+
+	if cfs.firstWrite != nil {
+		if err = cfs.firstWrite(name, info.Size()); err != nil {
+			cfs.counters.copyUpFailures.Add(1)
+			cfs.debug("cowfs: copy-up vetoed", "path", name, "bytes", info.Size(), "err", err)
+			return &refusedError{err}
+		}
+	}
+	if err = cfs.checkSpace(name, info.Size()); err != nil {
+		cfs.counters.copyUpFailures.Add(1)
+		cfs.debug("cowfs: copy-up refused", "path", name, "bytes", info.Size(), "err", err)
+		return &refusedError{err}
+	}
+	if err = cfs.adjustQuota("copyup", name, info.Size()); err != nil {
+		cfs.counters.copyUpFailures.Add(1)
+		return &refusedError{err}
+	}
+	if err = cfs.ensureSecondaryDir(path.Dir(name)); err != nil {
+		cfs.counters.copyUpFailures.Add(1)
+		cfs.adjustQuota("copyup", name, -info.Size())
+		return err
+	}
+	record, err := cfs.journalOp(journalEntry{Op: "copyup", Path: name})
+	if err != nil {
+		cfs.counters.copyUpFailures.Add(1)
+		cfs.adjustQuota("copyup", name, -info.Size())
+		return &refusedError{err}
+	}
+	defer record.done()
+	release := cfs.acquireCopySlot()
+	start := time.Now()
+	src, digest := cfs.verifySource(cfs.copySource(), name)
+	if s, ok := cfs.strategy.(bufferedStrategy); ok {
+		err = s.copyUpBuffered(src, cfs.secondary, name, info, cfs.copyBuffers())
+	} else {
+		err = cfs.strategy.CopyUp(src, cfs.secondary, name, info)
+	}
+	if err == nil {
+		err = cfs.verifyCopy(name, digest)
+	}
+	if err == nil && cfs.durability != DurabilityNone {
+		if err = cfs.syncPath(name); err == nil {
+			err = cfs.syncDirs(name)
+		}
+	}
+	release()
+	if err != nil {
+		cfs.counters.copyUpFailures.Add(1)
+		cfs.adjustQuota("copyup", name, -info.Size())
+		cfs.debug("cowfs: copy-up failed", "path", name, "bytes", info.Size(), "duration", time.Since(start), "err", err)
+		return err
+	}
+	cfs.debug("cowfs: copy-up", "path", name, "bytes", info.Size(), "duration", time.Since(start))
+	cfs.counters.copyUps.Add(1)
+	cfs.counters.copyUpBytes.Add(uint64(info.Size()))
+	cfs.counters.primary.read(info.Size())
+	cfs.counters.secondary.write(info.Size())
+	cfs.linkSiblings(name, info)
+	cfs.recordBase(name)
+	cfs.trackRead(name)
+	return nil
+}
+
+// copyUpDir creates the primary directory name in the secondary with its
+// mode and modification time, without its contents, so that metadata
+// changes can be applied to it.
+func (cfs *FileSystem) copyUpDir(name string, info os.FileInfo) error {
+	if _, err := cfs.secondary.Stat(name); err == nil {
+		return nil
+	}
+	if err := cfs.ensureSecondaryDir(name); err != nil {
+		return err
+	}
+	cfs.counters.secondary.meta()
+	cfs.secondary.Chtimes(name, info.ModTime(), info.ModTime())
+	cfs.debug("cowfs: directory copy-up", "path", name, "mode", info.Mode())
+	return nil
+}
+
+// markModified marks name modified for operation op, copying it up from the
+// primary first if it is not in the secondary yet. A name marked deleted is
+// reported missing and left alone. If the copy-up is refused the mark is
+// reverted and the reason returned; other copy failures are ignored and left
+// to surface from the subsequent secondary operation, unless strict errors
+// are enabled.
+func (cfs *FileSystem) markModified(op, name string) error {
+	cfs.mu.Lock()
+	if cfs.deleted[name] {
+		cfs.mu.Unlock()
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	wasModified := cfs.modified[name]
+	cfs.modified[name] = true
+	cfs.mu.Unlock()
+
+	if wasModified {
+		return nil
+	}
+	err := cfs.copyUp(name)
+	if err == nil || (!cfs.strict && !isRefused(err)) {
+		return nil
+	}
+	cfs.mu.Lock()
+	delete(cfs.modified, name)
+	cfs.mu.Unlock()
+	if isRefused(err) {
+		return unwrapRefused(err)
+	}
+	return pathError(op, name, err)
+}
@@ -0,0 +1,360 @@
+package cowfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/memfs"
+)
+
+type countingStrategy struct {
+	names []string
+}
+
+func (c *countingStrategy) CopyUp(primary, secondary absfs.Filer, name string, info os.FileInfo) error {
+	c.names = append(c.names, name)
+	return FullCopy{}.CopyUp(primary, secondary, name, info)
+}
+
+func TestCopyUpStrategy(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	strategy := &countingStrategy{}
+	WithCopyUpStrategy(strategy)(cfs)
+	writeMemFile(t, primary, "/file.txt", "content")
+
+	if err := cfs.Chmod("/file.txt", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if len(strategy.names) != 1 || strategy.names[0] != "/file.txt" {
+		t.Errorf("strategy called for %v, want [/file.txt]", strategy.names)
+	}
+	if data, _ := cfs.ReadFile("/file.txt"); string(data) != "content" {
+		t.Errorf("ReadFile() = %q, want copied content", data)
+	}
+}
+
+// blockingStrategy copies files once release is closed.
+type blockingStrategy struct {
+	release chan struct{}
+}
+
+func (b blockingStrategy) CopyUp(primary, secondary absfs.Filer, name string, info os.FileInfo) error {
+	<-b.release
+	return FullCopy{}.CopyUp(primary, secondary, name, info)
+}
+
+func TestMaxConcurrentCopyUps(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	strategy := blockingStrategy{release: make(chan struct{})}
+	WithCopyUpStrategy(strategy)(cfs)
+	WithMaxConcurrentCopyUps(2)(cfs)
+	names := []string{"/a", "/b", "/c", "/d"}
+	for _, name := range names {
+		writeMemFile(t, primary, name, "content")
+	}
+
+	errs := make(chan error, len(names))
+	for _, name := range names {
+		go func(name string) { errs <- cfs.Chmod(name, 0600) }(name)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		s := cfs.Stats()
+		if s.CopyUpsInFlight == 2 && s.CopyUpsWaiting == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("in flight = %d, waiting = %d, want 2 and 2", s.CopyUpsInFlight, s.CopyUpsWaiting)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(strategy.release)
+	for range names {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	if s := cfs.Stats(); s.CopyUps != 4 || s.CopyUpsInFlight != 0 || s.CopyUpsWaiting != 0 {
+		t.Errorf("copy-ups = %d, in flight = %d, waiting = %d, want 4, 0, 0", s.CopyUps, s.CopyUpsInFlight, s.CopyUpsWaiting)
+	}
+}
+
+func TestCopyUpCreatesParents(t *testing.T) {
+	cfs, primary, secondary := newMemOverlay(t)
+	primary.Mkdir("/a", 0750)
+	primary.Mkdir("/a/b", 0755)
+	writeMemFile(t, primary, "/a/b/file.txt", "content")
+
+	f, err := cfs.OpenFile("/a/b/file.txt", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	f.Close()
+
+	info, err := secondary.Stat("/a")
+	if err != nil {
+		t.Fatalf("parent not created in secondary: %v", err)
+	}
+	if info.Mode().Perm() != 0750 {
+		t.Errorf("parent mode = %v, want primary mode 0750", info.Mode().Perm())
+	}
+	if cfs.modified["/a"] {
+		t.Error("implicitly created parent marked modified")
+	}
+}
+
+func TestReflinkFallback(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	WithCopyUpStrategy(Reflink{})(cfs)
+	writeMemFile(t, primary, "/file.txt", "content")
+
+	if err := cfs.Truncate("/file.txt", 4); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := cfs.ReadFile("/file.txt"); string(data) != "cont" {
+		t.Errorf("ReadFile() = %q, want %q", data, "cont")
+	}
+}
+
+func TestHardlink(t *testing.T) {
+	primaryDir, secondaryDir := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(primaryDir, "file.txt"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(primaryDir, "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := Hardlink{PrimaryDir: primaryDir, SecondaryDir: secondaryDir}
+	if err := h.CopyUp(nil, nil, "/file.txt", info); err != nil {
+		t.Fatalf("CopyUp() error = %v", err)
+	}
+	linked, err := os.Stat(filepath.Join(secondaryDir, "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(info, linked) {
+		t.Error("secondary copy is not a hard link to the primary file")
+	}
+}
+
+func TestOnFirstWrite(t *testing.T) {
+	cfs, primary, secondary := newMemOverlay(t)
+	errDeclined := errors.New("declined")
+	var calls []string
+	OnFirstWrite(func(name string, size int64) error {
+		calls = append(calls, name)
+		if size != 7 {
+			t.Errorf("size = %d, want 7", size)
+		}
+		return errDeclined
+	})(cfs)
+	writeMemFile(t, primary, "/file.txt", "content")
+
+	if _, err := cfs.OpenFile("/file.txt", os.O_RDWR, 0); !errors.Is(err, errDeclined) {
+		t.Fatalf("OpenFile() error = %v, want the veto", err)
+	}
+	if err := cfs.Chmod("/file.txt", 0600); !errors.Is(err, errDeclined) {
+		t.Fatalf("Chmod() error = %v, want the veto", err)
+	}
+	if len(calls) != 2 {
+		t.Errorf("hook called for %v, want two calls", calls)
+	}
+	if cfs.IsModified("/file.txt") {
+		t.Error("vetoed file marked modified")
+	}
+	if _, err := secondary.Stat("/file.txt"); err == nil {
+		t.Error("vetoed file copied to secondary")
+	}
+
+	// Truncating writes do not copy and are not vetoed
+	f, err := cfs.OpenFile("/file.txt", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile(O_TRUNC) error = %v", err)
+	}
+	f.Close()
+	if len(calls) != 2 {
+		t.Errorf("hook called for a truncating write")
+	}
+}
+
+func TestOpenFileAppend(t *testing.T) {
+	base := strings.Repeat("0123456789abcdef", 8<<10) // Two delta blocks
+	options := map[string][]Option{
+		"default":    nil,
+		"delta":      {WithDeltaThreshold(1)},
+		"quota":      {WithMaxSecondaryBytes(1 << 20)},
+		"durability": {WithDurability(DurabilityStrict)},
+	}
+	for name, opts := range options {
+		t.Run(name, func(t *testing.T) {
+			primary, _ := memfs.NewFS()
+			secondary, _ := memfs.NewFS()
+			cfs := New(primary, secondary, opts...)
+			writeMemFile(t, primary, "/log", base)
+
+			// Appending copies the primary content up first
+			f, err := cfs.OpenFile("/log", os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.Write([]byte("one\n")); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if data, _ := cfs.ReadFile("/log"); string(data) != base+"one\n" {
+				t.Errorf("after O_WRONLY|O_APPEND, content ends with %q", tail(data))
+			}
+
+			// Reads start at the beginning, writes go to the end even after
+			// seeking
+			f, err = cfs.OpenFile("/log", os.O_RDWR|os.O_APPEND, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			head := make([]byte, 4)
+			if _, err := io.ReadFull(f, head); err != nil || string(head) != "0123" {
+				t.Errorf("Read() = %q, %v, want 0123", head, err)
+			}
+			f.Seek(0, io.SeekStart)
+			if _, err := f.Write([]byte("two\n")); err != nil {
+				t.Fatal(err)
+			}
+			if off, _ := f.Seek(0, io.SeekCurrent); off != int64(len(base)+8) {
+				t.Errorf("offset after append = %d, want %d", off, len(base)+8)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if data, _ := cfs.ReadFile("/log"); string(data) != base+"one\ntwo\n" {
+				t.Errorf("after O_RDWR|O_APPEND, content ends with %q", tail(data))
+			}
+			if data, _ := primary.ReadFile("/log"); string(data) != base {
+				t.Error("primary was modified")
+			}
+		})
+	}
+}
+
+func tail(data []byte) []byte {
+	if len(data) > 16 {
+		return data[len(data)-16:]
+	}
+	return data
+}
+
+func TestMetadataOnPrimaryDirectory(t *testing.T) {
+	cfs, primary, secondary := newMemOverlay(t)
+	primary.Mkdir("/dir", 0750)
+	writeMemFile(t, primary, "/dir/a.txt", "a")
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	if err := cfs.Chmod("/dir", 0700); err != nil {
+		t.Fatalf("Chmod() error = %v", err)
+	}
+	if err := cfs.Chtimes("/dir", mtime, mtime); err != nil {
+		t.Fatalf("Chtimes() error = %v", err)
+	}
+	info, err := secondary.Stat("/dir")
+	if err != nil || !info.IsDir() {
+		t.Fatalf("secondary copy = %v, %v, want a directory", info, err)
+	}
+	info, err = cfs.Stat("/dir")
+	if err != nil || !info.IsDir() || info.Mode().Perm() != 0700 || !info.ModTime().Equal(mtime) {
+		t.Errorf("Stat() = %v, %v, want a 0700 directory modified at %v", info, err, mtime)
+	}
+	// The primary's children stay visible
+	entries, err := cfs.ReadDir("/dir")
+	if err != nil || len(entries) != 1 || entries[0].Name() != "a.txt" {
+		t.Errorf("ReadDir() = %v, %v, want a.txt", entries, err)
+	}
+	if data, _ := cfs.ReadFile("/dir/a.txt"); string(data) != "a" {
+		t.Errorf("ReadFile() = %q, want a", data)
+	}
+	if info, _ := primary.Stat("/dir"); info.Mode().Perm() != 0750 {
+		t.Error("primary was modified")
+	}
+}
+
+func TestCopyBufferSize(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	WithCopyBufferSize(7)(cfs)
+	content := strings.Repeat("0123456789", 100)
+	writeMemFile(t, primary, "/file.txt", content)
+
+	if err := cfs.Chmod("/file.txt", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := cfs.ReadFile("/file.txt"); string(data) != content {
+		t.Errorf("copied %d bytes through small buffers, want %d", len(data), len(content))
+	}
+	if cfs.copyBuffers().size != 7 {
+		t.Errorf("buffer size = %d, want 7", cfs.copyBuffers().size)
+	}
+}
+
+func BenchmarkCopyFile(b *testing.B) {
+	src, _ := memfs.NewFS()
+	dst, _ := memfs.NewFS()
+	f, _ := src.OpenFile("/file", os.O_CREATE|os.O_WRONLY, 0644)
+	f.Write(make([]byte, 256<<10))
+	f.Close()
+
+	// Unpooled is the copy as made by io.Copy, which allocates a buffer
+	// for every file
+	b.Run("Unpooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			sf, _ := src.OpenFile("/file", os.O_RDONLY, 0)
+			df, _ := dst.OpenFile("/file", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+			io.Copy(df, sf)
+			df.Close()
+			sf.Close()
+		}
+	})
+	b.Run("Pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			copyFile(dst, "/file", src, "/file", 0644, false, defaultBuffers)
+		}
+	})
+}
+
+func TestCopyUpRateLimit(t *testing.T) {
+	_, primary, secondary := newMemOverlay(t)
+	writeMemFile(t, primary, "/big", strings.Repeat("x", 15000))
+	writeMemFile(t, primary, "/small", "x")
+	cfs := New(primary, secondary, WithCopyUpRateLimit(10000))
+
+	// The bucket starts with a second's worth of bytes, and the rest of the
+	// file is paid off at the limit
+	start := time.Now()
+	if err := cfs.Chmod("/big", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("copy-up of 15000 bytes at 10000 bytes/s took %v; want about 500ms", elapsed)
+	}
+	if data, err := cfs.ReadFile("/big"); err != nil || len(data) != 15000 {
+		t.Errorf("ReadFile(/big) = %d bytes, %v", len(data), err)
+	}
+
+	// Reads through the overlay are not limited
+	start = time.Now()
+	if _, err := cfs.ReadFile("/small"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("ReadFile took %v while the bucket was in debt", elapsed)
+	}
+}
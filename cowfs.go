@@ -5,14 +5,21 @@
 package cowfs
 
 import (
+	"hash"
 	"io"
 	"io/fs"
+	"log/slog"
 	"os"
 	"path"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/absfs/absfs"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // FileSystem implements absfs.Filer with copy-on-write semantics.
@@ -24,299 +31,877 @@ type FileSystem struct {
 	mu        sync.RWMutex    // Protects modified and deleted maps
 	modified  map[string]bool // Track which files have been modified
 	deleted   map[string]bool // Track which files have been deleted
+	opaque    map[string]bool // Recreated directories hiding the primary
+	opMu      sync.RWMutex    // Held shared by mutations, exclusively by barriers
+	gen       atomic.Uint64   // Incremented after every mutation
+	cache     *contentCache   // Optional cache of small primary files
+	strategy  CopyUpStrategy  // How primary files are copied to secondary
+	reserve   int64           // Free space to keep in secondary on copy-up
+	probe     SpaceProbe      // Reports free space in secondary, if set
+
+	deltaThreshold int64           // Minimum primary size for delta storage
+	deltas         map[string]bool // Secondary copies stored as deltas
+
+	runtime  bgRuntime // Background tasks of optional features
+	counters counters  // Activity counters reported by Stats
+	logger   *slog.Logger
+	tracer   trace.Tracer
+
+	resolutions *resolutionCache // Optional per-path layer resolution cache
+	statCache   *statCache       // Optional cache of primary Stat results
+	promotion   *promotionCache  // Optional read-through copies of primary files
+	viewMu      *sync.RWMutex    // Makes renames atomic to readers, if enabled
+	watchers    watchers         // Change subscriptions
+	durability  Durability       // When to sync secondary data
+	quota       *quota           // Optional limit on secondary usage
+	replica     *replica         // Optional replicated state markers
+	links       bool             // Both layers support symbolic links
+	linkPolicy  LinkPolicy       // Copy-up treatment of hard-linked files
+	linkIdx     linkIndex        // Hard-linked primary files, built on demand
+
+	preloadConcurrency int                      // Files copied up at once by Preload
+	copySlots          chan struct{}            // Limits concurrent copy-ups, if set
+	copyRate           *rateLimiter             // Limits the copy-up read rate, if set
+	asyncBuffer        int64                    // Bytes of writes buffered per background copy-up, if set
+	copying            map[string]chan struct{} // Background copy-ups in progress, by path
+	verifyHash         func() hash.Hash         // Digests copy-ups to verify them, if set
+	hasher             func() hash.Hash         // Digests file contents, if not SHA-256
+	buffers            *bufferPool              // Copy-up buffers, if not the default
+
+	firstWrite func(name string, size int64) error // Called before each copy-up
+
+	chownSupport atomic.Int32     // Whether the secondary supports Chown
+	owners       map[string]Owner // Ownership the secondary could not record
+
+	root       rootInfo // Synthesized root directory
+	rootForced bool     // Always report the synthesized root
+	labels     labelSet // Orchestration labels
+	strict     bool     // Report tolerated failures; see WithStrictErrors
+
+	lenientRemove bool // Remove succeeds for paths that exist nowhere
+	foldCase      bool // Paths are lower-cased; see WithCaseFolding
+	backslash     bool // Backslashes separate path elements; see Separator
+
+	accessHook AccessHook // Vets operations before they run, if set
+	rules      []Rule     // Zones of paths outside the overlay; see WithRules
+
+	mergeLimit int           // Entries merged in memory before spilling
+	spillSeq   atomic.Uint64 // Names spilled runs and other temporary files
+
+	idempotency idempotencyTable // Keys of operations run by Do
+	deletions   *deletionQueue   // Queued secondary removals, if deferred
+	writeBack   *writeBackQueue  // Paths to replicate to the primary, if enabled
+	store       *stateSaver      // Persisted state, if enabled
+	journal     *journal         // Write-ahead journal, if enabled
+
+	txMu sync.Mutex // Protects tx
+	tx   *txState   // Open transaction, if any
+
+	frozen atomic.Bool // Mutations fail with ErrFrozen; see Freeze
+
+	conflicts *conflictTracker // Primary versions of changed files, if tracked
+	reads     *readTracker     // Primary paths read, if tracked
+	auditLog  *auditLog        // Record of mutations, if kept
 }
 
 // New creates a new CowFS that reads from primary and writes to secondary.
-func New(primary, secondary absfs.Filer) *FileSystem {
-	return &FileSystem{
+// Options may be supplied to enable optional behavior.
+func New(primary, secondary absfs.Filer, opts ...Option) *FileSystem {
+	fs := &FileSystem{
 		primary:   primary,
 		secondary: secondary,
 		modified:  make(map[string]bool),
 		deleted:   make(map[string]bool),
+		strategy:  FullCopy{},
+		links:     supportsLinks(primary, secondary),
+		root:      rootInfo{mode: os.ModeDir | 0755, modTime: time.Now()},
 	}
+	for _, opt := range opts {
+		opt(fs)
+	}
+	fs.backslash = fs.Separator() == '\\'
+	if fs.writeBack != nil || asCAS(fs.secondary) != nil {
+		fs.deltas = nil
+	}
+	if fs.store != nil {
+		fs.loadState()
+	}
+	if fs.journal != nil {
+		fs.recoverJournal()
+	}
+	return fs
 }
 
 // OpenFile opens a file, reading from primary or secondary based on modification state.
 // Write operations mark files as modified and direct them to secondary.
-func (fs *FileSystem) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+// Opening a primary file for writing without O_TRUNC, including with
+// O_APPEND, copies its content to the secondary first, so appended data
+// follows the primary content.
+func (fs *FileSystem) OpenFile(name string, flag int, perm os.FileMode) (_ absfs.File, err error) {
+	if openOp(flag).Mutates() {
+		defer fs.audit(&err, AuditRecord{Op: "open", Path: name, Flags: flagString(flag), Mode: perm})
+	}
+	defer wrapErr(&err, "open", name)
+	name = fs.normalize(name)
+	if err := fs.access(openOp(flag), name); err != nil {
+		return nil, err
+	}
+	if fs.zoneOf(name) != ZoneOverlay {
+		return fs.openZoned(name, flag, perm)
+	}
 	// If writing or creating, use secondary
 	if flag&(os.O_CREATE|os.O_WRONLY|os.O_RDWR|os.O_TRUNC|os.O_APPEND) != 0 {
+		endOp := fs.beginOp()
+		defer func() {
+			if endOp != nil {
+				endOp()
+			}
+		}()
+		if fs.frozen.Load() {
+			return nil, ErrFrozen
+		}
+
+		// Exclusive creation fails on any name in the merged view, including
+		// symbolic links, which it does not follow
+		if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+			l, _ := fs.lookup(name, false)
+			if _, err := fs.lstat(name, l); err == nil {
+				return nil, os.ErrExist
+			}
+		}
+
+		name, err := fs.follow(name)
+		if err != nil {
+			return nil, err
+		}
+		fs.awaitCopies(name)
+
+		// Directories are not opened for writing. A file truncated before
+		// it is copied up keeps the mode it has in the merged view.
+		l, _ := fs.lookup(name, false)
+		if info, err := fs.lstat(name, l); err == nil {
+			if info.IsDir() {
+				return nil, syscall.EISDIR
+			}
+			if l != layerModified && l != layerSecondary {
+				perm = info.Mode().Perm()
+			}
+		}
+		fs.settle(name)
+		if err := fs.txTouch(name); err != nil {
+			return nil, err
+		}
+		record, err := fs.journalOp(fs.writeEntry(name, flag))
+		if err != nil {
+			return nil, err
+		}
+		// The write completes when the returned handle is closed
+		handedOff := false
+		defer func() {
+			if !handedOff {
+				record.done()
+			}
+		}()
+
+		op := EventModify
+		if fs.watched() && !fs.exists(name) {
+			op = EventCreate
+		}
+
+		if flag&os.O_TRUNC != 0 {
+			fs.recordTakeover(name)
+		}
 		fs.mu.Lock()
 		alreadyInSecondary := fs.modified[name]
+		wasDeleted := fs.deleted[name]
 		fs.modified[name] = true
 		delete(fs.deleted, name) // Undelete if recreating
 		fs.mu.Unlock()
 
-		// Try to copy from primary if it exists, not already in secondary, and we're not truncating
-		if !alreadyInSecondary && flag&os.O_TRUNC == 0 {
-			if primaryFile, err := fs.primary.OpenFile(name, os.O_RDONLY, 0); err == nil {
-				// Create in secondary and copy content
-				secondaryFile, err := fs.secondary.OpenFile(name, os.O_CREATE|os.O_WRONLY, perm)
-				if err == nil {
-					_, copyErr := io.Copy(secondaryFile, primaryFile)
-					secondaryFile.Close()
-					if copyErr != nil {
-						primaryFile.Close()
-						return nil, copyErr
-					}
-				}
-				primaryFile.Close()
+		// Restore the markers if the file cannot be opened after all
+		opened := false
+		defer func() {
+			if opened {
+				return
+			}
+			fs.mu.Lock()
+			if !alreadyInSecondary {
+				delete(fs.modified, name)
+			}
+			if wasDeleted {
+				fs.deleted[name] = true
 			}
+			fs.mu.Unlock()
+		}()
+
+		// Try to copy from primary if it exists, not already in secondary or
+		// deleted, and we're not truncating
+		if !alreadyInSecondary && !wasDeleted && flag&os.O_TRUNC == 0 {
+			if fs.copiesAsync(name, flag) {
+				opened = true
+				end := endOp
+				endOp = nil
+				return fs.openAsync(name, flag, perm, op, end), nil
+			}
+			if err := fs.copyUp(name); err != nil {
+				return nil, unwrapRefused(err)
+			}
+		}
+		file, created, err := fs.openSecondary(name, flag, perm, op)
+		opened = created
+		if err != nil || record == nil {
+			return file, err
 		}
-		return fs.secondary.OpenFile(name, flag, perm)
+		handedOff = true
+		return &journalFile{File: file, record: record}, nil
 	}
 
-	// For read-only access, check if file has been deleted
-	fs.mu.RLock()
-	isDeleted := fs.deleted[name]
-	isModified := fs.modified[name]
-	fs.mu.RUnlock()
-
-	if isDeleted {
-		return nil, os.ErrNotExist
+	// For read-only access, check if file has been deleted or modified
+	defer fs.viewLock()()
+	name, err = fs.follow(name)
+	if err != nil {
+		return nil, err
 	}
-
-	// For read-only access, check if file has been modified
-	if isModified {
-		file, err := fs.secondary.OpenFile(name, flag, perm)
+	fs.awaitCopies(name)
+	l, gen := fs.resolve(name)
+	switch l {
+	case layerDeleted:
+		return nil, os.ErrNotExist
+	case layerDelta:
+		fs.counters.hit(false)
+		file, err := fs.openDelta(name)
 		if err != nil {
 			return nil, err
 		}
-		// Check if directory - wrap for merging
-		if info, statErr := file.Stat(); statErr == nil && info.IsDir() {
-			return &mergedDirFile{
-				File:      file,
-				name:      name,
-				fs:        fs,
-				primary:   fs.primary,
-				secondary: fs.secondary,
-			}, nil
+		return &meteredFile{File: file, c: &fs.counters.secondary}, nil
+	case layerModified, layerSecondary:
+		fs.counters.hit(false)
+		file, err := fs.secondary.OpenFile(name, flag, perm)
+		if err != nil {
+			return nil, err
 		}
-		return file, nil
+		return fs.readHandle(name, file, false), nil
 	}
 
 	// Try primary first, fallback to secondary
-	file, err := fs.primary.OpenFile(name, flag, perm)
+	var file absfs.File
+	if fs.promotion != nil {
+		file, err = fs.openPromoted(name)
+	} else {
+		file, err = fs.primary.OpenFile(name, flag, perm)
+	}
 	if err != nil {
+		fs.debug("cowfs: fallback to secondary", "op", "open", "path", name, "err", err)
 		file, err = fs.secondary.OpenFile(name, flag, perm)
 		if err != nil {
 			return nil, err
 		}
-		// Check if directory from secondary - wrap for merging
-		if info, statErr := file.Stat(); statErr == nil && info.IsDir() {
-			return &mergedDirFile{
-				File:      file,
-				name:      name,
-				fs:        fs,
-				primary:   fs.primary,
-				secondary: fs.secondary,
-			}, nil
+		fs.counters.hit(false)
+		fs.remember(name, gen, layerSecondary)
+		return fs.readHandle(name, file, false), nil
+	}
+
+	fs.counters.hit(true)
+	fs.remember(name, gen, layerPrimary)
+	fs.trackRead(name)
+	_, promoted := file.(*promotedFile)
+	return fs.readHandle(name, file, !promoted), nil
+}
+
+// openSecondary opens name in the secondary for writing once its primary
+// contents, if needed, have been copied up, reporting op to watchers. It
+// reports whether the secondary file was opened, even if opening failed
+// after that.
+func (fs *FileSystem) openSecondary(name string, flag int, perm os.FileMode, op EventOp) (absfs.File, bool, error) {
+	if flag&os.O_TRUNC != 0 {
+		fs.setDelta(name, false)
+	} else if err := fs.materialize(name); err != nil {
+		return nil, false, err
+	}
+	// New files may live in directories that only the primary has
+	if flag&os.O_CREATE != 0 {
+		if err := fs.ensureParent(name); err != nil {
+			return nil, false, err
+		}
+	}
+	before := fs.secondarySize(name)
+	file, err := fs.secondary.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, false, err
+	}
+	file = &meteredFile{File: file, c: &fs.counters.secondary}
+	if flag&os.O_CREATE != 0 {
+		if err := fs.syncDirs(name); err != nil {
+			file.Close()
+			return nil, true, err
+		}
+	}
+	if fs.quota != nil {
+		var size int64
+		if info, err := file.Stat(); err == nil {
+			size = info.Size()
 		}
-		return file, nil
+		fs.adjustQuota("open", name, size-before)
+		file = &quotaFile{File: file, fs: fs, name: name, size: size, append: flag&os.O_APPEND != 0}
+	}
+	if fs.durability != DurabilityNone {
+		file = &syncedFile{File: file, strict: fs.durability >= DurabilityStrict}
+	}
+	fs.notify(Event{Op: op, Path: name})
+	if fs.deltas == nil && fs.writeBack == nil {
+		return file, true, nil
 	}
+	return &writeFile{File: file, fs: fs, name: name}, true, nil
+}
 
-	// Check if this is a directory from primary - wrap for merging
-	info, statErr := file.Stat()
-	if statErr == nil && info.IsDir() {
+// readHandle wraps file, opened for reading from the primary or the
+// secondary, for use through the merged view. Directories are wrapped to
+// merge listings from both layers, and regular files to count their reads.
+func (fs *FileSystem) readHandle(name string, file absfs.File, primary bool) absfs.File {
+	if info, err := file.Stat(); err == nil && info.IsDir() {
 		return &mergedDirFile{
 			File:      file,
 			name:      name,
 			fs:        fs,
 			primary:   fs.primary,
 			secondary: fs.secondary,
-		}, nil
+			limit:     fs.mergeLimit,
+		}
 	}
-
-	return file, nil
+	return &meteredFile{File: file, c: fs.counters.layer(primary)}
 }
 
-// Mkdir creates a directory in the secondary filesystem.
-func (fs *FileSystem) Mkdir(name string, perm os.FileMode) error {
+// Mkdir creates a directory in the secondary filesystem. It fails with
+// fs.ErrExist if name exists in the merged view.
+func (fs *FileSystem) Mkdir(name string, perm os.FileMode) (err error) {
+	defer fs.audit(&err, AuditRecord{Op: "mkdir", Path: name, Mode: perm})
+	defer wrapErr(&err, "mkdir", name)
+	name = fs.normalize(name)
+	if err := fs.access(OpMkdir, name); err != nil {
+		return err
+	}
+	defer fs.beginOp()()
+	if fs.frozen.Load() {
+		return ErrFrozen
+	}
+	if z, err := fs.writeZone(name); err != nil {
+		return err
+	} else if z == ZoneWriteThrough {
+		return fs.primary.Mkdir(name, perm)
+	}
+	fs.settle(name)
+	if fs.exists(name) {
+		return os.ErrExist
+	}
+	if err := fs.ensureParent(name); err != nil {
+		return err
+	}
+	if err := fs.txTouch(name); err != nil {
+		return err
+	}
+
 	fs.mu.Lock()
+	wasDeleted := fs.deleted[name]
+	if wasDeleted {
+		// Recreated; the old primary contents stay deleted
+		fs.setOpaque(name)
+	}
 	fs.modified[name] = true
 	delete(fs.deleted, name)
 	fs.mu.Unlock()
-	return fs.secondary.Mkdir(name, perm)
+	fs.counters.secondary.meta()
+	if err := fs.secondary.Mkdir(name, perm); err != nil {
+		fs.mu.Lock()
+		delete(fs.modified, name)
+		if wasDeleted {
+			fs.clearOpaque(name)
+			fs.deleted[name] = true
+		}
+		fs.mu.Unlock()
+		return err
+	}
+	if err := fs.syncDirs(name); err != nil {
+		return err
+	}
+	fs.notify(Event{Op: EventCreate, Path: name})
+	return nil
 }
 
 // Remove removes a file from the secondary filesystem and marks it as deleted.
-func (fs *FileSystem) Remove(name string) error {
+// It fails with fs.ErrNotExist if name does not exist in the merged view.
+func (fs *FileSystem) Remove(name string) (err error) {
+	defer fs.audit(&err, AuditRecord{Op: "remove", Path: name})
+	defer wrapErr(&err, "remove", name)
+	name = fs.normalize(name)
+	fs.awaitCopies(name)
+	if err := fs.access(OpRemove, name); err != nil {
+		return err
+	}
+	defer fs.beginOp()()
+	if fs.frozen.Load() {
+		return ErrFrozen
+	}
+	if z, err := fs.writeZone(name); err != nil {
+		return err
+	} else if z == ZoneWriteThrough {
+		return fs.primary.Remove(name)
+	}
+
+	if (fs.strict || !fs.lenientRemove) && !fs.exists(name) {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	if err := fs.txTouch(name); err != nil {
+		return err
+	}
+	record, err := fs.journalOp(journalEntry{Op: "remove", Path: name})
+	if err != nil {
+		return err
+	}
+	defer record.done()
+	fs.recordTakeover(name)
+	wasDelta := fs.isDelta(name)
 	fs.mu.Lock()
+	wasModified := fs.modified[name]
+	owner, hadOwner := fs.owners[name]
+	wasOpaque := fs.opaque[name]
 	fs.deleted[name] = true
 	delete(fs.modified, name)
+	delete(fs.owners, name)
+	delete(fs.opaque, name)
 	fs.mu.Unlock()
+	fs.setDelta(name, false)
+
+	if fs.deletions != nil && !fs.strict {
+		fs.deletions.push(name)
+		fs.counters.deferredDeletions.Add(1)
+		fs.notify(Event{Op: EventDelete, Path: name})
+		return nil
+	}
 
 	// Try to remove from secondary if it exists there
-	_ = fs.secondary.Remove(name)
-	return nil
+	size := fs.secondarySize(name)
+	fs.counters.secondary.meta()
+	err = fs.secondary.Remove(name)
+	if err == nil {
+		fs.adjustQuota("remove", name, -size)
+	}
+	fs.debug("cowfs: remove", "path", name, "secondaryErr", err)
+	if err != nil && fs.strict && !os.IsNotExist(err) {
+		fs.mu.Lock()
+		delete(fs.deleted, name)
+		if wasModified {
+			fs.modified[name] = true
+		}
+		if hadOwner {
+			fs.owners[name] = owner
+		}
+		if wasOpaque {
+			fs.setOpaque(name)
+		}
+		fs.mu.Unlock()
+		fs.setDelta(name, wasDelta)
+		return pathError("remove", name, err)
+	}
+	fs.notify(Event{Op: EventDelete, Path: name})
+	return fs.syncDirs(name)
 }
 
-// Rename renames a file in the secondary filesystem.
-func (fs *FileSystem) Rename(oldpath, newpath string) error {
-	fs.mu.Lock()
+// Rename renames a file in the secondary filesystem. Renaming a directory
+// copies up the part of its tree that only the primary holds first. Rename
+// fails with fs.ErrNotExist if oldpath does not exist in the merged view,
+// including when it has been deleted.
+func (fs *FileSystem) Rename(oldpath, newpath string) (err error) {
+	defer fs.audit(&err, AuditRecord{Op: "rename", Path: oldpath, NewPath: newpath})
+	defer wrapLinkErr(&err, "rename", oldpath, newpath)
+	oldpath, newpath = fs.normalize(oldpath), fs.normalize(newpath)
+	fs.awaitCopies(oldpath, newpath)
+	if err := fs.access(OpRename, oldpath, newpath); err != nil {
+		return err
+	}
+	defer fs.beginOp()()
+	if fs.frozen.Load() {
+		return ErrFrozen
+	}
+	if z, err := fs.writeZone(oldpath, newpath); err != nil {
+		return err
+	} else if z == ZoneWriteThrough {
+		return fs.primary.Rename(oldpath, newpath)
+	}
+	fs.settle(oldpath, newpath)
+	if err := fs.txTouch(oldpath, newpath); err != nil {
+		return err
+	}
+	record, err := fs.journalOp(journalEntry{Op: "rename", Path: oldpath, NewPath: newpath})
+	if err != nil {
+		return err
+	}
+	defer record.done()
+
+	// Deleted sources must not be brought back from the primary
+	l, _ := fs.lookup(oldpath, false)
+	info, err := fs.lstat(oldpath, l)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fs.renameDir(oldpath, newpath, record)
+	}
+
+	// A file never replaces a directory, whichever layer holds it
+	l, _ = fs.lookup(newpath, false)
+	if target, err := fs.lstat(newpath, l); err == nil && target.IsDir() {
+		return syscall.EEXIST
+	}
+
+	fs.mu.RLock()
 	wasModified := fs.modified[oldpath]
-	fs.deleted[oldpath] = true
-	delete(fs.modified, oldpath)
-	fs.modified[newpath] = true
-	delete(fs.deleted, newpath)
-	fs.mu.Unlock()
+	fs.mu.RUnlock()
 
 	// If file wasn't in secondary, copy from primary first
 	if !wasModified {
-		if primaryFile, err := fs.primary.OpenFile(oldpath, os.O_RDONLY, 0); err == nil {
-			secondaryFile, err := fs.secondary.OpenFile(oldpath, os.O_CREATE|os.O_WRONLY, 0644)
-			if err == nil {
-				io.Copy(secondaryFile, primaryFile)
-				secondaryFile.Close()
-			}
-			primaryFile.Close()
+		if err := fs.copyUp(oldpath); isRefused(err) {
+			return unwrapRefused(err)
+		} else if err != nil && fs.strict {
+			return err
 		}
 	}
 
-	return fs.secondary.Rename(oldpath, newpath)
-}
-
-// Stat returns file info, checking secondary first if modified.
-func (fs *FileSystem) Stat(name string) (os.FileInfo, error) {
-	fs.mu.RLock()
-	isDeleted := fs.deleted[name]
-	isModified := fs.modified[name]
-	fs.mu.RUnlock()
+	// A delta only applies to the primary file it was recorded against
+	if err := fs.materialize(oldpath); err != nil {
+		return err
+	}
 
-	if isDeleted {
-		return nil, os.ErrNotExist
+	// The copy-up staged the file under oldpath in the secondary, where the
+	// primary still shadows it. Publish it with one secondary rename, and
+	// only then swap the overlay state.
+	if err := fs.ensureParent(newpath); err != nil {
+		return err
 	}
+	fs.recordTakeover(newpath)
+	replaced := fs.secondarySize(newpath)
+	unlock := fs.commitLock()
+	fs.counters.secondary.meta()
+	err = fs.secondary.Rename(oldpath, newpath)
+	if err == nil {
+		fs.mu.Lock()
+		fs.moveMarkers(oldpath, newpath)
+		fs.mu.Unlock()
+		record.step()
+	}
+	unlock()
+	fs.debug("cowfs: rename", "old", oldpath, "new", newpath, "copiedUp", !wasModified, "err", err)
+	if err != nil {
+		return err
+	}
+	fs.adjustQuota("rename", newpath, -replaced)
+	if err := fs.syncDirs(oldpath, newpath); err != nil {
+		return err
+	}
+	fs.notify(Event{Op: EventRename, Path: newpath, OldPath: oldpath})
+	return nil
+}
 
-	if isModified {
-		return fs.secondary.Stat(name)
+// Stat returns file info, checking secondary first if modified. The root
+// directory "/" always exists; see WithSyntheticRoot.
+func (fs *FileSystem) Stat(name string) (_ os.FileInfo, err error) {
+	defer wrapErr(&err, "stat", name)
+	name = fs.normalize(name)
+	fs.awaitCopies(name)
+	if err := fs.access(OpStat, name); err != nil {
+		return nil, err
 	}
-	info, err := fs.primary.Stat(name)
+	if fs.zoneOf(name) != ZoneOverlay {
+		return fs.primary.Stat(name)
+	}
+	defer fs.viewLock()()
+	if name == "/" {
+		return fs.statRoot()
+	}
+	name, err = fs.follow(name)
 	if err != nil {
+		return nil, err
+	}
+	l, gen := fs.resolve(name)
+	switch l {
+	case layerDeleted:
+		return nil, os.ErrNotExist
+	case layerDelta:
+		fs.counters.hit(false)
+		fs.counters.secondary.meta()
+		return fs.deltaStat(name)
+	case layerModified, layerSecondary:
+		fs.counters.hit(false)
+		fs.counters.secondary.meta()
 		return fs.secondary.Stat(name)
 	}
+	info, err := fs.primaryStat(name)
+	if err != nil {
+		fs.counters.hit(false)
+		fs.debug("cowfs: fallback to secondary", "op", "stat", "path", name, "err", err)
+		fs.counters.secondary.meta()
+		info, err = fs.secondary.Stat(name)
+		if err == nil {
+			fs.remember(name, gen, layerSecondary)
+		}
+		return info, err
+	}
+	fs.counters.hit(true)
+	fs.remember(name, gen, layerPrimary)
 	return info, nil
 }
 
 // Chmod changes the mode in the secondary filesystem.
 // If the file exists only in primary, it's copied to secondary first.
-func (fs *FileSystem) Chmod(name string, mode os.FileMode) error {
-	fs.mu.Lock()
-	wasModified := fs.modified[name]
-	fs.modified[name] = true
-	fs.mu.Unlock()
+func (fs *FileSystem) Chmod(name string, mode os.FileMode) (err error) {
+	defer fs.audit(&err, AuditRecord{Op: "chmod", Path: name, Mode: mode})
+	defer wrapErr(&err, "chmod", name)
+	name = fs.normalize(name)
+	fs.awaitCopies(name)
+	if err := fs.access(OpChmod, name); err != nil {
+		return err
+	}
+	defer fs.beginOp()()
+	if fs.frozen.Load() {
+		return ErrFrozen
+	}
+	if z, err := fs.writeZone(name); err != nil {
+		return err
+	} else if z == ZoneWriteThrough {
+		return fs.primary.Chmod(name, mode)
+	}
+	if err := fs.txTouch(name); err != nil {
+		return err
+	}
+	record, err := fs.journalOp(journalEntry{Op: "chmod", Path: name, Mode: mode})
+	if err != nil {
+		return err
+	}
+	defer record.done()
 
 	// If file wasn't in secondary, copy from primary first
-	if !wasModified {
-		if primaryFile, err := fs.primary.OpenFile(name, os.O_RDONLY, 0); err == nil {
-			stat, _ := primaryFile.Stat()
-			perm := os.FileMode(0644)
-			if stat != nil {
-				perm = stat.Mode().Perm()
-			}
-			secondaryFile, err := fs.secondary.OpenFile(name, os.O_CREATE|os.O_WRONLY, perm)
-			if err == nil {
-				io.Copy(secondaryFile, primaryFile)
-				secondaryFile.Close()
-			}
-			primaryFile.Close()
-		}
+	if err := fs.markModified("chmod", name); err != nil {
+		return err
 	}
+	fs.encodeDelta(name)
 
-	return fs.secondary.Chmod(name, mode)
+	// Keep the file type, which some layers replace along with the
+	// permissions
+	if info, err := fs.secondary.Stat(name); err == nil {
+		mode = info.Mode().Type() | mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)
+	}
+	fs.counters.secondary.meta()
+	if err := fs.secondary.Chmod(name, mode); err != nil {
+		return err
+	}
+	if err := fs.syncStrict(name); err != nil {
+		return err
+	}
+	fs.notify(Event{Op: EventModify, Path: name})
+	return nil
 }
 
 // Chtimes changes the times in the secondary filesystem.
 // If the file exists only in primary, it's copied to secondary first.
-func (fs *FileSystem) Chtimes(name string, atime time.Time, mtime time.Time) error {
-	fs.mu.Lock()
-	wasModified := fs.modified[name]
-	fs.modified[name] = true
-	fs.mu.Unlock()
+func (fs *FileSystem) Chtimes(name string, atime time.Time, mtime time.Time) (err error) {
+	defer fs.audit(&err, AuditRecord{Op: "chtimes", Path: name})
+	defer wrapErr(&err, "chtimes", name)
+	name = fs.normalize(name)
+	fs.awaitCopies(name)
+	if err := fs.access(OpChtimes, name); err != nil {
+		return err
+	}
+	defer fs.beginOp()()
+	if fs.frozen.Load() {
+		return ErrFrozen
+	}
+	if z, err := fs.writeZone(name); err != nil {
+		return err
+	} else if z == ZoneWriteThrough {
+		return fs.primary.Chtimes(name, atime, mtime)
+	}
+	if err := fs.txTouch(name); err != nil {
+		return err
+	}
+	record, err := fs.journalOp(journalEntry{Op: "chtimes", Path: name, Atime: &atime, Mtime: &mtime})
+	if err != nil {
+		return err
+	}
+	defer record.done()
 
 	// If file wasn't in secondary, copy from primary first
-	if !wasModified {
-		if primaryFile, err := fs.primary.OpenFile(name, os.O_RDONLY, 0); err == nil {
-			stat, _ := primaryFile.Stat()
-			perm := os.FileMode(0644)
-			if stat != nil {
-				perm = stat.Mode().Perm()
-			}
-			secondaryFile, err := fs.secondary.OpenFile(name, os.O_CREATE|os.O_WRONLY, perm)
-			if err == nil {
-				io.Copy(secondaryFile, primaryFile)
-				secondaryFile.Close()
-			}
-			primaryFile.Close()
-		}
+	if err := fs.markModified("chtimes", name); err != nil {
+		return err
 	}
+	fs.encodeDelta(name)
 
-	return fs.secondary.Chtimes(name, atime, mtime)
+	fs.counters.secondary.meta()
+	if err := fs.secondary.Chtimes(name, atime, mtime); err != nil {
+		return err
+	}
+	if err := fs.syncStrict(name); err != nil {
+		return err
+	}
+	fs.notify(Event{Op: EventModify, Path: name})
+	return nil
 }
 
 // Chown changes the owner in the secondary filesystem.
 // If the file exists only in primary, it's copied to secondary first.
-func (fs *FileSystem) Chown(name string, uid, gid int) error {
-	fs.mu.Lock()
-	wasModified := fs.modified[name]
-	fs.modified[name] = true
-	fs.mu.Unlock()
+// If the secondary does not support Chown, the ownership is recorded and
+// reported by DeferredOwners instead.
+func (fs *FileSystem) Chown(name string, uid, gid int) (err error) {
+	defer fs.audit(&err, AuditRecord{Op: "chown", Path: name, Owner: &Owner{UID: uid, GID: gid}})
+	defer wrapErr(&err, "chown", name)
+	name = fs.normalize(name)
+	fs.awaitCopies(name)
+	if err := fs.access(OpChown, name); err != nil {
+		return err
+	}
+	defer fs.beginOp()()
+	if fs.frozen.Load() {
+		return ErrFrozen
+	}
+	if z, err := fs.writeZone(name); err != nil {
+		return err
+	} else if z == ZoneWriteThrough {
+		return fs.primary.Chown(name, uid, gid)
+	}
+	if err := fs.txTouch(name); err != nil {
+		return err
+	}
+
+	// Without Chown support in the secondary, record the ownership instead
+	// of copying the file up only to fail
+	deferred, err := fs.deferChown(name, uid, gid)
+	if err != nil {
+		return err
+	}
+	if deferred {
+		fs.notify(Event{Op: EventModify, Path: name})
+		return nil
+	}
+	record, err := fs.journalOp(journalEntry{Op: "chown", Path: name, UID: uid, GID: gid})
+	if err != nil {
+		return err
+	}
+	defer record.done()
 
 	// If file wasn't in secondary, copy from primary first
-	if !wasModified {
-		if primaryFile, err := fs.primary.OpenFile(name, os.O_RDONLY, 0); err == nil {
-			stat, _ := primaryFile.Stat()
-			perm := os.FileMode(0644)
-			if stat != nil {
-				perm = stat.Mode().Perm()
-			}
-			secondaryFile, err := fs.secondary.OpenFile(name, os.O_CREATE|os.O_WRONLY, perm)
-			if err == nil {
-				io.Copy(secondaryFile, primaryFile)
-				secondaryFile.Close()
-			}
-			primaryFile.Close()
-		}
+	if err := fs.markModified("chown", name); err != nil {
+		return err
 	}
+	fs.encodeDelta(name)
 
-	return fs.secondary.Chown(name, uid, gid)
+	fs.counters.secondary.meta()
+	if err := fs.secondary.Chown(name, uid, gid); err != nil {
+		return err
+	}
+	if err := fs.syncStrict(name); err != nil {
+		return err
+	}
+	fs.notify(Event{Op: EventModify, Path: name})
+	return nil
 }
 
 // Truncate truncates a file to the specified size.
 // If the file exists only in primary, it's copied to secondary first.
-func (fs *FileSystem) Truncate(name string, size int64) error {
-	fs.mu.Lock()
-	wasModified := fs.modified[name]
-	fs.modified[name] = true
-	fs.mu.Unlock()
+func (fs *FileSystem) Truncate(name string, size int64) (err error) {
+	defer fs.audit(&err, AuditRecord{Op: "truncate", Path: name, Size: &size})
+	defer wrapErr(&err, "truncate", name)
+	name = fs.normalize(name)
+	fs.awaitCopies(name)
+	if err := fs.access(OpWrite, name); err != nil {
+		return err
+	}
+	defer fs.beginOp()()
+	if fs.frozen.Load() {
+		return ErrFrozen
+	}
+	if z, err := fs.writeZone(name); err != nil {
+		return err
+	} else if z == ZoneWriteThrough {
+		return fs.truncatePrimary(name, size)
+	}
+	if err := fs.txTouch(name); err != nil {
+		return err
+	}
+	record, err := fs.journalOp(journalEntry{Op: "truncate", Path: name, Size: size})
+	if err != nil {
+		return err
+	}
+	defer record.done()
 
 	// If file wasn't in secondary, copy from primary first
-	if !wasModified {
-		if primaryFile, err := fs.primary.OpenFile(name, os.O_RDONLY, 0); err == nil {
-			stat, _ := primaryFile.Stat()
-			perm := os.FileMode(0644)
-			if stat != nil {
-				perm = stat.Mode().Perm()
-			}
-			secondaryFile, err := fs.secondary.OpenFile(name, os.O_CREATE|os.O_WRONLY, perm)
-			if err == nil {
-				io.Copy(secondaryFile, primaryFile)
-				secondaryFile.Close()
-			}
-			primaryFile.Close()
-		}
+	if err := fs.markModified("truncate", name); err != nil {
+		return err
 	}
 
 	// Now truncate in secondary
+	if err := fs.materialize(name); err != nil {
+		return err
+	}
+	before := fs.secondarySize(name)
+	if err := fs.adjustQuota("truncate", name, size-before); err != nil {
+		return err
+	}
+	fs.counters.secondary.meta()
 	f, err := fs.secondary.OpenFile(name, os.O_WRONLY, 0)
 	if err != nil {
+		fs.adjustQuota("truncate", name, before-size)
+		return err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		fs.adjustQuota("truncate", name, before-size)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fs.encodeDelta(name)
+	if err := fs.syncStrict(name); err != nil {
 		return err
 	}
-	defer f.Close()
-	return f.Truncate(size)
+	fs.notify(Event{Op: EventModify, Path: name})
+	return nil
 }
 
-// ReadDir reads the named directory and returns a list of directory entries.
-func (cfs *FileSystem) ReadDir(name string) ([]fs.DirEntry, error) {
+// ReadDir reads the named directory and returns a list of directory entries
+// sorted by filename, as os.ReadDir does.
+func (cfs *FileSystem) ReadDir(name string) (_ []fs.DirEntry, err error) {
+	defer wrapErr(&err, "readdir", name)
+	name = cfs.normalize(name)
+	cfs.awaitCopies(name)
+	if err := cfs.access(OpReadDir, name); err != nil {
+		return nil, err
+	}
+	if cfs.zoneOf(name) != ZoneOverlay {
+		entries, err := cfs.primary.ReadDir(name)
+		if err == nil {
+			cfs.trackRead(name)
+		}
+		return entries, err
+	}
+	defer cfs.viewLock()()
+	entries, err := cfs.readDir(name)
+	if err != nil {
+		return nil, err
+	}
+	if name == "/" {
+		kept := entries[:0]
+		for _, e := range entries {
+			if !internalDir(name, e.Name()) {
+				kept = append(kept, e)
+			}
+		}
+		entries = kept
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// readDir returns the merged entries of directory name in layer order.
+func (cfs *FileSystem) readDir(name string) ([]fs.DirEntry, error) {
 	cfs.mu.RLock()
 	isDeleted := cfs.deleted[name]
 	isModified := cfs.modified[name]
@@ -328,74 +913,190 @@ func (cfs *FileSystem) ReadDir(name string) ([]fs.DirEntry, error) {
 
 	// If the directory was modified, read from secondary
 	if isModified {
+		cfs.counters.hit(false)
+		cfs.counters.secondary.meta()
+		entries, err := cfs.secondary.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		if cfs.isOpaque(name) {
+			return entries, nil
+		}
+		// A directory modified in place, such as by Chmod, keeps the
+		// primary's children
+		cfs.counters.primary.meta()
+		primaryEntries, err := cfs.primary.ReadDir(name)
+		if err != nil {
+			return entries, nil
+		}
+		cfs.trackRead(name)
+		return cfs.mergeEntries(name, primaryEntries, entries), nil
+	}
+
+	if cfs.isOpaque(name) {
+		cfs.counters.hit(false)
+		cfs.counters.secondary.meta()
 		return cfs.secondary.ReadDir(name)
 	}
 
 	// Try primary first
+	cfs.counters.primary.meta()
 	entries, err := cfs.primary.ReadDir(name)
 	if err != nil {
 		// Fallback to secondary
-		return cfs.secondary.ReadDir(name)
+		primaryErr := err
+		cfs.counters.hit(false)
+		cfs.debug("cowfs: fallback to secondary", "op", "readdir", "path", name, "err", err)
+		cfs.counters.secondary.meta()
+		entries, err = cfs.secondary.ReadDir(name)
+		if err != nil && name == "/" {
+			// Neither layer has a root; list the synthesized one
+			return []fs.DirEntry{}, nil
+		}
+		if os.IsNotExist(err) && !os.IsNotExist(primaryErr) {
+			// The primary has name, but not as a directory
+			return nil, primaryErr
+		}
+		return entries, err
+	}
+	cfs.counters.hit(true)
+	cfs.trackRead(name)
+	return cfs.mergeDir(name, entries)
+}
+
+// internalDir reports whether entry name of directory dir is one of the
+// secondary directories the overlay keeps its own files in.
+func internalDir(dir, name string) bool {
+	switch "/" + name {
+	case spillDir, promoteDir, journalName, txDir, basesDir, casDir, writeDir:
+		return dir == "/"
+	}
+	return false
+}
+
+// mergeDir merges the primary entries of directory name with its secondary
+// entries, dropping deleted paths.
+func (cfs *FileSystem) mergeDir(name string, entries []fs.DirEntry) ([]fs.DirEntry, error) {
+	// Add entries from secondary that aren't in primary
+	cfs.counters.secondary.meta()
+	secondaryEntries, err := cfs.secondary.ReadDir(name)
+	if err != nil && cfs.strict && !os.IsNotExist(err) {
+		return nil, pathError("readdir", name, err)
 	}
+	return cfs.mergeEntries(name, entries, secondaryEntries), nil
+}
+
+// mergeEntries merges the primary and secondary entries of directory name,
+// dropping deleted paths. Paths modified through the overlay are listed from
+// the secondary.
+func (cfs *FileSystem) mergeEntries(name string, primary, secondary []fs.DirEntry) []fs.DirEntry {
+	span := cfs.startSpan("cowfs.ReadDir", attribute.String("cowfs.path", name))
+	defer span.End()
 
 	// Filter deleted entries and merge with secondary
 	var result []fs.DirEntry
 	seen := make(map[string]bool)
 
-	for _, entry := range entries {
-		entryPath := path.Join(name, entry.Name())
+	for _, entry := range primary {
+		entryPath := cfs.normalize(path.Join(name, entry.Name()))
 		cfs.mu.RLock()
 		isDeleted := cfs.deleted[entryPath]
+		isModified := cfs.modified[entryPath]
 		cfs.mu.RUnlock()
 
-		if !isDeleted {
+		if !isDeleted && !isModified {
 			result = append(result, entry)
-			seen[entry.Name()] = true
+			seen[entryPath] = true
 		}
 	}
 
-	// Add entries from secondary that aren't in primary
-	secondaryEntries, err := cfs.secondary.ReadDir(name)
-	if err == nil {
-		for _, entry := range secondaryEntries {
-			if !seen[entry.Name()] {
-				entryPath := path.Join(name, entry.Name())
-				cfs.mu.RLock()
-				isDeleted := cfs.deleted[entryPath]
-				cfs.mu.RUnlock()
+	for _, entry := range secondary {
+		if entryPath := cfs.normalize(path.Join(name, entry.Name())); !seen[entryPath] {
+			cfs.mu.RLock()
+			isDeleted := cfs.deleted[entryPath]
+			cfs.mu.RUnlock()
 
-				if !isDeleted {
-					result = append(result, entry)
+			if !isDeleted {
+				if cfs.isDelta(entryPath) {
+					if info, err := cfs.deltaStat(entryPath); err == nil {
+						entry = fs.FileInfoToDirEntry(info)
+					}
 				}
+				result = append(result, entry)
 			}
 		}
 	}
 
-	return result, nil
+	span.SetAttributes(attribute.Int("cowfs.entries", len(result)))
+	return result
 }
 
 // ReadFile reads the named file and returns its contents.
-func (cfs *FileSystem) ReadFile(name string) ([]byte, error) {
-	cfs.mu.RLock()
-	isDeleted := cfs.deleted[name]
-	isModified := cfs.modified[name]
-	cfs.mu.RUnlock()
-
-	if isDeleted {
-		return nil, os.ErrNotExist
+func (cfs *FileSystem) ReadFile(name string) (_ []byte, err error) {
+	defer wrapErr(&err, "readfile", name)
+	name = cfs.normalize(name)
+	cfs.awaitCopies(name)
+	if err := cfs.access(OpRead, name); err != nil {
+		return nil, err
 	}
-
-	// If the file was modified, read from secondary
-	if isModified {
-		return cfs.secondary.ReadFile(name)
+	if cfs.zoneOf(name) != ZoneOverlay {
+		data, err := cfs.primary.ReadFile(name)
+		if err == nil {
+			cfs.trackRead(name)
+		}
+		return data, err
+	}
+	defer cfs.viewLock()()
+	name, err = cfs.follow(name)
+	if err != nil {
+		return nil, err
+	}
+	l, gen := cfs.resolve(name)
+	switch l {
+	case layerDeleted:
+		return nil, os.ErrNotExist
+	case layerDelta:
+		cfs.counters.hit(false)
+		f, err := cfs.openDelta(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		data, err := io.ReadAll(f)
+		cfs.counters.secondary.read(int64(len(data)))
+		return data, err
+	case layerModified, layerSecondary:
+		// If the file was modified, read from secondary
+		cfs.counters.hit(false)
+		data, err := cfs.secondary.ReadFile(name)
+		cfs.counters.secondary.read(int64(len(data)))
+		return data, err
 	}
 
 	// Try primary first
-	data, err := cfs.primary.ReadFile(name)
+	var data []byte
+	if cfs.cache != nil {
+		data, err = cfs.readPrimaryCached(name)
+	} else if cfs.promotion != nil {
+		data, err = cfs.readPromoted(name)
+	} else {
+		data, err = cfs.primary.ReadFile(name)
+		cfs.counters.primary.read(int64(len(data)))
+	}
 	if err != nil {
 		// Fallback to secondary
-		return cfs.secondary.ReadFile(name)
+		cfs.counters.hit(false)
+		cfs.debug("cowfs: fallback to secondary", "op", "readfile", "path", name, "err", err)
+		data, err = cfs.secondary.ReadFile(name)
+		cfs.counters.secondary.read(int64(len(data)))
+		if err == nil {
+			cfs.remember(name, gen, layerSecondary)
+		}
+		return data, err
 	}
+	cfs.counters.hit(true)
+	cfs.remember(name, gen, layerPrimary)
+	cfs.trackRead(name)
 
 	return data, nil
 }
@@ -415,9 +1116,94 @@ func (cfs *FileSystem) TempDir() string {
 	return "/tmp"
 }
 
-// Sub returns a Filer corresponding to the subtree rooted at dir.
-func (cfs *FileSystem) Sub(dir string) (fs.FS, error) {
-	return absfs.FilerToFS(cfs, dir)
+// ensureSecondaryDir creates dir and any missing parents in the secondary
+// filesystem, taking permissions from the primary where it has the directory.
+// Directories created this way are not marked modified, so the merged view of
+// their contents is unaffected.
+func (cfs *FileSystem) ensureSecondaryDir(dir string) error {
+	if info, err := cfs.secondary.Stat(dir); err == nil {
+		if !info.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR}
+		}
+		return nil
+	}
+	if parent := path.Dir(dir); parent != dir {
+		if err := cfs.ensureSecondaryDir(parent); err != nil {
+			return err
+		}
+	}
+	if err := cfs.txTouch(dir); err != nil {
+		return err
+	}
+	perm := os.FileMode(0755)
+	if info, err := cfs.primary.Stat(dir); err == nil && info.IsDir() {
+		perm = info.Mode().Perm()
+	}
+	if err := cfs.secondary.Mkdir(dir, perm); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ensureParent creates the parent directory of name in the secondary if it
+// only exists in the primary.
+func (cfs *FileSystem) ensureParent(name string) error {
+	dir := path.Dir(name)
+	cfs.mu.RLock()
+	dirDeleted := cfs.deleted[dir]
+	cfs.mu.RUnlock()
+	if dirDeleted || cfs.isOpaque(path.Dir(dir)) {
+		return nil
+	}
+	if info, err := cfs.primary.Stat(dir); err == nil && info.IsDir() {
+		return cfs.ensureSecondaryDir(dir)
+	}
+	return nil
+}
+
+// removeAll removes name and, if it is a directory, everything below it from
+// filer. Errors are ignored; it is used to discard overlay copies.
+func removeAll(filer absfs.Filer, name string) {
+	if entries, err := filer.ReadDir(name); err == nil {
+		for _, entry := range entries {
+			removeAll(filer, path.Join(name, entry.Name()))
+		}
+	}
+	filer.Remove(name)
+}
+
+// removeTree is removeAll for removals that must not be lost, such as those
+// made by Commit: it reports the first failure, other than name not
+// existing.
+func removeTree(filer absfs.Filer, name string) error {
+	if entries, err := filer.ReadDir(name); err == nil {
+		for _, entry := range entries {
+			if err := removeTree(filer, path.Join(name, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	if err := filer.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// replaceFile renames tmp over name in filer. Filesystems that refuse to
+// rename onto an existing file get the target removed first, which briefly
+// leaves neither name present.
+func replaceFile(filer absfs.Filer, tmp, name string) error {
+	err := filer.Rename(tmp, name)
+	if err == nil {
+		return nil
+	}
+	if _, statErr := filer.Stat(name); statErr != nil {
+		return err
+	}
+	if err := filer.Remove(name); err != nil {
+		return err
+	}
+	return filer.Rename(tmp, name)
 }
 
 // mergedDirFile wraps a directory File to merge listings from primary and secondary
@@ -428,18 +1214,23 @@ type mergedDirFile struct {
 	fs        *FileSystem
 	primary   absfs.Filer
 	secondary absfs.Filer
-	merged    []os.FileInfo // Cached merged result
-	offset    int           // Current read position in merged
+	limit     int             // Merge limit, as set by WithMergeLimit
+	merged    []os.FileInfo   // Cached merged result
+	offset    int             // Current read position in merged
+	spill     *spilledListing // Merge in progress on disk, if spilled
 }
 
 // Readdir reads directory entries, merging from both primary and secondary
 // while filtering deleted files.
 func (f *mergedDirFile) Readdir(n int) ([]os.FileInfo, error) {
-	if f.merged == nil {
+	if f.merged == nil && f.spill == nil {
 		if err := f.buildMerged(); err != nil {
 			return nil, err
 		}
 	}
+	if f.spill != nil {
+		return f.spill.next(n)
+	}
 
 	if n <= 0 {
 		// Return all remaining entries
@@ -484,17 +1275,42 @@ func (f *mergedDirFile) Readdirnames(n int) ([]string, error) {
 // ReadDir reads directory entries, merging from both primary and secondary
 // while filtering deleted files. Returns fs.DirEntry values.
 func (f *mergedDirFile) ReadDir(n int) ([]fs.DirEntry, error) {
-	// Use the filesystem-level ReadDir for proper merging
-	return f.fs.ReadDir(f.name)
+	infos, err := f.Readdir(n)
+	entries := make([]fs.DirEntry, len(infos))
+	for i, info := range infos {
+		entries[i] = fs.FileInfoToDirEntry(info)
+	}
+	if n <= 0 && err == io.EOF {
+		err = nil
+	}
+	return entries, err
+}
+
+// Close closes the directory and discards a spilled merge.
+func (f *mergedDirFile) Close() error {
+	if f.spill != nil {
+		f.spill.Close()
+		f.spill = nil
+	}
+	return f.File.Close()
 }
 
-// buildMerged constructs the merged directory listing.
+// buildMerged constructs the merged directory listing, sorted by name so
+// that successive Readdir calls page through a stable order.
 func (f *mergedDirFile) buildMerged() error {
+	if f.limit > 0 {
+		return f.buildLimited()
+	}
 	seen := make(map[string]bool)
-	var result []os.FileInfo
-
-	// Get entries from primary
-	primaryFile, err := f.primary.OpenFile(f.name, os.O_RDONLY, 0)
+	result := []os.FileInfo{}
+
+	// Get entries from primary, unless hidden
+	var primaryFile absfs.File
+	err := os.ErrNotExist
+	if !f.fs.isOpaque(f.name) {
+		f.fs.counters.primary.meta()
+		primaryFile, err = f.primary.OpenFile(f.name, os.O_RDONLY, 0)
+	}
 	if err == nil {
 		primaryEntries, _ := primaryFile.Readdir(-1)
 		primaryFile.Close()
@@ -506,22 +1322,24 @@ func (f *mergedDirFile) buildMerged() error {
 				continue
 			}
 
-			// Use path.Join for virtual filesystem paths (always uses /)
-			entryPath := path.Join(f.name, name)
+			// The overlay tracks the entry under its normalized path
+			entryPath := f.fs.normalize(path.Join(f.name, name))
 
-			// Skip if deleted in overlay
+			// Skip if deleted in overlay, or listed from secondary
 			f.fs.mu.RLock()
 			isDeleted := f.fs.deleted[entryPath]
+			isModified := f.fs.modified[entryPath]
 			f.fs.mu.RUnlock()
 
-			if !isDeleted {
+			if !isDeleted && !isModified {
 				result = append(result, entry)
-				seen[name] = true
+				seen[entryPath] = true
 			}
 		}
 	}
 
-	// Get entries from secondary (only new/modified ones not in primary)
+	// Get entries from secondary (only new/modified ones not listed above)
+	f.fs.counters.secondary.meta()
 	secondaryFile, err := f.secondary.OpenFile(f.name, os.O_RDONLY, 0)
 	if err == nil {
 		secondaryEntries, _ := secondaryFile.Readdir(-1)
@@ -534,22 +1352,21 @@ func (f *mergedDirFile) buildMerged() error {
 				continue
 			}
 
-			if !seen[name] {
-				// Use path.Join for virtual filesystem paths (always uses /)
-				entryPath := path.Join(f.name, name)
-
+			entryPath := f.fs.normalize(path.Join(f.name, name))
+			if !seen[entryPath] && !internalDir(f.name, name) {
 				// Skip if marked as deleted
 				f.fs.mu.RLock()
 				isDeleted := f.fs.deleted[entryPath]
 				f.fs.mu.RUnlock()
 
 				if !isDeleted {
-					result = append(result, entry)
+					result = append(result, f.fs.secondaryInfo(entryPath, entry))
 				}
 			}
 		}
 	}
 
+	sort.Slice(result, func(i, j int) bool { return result[i].Name() < result[j].Name() })
 	f.merged = result
 	return nil
 }
@@ -559,43 +1376,43 @@ func (f *mergedDirFile) buildMerged() error {
 type emptyFiler struct{}
 
 func (e *emptyFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
-	return nil, os.ErrNotExist
+	return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
 }
 
 func (e *emptyFiler) Mkdir(name string, perm os.FileMode) error {
-	return os.ErrNotExist
+	return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrNotExist}
 }
 
 func (e *emptyFiler) Remove(name string) error {
-	return os.ErrNotExist
+	return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
 }
 
 func (e *emptyFiler) Rename(oldpath, newpath string) error {
-	return os.ErrNotExist
+	return &os.PathError{Op: "rename", Path: oldpath, Err: os.ErrNotExist}
 }
 
 func (e *emptyFiler) Stat(name string) (os.FileInfo, error) {
-	return nil, os.ErrNotExist
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
 }
 
 func (e *emptyFiler) Chmod(name string, mode os.FileMode) error {
-	return os.ErrNotExist
+	return &os.PathError{Op: "chmod", Path: name, Err: os.ErrNotExist}
 }
 
 func (e *emptyFiler) Chtimes(name string, atime time.Time, mtime time.Time) error {
-	return os.ErrNotExist
+	return &os.PathError{Op: "chtimes", Path: name, Err: os.ErrNotExist}
 }
 
 func (e *emptyFiler) Chown(name string, uid, gid int) error {
-	return os.ErrNotExist
+	return &os.PathError{Op: "chown", Path: name, Err: os.ErrNotExist}
 }
 
 func (e *emptyFiler) ReadDir(name string) ([]fs.DirEntry, error) {
-	return nil, os.ErrNotExist
+	return nil, &os.PathError{Op: "readdir", Path: name, Err: os.ErrNotExist}
 }
 
 func (e *emptyFiler) ReadFile(name string) ([]byte, error) {
-	return nil, os.ErrNotExist
+	return nil, &os.PathError{Op: "readfile", Path: name, Err: os.ErrNotExist}
 }
 
 func (e *emptyFiler) Sub(dir string) (fs.FS, error) {
@@ -1,6 +1,7 @@
 package cowfs
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -234,12 +235,29 @@ func TestMkdir(t *testing.T) {
 	if err != nil {
 		t.Errorf("Mkdir() error = %v", err)
 	}
+	if err := fs.Mkdir("/testdir", 0755); !errors.Is(err, os.ErrExist) {
+		t.Errorf("second Mkdir() error = %v, want ErrExist", err)
+	}
+}
+
+func TestFailedCreateLeavesNoMarkers(t *testing.T) {
+	cfs, _, _ := newMemOverlay(t)
+	if _, err := cfs.OpenFile("/missing/file.txt", os.O_CREATE|os.O_WRONLY, 0644); err == nil {
+		t.Fatal("OpenFile below a missing directory succeeded")
+	}
+	if err := cfs.Mkdir("/missing/dir", 0755); err == nil {
+		t.Fatal("Mkdir below a missing directory succeeded")
+	}
+	if modified, deleted := cfs.state(); len(modified)+len(deleted) != 0 {
+		t.Errorf("failed creations left markers %v %v", modified, deleted)
+	}
 }
 
 func TestRemove(t *testing.T) {
 	primary := newMockFiler()
 	secondary := newMockFiler()
 	fs := New(primary, secondary)
+	primary.files["/test.txt"] = &mockFile{name: "/test.txt", data: []byte("data"), mode: 0644}
 
 	err := fs.Remove("/test.txt")
 	if err != nil {
@@ -250,6 +268,24 @@ func TestRemove(t *testing.T) {
 	if !fs.deleted["/test.txt"] {
 		t.Error("File not marked as deleted")
 	}
+
+	// Removing it again, or a path that never existed, fails
+	for _, name := range []string{"/test.txt", "/missing.txt"} {
+		var pathErr *os.PathError
+		if err := fs.Remove(name); !errors.As(err, &pathErr) || !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Remove(%s) error = %v, want *os.PathError wrapping ErrNotExist", name, err)
+		}
+	}
+}
+
+func TestLenientRemove(t *testing.T) {
+	cfs := New(newMockFiler(), newMockFiler(), WithLenientRemove())
+	if err := cfs.Remove("/missing.txt"); err != nil {
+		t.Errorf("Remove() error = %v", err)
+	}
+	if !cfs.IsDeleted("/missing.txt") {
+		t.Error("missing path not marked deleted")
+	}
 }
 
 func TestRemoveBlocksPrimaryRead(t *testing.T) {
@@ -268,7 +304,7 @@ func TestRemoveBlocksPrimaryRead(t *testing.T) {
 
 	// Try to read the file - should get ErrNotExist
 	_, err = fs.OpenFile("/test.txt", os.O_RDONLY, 0)
-	if err != os.ErrNotExist {
+	if !errors.Is(err, os.ErrNotExist) {
 		t.Errorf("Expected os.ErrNotExist after Remove, got %v", err)
 	}
 }
@@ -334,7 +370,7 @@ func TestStatDeleted(t *testing.T) {
 
 	// Stat should return ErrNotExist
 	_, err := fs.Stat("/test.txt")
-	if err != os.ErrNotExist {
+	if !errors.Is(err, os.ErrNotExist) {
 		t.Errorf("Expected os.ErrNotExist for deleted file, got %v", err)
 	}
 }
@@ -462,11 +498,42 @@ func TestOpenFileDeleted(t *testing.T) {
 
 	// Try to open - should get ErrNotExist
 	_, err := fs.OpenFile("/test.txt", os.O_RDONLY, 0)
-	if err != os.ErrNotExist {
+	if !errors.Is(err, os.ErrNotExist) {
 		t.Errorf("Expected os.ErrNotExist for deleted file, got %v", err)
 	}
 }
 
+func TestMetadataOnDeleted(t *testing.T) {
+	cfs, primary, secondary := newMemOverlay(t)
+	writeMemFile(t, primary, "/a.txt", "pri")
+	if err := cfs.Remove("/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cfs.Chmod("/a.txt", 0600); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Chmod() of a deleted file = %v, want ErrNotExist", err)
+	}
+	if err := cfs.Chtimes("/a.txt", time.Now(), time.Now()); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Chtimes() of a deleted file = %v, want ErrNotExist", err)
+	}
+	if err := cfs.Truncate("/a.txt", 1); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Truncate() of a deleted file = %v, want ErrNotExist", err)
+	}
+	if _, err := secondary.Stat("/a.txt"); !os.IsNotExist(err) {
+		t.Errorf("deleted file copied up: %v", err)
+	}
+
+	f, err := cfs.OpenFile("/a.txt", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(f)
+	f.Close()
+	if len(data) != 0 {
+		t.Errorf("recreated file reads %q, want it empty", data)
+	}
+}
+
 func TestOpenFileRecreateAfterDelete(t *testing.T) {
 	primary := newMockFiler()
 	secondary := newMockFiler()
@@ -579,7 +646,7 @@ func ExampleFileSystem_Remove() {
 
 	// File appears deleted even though it's still in primary
 	_, err := fs.OpenFile("/file.txt", os.O_RDONLY, 0)
-	fmt.Println(err == os.ErrNotExist)
+	fmt.Println(errors.Is(err, os.ErrNotExist))
 	// Output: true
 }
 
@@ -677,3 +744,51 @@ func BenchmarkConcurrentReads(b *testing.B) {
 		}
 	})
 }
+
+func TestOpenFileExclusive(t *testing.T) {
+	cfs, primary, secondary := newMemOverlay(t)
+	writeMemFile(t, primary, "/primary.txt", "primary")
+	writeMemFile(t, primary, "/deleted.txt", "primary")
+	const excl = os.O_CREATE | os.O_EXCL | os.O_WRONLY
+
+	// Exists in the primary
+	if _, err := cfs.OpenFile("/primary.txt", excl, 0644); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("OpenFile(O_EXCL) of primary file error = %v, want ErrExist", err)
+	}
+	if cfs.IsModified("/primary.txt") {
+		t.Error("failed exclusive create marked the file modified")
+	}
+	if _, err := secondary.Stat("/primary.txt"); err == nil {
+		t.Error("failed exclusive create copied the file up")
+	}
+
+	// Deleted, then recreated
+	if err := cfs.Remove("/deleted.txt"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := cfs.OpenFile("/deleted.txt", excl, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile(O_EXCL) of deleted file error = %v", err)
+	}
+	f.Write([]byte("new"))
+	f.Close()
+	if data, _ := cfs.ReadFile("/deleted.txt"); string(data) != "new" {
+		t.Errorf("recreated file = %q, want new", data)
+	}
+
+	// Exists in the secondary
+	if _, err := cfs.OpenFile("/deleted.txt", excl, 0644); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("OpenFile(O_EXCL) of secondary file error = %v, want ErrExist", err)
+	}
+
+	// Dangling symbolic links are not followed
+	if err := cfs.Symlink("/missing.txt", "/link"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfs.OpenFile("/link", excl, 0644); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("OpenFile(O_EXCL) of symlink error = %v, want ErrExist", err)
+	}
+	if _, err := cfs.Stat("/missing.txt"); err == nil {
+		t.Error("exclusive create followed the symlink")
+	}
+}
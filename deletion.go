@@ -0,0 +1,159 @@
+package cowfs
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// WithDeferredDeletion makes Remove return as soon as the path is marked
+// deleted, which hides it from the merged view, and queues the removal of
+// its secondary copy instead of carrying it out. Remove latency then no
+// longer depends on the secondary. The queue is drained in order by a
+// background task once Start is called, and by Close. Stats reports its
+// length as DeletionBacklog.
+//
+// A queued removal is carried out before the path, a path below it or one of
+// its parents is created again, and before operations that work on the
+// secondary as a whole: ExportTar, ImportTar, Split, GC and
+// MergeReplicaState. Secondary space held by queued removals counts against
+// WithMaxSecondaryBytes until they are carried out.
+//
+// WithStrictErrors needs the outcome of each removal and disables deferral.
+func WithDeferredDeletion() Option {
+	return func(fs *FileSystem) {
+		fs.deletions = &deletionQueue{
+			pending: make(map[string]int),
+			wake:    make(chan struct{}, 1),
+		}
+		fs.addTask("deletions", fs.runDeletions)
+	}
+}
+
+// deletionQueue holds paths whose secondary copies are still to be removed.
+type deletionQueue struct {
+	work    sync.Mutex // Held while removals are carried out
+	mu      sync.Mutex // Protects paths and pending
+	paths   []string
+	pending map[string]int // Number of queued or running removals of each path
+	wake    chan struct{}
+}
+
+// push queues the removal of name.
+func (q *deletionQueue) push(name string) {
+	q.mu.Lock()
+	q.paths = append(q.paths, name)
+	q.pending[name]++
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pop dequeues the oldest queued removal, which stays pending until done is
+// called for it. q.work must be held.
+func (q *deletionQueue) pop() (string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.paths) == 0 {
+		return "", false
+	}
+	name := q.paths[0]
+	q.paths[0] = ""
+	q.paths = q.paths[1:]
+	return name, true
+}
+
+// done records that the removal of name popped from the queue was carried
+// out.
+func (q *deletionQueue) done(name string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.pending[name]--; q.pending[name] == 0 {
+		delete(q.pending, name)
+	}
+}
+
+// len returns the number of queued removals.
+func (q *deletionQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.paths)
+}
+
+// affects reports whether a queued or running removal concerns name, one
+// of its parents or a path below it.
+func (q *deletionQueue) affects(name string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for p := range q.pending {
+		if p == name || strings.HasPrefix(name, p+"/") || strings.HasPrefix(p, name+"/") ||
+			p == "/" || name == "/" {
+			return true
+		}
+	}
+	return false
+}
+
+// runDeletions is the background task draining the deletion queue.
+func (cfs *FileSystem) runDeletions(ctx context.Context) error {
+	q := cfs.deletions
+	for {
+		cfs.flushDeletions()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-q.wake:
+		}
+	}
+}
+
+// flushDeletions carries out all queued removals.
+func (cfs *FileSystem) flushDeletions() {
+	q := cfs.deletions
+	if q == nil {
+		return
+	}
+	q.work.Lock()
+	defer q.work.Unlock()
+	for {
+		name, ok := q.pop()
+		if !ok {
+			return
+		}
+		cfs.purge(name)
+		q.done(name)
+	}
+}
+
+// settle carries out the queued removals before name is created in the
+// secondary, if any of them concern it, waiting for one already running.
+func (cfs *FileSystem) settle(names ...string) {
+	q := cfs.deletions
+	if q == nil {
+		return
+	}
+	for _, name := range names {
+		if q.affects(name) {
+			cfs.flushDeletions()
+			return
+		}
+	}
+}
+
+// purge removes the secondary copy of the deleted path name. Paths that
+// have been recreated since they were queued are left alone.
+func (cfs *FileSystem) purge(name string) {
+	if !cfs.isDeletedPath(name) {
+		return
+	}
+	size := cfs.secondarySize(name)
+	cfs.counters.secondary.meta()
+	err := cfs.secondary.Remove(name)
+	if err == nil {
+		cfs.adjustQuota("remove", name, -size)
+		err = cfs.syncDirs(name)
+	}
+	cfs.debug("cowfs: deferred remove", "path", name, "secondaryErr", err)
+}
@@ -0,0 +1,169 @@
+package cowfs
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/absfs/memfs"
+)
+
+func newDeferredOverlay(t *testing.T) (*FileSystem, *memfs.FileSystem, *memfs.FileSystem) {
+	t.Helper()
+	primary, _ := memfs.NewFS()
+	secondary, _ := memfs.NewFS()
+	return New(primary, secondary, WithDeferredDeletion()), primary, secondary
+}
+
+func TestDeferredDeletion(t *testing.T) {
+	cfs, primary, secondary := newDeferredOverlay(t)
+	writeMemFile(t, primary, "/a.txt", "primary")
+	if err := cfs.WriteFile("/a.txt", []byte("modified"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.WriteFile("/b.txt", []byte("created"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cfs.Remove("/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Remove("/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	// Hidden at once, removed from the secondary later
+	if _, err := cfs.Stat("/a.txt"); !os.IsNotExist(err) {
+		t.Errorf("Stat() of removed file error = %v, want not exist", err)
+	}
+	if _, err := secondary.Stat("/a.txt"); err != nil {
+		t.Error("secondary copy removed before the queue was drained")
+	}
+	if s := cfs.Stats(); s.DeletionBacklog != 2 || s.DeferredDeletions != 2 {
+		t.Errorf("backlog = %d, queued = %d, want 2 and 2", s.DeletionBacklog, s.DeferredDeletions)
+	}
+
+	// Recreating a path carries out its removal first
+	f, err := cfs.OpenFile("/a.txt", os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("new"))
+	f.Close()
+	if data, _ := cfs.ReadFile("/a.txt"); string(data) != "new" {
+		t.Errorf("recreated file = %q, want new", data)
+	}
+	if s := cfs.Stats(); s.DeletionBacklog != 0 {
+		t.Errorf("backlog after recreate = %d, want 0", s.DeletionBacklog)
+	}
+	if _, err := secondary.Stat("/b.txt"); err == nil {
+		t.Error("queue not drained in order")
+	}
+
+	// Close drains the queue
+	cfs.Remove("/a.txt")
+	if err := cfs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := secondary.Stat("/a.txt"); err == nil {
+		t.Error("Close() left a queued removal")
+	}
+	if data, _ := primary.ReadFile("/a.txt"); string(data) != "primary" {
+		t.Error("primary was modified")
+	}
+}
+
+func TestDeferredDeletionBackground(t *testing.T) {
+	cfs, _, secondary := newDeferredOverlay(t)
+	cfs.Mkdir("/dir", 0755)
+	cfs.WriteFile("/dir/f", []byte("data"), 0644)
+	if err := cfs.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer cfs.Close()
+
+	cfs.Remove("/dir/f")
+	cfs.Remove("/dir")
+	deadline := time.Now().Add(time.Second)
+	for cfs.Stats().DeletionBacklog > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := secondary.Stat("/dir"); err == nil {
+		t.Error("background task did not remove the queued paths")
+	}
+}
+
+func TestDeferredDeletionStrict(t *testing.T) {
+	primary, _ := memfs.NewFS()
+	secondary, _ := memfs.NewFS()
+	cfs := New(primary, secondary, WithDeferredDeletion(), WithStrictErrors())
+	cfs.WriteFile("/a.txt", []byte("data"), 0644)
+
+	if err := cfs.Remove("/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := secondary.Stat("/a.txt"); err == nil {
+		t.Error("strict Remove was deferred")
+	}
+}
+
+// gatedFiler blocks the first Remove until release is closed, reporting on
+// entered that it started.
+type gatedFiler struct {
+	*lockedFiler
+	once    sync.Once
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (g *gatedFiler) Remove(name string) error {
+	g.once.Do(func() {
+		close(g.entered)
+		<-g.release
+	})
+	return g.lockedFiler.Remove(name)
+}
+
+func TestDeferredDeletionRecreateDuringPurge(t *testing.T) {
+	secondary := &gatedFiler{
+		lockedFiler: &lockedFiler{Filer: must(memfs.NewFS())},
+		entered:     make(chan struct{}),
+		release:     make(chan struct{}),
+	}
+	cfs := New(must(memfs.NewFS()), secondary, WithDeferredDeletion())
+	if err := cfs.WriteFile("/a.txt", []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Remove("/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	flushed := make(chan struct{})
+	go func() {
+		cfs.flushDeletions()
+		close(flushed)
+	}()
+	<-secondary.entered
+
+	// Create the path again while its removal is running
+	created := make(chan error)
+	go func() {
+		f, err := cfs.OpenFile("/a.txt", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err == nil {
+			_, err = f.Write([]byte("new"))
+			f.Close()
+		}
+		created <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(secondary.release)
+	if err := <-created; err != nil {
+		t.Fatal(err)
+	}
+	<-flushed
+
+	if data, err := cfs.ReadFile("/a.txt"); err != nil || string(data) != "new" {
+		t.Errorf("ReadFile() = %q, %v, want the recreated file", data, err)
+	}
+}
@@ -0,0 +1,429 @@
+package cowfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+
+	"github.com/absfs/absfs"
+)
+
+// ErrDeltaBaseChanged is returned when reading a delta-encoded file whose
+// primary version has changed since the delta was recorded, so the original
+// content can no longer be reconstructed.
+var ErrDeltaBaseChanged = errors.New("cowfs: primary changed under delta-encoded file")
+
+const (
+	deltaMagic     = "COWFSDLT"
+	deltaBlockSize = 32 << 10
+)
+
+// WithDeltaThreshold stores modified files whose primary version is at least
+// threshold bytes as block-level deltas against the primary instead of full
+// copies. The delta is computed when a writable handle is closed or a
+// metadata change is applied, and is only kept if it is less than half the
+// size of the file; content is reconstructed transparently on read.
+//
+// Delta encoding assumes the primary is not modified underneath the overlay;
+// reading a delta-encoded file whose primary changed fails with
+// ErrDeltaBaseChanged.
+func WithDeltaThreshold(threshold int64) Option {
+	return func(fs *FileSystem) {
+		fs.deltaThreshold = threshold
+		fs.deltas = make(map[string]bool)
+	}
+}
+
+// delta describes a file as a set of changed blocks over a primary base.
+type delta struct {
+	base    fingerprint      // Primary version the delta applies to
+	size    int64            // Size of the reconstructed file
+	patches map[int64][]byte // Changed block contents keyed by block index
+}
+
+// isDelta reports whether the secondary copy of name is delta-encoded.
+func (cfs *FileSystem) isDelta(name string) bool {
+	if cfs.deltas == nil {
+		return false
+	}
+	cfs.mu.RLock()
+	defer cfs.mu.RUnlock()
+	return cfs.deltas[name]
+}
+
+func (cfs *FileSystem) setDelta(name string, encoded bool) {
+	if cfs.deltas == nil {
+		return
+	}
+	cfs.mu.Lock()
+	if encoded {
+		cfs.deltas[name] = true
+	} else {
+		delete(cfs.deltas, name)
+	}
+	cfs.mu.Unlock()
+}
+
+// encodeDelta replaces the full secondary copy of name with a delta against
+// the primary when delta encoding is enabled, the file is large enough and
+// the delta is small enough to be worthwhile. Failures leave the full copy in
+// place.
+func (cfs *FileSystem) encodeDelta(name string) {
+	if cfs.deltas == nil || cfs.isDelta(name) {
+		return
+	}
+	base, err := cfs.primary.Stat(name)
+	if err != nil || !base.Mode().IsRegular() || base.Size() < cfs.deltaThreshold {
+		return
+	}
+	info, err := cfs.secondary.Stat(name)
+	if err != nil || !info.Mode().IsRegular() {
+		return
+	}
+	// Replacing the file with its delta would break its hard links
+	if _, nlink, ok := fileIDOf(info); ok && nlink > 1 {
+		return
+	}
+
+	d, ok := cfs.diffBlocks(name, fingerprintOf(base), info.Size())
+	if !ok {
+		return
+	}
+
+	tmp := name + ".cowfs-delta~"
+	f, err := cfs.secondary.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return
+	}
+	w := bufio.NewWriter(f)
+	err = d.writeTo(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil && cfs.durability != DurabilityNone {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		cfs.secondary.Chmod(tmp, info.Mode())
+		cfs.secondary.Chtimes(tmp, info.ModTime(), info.ModTime())
+		err = replaceFile(cfs.secondary, tmp, name)
+	}
+	if err != nil {
+		cfs.secondary.Remove(tmp)
+		return
+	}
+	cfs.syncDirs(name)
+	cfs.adjustQuota("write", name, cfs.secondarySize(name)-info.Size())
+	cfs.setDelta(name, true)
+}
+
+// diffBlocks compares the secondary copy of name with its primary base block
+// by block. It reports false if the changed blocks amount to half the file or
+// more.
+func (cfs *FileSystem) diffBlocks(name string, base fingerprint, size int64) (*delta, bool) {
+	pf, err := cfs.primary.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, false
+	}
+	defer pf.Close()
+	sf, err := cfs.secondary.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, false
+	}
+	defer sf.Close()
+
+	d := &delta{base: base, size: size, patches: make(map[int64][]byte)}
+	var changed int64
+	pbuf := make([]byte, deltaBlockSize)
+	sbuf := make([]byte, deltaBlockSize)
+	for idx := int64(0); idx*deltaBlockSize < size; idx++ {
+		sn, err := io.ReadFull(sf, sbuf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, false
+		}
+		pn, err := io.ReadFull(pf, pbuf)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return nil, false
+		}
+		if pn != sn || !bytes.Equal(pbuf[:pn], sbuf[:sn]) {
+			d.patches[idx] = append([]byte(nil), sbuf[:sn]...)
+			changed += int64(sn)
+			if changed*2 >= size {
+				return nil, false
+			}
+		}
+	}
+	return d, true
+}
+
+// materialize replaces a delta-encoded secondary copy of name with the full
+// reconstructed content so it can be modified in place.
+func (cfs *FileSystem) materialize(name string) error {
+	if !cfs.isDelta(name) {
+		return nil
+	}
+	info, err := cfs.secondary.Stat(name)
+	if err != nil {
+		return err
+	}
+	src, err := cfs.openDelta(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	growth := src.info.Size() - info.Size()
+	if err := cfs.adjustQuota("write", name, growth); err != nil {
+		return err
+	}
+
+	tmp := name + ".cowfs-delta~"
+	dst, err := cfs.secondary.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = cfs.copyBuffers().copy(dst, src)
+	if err == nil && cfs.durability != DurabilityNone {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		cfs.secondary.Chmod(tmp, info.Mode())
+		err = replaceFile(cfs.secondary, tmp, name)
+	}
+	if err == nil {
+		err = cfs.syncDirs(name)
+	}
+	if err != nil {
+		cfs.secondary.Remove(tmp)
+		cfs.adjustQuota("write", name, -growth)
+		return err
+	}
+	cfs.setDelta(name, false)
+	return nil
+}
+
+// openDelta opens a read-only view of the delta-encoded file name.
+func (cfs *FileSystem) openDelta(name string) (*deltaFile, error) {
+	sf, err := cfs.secondary.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	info, err := sf.Stat()
+	if err != nil {
+		sf.Close()
+		return nil, err
+	}
+	d, err := readDelta(bufio.NewReader(sf))
+	sf.Close()
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	base, err := cfs.primary.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	baseInfo, err := base.Stat()
+	if err != nil || fingerprintOf(baseInfo) != d.base {
+		base.Close()
+		return nil, &os.PathError{Op: "open", Path: name, Err: ErrDeltaBaseChanged}
+	}
+	return &deltaFile{
+		name:  name,
+		base:  base,
+		delta: d,
+		info:  deltaInfo{FileInfo: info, size: d.size},
+	}, nil
+}
+
+// deltaStat returns file info for a delta-encoded file, reporting the size of
+// the reconstructed content.
+func (cfs *FileSystem) deltaStat(name string) (os.FileInfo, error) {
+	f, err := cfs.openDelta(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.info, nil
+}
+
+// secondaryInfo returns the info to list for name given the secondary's
+// info, which describes the encoded delta for files stored as deltas.
+func (cfs *FileSystem) secondaryInfo(name string, info os.FileInfo) os.FileInfo {
+	if cfs.isDelta(name) {
+		if di, err := cfs.deltaStat(name); err == nil {
+			return di
+		}
+	}
+	return info
+}
+
+func (d *delta) writeTo(w io.Writer) error {
+	hdr := []int64{d.base.size, d.base.modTime, d.size, deltaBlockSize, int64(len(d.patches))}
+	if _, err := io.WriteString(w, deltaMagic); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, hdr); err != nil {
+		return err
+	}
+	for idx, data := range d.patches {
+		if err := binary.Write(w, binary.LittleEndian, []int64{idx, int64(len(data))}); err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readDelta(r io.Reader) (*delta, error) {
+	magic := make([]byte, len(deltaMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != deltaMagic {
+		return nil, errors.New("cowfs: corrupt delta")
+	}
+	hdr := make([]int64, 5)
+	if err := binary.Read(r, binary.LittleEndian, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[3] != deltaBlockSize {
+		return nil, errors.New("cowfs: unsupported delta block size")
+	}
+	d := &delta{
+		base:    fingerprint{size: hdr[0], modTime: hdr[1]},
+		size:    hdr[2],
+		patches: make(map[int64][]byte, hdr[4]),
+	}
+	for i := int64(0); i < hdr[4]; i++ {
+		rec := make([]int64, 2)
+		if err := binary.Read(r, binary.LittleEndian, rec); err != nil {
+			return nil, err
+		}
+		if rec[1] < 0 || rec[1] > deltaBlockSize {
+			return nil, errors.New("cowfs: corrupt delta")
+		}
+		data := make([]byte, rec[1])
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		d.patches[rec[0]] = data
+	}
+	return d, nil
+}
+
+// deltaInfo reports the reconstructed size of a delta-encoded file.
+type deltaInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (i deltaInfo) Size() int64 { return i.size }
+
+// deltaFile is a read-only file reconstructing content from a primary base
+// and a delta.
+type deltaFile struct {
+	name   string
+	base   absfs.File
+	delta  *delta
+	info   os.FileInfo
+	offset int64
+}
+
+func (f *deltaFile) Name() string               { return f.name }
+func (f *deltaFile) Close() error               { return f.base.Close() }
+func (f *deltaFile) Sync() error                { return nil }
+func (f *deltaFile) Stat() (os.FileInfo, error) { return f.info, nil }
+
+func (f *deltaFile) Read(b []byte) (int, error) {
+	n, err := f.ReadAt(b, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *deltaFile) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, &os.PathError{Op: "readat", Path: f.name, Err: syscall.EINVAL}
+	}
+	n := 0
+	for n < len(b) && off < f.delta.size {
+		idx, within := off/deltaBlockSize, off%deltaBlockSize
+		want := int64(len(b) - n)
+		if rest := deltaBlockSize - within; want > rest {
+			want = rest
+		}
+		if rest := f.delta.size - off; want > rest {
+			want = rest
+		}
+		var m int
+		if patch, ok := f.delta.patches[idx]; ok {
+			m = copy(b[n:n+int(want)], patch[within:])
+		} else {
+			var err error
+			m, err = f.base.ReadAt(b[n:n+int(want)], off)
+			if m == 0 && err != nil {
+				return n, err
+			}
+		}
+		n += m
+		off += int64(m)
+	}
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *deltaFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.delta.size
+	}
+	if offset < 0 {
+		return f.offset, &os.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *deltaFile) Write(b []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.name, Err: syscall.EBADF}
+}
+
+func (f *deltaFile) WriteAt(b []byte, off int64) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.name, Err: syscall.EBADF}
+}
+
+func (f *deltaFile) WriteString(s string) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.name, Err: syscall.EBADF}
+}
+
+func (f *deltaFile) Truncate(size int64) error {
+	return &os.PathError{Op: "truncate", Path: f.name, Err: syscall.EBADF}
+}
+
+func (f *deltaFile) Readdir(int) ([]os.FileInfo, error) {
+	return nil, &os.PathError{Op: "readdir", Path: f.name, Err: syscall.ENOTDIR}
+}
+
+func (f *deltaFile) Readdirnames(int) ([]string, error) {
+	return nil, &os.PathError{Op: "readdir", Path: f.name, Err: syscall.ENOTDIR}
+}
+
+func (f *deltaFile) ReadDir(int) ([]fs.DirEntry, error) {
+	return nil, &os.PathError{Op: "readdir", Path: f.name, Err: syscall.ENOTDIR}
+}
@@ -0,0 +1,145 @@
+package cowfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+func newDeltaOverlay(t *testing.T, size int) (*FileSystem, []byte) {
+	t.Helper()
+	cfs, primary, _ := newMemOverlay(t)
+	WithDeltaThreshold(64 << 10)(cfs)
+
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	writeMemFile(t, primary, "/big.bin", string(data))
+	return cfs, data
+}
+
+func TestDeltaStorage(t *testing.T) {
+	cfs, want := newDeltaOverlay(t, 256<<10)
+
+	f, err := cfs.OpenFile("/big.bin", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("patched"), 100000); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	copy(want[100000:], "patched")
+
+	if !cfs.isDelta("/big.bin") {
+		t.Fatal("large file with a small edit was not delta-encoded")
+	}
+	raw, _ := cfs.secondary.Stat("/big.bin")
+	if raw.Size() >= int64(len(want))/2 {
+		t.Errorf("secondary copy is %d bytes, want a small delta", raw.Size())
+	}
+
+	got, err := cfs.ReadFile("/big.bin")
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("ReadFile() did not reconstruct the modified content")
+	}
+	info, err := cfs.Stat("/big.bin")
+	if err != nil || info.Size() != int64(len(want)) {
+		t.Errorf("Stat() = %v, %v, want size %d", info, err, len(want))
+	}
+	entries, _ := cfs.ReadDir("/")
+	if len(entries) != 1 {
+		t.Fatalf("ReadDir() returned %d entries, want 1", len(entries))
+	}
+	if info, _ := entries[0].Info(); info.Size() != int64(len(want)) {
+		t.Errorf("ReadDir() size = %d, want %d", info.Size(), len(want))
+	}
+
+	r, err := cfs.OpenFile("/big.bin", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Seek(99990, io.SeekStart)
+	buf := make([]byte, 20)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if !bytes.Equal(buf, want[99990:100010]) {
+		t.Errorf("read across patched block = %q, want %q", buf, want[99990:100010])
+	}
+}
+
+func TestDeltaRewriteAndTruncate(t *testing.T) {
+	cfs, want := newDeltaOverlay(t, 128<<10)
+	if err := cfs.Chmod("/big.bin", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if !cfs.isDelta("/big.bin") {
+		t.Fatal("metadata change did not produce a delta")
+	}
+
+	f, err := cfs.OpenFile("/big.bin", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("tail"))
+	f.Close()
+	want = append(want, "tail"...)
+	if got, _ := cfs.ReadFile("/big.bin"); !bytes.Equal(got, want) {
+		t.Error("ReadFile() after append does not match")
+	}
+
+	if err := cfs.Truncate("/big.bin", 1000); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := cfs.ReadFile("/big.bin"); !bytes.Equal(got, want[:1000]) {
+		t.Errorf("ReadFile() after Truncate returned %d bytes", len(got))
+	}
+}
+
+func TestDeltaRenameMaterializes(t *testing.T) {
+	cfs, want := newDeltaOverlay(t, 128<<10)
+	cfs.Chmod("/big.bin", 0600)
+
+	if err := cfs.Rename("/big.bin", "/moved.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if cfs.isDelta("/big.bin") || cfs.isDelta("/moved.bin") {
+		t.Error("renamed file is still delta-encoded")
+	}
+	if got, _ := cfs.ReadFile("/moved.bin"); !bytes.Equal(got, want) {
+		t.Error("ReadFile() after Rename does not match")
+	}
+}
+
+func TestDeltaBaseChanged(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	WithDeltaThreshold(1)(cfs)
+	writeMemFile(t, primary, "/file", "original content")
+	cfs.Chmod("/file", 0600)
+
+	writeMemFile(t, primary, "/file", "changed underneath")
+	if _, err := cfs.ReadFile("/file"); !errors.Is(err, ErrDeltaBaseChanged) {
+		t.Errorf("ReadFile() error = %v, want ErrDeltaBaseChanged", err)
+	}
+}
+
+func TestDeltaSkippedForLargeEdits(t *testing.T) {
+	cfs, want := newDeltaOverlay(t, 128<<10)
+	f, _ := cfs.OpenFile("/big.bin", os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
+	f.Write(want[:1000])
+	f.Close()
+
+	if cfs.isDelta("/big.bin") {
+		t.Error("rewritten file was delta-encoded")
+	}
+}
@@ -0,0 +1,265 @@
+package cowfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+)
+
+// Diff returns the differences between the primary and merged versions of
+// the regular file name as a unified diff, with the versions named a/name
+// and b/name, or /dev/null where one is missing or deleted. Files whose
+// content either version shows to be binary, as decided by Classify, are
+// summarized in a single "Binary files ... differ" line. The result is empty
+// for unchanged files and paths that are not regular files in either
+// version.
+func (cfs *FileSystem) Diff(name string) (_ string, err error) {
+	defer wrapErr(&err, "diff", name)
+	clean := cfs.normalize(name)
+	if err := cfs.access(OpRead, clean); err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := cfs.diff(&b, clean); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// DiffAll writes the diffs of every modified, created and deleted file to w
+// in path order, in the format of Diff, for reviewing the overlay's changes
+// before they are committed.
+func (cfs *FileSystem) DiffAll(w io.Writer) error {
+	modified, deleted := cfs.state()
+	names := append(modified, deleted...)
+	sort.Strings(names)
+	for _, name := range names {
+		if err := cfs.diff(w, name); err != nil {
+			return pathError("diff", name, err)
+		}
+	}
+	return nil
+}
+
+// diff writes the diff of name to w.
+func (cfs *FileSystem) diff(w io.Writer, name string) error {
+	old, hasOld, err := readRegular(cfs.primary, name)
+	if err != nil {
+		return err
+	}
+	var new []byte
+	hasNew := false
+	if !cfs.IsDeleted(name) {
+		if new, hasNew, err = readRegular(cfs, name); err != nil {
+			return err
+		}
+	}
+	if !hasOld && !hasNew {
+		return nil // Not a regular file in either version
+	}
+	oldName, newName := "/dev/null", "/dev/null"
+	if hasOld {
+		oldName = "a" + name
+	}
+	if hasNew {
+		newName = "b" + name
+	}
+	if isBinary(old) || isBinary(new) {
+		if bytes.Equal(old, new) {
+			return nil
+		}
+		_, err := fmt.Fprintf(w, "Binary files %s and %s differ\n", oldName, newName)
+		return err
+	}
+	return writeUnified(w, oldName, newName, old, new)
+}
+
+// readRegular returns the contents of name in fsys, reporting whether it is
+// a regular file there.
+func readRegular(fsys interface {
+	Stat(name string) (fs.FileInfo, error)
+	ReadFile(name string) ([]byte, error)
+}, name string) ([]byte, bool, error) {
+	info, err := fsys.Stat(name)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && !info.Mode().IsRegular()) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	data, err := fsys.ReadFile(name)
+	return data, true, err
+}
+
+// isBinary reports whether Classify would find data binary.
+func isBinary(data []byte) bool {
+	if len(data) > classifySample {
+		return classifyContent(data[:classifySample], false) == KindBinary
+	}
+	return classifyContent(data, true) == KindBinary
+}
+
+// diffContext is the number of unchanged lines shown around each change.
+const diffContext = 3
+
+// edit is one line of an edit script: ' ' for a line both versions share,
+// '-' for a line only the old version has and '+' for one only the new
+// version has.
+type edit struct {
+	kind byte
+	text string
+}
+
+// splitLines splits data into lines, each keeping its newline.
+func splitLines(data []byte) []string {
+	var lines []string
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n') + 1
+		if i == 0 {
+			i = len(data)
+		}
+		lines = append(lines, string(data[:i]))
+		data = data[i:]
+	}
+	return lines
+}
+
+// diffLines returns a shortest edit script turning a into b, using Myers'
+// algorithm.
+func diffLines(a, b []string) []edit {
+	n, m := len(a), len(b)
+	max := n + m
+	offset := max + 1
+	v := make([]int, 2*max+3)
+	var trace [][]int
+search:
+	for d := 0; d <= max; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				break search
+			}
+		}
+	}
+
+	// Walk the trace back from the end, collecting edits in reverse
+	var edits []edit
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		v := trace[d]
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			prevK = k + 1
+		}
+		prevX := v[offset+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			edits = append(edits, edit{' ', a[x-1]})
+			x, y = x-1, y-1
+		}
+		if x == prevX {
+			edits = append(edits, edit{'+', b[y-1]})
+			y--
+		} else {
+			edits = append(edits, edit{'-', a[x-1]})
+			x--
+		}
+	}
+	for x > 0 && y > 0 {
+		edits = append(edits, edit{' ', a[x-1]})
+		x, y = x-1, y-1
+	}
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits
+}
+
+// writeUnified writes the differences between old and new as a unified
+// diff with the given file names. Nothing is written if they are equal.
+func writeUnified(w io.Writer, oldName, newName string, old, new []byte) error {
+	edits := diffLines(splitLines(old), splitLines(new))
+	// Lines of each version consumed before each edit
+	aPos := make([]int, len(edits)+1)
+	bPos := make([]int, len(edits)+1)
+	var changes []int
+	for i, e := range edits {
+		aPos[i+1], bPos[i+1] = aPos[i], bPos[i]
+		if e.kind != '+' {
+			aPos[i+1]++
+		}
+		if e.kind != '-' {
+			bPos[i+1]++
+		}
+		if e.kind != ' ' {
+			changes = append(changes, i)
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	if _, err := fmt.Fprintf(w, "--- %s\n+++ %s\n", oldName, newName); err != nil {
+		return err
+	}
+
+	for c := 0; c < len(changes); {
+		// Extend the hunk over changes whose contexts overlap
+		last := c
+		for last+1 < len(changes) && changes[last+1]-changes[last] <= 2*diffContext {
+			last++
+		}
+		start := changes[c] - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := changes[last] + diffContext + 1
+		if end > len(edits) {
+			end = len(edits)
+		}
+		c = last + 1
+
+		if _, err := fmt.Fprintf(w, "@@ -%s +%s @@\n",
+			hunkRange(aPos[start], aPos[end]-aPos[start]),
+			hunkRange(bPos[start], bPos[end]-bPos[start])); err != nil {
+			return err
+		}
+		for _, e := range edits[start:end] {
+			line := string(e.kind) + e.text
+			if line[len(line)-1] != '\n' {
+				line += "\n\\ No newline at end of file\n"
+			}
+			if _, err := io.WriteString(w, line); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// hunkRange formats the line range of a hunk starting after line pos and
+// spanning n lines.
+func hunkRange(pos, n int) string {
+	if n == 0 {
+		return fmt.Sprintf("%d,0", pos)
+	}
+	if n == 1 {
+		return fmt.Sprint(pos + 1)
+	}
+	return fmt.Sprintf("%d,%d", pos+1, n)
+}
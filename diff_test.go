@@ -0,0 +1,82 @@
+package cowfs
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	writeMemFile(t, primary, "/edit.txt", "one\ntwo\nthree\n")
+	writeMemFile(t, primary, "/gone.txt", "gone\n")
+	writeMemFile(t, primary, "/same.txt", "same\n")
+	writeMemFile(t, primary, "/image.bin", "\x00\x01")
+	cfs.WriteFile("/edit.txt", []byte("one\n2\nthree\n"), 0644)
+	cfs.WriteFile("/new.txt", []byte("new"), 0644)
+	cfs.WriteFile("/image.bin", []byte("\x00\x02"), 0644)
+	cfs.Remove("/gone.txt")
+	cfs.Chmod("/same.txt", 0600)
+
+	got, err := cfs.Diff("/edit.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "--- a/edit.txt\n+++ b/edit.txt\n@@ -1,3 +1,3 @@\n one\n-two\n+2\n three\n"
+	if got != want {
+		t.Errorf("Diff(/edit.txt) =\n%s\nwant\n%s", got, want)
+	}
+	if got, _ := cfs.Diff("/same.txt"); got != "" {
+		t.Errorf("Diff() of an unchanged file = %q, want nothing", got)
+	}
+
+	var buf bytes.Buffer
+	if err := cfs.DiffAll(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want = strings.Join([]string{
+		"--- a/edit.txt",
+		"+++ b/edit.txt",
+		"@@ -1,3 +1,3 @@",
+		" one",
+		"-two",
+		"+2",
+		" three",
+		"--- a/gone.txt",
+		"+++ /dev/null",
+		"@@ -1 +0,0 @@",
+		"-gone",
+		"Binary files a/image.bin and b/image.bin differ",
+		"--- /dev/null",
+		"+++ b/new.txt",
+		"@@ -0,0 +1 @@",
+		"+new",
+		`\ No newline at end of file`,
+		"",
+	}, "\n")
+	if got := buf.String(); got != want {
+		t.Errorf("DiffAll() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestDiffHunks(t *testing.T) {
+	var old, new []string
+	for i := 1; i <= 20; i++ {
+		line := strings.Repeat("x", i)
+		old = append(old, line)
+		if i != 2 && i != 18 {
+			new = append(new, line)
+		}
+	}
+	var buf bytes.Buffer
+	writeUnified(&buf, "a", "b", []byte(strings.Join(old, "\n")), []byte(strings.Join(new, "\n")+"\nend"))
+	out := buf.String()
+	if n := strings.Count(out, "@@ -"); n != 2 {
+		t.Errorf("wrote %d hunks, want 2:\n%s", n, out)
+	}
+	for _, want := range []string{"@@ -1,5 +1,4 @@", "@@ -15,6 +14,6 @@", "-xx\n", "+end\n\\ No newline at end of file\n"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("diff missing %q:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// Package dirfs implements an absfs.Filer rooted at a directory of the host
+// filesystem. It is a minimal layer for building cowfs overlays over on-disk
+// trees: paths are slash-separated and interpreted relative to the root, and
+// ".." cannot escape it. Files are backed by *os.File, so copy-up strategies
+// that need operating system file descriptors, such as cowfs.Reflink, work
+// with it.
+package dirfs
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// FileSystem is an absfs.Filer over a host directory.
+type FileSystem struct {
+	root string
+}
+
+// New returns a FileSystem rooted at dir, which must be an existing
+// directory.
+func New(dir string) (*FileSystem, error) {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: fs.ErrInvalid}
+	}
+	return &FileSystem{root: root}, nil
+}
+
+// Root returns the host directory the filesystem is rooted at.
+func (d *FileSystem) Root() string {
+	return d.root
+}
+
+// HostPath returns the host path backing name.
+func (d *FileSystem) HostPath(name string) string {
+	return filepath.Join(d.root, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+// File is an open file. It embeds *os.File but reports the name it was
+// opened with rather than the host path.
+type File struct {
+	*os.File
+	name string
+}
+
+// Name returns the name of the file as presented to OpenFile.
+func (f *File) Name() string {
+	return f.name
+}
+
+// OpenFile opens the named file with the given flags and permissions.
+func (d *FileSystem) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	f, err := os.OpenFile(d.HostPath(name), flag, perm)
+	if err != nil {
+		return nil, d.fixErr(err, name)
+	}
+	return &File{File: f, name: name}, nil
+}
+
+// Mkdir creates the named directory.
+func (d *FileSystem) Mkdir(name string, perm os.FileMode) error {
+	return d.fixErr(os.Mkdir(d.HostPath(name), perm), name)
+}
+
+// Remove removes the named file or empty directory.
+func (d *FileSystem) Remove(name string) error {
+	return d.fixErr(os.Remove(d.HostPath(name)), name)
+}
+
+// Rename renames oldpath to newpath, replacing newpath if it exists.
+func (d *FileSystem) Rename(oldpath, newpath string) error {
+	err := os.Rename(d.HostPath(oldpath), d.HostPath(newpath))
+	if le, ok := err.(*os.LinkError); ok {
+		le.Old, le.New = oldpath, newpath
+	}
+	return err
+}
+
+// Link creates newname as a hard link to oldname.
+func (d *FileSystem) Link(oldname, newname string) error {
+	err := os.Link(d.HostPath(oldname), d.HostPath(newname))
+	if le, ok := err.(*os.LinkError); ok {
+		le.Old, le.New = oldname, newname
+	}
+	return err
+}
+
+// Stat returns file info for the named file.
+func (d *FileSystem) Stat(name string) (os.FileInfo, error) {
+	info, err := os.Stat(d.HostPath(name))
+	return info, d.fixErr(err, name)
+}
+
+// Chmod changes the mode of the named file.
+func (d *FileSystem) Chmod(name string, mode os.FileMode) error {
+	return d.fixErr(os.Chmod(d.HostPath(name), mode), name)
+}
+
+// Chtimes changes the access and modification times of the named file.
+func (d *FileSystem) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return d.fixErr(os.Chtimes(d.HostPath(name), atime, mtime), name)
+}
+
+// Chown changes the owner and group of the named file.
+func (d *FileSystem) Chown(name string, uid, gid int) error {
+	return d.fixErr(os.Chown(d.HostPath(name), uid, gid), name)
+}
+
+// ReadDir reads the named directory, returning entries sorted by name.
+func (d *FileSystem) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := os.ReadDir(d.HostPath(name))
+	return entries, d.fixErr(err, name)
+}
+
+// ReadFile reads the named file and returns its contents.
+func (d *FileSystem) ReadFile(name string) ([]byte, error) {
+	data, err := os.ReadFile(d.HostPath(name))
+	return data, d.fixErr(err, name)
+}
+
+// Sub returns an fs.FS corresponding to the subtree rooted at dir.
+func (d *FileSystem) Sub(dir string) (fs.FS, error) {
+	return absfs.FilerToFS(d, dir)
+}
+
+// fixErr replaces the host path in a *os.PathError with name.
+func (d *FileSystem) fixErr(err error, name string) error {
+	if pe, ok := err.(*os.PathError); ok {
+		pe.Path = name
+	}
+	return err
+}
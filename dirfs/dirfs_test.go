@@ -0,0 +1,83 @@
+package dirfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileSystem(t *testing.T) {
+	root := t.TempDir()
+	d, err := New(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Mkdir("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := d.OpenFile("/dir/file.txt", os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Name() != "/dir/file.txt" {
+		t.Errorf("Name() = %q, want the virtual path", f.Name())
+	}
+	f.Write([]byte("hello"))
+	f.Close()
+
+	data, err := os.ReadFile(filepath.Join(root, "dir", "file.txt"))
+	if err != nil || string(data) != "hello" {
+		t.Errorf("host file = %q, %v", data, err)
+	}
+	if entries, err := d.ReadDir("/dir"); err != nil || len(entries) != 1 {
+		t.Errorf("ReadDir() = %v, %v", entries, err)
+	}
+	if err := d.Rename("/dir/file.txt", "/moved.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Stat("/dir/file.txt"); !os.IsNotExist(err) {
+		t.Errorf("Stat(old name) error = %v", err)
+	}
+}
+
+func TestConfinement(t *testing.T) {
+	root := t.TempDir()
+	d, _ := New(filepath.Join(root))
+	if got, want := d.HostPath("/../../etc/passwd"), filepath.Join(root, "etc", "passwd"); got != want {
+		t.Errorf("HostPath() = %q, want %q", got, want)
+	}
+}
+
+func TestErrorPaths(t *testing.T) {
+	d, _ := New(t.TempDir())
+	_, err := d.Stat("/missing")
+	pe, ok := err.(*os.PathError)
+	if !ok || pe.Path != "/missing" {
+		t.Errorf("Stat() error = %v, want PathError naming the virtual path", err)
+	}
+}
+
+func TestLink(t *testing.T) {
+	d, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := d.OpenFile("/a", os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := d.Link("/a", "/b"); err != nil {
+		t.Fatal(err)
+	}
+	a, _ := d.Stat("/a")
+	b, _ := d.Stat("/b")
+	if !os.SameFile(a, b) {
+		t.Error("/a and /b are not the same file")
+	}
+	err = d.Link("/missing", "/c")
+	if le, ok := err.(*os.LinkError); !ok || le.Old != "/missing" {
+		t.Errorf("Link error = %v, want LinkError with virtual paths", err)
+	}
+}
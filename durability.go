@@ -0,0 +1,126 @@
+package cowfs
+
+import (
+	"io"
+	"os"
+	"path"
+
+	"github.com/absfs/absfs"
+)
+
+// Durability selects when the overlay flushes secondary data to stable
+// storage.
+type Durability int
+
+const (
+	// DurabilityNone never syncs. Data reaches stable storage whenever the
+	// secondary filesystem gets around to it. This is the default.
+	DurabilityNone Durability = iota
+
+	// DurabilityOnClose syncs files written through the overlay when they
+	// are closed, and files copied up from the primary once the copy is
+	// complete.
+	DurabilityOnClose
+
+	// DurabilityStrict additionally syncs after every write, truncation and
+	// metadata change, and syncs the parent directories of created, renamed
+	// and removed paths, so that an operation that has returned survives
+	// power loss. An operation whose sync fails reports the sync error.
+	DurabilityStrict
+)
+
+// WithDurability sets when secondary writes and copy-ups are synced to
+// stable storage. Syncing relies on the secondary filesystem's File.Sync,
+// including on directories opened read-only.
+func WithDurability(level Durability) Option {
+	return func(fs *FileSystem) {
+		fs.durability = level
+	}
+}
+
+// syncPath syncs name in the secondary.
+func (cfs *FileSystem) syncPath(name string) error {
+	f, err := cfs.secondary.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// syncDirs syncs the parent directories of names in the secondary under
+// DurabilityStrict. Parents missing from the secondary have nothing to sync.
+func (cfs *FileSystem) syncDirs(names ...string) error {
+	if cfs.durability < DurabilityStrict {
+		return nil
+	}
+	for _, name := range names {
+		if err := cfs.syncPath(path.Dir(name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncStrict syncs name and its parent directory under DurabilityStrict.
+func (cfs *FileSystem) syncStrict(name string) error {
+	if cfs.durability < DurabilityStrict {
+		return nil
+	}
+	if err := cfs.syncPath(name); err != nil {
+		return err
+	}
+	return cfs.syncDirs(name)
+}
+
+// syncedFile syncs a writable secondary file according to the durability
+// level: on close, and under DurabilityStrict after every change.
+type syncedFile struct {
+	absfs.File
+	strict bool
+}
+
+func (f *syncedFile) sync(err error) error {
+	if err == nil && f.strict {
+		err = f.File.Sync()
+	}
+	return err
+}
+
+func (f *syncedFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	return n, f.sync(err)
+}
+
+func (f *syncedFile) WriteAt(p []byte, off int64) (int, error) {
+	n, err := f.File.WriteAt(p, off)
+	return n, f.sync(err)
+}
+
+func (f *syncedFile) WriteString(s string) (int, error) {
+	n, err := f.File.WriteString(s)
+	return n, f.sync(err)
+}
+
+func (f *syncedFile) ReadFrom(r io.Reader) (int64, error) {
+	n, err := readFrom(f.File, r)
+	return n, f.sync(err)
+}
+
+func (f *syncedFile) WriteTo(w io.Writer) (int64, error) { return writeTo(f.File, w) }
+
+func (f *syncedFile) Truncate(size int64) error {
+	return f.sync(f.File.Truncate(size))
+}
+
+// Close syncs the file before closing it.
+func (f *syncedFile) Close() error {
+	err := f.File.Sync()
+	if closeErr := f.File.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
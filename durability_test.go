@@ -0,0 +1,116 @@
+package cowfs
+
+import (
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/cowfs/dirfs"
+	"github.com/absfs/memfs"
+)
+
+// syncCounter counts Sync calls on files opened from the wrapped filesystem.
+type syncCounter struct {
+	*memfs.FileSystem
+	syncs atomic.Int64
+}
+
+func (s *syncCounter) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	f, err := s.FileSystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &countedFile{File: f, syncs: &s.syncs}, nil
+}
+
+type countedFile struct {
+	absfs.File
+	syncs *atomic.Int64
+}
+
+func (f *countedFile) Sync() error {
+	f.syncs.Add(1)
+	return f.File.Sync()
+}
+
+func newSyncOverlay(t *testing.T, level Durability) (*FileSystem, *memfs.FileSystem, *syncCounter) {
+	t.Helper()
+	primary, err := memfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem, err := memfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondary := &syncCounter{FileSystem: mem}
+	return New(primary, secondary, WithDurability(level)), primary, secondary
+}
+
+func TestDurability(t *testing.T) {
+	for _, tt := range []struct {
+		level   Durability
+		copyUp  int64 // Syncs after a copy-up
+		written int64 // Syncs after two writes and a close
+	}{
+		{DurabilityNone, 0, 0},
+		{DurabilityOnClose, 1, 1},
+		{DurabilityStrict, 2, 4}, // Parent dir, each write, close
+	} {
+		cfs, primary, secondary := newSyncOverlay(t, tt.level)
+		writeMemFile(t, primary, "/a.txt", "aaaa")
+
+		if err := cfs.Chmod("/a.txt", 0600); err != nil {
+			t.Fatal(err)
+		}
+		copyUp := secondary.syncs.Load()
+		if tt.level == DurabilityStrict {
+			copyUp -= 2 // The Chmod itself
+		}
+		if copyUp != tt.copyUp {
+			t.Errorf("level %d: %d syncs for copy-up, want %d", tt.level, copyUp, tt.copyUp)
+		}
+
+		secondary.syncs.Store(0)
+		f, err := cfs.OpenFile("/b.txt", os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte("b"))
+		f.Write([]byte("b"))
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if n := secondary.syncs.Load(); n != tt.written {
+			t.Errorf("level %d: %d syncs for new file, want %d", tt.level, n, tt.written)
+		}
+	}
+}
+
+func TestDurabilityStrictDir(t *testing.T) {
+	dir := t.TempDir()
+	secondary, err := dirfs.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary, err := memfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeMemFile(t, primary, "/a.txt", "aaaa")
+	cfs := New(primary, secondary, WithDurability(DurabilityStrict))
+
+	if err := cfs.Mkdir("/d", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Rename("/a.txt", "/d/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Chmod("/d/a.txt", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Remove("/d/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+}
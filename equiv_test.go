@@ -0,0 +1,61 @@
+package cowfs_test
+
+import (
+	"testing"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/cowfs"
+	"github.com/absfs/cowfs/equivtest"
+	"github.com/absfs/memfs"
+)
+
+// TestEquivalence checks that an overlay over empty memfs layers behaves
+// like a plain memfs.
+func TestEquivalence(t *testing.T) {
+	equivtest.Run(t, equivtest.Config{
+		New: func() (absfs.Filer, absfs.Filer, error) {
+			ref, err := memfs.NewFS()
+			if err != nil {
+				return nil, nil, err
+			}
+			primary, err := memfs.NewFS()
+			if err != nil {
+				return nil, nil, err
+			}
+			secondary, err := memfs.NewFS()
+			if err != nil {
+				return nil, nil, err
+			}
+			return ref, cowfs.New(primary, secondary), nil
+		},
+	})
+}
+
+// TestEquivalenceSeededPrimary checks that an overlay whose primary holds a
+// tree behaves like a plain memfs holding the same tree.
+func TestEquivalenceSeededPrimary(t *testing.T) {
+	equivtest.Run(t, equivtest.Config{
+		New: func() (absfs.Filer, absfs.Filer, error) {
+			ref, err := memfs.NewFS()
+			if err != nil {
+				return nil, nil, err
+			}
+			primary, err := memfs.NewFS()
+			if err != nil {
+				return nil, nil, err
+			}
+			secondary, err := memfs.NewFS()
+			if err != nil {
+				return nil, nil, err
+			}
+			if err := equivtest.Populate(ref); err != nil {
+				return nil, nil, err
+			}
+			if err := equivtest.Populate(primary); err != nil {
+				return nil, nil, err
+			}
+			return ref, cowfs.New(primary, secondary), nil
+		},
+		Sequences: 500,
+	})
+}
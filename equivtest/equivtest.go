@@ -0,0 +1,361 @@
+// Package equivtest checks that an absfs.Filer behaves like a reference
+// Filer. It runs randomized sequences of operations against both and
+// compares what a caller can observe: which operations fail, how they fail,
+// and the resulting trees of files, directories, permissions and contents.
+// It was written for cowfs overlays, compared against a plain memfs, and
+// suits any other absfs wrapper that should be transparent:
+//
+//	equivtest.Run(t, equivtest.Config{
+//		New: func() (ref, subject absfs.Filer, err error) { ... },
+//	})
+//
+// A failing sequence is reported with its seed and the operations up to the
+// divergence, and Config.Seed replays it. Populate gives both sides the same
+// starting tree, for subjects that should pass through existing contents.
+package equivtest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/absfs/absfs"
+)
+
+// Config configures Run.
+type Config struct {
+	// New returns a fresh reference and subject pair. Both must start out
+	// with identical trees.
+	New func() (ref, subject absfs.Filer, err error)
+
+	// Seed seeds the first sequence; later sequences use Seed+1, Seed+2 and
+	// so on. Zero uses 1.
+	Seed int64
+
+	// Sequences is the number of sequences run, by default 100.
+	Sequences int
+
+	// Ops is the number of operations in each sequence, by default 50.
+	Ops int
+
+	// Names are the paths operations pick from. The default is a small set
+	// of nested names under "/", so that operations often collide.
+	Names []string
+}
+
+var defaultNames = []string{"/a", "/b", "/a/a", "/a/b", "/b/a", "/a/a/a"}
+
+// Populate creates a small tree over the default names in filer: the
+// directories /a, /a/a and /b, and the files /a/a/a, /a/b and /b/a. Applied
+// to both the reference and the lower layer of the subject, such as the
+// primary of a cowfs overlay, it starts sequences from a tree the subject
+// did not write itself, exercising copy-ups, whiteouts and merged listings.
+func Populate(filer absfs.Filer) error {
+	for _, dir := range []string{"/a", "/a/a", "/b"} {
+		if err := filer.Mkdir(dir, 0755); err != nil {
+			return err
+		}
+	}
+	files := []struct {
+		name, data string
+		perm       os.FileMode
+	}{
+		{"/a/a/a", "aaa", 0644},
+		{"/a/b", "ab", 0600},
+		{"/b/a", "ba", 0644},
+	}
+	for _, file := range files {
+		f, err := filer.OpenFile(file.name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, file.perm)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write([]byte(file.data))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Op is one operation of a sequence.
+type Op struct {
+	Kind string // mkdir, write, append, remove, rename, chmod, read or readdir
+	Name string
+	To   string      // Target of rename
+	Data string      // Written by write and append
+	Mode os.FileMode // Set by mkdir, write and chmod
+}
+
+func (op Op) String() string {
+	switch op.Kind {
+	case "rename":
+		return fmt.Sprintf("rename %s %s", op.Name, op.To)
+	case "write", "append":
+		return fmt.Sprintf("%s %s %q %v", op.Kind, op.Name, op.Data, op.Mode)
+	case "mkdir", "chmod":
+		return fmt.Sprintf("%s %s %v", op.Kind, op.Name, op.Mode)
+	}
+	return op.Kind + " " + op.Name
+}
+
+// Run runs the configured sequences, failing t at the first divergence of
+// the subject from the reference in each failing sequence.
+func Run(t testing.TB, cfg Config) {
+	t.Helper()
+	if cfg.Seed == 0 {
+		cfg.Seed = 1
+	}
+	if cfg.Sequences <= 0 {
+		cfg.Sequences = 100
+	}
+	if cfg.Ops <= 0 {
+		cfg.Ops = 50
+	}
+	if len(cfg.Names) == 0 {
+		cfg.Names = defaultNames
+	}
+	for i := 0; i < cfg.Sequences; i++ {
+		seed := cfg.Seed + int64(i)
+		ref, subject, err := cfg.New()
+		if err != nil {
+			t.Fatalf("equivtest: creating filesystems: %v", err)
+		}
+		r := rand.New(rand.NewSource(seed))
+		var ops []Op
+		for n := 0; n < cfg.Ops; n++ {
+			op := Next(r, ref, cfg.Names)
+			ops = append(ops, op)
+			if err := Step(ref, subject, op); err != nil {
+				t.Errorf("equivtest: seed %d diverged after:\n%s\n%v", seed, formatOps(ops), err)
+				break
+			}
+		}
+	}
+}
+
+// Next returns a random operation on names that is well defined given the
+// current tree of ref. Operations whose outcome differs between correct
+// filesystems are not generated: creating below a path that is not a
+// directory, removing a directory that is not empty, renaming into the
+// renamed directory itself, and renaming onto an existing path, which memfs
+// refuses where os.Rename replaces files and empty directories. Operations
+// on missing paths are, since they must fail the same way everywhere.
+func Next(r *rand.Rand, ref absfs.Filer, names []string) Op {
+	kinds := []string{"mkdir", "write", "write", "append", "remove", "rename", "chmod", "read", "readdir"}
+	modes := []os.FileMode{0755, 0700, 0644, 0600}
+	for {
+		op := Op{
+			Kind: kinds[r.Intn(len(kinds))],
+			Name: names[r.Intn(len(names))],
+			To:   names[r.Intn(len(names))],
+			Data: strings.Repeat(string(rune('a'+r.Intn(26))), r.Intn(8)),
+			Mode: modes[r.Intn(len(modes))],
+		}
+		if wellDefined(ref, op) {
+			return op
+		}
+	}
+}
+
+// wellDefined reports whether the outcome of op on ref is the same on every
+// correct filesystem.
+func wellDefined(ref absfs.Filer, op Op) bool {
+	switch op.Kind {
+	case "mkdir", "write", "append":
+		return isDir(ref, path.Dir(op.Name))
+	case "remove":
+		entries, err := ref.ReadDir(op.Name)
+		return err != nil || len(entries) == 0
+	case "rename":
+		if op.To == op.Name || strings.HasPrefix(op.To, op.Name+"/") || strings.HasPrefix(op.Name, op.To+"/") {
+			return false
+		}
+		if _, err := ref.Stat(op.To); err == nil {
+			return false
+		}
+		return isDir(ref, path.Dir(op.To))
+	}
+	return true
+}
+
+func isDir(filer absfs.Filer, name string) bool {
+	info, err := filer.Stat(name)
+	return err == nil && info.IsDir()
+}
+
+// Compare applies ops to ref and subject in turn, comparing them after
+// every operation as by Step. It returns the index of the operation after
+// which they diverged and an error describing how.
+func Compare(ref, subject absfs.Filer, ops []Op) (int, error) {
+	for i, op := range ops {
+		if err := Step(ref, subject, op); err != nil {
+			return i, err
+		}
+	}
+	return 0, nil
+}
+
+// Step applies op to ref and subject, and reports how the subject diverged
+// from the reference in the outcome of op or the resulting tree.
+func Step(ref, subject absfs.Filer, op Op) error {
+	want, werr := Apply(ref, op)
+	got, gerr := Apply(subject, op)
+	if outcome(werr) != outcome(gerr) {
+		return fmt.Errorf("error = %v, want %v", gerr, werr)
+	}
+	if got != want {
+		return fmt.Errorf("result = %q, want %q", got, want)
+	}
+	wtree, err := Snapshot(ref)
+	if err != nil {
+		return fmt.Errorf("reading reference tree: %w", err)
+	}
+	gtree, err := Snapshot(subject)
+	if err != nil {
+		return fmt.Errorf("reading subject tree: %w", err)
+	}
+	if diff := diffTrees(wtree, gtree); diff != "" {
+		return errors.New(diff)
+	}
+	return nil
+}
+
+// Apply performs op on filer, returning what reads observed.
+func Apply(filer absfs.Filer, op Op) (string, error) {
+	switch op.Kind {
+	case "mkdir":
+		return "", filer.Mkdir(op.Name, op.Mode)
+	case "write", "append":
+		flag := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		if op.Kind == "append" {
+			flag = os.O_WRONLY | os.O_APPEND
+		}
+		f, err := filer.OpenFile(op.Name, flag, op.Mode)
+		if err != nil {
+			return "", err
+		}
+		_, err = f.Write([]byte(op.Data))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return "", err
+	case "remove":
+		return "", filer.Remove(op.Name)
+	case "rename":
+		return "", filer.Rename(op.Name, op.To)
+	case "chmod":
+		// Some Filers replace the whole mode, file type included
+		info, err := filer.Stat(op.Name)
+		if err != nil {
+			return "", err
+		}
+		return "", filer.Chmod(op.Name, info.Mode().Type()|op.Mode)
+	case "read":
+		f, err := filer.OpenFile(op.Name, os.O_RDONLY, 0)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		data, err := io.ReadAll(f)
+		return string(data), err
+	case "readdir":
+		entries, err := filer.ReadDir(op.Name)
+		names := make([]string, len(entries))
+		for i, e := range entries {
+			names[i] = e.Name()
+		}
+		return strings.Join(names, " "), err
+	}
+	return "", fmt.Errorf("equivtest: unknown operation %q", op.Kind)
+}
+
+// outcome classifies err into what callers commonly test for.
+func outcome(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, fs.ErrNotExist):
+		return "not exist"
+	case errors.Is(err, fs.ErrExist):
+		return "exist"
+	}
+	return "error"
+}
+
+// Entry describes a path in a Snapshot.
+type Entry struct {
+	Dir  bool
+	Perm os.FileMode
+	Data string // Contents of regular files
+}
+
+// Snapshot returns every path below the root of filer with its Entry.
+func Snapshot(filer absfs.Filer) (map[string]Entry, error) {
+	tree := make(map[string]Entry)
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		entries, err := filer.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			name := path.Join(dir, e.Name())
+			info, err := filer.Stat(name)
+			if err != nil {
+				return err
+			}
+			entry := Entry{Dir: info.IsDir(), Perm: info.Mode().Perm()}
+			if entry.Dir {
+				if err := walk(name); err != nil {
+					return err
+				}
+			} else {
+				data, err := filer.ReadFile(name)
+				if err != nil {
+					return err
+				}
+				entry.Data = string(data)
+			}
+			tree[name] = entry
+		}
+		return nil
+	}
+	return tree, walk("/")
+}
+
+// diffTrees describes the differences between the snapshots want and got.
+func diffTrees(want, got map[string]Entry) string {
+	var diffs []string
+	for name, w := range want {
+		if g, ok := got[name]; !ok {
+			diffs = append(diffs, fmt.Sprintf("missing %s", name))
+		} else if g != w {
+			diffs = append(diffs, fmt.Sprintf("%s = %+v, want %+v", name, g, w))
+		}
+	}
+	for name := range got {
+		if _, ok := want[name]; !ok {
+			diffs = append(diffs, fmt.Sprintf("unexpected %s", name))
+		}
+	}
+	sort.Strings(diffs)
+	return strings.Join(diffs, "\n")
+}
+
+func formatOps(ops []Op) string {
+	lines := make([]string, len(ops))
+	for i, op := range ops {
+		lines[i] = fmt.Sprintf("\t%d: %v", i, op)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,32 @@
+package equivtest
+
+import (
+	"testing"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/memfs"
+)
+
+func TestRunIdentical(t *testing.T) {
+	Run(t, Config{
+		New: func() (absfs.Filer, absfs.Filer, error) {
+			ref, err := memfs.NewFS()
+			if err != nil {
+				return nil, nil, err
+			}
+			subject, err := memfs.NewFS()
+			return ref, subject, err
+		},
+		Sequences: 20,
+	})
+}
+
+func TestCompareDetectsDivergence(t *testing.T) {
+	ref, _ := memfs.NewFS()
+	subject, _ := memfs.NewFS()
+	subject.Mkdir("/extra", 0755)
+	n, err := Compare(ref, subject, []Op{{Kind: "read", Name: "/a"}})
+	if err == nil || n != 0 {
+		t.Fatalf("Compare = %d, %v, want divergence at 0", n, err)
+	}
+}
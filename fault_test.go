@@ -0,0 +1,76 @@
+package cowfs
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/absfs/cowfs/faultfs"
+	"github.com/absfs/memfs"
+)
+
+// newFaultOverlay returns an overlay over faultfs layers, with the primary
+// holding /data.txt.
+func newFaultOverlay(t *testing.T) (*FileSystem, *faultfs.FileSystem, *faultfs.FileSystem) {
+	t.Helper()
+	base := must(memfs.NewFS())
+	writeMemFile(t, base, "/data.txt", "original")
+	primary := faultfs.New(base)
+	secondary := faultfs.New(must(memfs.NewFS()))
+	return New(primary, secondary), primary, secondary
+}
+
+func TestFaultCopyUp(t *testing.T) {
+	cfs, primary, _ := newFaultOverlay(t)
+	remove := primary.Inject(faultfs.Fault{Op: faultfs.OpRead, Path: "/data.txt", Err: syscall.EIO})
+
+	_, err := cfs.OpenFile("/data.txt", os.O_RDWR, 0)
+	if !errors.Is(err, syscall.EIO) {
+		t.Fatalf("OpenFile during failing copy-up error = %v, want EIO", err)
+	}
+	if modified, deleted := cfs.state(); len(modified)+len(deleted) != 0 {
+		t.Errorf("failed copy-up left changes %v %v", modified, deleted)
+	}
+
+	// Once the primary recovers the copy-up goes ahead
+	remove()
+	f, err := cfs.OpenFile("/data.txt", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if data, err := cfs.ReadFile("/data.txt"); err != nil || string(data) != "original" {
+		t.Errorf("ReadFile after copy-up = %q, %v, want original", data, err)
+	}
+}
+
+func TestFaultSecondaryFull(t *testing.T) {
+	cfs, _, secondary := newFaultOverlay(t)
+	secondary.Inject(faultfs.Fault{Op: faultfs.OpWrite, Partial: 4, Err: syscall.ENOSPC})
+
+	err := cfs.WriteFile("/new.txt", []byte("new contents"), 0644)
+	if !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("WriteFile error = %v, want ENOSPC", err)
+	}
+	err = cfs.WriteFile("/data.txt", []byte("replaced"), 0644)
+	if !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("WriteFile over primary file error = %v, want ENOSPC", err)
+	}
+	if data, err := cfs.ReadFile("/data.txt"); err != nil || string(data) != "original" {
+		t.Errorf("ReadFile after failed write = %q, %v, want original", data, err)
+	}
+}
+
+func TestFaultPrimaryEIO(t *testing.T) {
+	cfs, primary, _ := newFaultOverlay(t)
+	primary.Inject(faultfs.Fault{Path: "/data.txt", Err: syscall.EIO})
+
+	// Reads fall back to the secondary, which does not hold the file
+	if data, err := cfs.ReadFile("/data.txt"); err == nil {
+		t.Errorf("ReadFile = %q despite the failing primary", data)
+	}
+	if err := cfs.WriteFile("/other.txt", []byte("other"), 0644); err != nil {
+		t.Errorf("WriteFile of unaffected path error = %v", err)
+	}
+}
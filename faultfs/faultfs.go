@@ -0,0 +1,291 @@
+// Package faultfs implements an absfs.Filer that wraps another and injects
+// faults into chosen operations: errors, latency and partial writes. It is
+// meant for testing how code built on absfs, such as cowfs overlays, behaves
+// when a layer fails.
+package faultfs
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// Op identifies an operation faults can be injected into.
+type Op string
+
+const (
+	OpOpen     Op = "open"
+	OpMkdir    Op = "mkdir"
+	OpRemove   Op = "remove"
+	OpRename   Op = "rename" // Matched against the old path
+	OpStat     Op = "stat"
+	OpChmod    Op = "chmod"
+	OpChtimes  Op = "chtimes"
+	OpChown    Op = "chown"
+	OpReadDir  Op = "readdir"
+	OpReadFile Op = "readfile"
+	OpRead     Op = "read"  // Read and ReadAt on open files
+	OpWrite    Op = "write" // Write, WriteAt and WriteString on open files
+)
+
+// Fault describes a fault and the operations it applies to.
+type Fault struct {
+	// Op selects the operation; the empty Op matches every operation.
+	Op Op
+
+	// Path selects the paths, with the syntax of path.Match; the empty
+	// pattern matches every path.
+	Path string
+
+	// Delay is waited before the operation goes ahead or fails.
+	Delay time.Duration
+
+	// Err is returned instead of performing the operation, wrapped in an
+	// *os.PathError. A nil Err only delays the operation, or for writes
+	// limited by Partial, fails them with io.ErrShortWrite.
+	Err error
+
+	// Partial limits writes to at most Partial bytes, which are written
+	// before the write fails. It only applies to OpWrite faults.
+	Partial int
+
+	// Times is the number of operations the fault applies to before it is
+	// removed; zero applies it indefinitely.
+	Times int
+}
+
+// FileSystem is an absfs.Filer that passes operations through to another
+// Filer unless a fault was injected into them.
+type FileSystem struct {
+	absfs.Filer
+
+	mu     sync.Mutex
+	faults []*Fault
+}
+
+// New returns a FileSystem wrapping filer, with no faults injected.
+func New(filer absfs.Filer) *FileSystem {
+	return &FileSystem{Filer: filer}
+}
+
+// Inject adds fault f. Faults are matched in the order they were injected,
+// and the first match applies. The returned function removes the fault.
+func (f *FileSystem) Inject(fault Fault) (remove func()) {
+	p := &fault
+	f.mu.Lock()
+	f.faults = append(f.faults, p)
+	f.mu.Unlock()
+	return func() { f.remove(p) }
+}
+
+// Reset removes all injected faults.
+func (f *FileSystem) Reset() {
+	f.mu.Lock()
+	f.faults = nil
+	f.mu.Unlock()
+}
+
+func (f *FileSystem) remove(p *Fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, q := range f.faults {
+		if q == p {
+			f.faults = append(f.faults[:i:i], f.faults[i+1:]...)
+			return
+		}
+	}
+}
+
+// match returns a copy of the first fault applying to op on name, counting
+// it against its Times.
+func (f *FileSystem) match(op Op, name string) (Fault, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, p := range f.faults {
+		if p.Op != "" && p.Op != op {
+			continue
+		}
+		if p.Path != "" {
+			if ok, _ := path.Match(p.Path, name); !ok {
+				continue
+			}
+		}
+		fault := *p
+		if p.Times > 0 {
+			if p.Times--; p.Times == 0 {
+				f.faults = append(f.faults[:i:i], f.faults[i+1:]...)
+			}
+		}
+		return fault, true
+	}
+	return Fault{}, false
+}
+
+// inject applies the fault matching op on name, if any, returning the error
+// to fail the operation with.
+func (f *FileSystem) inject(op Op, name string) error {
+	fault, ok := f.match(op, name)
+	if !ok {
+		return nil
+	}
+	time.Sleep(fault.Delay)
+	if fault.Err == nil {
+		return nil
+	}
+	return &os.PathError{Op: string(op), Path: name, Err: fault.Err}
+}
+
+// OpenFile opens the named file. Reads and writes on the returned file are
+// subject to OpRead and OpWrite faults.
+func (f *FileSystem) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	if err := f.inject(OpOpen, name); err != nil {
+		return nil, err
+	}
+	file, err := f.Filer.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &File{File: file, fs: f, name: name}, nil
+}
+
+// Mkdir creates the named directory.
+func (f *FileSystem) Mkdir(name string, perm os.FileMode) error {
+	if err := f.inject(OpMkdir, name); err != nil {
+		return err
+	}
+	return f.Filer.Mkdir(name, perm)
+}
+
+// Remove removes the named file or empty directory.
+func (f *FileSystem) Remove(name string) error {
+	if err := f.inject(OpRemove, name); err != nil {
+		return err
+	}
+	return f.Filer.Remove(name)
+}
+
+// Rename renames oldpath to newpath.
+func (f *FileSystem) Rename(oldpath, newpath string) error {
+	if err := f.inject(OpRename, oldpath); err != nil {
+		return &os.LinkError{Op: string(OpRename), Old: oldpath, New: newpath, Err: err.(*os.PathError).Err}
+	}
+	return f.Filer.Rename(oldpath, newpath)
+}
+
+// Stat returns file info for the named file.
+func (f *FileSystem) Stat(name string) (os.FileInfo, error) {
+	if err := f.inject(OpStat, name); err != nil {
+		return nil, err
+	}
+	return f.Filer.Stat(name)
+}
+
+// Chmod changes the mode of the named file.
+func (f *FileSystem) Chmod(name string, mode os.FileMode) error {
+	if err := f.inject(OpChmod, name); err != nil {
+		return err
+	}
+	return f.Filer.Chmod(name, mode)
+}
+
+// Chtimes changes the access and modification times of the named file.
+func (f *FileSystem) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	if err := f.inject(OpChtimes, name); err != nil {
+		return err
+	}
+	return f.Filer.Chtimes(name, atime, mtime)
+}
+
+// Chown changes the owner and group of the named file.
+func (f *FileSystem) Chown(name string, uid, gid int) error {
+	if err := f.inject(OpChown, name); err != nil {
+		return err
+	}
+	return f.Filer.Chown(name, uid, gid)
+}
+
+// ReadDir reads the named directory.
+func (f *FileSystem) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := f.inject(OpReadDir, name); err != nil {
+		return nil, err
+	}
+	return f.Filer.ReadDir(name)
+}
+
+// ReadFile reads the named file and returns its contents.
+func (f *FileSystem) ReadFile(name string) ([]byte, error) {
+	if err := f.inject(OpReadFile, name); err != nil {
+		return nil, err
+	}
+	return f.Filer.ReadFile(name)
+}
+
+// Sub returns an fs.FS corresponding to the subtree rooted at dir, subject
+// to the same faults.
+func (f *FileSystem) Sub(dir string) (fs.FS, error) {
+	return absfs.FilerToFS(f, dir)
+}
+
+// File is an open file whose reads and writes are subject to faults.
+type File struct {
+	absfs.File
+	fs   *FileSystem
+	name string
+}
+
+func (f *File) Read(p []byte) (int, error) {
+	if err := f.fs.inject(OpRead, f.name); err != nil {
+		return 0, err
+	}
+	return f.File.Read(p)
+}
+
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.fs.inject(OpRead, f.name); err != nil {
+		return 0, err
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func (f *File) Write(p []byte) (int, error) {
+	return f.write(p, f.File.Write)
+}
+
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	return f.write(p, func(p []byte) (int, error) {
+		return f.File.WriteAt(p, off)
+	})
+}
+
+func (f *File) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+// write applies the OpWrite fault matching the file, if any, to a write of p
+// carried out by fn.
+func (f *File) write(p []byte, fn func([]byte) (int, error)) (int, error) {
+	fault, ok := f.fs.match(OpWrite, f.name)
+	if !ok {
+		return fn(p)
+	}
+	time.Sleep(fault.Delay)
+	if fault.Partial > 0 && fault.Partial < len(p) {
+		n, err := fn(p[:fault.Partial])
+		if err != nil {
+			return n, err
+		}
+		if fault.Err == nil {
+			return n, io.ErrShortWrite
+		}
+		return n, &os.PathError{Op: string(OpWrite), Path: f.name, Err: fault.Err}
+	}
+	if fault.Err != nil {
+		return 0, &os.PathError{Op: string(OpWrite), Path: f.name, Err: fault.Err}
+	}
+	return fn(p)
+}
@@ -0,0 +1,81 @@
+package faultfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/absfs/memfs"
+)
+
+func newFS(t *testing.T) *FileSystem {
+	t.Helper()
+	mfs, err := memfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(mfs)
+}
+
+func TestInject(t *testing.T) {
+	f := newFS(t)
+	remove := f.Inject(Fault{Op: OpMkdir, Path: "/bad*", Err: syscall.EIO})
+	if err := f.Mkdir("/bad", 0755); !errors.Is(err, syscall.EIO) {
+		t.Errorf("Mkdir(/bad) error = %v, want EIO", err)
+	}
+	if err := f.Mkdir("/good", 0755); err != nil {
+		t.Errorf("Mkdir(/good) error = %v", err)
+	}
+	remove()
+	if err := f.Mkdir("/bad", 0755); err != nil {
+		t.Errorf("Mkdir(/bad) after removal error = %v", err)
+	}
+
+	f.Inject(Fault{Op: OpStat, Err: syscall.ENOENT, Times: 1})
+	if _, err := f.Stat("/good"); !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("first Stat error = %v, want ENOENT", err)
+	}
+	if _, err := f.Stat("/good"); err != nil {
+		t.Errorf("second Stat error = %v, want the fault used up", err)
+	}
+}
+
+func TestPartialWrite(t *testing.T) {
+	f := newFS(t)
+	f.Inject(Fault{Op: OpWrite, Path: "/full.txt", Partial: 3, Err: syscall.ENOSPC})
+	file, err := f.OpenFile("/full.txt", os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := file.Write([]byte("hello"))
+	file.Close()
+	if n != 3 || !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("Write = %d, %v, want 3, ENOSPC", n, err)
+	}
+	if data, _ := f.ReadFile("/full.txt"); string(data) != "hel" {
+		t.Errorf("contents = %q, want hel", data)
+	}
+
+	f.Reset()
+	f.Inject(Fault{Op: OpWrite, Partial: 1})
+	file, _ = f.OpenFile("/short.txt", os.O_CREATE|os.O_WRONLY, 0644)
+	defer file.Close()
+	if n, err := file.WriteString("ab"); n != 1 || err != io.ErrShortWrite {
+		t.Errorf("WriteString = %d, %v, want 1, io.ErrShortWrite", n, err)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	f := newFS(t)
+	f.Inject(Fault{Op: OpReadDir, Delay: 20 * time.Millisecond})
+	start := time.Now()
+	if _, err := f.ReadDir("/"); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Errorf("ReadDir took %v, want at least the injected delay", d)
+	}
+}
@@ -0,0 +1,109 @@
+package cowfs
+
+import (
+	"io"
+
+	"github.com/absfs/absfs"
+)
+
+// writeFile wraps a writable secondary file handle so the overlay can act
+// when it is closed.
+type writeFile struct {
+	absfs.File
+	fs   *FileSystem
+	name string
+}
+
+// Close closes the underlying file, re-encodes it as a delta if delta
+// storage applies and queues it for write-back.
+func (f *writeFile) Close() error {
+	err := f.File.Close()
+	if err == nil {
+		f.fs.encodeDelta(f.name)
+		f.fs.queueWriteBack(Event{Op: EventModify, Path: f.name})
+	}
+	return err
+}
+
+func (f *writeFile) ReadFrom(r io.Reader) (int64, error) { return readFrom(f.File, r) }
+func (f *writeFile) WriteTo(w io.Writer) (int64, error)  { return writeTo(f.File, w) }
+
+// meteredFile wraps a layer file handle to count its reads and writes in the
+// layer's Stats.
+type meteredFile struct {
+	absfs.File
+	c *layerCounters
+}
+
+func (f *meteredFile) Read(b []byte) (int, error) {
+	n, err := f.File.Read(b)
+	f.c.read(int64(n))
+	return n, err
+}
+
+func (f *meteredFile) ReadAt(b []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(b, off)
+	f.c.read(int64(n))
+	return n, err
+}
+
+func (f *meteredFile) Write(b []byte) (int, error) {
+	n, err := f.File.Write(b)
+	f.c.write(int64(n))
+	return n, err
+}
+
+func (f *meteredFile) WriteAt(b []byte, off int64) (int, error) {
+	n, err := f.File.WriteAt(b, off)
+	f.c.write(int64(n))
+	return n, err
+}
+
+func (f *meteredFile) WriteString(s string) (int, error) {
+	n, err := f.File.WriteString(s)
+	f.c.write(int64(n))
+	return n, err
+}
+
+func (f *meteredFile) ReadFrom(r io.Reader) (int64, error) {
+	n, err := readFrom(f.File, r)
+	f.c.write(n)
+	return n, err
+}
+
+func (f *meteredFile) WriteTo(w io.Writer) (int64, error) {
+	n, err := writeTo(f.File, w)
+	f.c.read(n)
+	return n, err
+}
+
+// readFrom copies r to file, through its io.ReaderFrom if it has one, such
+// as that of an *os.File, which can copy between files and sockets without
+// passing the data through user space. Handles wrapping layer files
+// implement io.ReaderFrom and io.WriterTo with it and writeTo, so io.Copy
+// still finds those fast paths.
+func readFrom(file absfs.File, r io.Reader) (int64, error) {
+	if rf, ok := file.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(writerOnly{file}, r)
+}
+
+// writeTo copies file to w, through its io.WriterTo if it has one.
+func writeTo(file absfs.File, w io.Writer) (int64, error) {
+	if wt, ok := file.(io.WriterTo); ok {
+		return wt.WriteTo(w)
+	}
+	return io.Copy(w, readerOnly{file})
+}
+
+// writerOnly hides the io.ReaderFrom of a writer, so that io.Copy to it
+// does not call back into the ReadFrom being implemented.
+type writerOnly struct {
+	io.Writer
+}
+
+// readerOnly hides the io.WriterTo of a reader.
+type readerOnly struct {
+	io.Reader
+}
@@ -0,0 +1,86 @@
+package cowfs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/memfs"
+)
+
+// fastFiler returns files with io.ReaderFrom and io.WriterTo fast paths
+// that count their calls.
+type fastFiler struct {
+	absfs.Filer
+	readFroms, writeTos int
+}
+
+func (f *fastFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	file, err := f.Filer.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &fastFile{File: file, fs: f}, nil
+}
+
+type fastFile struct {
+	absfs.File
+	fs *fastFiler
+}
+
+func (f *fastFile) ReadFrom(r io.Reader) (int64, error) {
+	f.fs.readFroms++
+	return io.Copy(writerOnly{f.File}, r)
+}
+
+func (f *fastFile) WriteTo(w io.Writer) (int64, error) {
+	f.fs.writeTos++
+	return io.Copy(w, readerOnly{f.File})
+}
+
+func TestCopyFastPaths(t *testing.T) {
+	primary := &fastFiler{Filer: must(memfs.NewFS())}
+	secondary := &fastFiler{Filer: must(memfs.NewFS())}
+	writeMemFile(t, primary.Filer.(*memfs.FileSystem), "/in.txt", "from the primary")
+	cfs := New(primary, secondary, WithDurability(DurabilityStrict))
+
+	var buf bytes.Buffer
+	in := must(cfs.OpenFile("/in.txt", os.O_RDONLY, 0))
+	if n, err := io.Copy(&buf, in); err != nil || n != 16 {
+		t.Fatalf("io.Copy from cowfs file = %d, %v", n, err)
+	}
+	in.Close()
+	if primary.writeTos != 1 {
+		t.Errorf("primary WriteTo called %d times, want 1", primary.writeTos)
+	}
+
+	out := must(cfs.OpenFile("/out.txt", os.O_CREATE|os.O_WRONLY, 0644))
+	if n, err := io.Copy(out, readerOnly{strings.NewReader("to the secondary")}); err != nil || n != 16 {
+		t.Fatalf("io.Copy to cowfs file = %d, %v", n, err)
+	}
+	out.Close()
+	if secondary.readFroms != 1 {
+		t.Errorf("secondary ReadFrom called %d times, want 1", secondary.readFroms)
+	}
+	if data, _ := cfs.ReadFile("/out.txt"); string(data) != "to the secondary" {
+		t.Errorf("ReadFile(/out.txt) = %q", data)
+	}
+	stats := cfs.Stats()
+	if stats.Primary.ReadBytes != 16 || stats.Secondary.WriteBytes < 16 {
+		t.Errorf("Stats = %+v, %+v; want the fast path copies counted", stats.Primary, stats.Secondary)
+	}
+
+	// Quotas charge writes as they are made, so they bypass ReadFrom
+	WithMaxSecondaryBytes(20)(cfs)
+	out = must(cfs.OpenFile("/big.txt", os.O_CREATE|os.O_WRONLY, 0644))
+	if _, err := io.Copy(out, readerOnly{strings.NewReader(strings.Repeat("x", 64))}); err == nil {
+		t.Error("io.Copy past the quota succeeded")
+	}
+	out.Close()
+	if secondary.readFroms != 1 {
+		t.Errorf("secondary ReadFrom called %d times under a quota, want no more", secondary.readFroms)
+	}
+}
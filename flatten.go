@@ -0,0 +1,65 @@
+package cowfs
+
+import (
+	"io"
+
+	"github.com/absfs/absfs"
+)
+
+// Flatten collapses a stack of overlays, where the primary of this overlay
+// is itself a FileSystem, possibly nested further, into a single overlay
+// over the bottom primary. Reads through a stack look up each layer in
+// turn; the flattened overlay resolves every path with one lookup.
+//
+// The changes of every layer are copied into secondary, which should be
+// empty, from the bottom layer up, so that the flattened overlay presents
+// the same merged view: contents and deletions of upper layers win, and
+// directories recreated in an upper layer hide what the layers below held
+// in them. opts configure the new overlay. The stack itself is left
+// unchanged, and mutations of its layers are held back while Flatten runs.
+func (cfs *FileSystem) Flatten(secondary absfs.Filer, opts ...Option) (*FileSystem, error) {
+	layers := []*FileSystem{cfs}
+	for l := cfs; ; {
+		inner, ok := l.primary.(*FileSystem)
+		if !ok {
+			break
+		}
+		layers = append(layers, inner)
+		l = inner
+	}
+	for _, l := range layers {
+		l.opMu.Lock()
+		defer l.opMu.Unlock()
+	}
+
+	flat := New(layers[len(layers)-1].primary, secondary, opts...)
+	for i := len(layers) - 1; i >= 0; i-- {
+		if err := flat.squash(layers[i]); err != nil {
+			return nil, err
+		}
+	}
+	cfs.debug("cowfs: flattened", "layers", len(layers))
+	return flat, nil
+}
+
+// squash applies the changes of the overlay l on top of cfs.
+func (cfs *FileSystem) squash(l *FileSystem) error {
+	// Recreated directories hide everything the lower layers put in them
+	l.mu.RLock()
+	opaque := make([]string, 0, len(l.opaque))
+	for dir := range l.opaque {
+		opaque = append(opaque, dir)
+	}
+	l.mu.RUnlock()
+	for _, dir := range opaque {
+		cfs.importWhiteout(dir)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(l.ExportTar(pw))
+	}()
+	err := cfs.ImportTar(pr)
+	pr.CloseWithError(err)
+	return err
+}
@@ -0,0 +1,60 @@
+package cowfs
+
+import (
+	"errors"
+	"io/fs"
+	"reflect"
+	"testing"
+
+	"github.com/absfs/memfs"
+)
+
+func TestFlatten(t *testing.T) {
+	base, primary, _ := newMemOverlay(t)
+	primary.Mkdir("/dir", 0755)
+	writeMemFile(t, primary, "/a.txt", "base a")
+	writeMemFile(t, primary, "/b.txt", "base b")
+	writeMemFile(t, primary, "/dir/old.txt", "old")
+
+	// Three layers: base, middle and top
+	base.WriteFile("/a.txt", []byte("layer 1 a"), 0644)
+	base.WriteFile("/dir/one.txt", []byte("one"), 0644)
+	mid := New(base, must(memfs.NewFS()))
+	mid.WriteFile("/a.txt", []byte("layer 2 a"), 0644)
+	mid.Remove("/b.txt")
+	mid.WriteFile("/c.txt", []byte("layer 2 c"), 0644)
+	top := New(mid, must(memfs.NewFS()))
+	top.Remove("/dir/one.txt")
+	top.Remove("/dir/old.txt")
+	top.Remove("/dir")
+	top.Mkdir("/dir", 0755)
+	top.WriteFile("/dir/new.txt", []byte("new"), 0644)
+
+	flat, err := top.Flatten(must(memfs.NewFS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flat.primary != primary {
+		t.Error("flattened overlay is not over the bottom primary")
+	}
+	for _, fsys := range []*FileSystem{top, flat} {
+		for name, want := range map[string]string{"/a.txt": "layer 2 a", "/c.txt": "layer 2 c", "/dir/new.txt": "new"} {
+			if data, err := fsys.ReadFile(name); err != nil || string(data) != want {
+				t.Errorf("ReadFile(%s) = %q, %v, want %q", name, data, err, want)
+			}
+		}
+		if _, err := fsys.Stat("/b.txt"); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Stat(/b.txt) error = %v, want not exist", err)
+		}
+		if names := listNames(t, fsys, "/dir"); !reflect.DeepEqual(names, []string{"new.txt"}) {
+			t.Errorf("ReadDir(/dir) = %v, want only new.txt", names)
+		}
+	}
+}
+
+func must[T any](v T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
@@ -0,0 +1,29 @@
+package cowfs
+
+import "errors"
+
+// ErrFrozen is returned by mutating operations of an overlay after Freeze.
+var ErrFrozen = errors.New("cowfs: overlay is frozen")
+
+// Freeze makes the overlay read-only. Once it returns, every operation that
+// would change the merged view, such as OpenFile for writing, Remove,
+// Rename, Chmod, ImportTar, GC, Split or Begin, fails with ErrFrozen, while
+// reads keep working. Mutations already in progress finish first.
+//
+// Freeze returns a ReadOnlyView of the frozen overlay, a snapshot of it to
+// hand to code that must not change it.
+//
+// Freezing cannot be undone. Writes through file handles opened for writing
+// before Freeze are not stopped; close them first for a fully frozen view.
+func (cfs *FileSystem) Freeze() ReadOnlyView {
+	cfs.opMu.Lock()
+	cfs.frozen.Store(true)
+	cfs.opMu.Unlock()
+	cfs.debug("cowfs: frozen")
+	return cfs.ReadOnly()
+}
+
+// Frozen reports whether Freeze has been called.
+func (cfs *FileSystem) Frozen() bool {
+	return cfs.frozen.Load()
+}
@@ -0,0 +1,58 @@
+package cowfs
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestFreeze(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	writeMemFile(t, primary, "/a.txt", "primary")
+	cfs.WriteFile("/b.txt", []byte("secondary"), 0644)
+	view := cfs.Freeze()
+	if !cfs.Frozen() {
+		t.Fatal("Frozen() = false after Freeze()")
+	}
+
+	mutations := map[string]func() error{
+		"OpenFile": func() error {
+			_, err := cfs.OpenFile("/a.txt", os.O_RDWR, 0)
+			return err
+		},
+		"WriteFile": func() error { return cfs.WriteFile("/c.txt", []byte("c"), 0644) },
+		"Mkdir":     func() error { return cfs.Mkdir("/dir", 0755) },
+		"Remove":    func() error { return cfs.Remove("/b.txt") },
+		"Rename":    func() error { return cfs.Rename("/a.txt", "/d.txt") },
+		"Chmod":     func() error { return cfs.Chmod("/a.txt", 0600) },
+		"Truncate":  func() error { return cfs.Truncate("/b.txt", 0) },
+		"GC": func() error {
+			_, err := cfs.GC()
+			return err
+		},
+		"Begin": func() error {
+			_, err := cfs.Begin()
+			return err
+		},
+	}
+	for op, fn := range mutations {
+		if err := fn(); !errors.Is(err, ErrFrozen) {
+			t.Errorf("%s error = %v, want ErrFrozen", op, err)
+		}
+	}
+
+	for name, want := range map[string]string{"/a.txt": "primary", "/b.txt": "secondary"} {
+		if data, err := cfs.ReadFile(name); err != nil || string(data) != want {
+			t.Errorf("ReadFile(%s) = %q, %v, want %q", name, data, err, want)
+		}
+		if data, err := view.ReadFile(name); err != nil || string(data) != want {
+			t.Errorf("view ReadFile(%s) = %q, %v, want %q", name, data, err, want)
+		}
+	}
+	if _, err := cfs.Stat("/c.txt"); !os.IsNotExist(err) {
+		t.Errorf("Stat(/c.txt) error = %v, want not exist", err)
+	}
+	if names := listNames(t, cfs, "/"); len(names) != 2 {
+		t.Errorf("ReadDir() = %v, want a.txt and b.txt", names)
+	}
+}
@@ -0,0 +1,191 @@
+package cowfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// NewFromFS is like New with an io/fs.FS as the read-only primary, such as
+// an embed.FS, a *zip.Reader or an fstest.MapFS. Paths in the overlay are
+// rooted, so "/static/app.js" is "static/app.js" in primary.
+//
+// Files opened from primary support ReadAt and Seek only if primary's
+// files implement io.ReaderAt and io.Seeker, which, for example, the files
+// of a *zip.Reader do not; reads and copy-ups work either way. Copy-ups
+// keep the modes primary reports, so the read-only files of an embed.FS
+// need a Chmod before secondaries that enforce permissions let them be
+// written. Operations that would write to primary, such as Commit, fail
+// with syscall.EROFS.
+func NewFromFS(primary fs.FS, secondary absfs.Filer, opts ...Option) *FileSystem {
+	return New(&fsFiler{fsys: primary}, secondary, opts...)
+}
+
+// fsFiler is a read-only absfs.Filer serving an io/fs.FS.
+type fsFiler struct {
+	fsys fs.FS
+}
+
+// fsName returns the io/fs name of the overlay path name.
+func fsName(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// fsErr reports err, returned by the io/fs.FS for name, with the overlay
+// path instead of the io/fs name.
+func fsErr(op, name string, err error) error {
+	var pe *fs.PathError
+	if errors.As(err, &pe) {
+		err = pe.Err
+	}
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+func (f *fsFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	if openOp(flag) == OpWrite {
+		return nil, readOnly("open", name)
+	}
+	file, err := f.fsys.Open(fsName(name))
+	if err != nil {
+		return nil, fsErr("open", name, err)
+	}
+	return &fsFile{File: file, name: name}, nil
+}
+
+func (f *fsFiler) Mkdir(name string, perm os.FileMode) error {
+	return readOnly("mkdir", name)
+}
+
+func (f *fsFiler) Remove(name string) error {
+	return readOnly("remove", name)
+}
+
+func (f *fsFiler) Rename(oldpath, newpath string) error {
+	return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EROFS}
+}
+
+func (f *fsFiler) Stat(name string) (os.FileInfo, error) {
+	info, err := fs.Stat(f.fsys, fsName(name))
+	if err != nil {
+		return nil, fsErr("stat", name, err)
+	}
+	return info, nil
+}
+
+func (f *fsFiler) Chmod(name string, mode os.FileMode) error {
+	return readOnly("chmod", name)
+}
+
+func (f *fsFiler) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return readOnly("chtimes", name)
+}
+
+func (f *fsFiler) Chown(name string, uid, gid int) error {
+	return readOnly("chown", name)
+}
+
+func (f *fsFiler) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDir(f.fsys, fsName(name))
+	if err != nil {
+		return nil, fsErr("readdir", name, err)
+	}
+	return entries, nil
+}
+
+func (f *fsFiler) ReadFile(name string) ([]byte, error) {
+	data, err := fs.ReadFile(f.fsys, fsName(name))
+	if err != nil {
+		return nil, fsErr("readfile", name, err)
+	}
+	return data, nil
+}
+
+func (f *fsFiler) Sub(dir string) (fs.FS, error) {
+	return fs.Sub(f.fsys, fsName(dir))
+}
+
+// fsFile adapts an io/fs.File to absfs.File. Writes fail with EBADF, as
+// for a file opened read-only.
+type fsFile struct {
+	fs.File
+	name string
+}
+
+func (f *fsFile) Name() string { return f.name }
+
+func (f *fsFile) unsupported(op string) error {
+	return &os.PathError{Op: op, Path: f.name, Err: errors.ErrUnsupported}
+}
+
+func (f *fsFile) ReadAt(b []byte, off int64) (int, error) {
+	if ra, ok := f.File.(io.ReaderAt); ok {
+		return ra.ReadAt(b, off)
+	}
+	return 0, f.unsupported("read")
+}
+
+func (f *fsFile) Seek(offset int64, whence int) (int64, error) {
+	if s, ok := f.File.(io.Seeker); ok {
+		return s.Seek(offset, whence)
+	}
+	return 0, f.unsupported("seek")
+}
+
+func (f *fsFile) Write(b []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.name, Err: syscall.EBADF}
+}
+
+func (f *fsFile) WriteAt(b []byte, off int64) (int, error) {
+	return f.Write(b)
+}
+
+func (f *fsFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *fsFile) Truncate(size int64) error {
+	return &os.PathError{Op: "truncate", Path: f.name, Err: syscall.EBADF}
+}
+
+func (f *fsFile) Sync() error { return nil }
+
+func (f *fsFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	d, ok := f.File.(fs.ReadDirFile)
+	if !ok {
+		return nil, &os.PathError{Op: "readdir", Path: f.name, Err: syscall.ENOTDIR}
+	}
+	return d.ReadDir(n)
+}
+
+func (f *fsFile) Readdir(n int) ([]os.FileInfo, error) {
+	entries, err := f.ReadDir(n)
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		info, infoErr := e.Info()
+		if infoErr != nil {
+			return infos, infoErr
+		}
+		infos = append(infos, info)
+	}
+	return infos, err
+}
+
+func (f *fsFile) Readdirnames(n int) ([]string, error) {
+	entries, err := f.ReadDir(n)
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.Name()
+	}
+	return names, err
+}
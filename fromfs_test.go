@@ -0,0 +1,90 @@
+package cowfs
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+	"testing/fstest"
+
+	"github.com/absfs/memfs"
+)
+
+func TestNewFromFS(t *testing.T) {
+	base := fstest.MapFS{
+		"static/app.js":   {Data: []byte("console.log(1)"), Mode: 0o644},
+		"static/app.css":  {Data: []byte("body{}"), Mode: 0o644},
+		"templates/index": {Data: []byte("<html>"), Mode: 0o644},
+	}
+	cfs := NewFromFS(base, must(memfs.NewFS()))
+
+	if data, err := cfs.ReadFile("/static/app.js"); err != nil || string(data) != "console.log(1)" {
+		t.Fatalf("ReadFile = %q, %v", data, err)
+	}
+	if got := listNames(t, cfs, "/"); len(got) != 2 || got[0] != "static" || got[1] != "templates" {
+		t.Errorf("ReadDir(/) = %v", got)
+	}
+	f, err := cfs.OpenFile("/static/app.css", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2)
+	if _, err := f.ReadAt(buf, 4); err != nil || string(buf) != "{}" {
+		t.Errorf("ReadAt = %q, %v", buf, err)
+	}
+	if _, err := f.Write([]byte("x")); err == nil {
+		t.Error("Write to a primary file handle succeeded")
+	}
+	f.Close()
+	if _, err := cfs.Stat("/missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Stat(/missing) = %v; want not exist", err)
+	}
+
+	// Changes copy up into the secondary
+	f, err = cfs.OpenFile("/static/app.js", os.O_RDWR|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(";")); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if data, _ := cfs.ReadFile("/static/app.js"); string(data) != "console.log(1);" {
+		t.Errorf("ReadFile after append = %q", data)
+	}
+	if err := cfs.Remove("/templates/index"); err != nil {
+		t.Fatal(err)
+	}
+	if got := listNames(t, cfs, "/templates"); len(got) != 0 {
+		t.Errorf("ReadDir(/templates) after Remove = %v", got)
+	}
+	if err := cfs.Commit(context.Background()); !errors.Is(err, syscall.EROFS) {
+		t.Errorf("Commit = %v; want EROFS", err)
+	}
+}
+
+func TestNewFromFSZip(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("docs/readme.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "zipped")
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zr := must(zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len())))
+	cfs := NewFromFS(zr, must(memfs.NewFS()))
+
+	if err := cfs.Chmod("/docs/readme.txt", 0o600); err != nil {
+		t.Fatalf("Chmod copying up a zip entry: %v", err)
+	}
+	if data, err := cfs.ReadFile("/docs/readme.txt"); err != nil || string(data) != "zipped" {
+		t.Errorf("ReadFile after copy-up = %q, %v", data, err)
+	}
+}
@@ -118,3 +118,30 @@ func TestCowFS_QuickCheck(t *testing.T) {
 
 	suite.QuickCheck(t)
 }
+
+// FuzzCowFS_OpenFlags runs the fstesting open-flag fuzzer, including
+// O_APPEND combinations, over files that exist only in the primary.
+func FuzzCowFS_OpenFlags(f *testing.F) {
+	primary, err := memfs.NewFS()
+	if err != nil {
+		f.Fatal(err)
+	}
+	secondary, err := memfs.NewFS()
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	// Seed the primary with every file the fuzzer opens, so that files not
+	// created by the fuzzer itself are copied up
+	primary.MkdirAll("/fuzz/fuzz_flags", 0755)
+	for c := 'a'; c <= 'z'; c++ {
+		file, err := primary.Create("/fuzz/fuzz_flags/" + string(c) + ".txt")
+		if err != nil {
+			f.Fatal(err)
+		}
+		file.Write([]byte("primary content"))
+		file.Close()
+	}
+
+	fstesting.FuzzOpenFlags(f, absfs.ExtendFiler(cowfs.New(primary, secondary)), "/fuzz")
+}
@@ -0,0 +1,143 @@
+package cowfs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+// checkMarkers fails t if a path is marked both modified and deleted.
+func checkMarkers(t *testing.T, cfs *FileSystem) {
+	t.Helper()
+	cfs.mu.RLock()
+	defer cfs.mu.RUnlock()
+	for name := range cfs.modified {
+		if cfs.deleted[name] {
+			t.Fatalf("%q marked both modified and deleted", name)
+		}
+	}
+}
+
+// snapshotMarkers returns the overlay state for comparisons.
+func snapshotMarkers(cfs *FileSystem) State {
+	s := cfs.snapshotState()
+	s.Bases = nil
+	return s
+}
+
+// newFuzzOverlay returns an overlay whose primary holds /file.txt and
+// /dir/child.txt.
+func newFuzzOverlay(t *testing.T) *FileSystem {
+	cfs, primary, _ := newMemOverlay(t)
+	primary.Mkdir("/dir", 0755)
+	writeMemFile(t, primary, "/file.txt", "primary")
+	writeMemFile(t, primary, "/dir/child.txt", "child")
+	return cfs
+}
+
+func FuzzOpenFileFlags(f *testing.F) {
+	for _, flag := range []int{
+		os.O_RDONLY,
+		os.O_WRONLY,
+		os.O_RDWR | os.O_APPEND,
+		os.O_CREATE | os.O_TRUNC | os.O_WRONLY,
+		os.O_CREATE | os.O_EXCL | os.O_WRONLY,
+		os.O_TRUNC,
+	} {
+		f.Add(uint16(flag), "/file.txt", false)
+		f.Add(uint16(flag), "/dir/new.txt", true)
+	}
+	f.Fuzz(func(t *testing.T, flags uint16, name string, deleted bool) {
+		flag := int(flags) & (os.O_WRONLY | os.O_RDWR | os.O_APPEND | os.O_CREATE | os.O_EXCL | os.O_TRUNC)
+		cfs := newFuzzOverlay(t)
+		if deleted {
+			cfs.Remove(name)
+		}
+		before := snapshotMarkers(cfs)
+
+		file, err := cfs.OpenFile(name, flag, 0644)
+		checkMarkers(t, cfs)
+		if err != nil {
+			if after := snapshotMarkers(cfs); !reflect.DeepEqual(after, before) {
+				t.Fatalf("failed OpenFile(%q, %#x) changed the state from %+v to %+v", name, flag, before, after)
+			}
+			return
+		}
+		file.Close()
+		if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 && !cfs.IsModified(name) {
+			t.Fatalf("OpenFile(%q, %#x) for writing did not mark it modified", name, flag)
+		}
+		if _, err := cfs.Stat(name); err != nil {
+			t.Fatalf("Stat(%q) after OpenFile(%#x) failed: %v", name, flag, err)
+		}
+	})
+}
+
+func FuzzPathNames(f *testing.F) {
+	for _, name := range []string{"/file.txt", "/dir/child.txt", "/dir/new.txt", "/new", "/dir/", "file.txt", "/dir/../new.txt", "./dir//new.txt"} {
+		f.Add(name)
+	}
+	f.Fuzz(func(t *testing.T, name string) {
+		cfs := newFuzzOverlay(t)
+		if err := cfs.WriteFile(name, []byte("fuzz"), 0644); err != nil {
+			checkMarkers(t, cfs)
+			return
+		}
+		checkMarkers(t, cfs)
+
+		// Every spelling of a path reaches the same file
+		clean := path.Clean("/" + name)
+		for _, alias := range []string{name, clean, clean[1:], clean + "/", "/./" + clean} {
+			if data, err := cfs.ReadFile(alias); err != nil || string(data) != "fuzz" {
+				t.Fatalf("ReadFile(%q) after WriteFile(%q) = %q, %v", alias, name, data, err)
+			}
+		}
+		if err := cfs.Remove(clean[1:]); err != nil {
+			t.Fatalf("Remove(%q) after WriteFile(%q) failed: %v", clean[1:], name, err)
+		}
+		checkMarkers(t, cfs)
+		if _, err := cfs.Stat(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("Stat(%q) after Remove error = %v, want not exist", name, err)
+		}
+	})
+}
+
+func FuzzRename(f *testing.F) {
+	for _, p := range [][2]string{
+		{"/file.txt", "/renamed.txt"},
+		{"/file.txt", "/dir/child.txt"},
+		{"/dir", "/moved"},
+		{"/dir", "/dir/sub"},
+		{"/missing", "/file.txt"},
+		{"/file.txt", "/file.txt"},
+	} {
+		f.Add(p[0], p[1], false)
+	}
+	f.Fuzz(func(t *testing.T, oldpath, newpath string, modified bool) {
+		cfs := newFuzzOverlay(t)
+		if modified {
+			cfs.Chmod(oldpath, 0600)
+		}
+		before := snapshotMarkers(cfs)
+
+		err := cfs.Rename(oldpath, newpath)
+		checkMarkers(t, cfs)
+		if err != nil {
+			if after := snapshotMarkers(cfs); !reflect.DeepEqual(after, before) {
+				t.Fatalf("failed Rename(%q, %q) changed the state from %+v to %+v", oldpath, newpath, before, after)
+			}
+			return
+		}
+		if _, err := cfs.Stat(newpath); err != nil {
+			t.Fatalf("Stat(%q) after Rename from %q failed: %v", newpath, oldpath, err)
+		}
+		if path.Clean("/"+oldpath) != path.Clean("/"+newpath) {
+			if _, err := cfs.Stat(oldpath); !errors.Is(err, fs.ErrNotExist) {
+				t.Fatalf("Stat(%q) after Rename to %q error = %v, want not exist", oldpath, newpath, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,110 @@
+package cowfs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+
+	"github.com/absfs/absfs"
+)
+
+// GCResult reports what GC reclaimed.
+type GCResult struct {
+	Removed int   // Secondary copies removed
+	Bytes   int64 // Size of the removed copies
+}
+
+// GC removes secondary copies of regular files that have the same contents
+// and permission bits as their primary counterparts, clearing their modified
+// flag so reads go back to the primary. This reclaims space after copy-ups
+// that turned out to change nothing, such as a Chmod that was later undone.
+// Modification times and ownership are not compared.
+//
+// Mutations are held back while GC runs. Writes made through already open
+// file handles are not tracked; close writable handles before calling GC.
+func (cfs *FileSystem) GC() (GCResult, error) {
+	cfs.opMu.Lock()
+	defer cfs.opMu.Unlock()
+	if cfs.frozen.Load() {
+		return GCResult{}, ErrFrozen
+	}
+	cfs.flushDeletions()
+
+	var res GCResult
+	modified, _ := cfs.state()
+	for _, name := range modified {
+		if cfs.isOpaque(path.Dir(name)) {
+			continue // The primary version is hidden
+		}
+		size, same, err := cfs.sameAsPrimary(name)
+		if err != nil {
+			return res, err
+		}
+		if !same {
+			continue
+		}
+		if err := cfs.txTouch(name); err != nil {
+			return res, err
+		}
+		if err := cfs.secondary.Remove(name); err != nil {
+			return res, err
+		}
+		cfs.mu.Lock()
+		delete(cfs.modified, name)
+		cfs.mu.Unlock()
+		cfs.setDelta(name, false)
+		cfs.dropBase(name)
+		cfs.adjustQuota("gc", name, -size)
+		res.Removed++
+		res.Bytes += size
+		cfs.debug("cowfs: gc", "path", name, "bytes", size)
+	}
+	if res.Removed > 0 {
+		cfs.gen.Add(1)
+		cfs.stateChanged()
+	}
+	return res, nil
+}
+
+// sameAsPrimary reports whether the modified file name is a regular file
+// identical to its primary counterpart, along with the size of its secondary
+// copy. Paths missing from either layer are reported as different.
+func (cfs *FileSystem) sameAsPrimary(name string) (int64, bool, error) {
+	pinfo, err := cfs.primary.Stat(name)
+	if err != nil || !pinfo.Mode().IsRegular() {
+		return 0, false, nil
+	}
+	sinfo, err := cfs.secondary.Stat(name)
+	if err != nil || !sinfo.Mode().IsRegular() || sinfo.Mode() != pinfo.Mode() {
+		return 0, false, nil
+	}
+
+	var sf absfs.File
+	if cfs.isDelta(name) {
+		sf, err = cfs.openDelta(name)
+	} else {
+		sf, err = cfs.secondary.OpenFile(name, os.O_RDONLY, 0)
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	defer sf.Close()
+	if info, err := sf.Stat(); err != nil || info.Size() != pinfo.Size() {
+		return 0, false, err
+	}
+	pf, err := cfs.primary.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, false, err
+	}
+	defer pf.Close()
+
+	ph, sh := cfs.newHash(), cfs.newHash()
+	if _, err := io.Copy(ph, pf); err != nil {
+		return 0, false, err
+	}
+	if _, err := io.Copy(sh, sf); err != nil {
+		return 0, false, err
+	}
+	return sinfo.Size(), bytes.Equal(ph.Sum(nil), sh.Sum(nil)), nil
+}
@@ -0,0 +1,58 @@
+package cowfs
+
+import (
+	"os"
+	"testing"
+)
+
+func TestGC(t *testing.T) {
+	cfs, primary, secondary := newMemOverlay(t)
+	writeMemFile(t, primary, "/same.txt", "same")
+	writeMemFile(t, primary, "/chmod.txt", "mode")
+	writeMemFile(t, primary, "/edited.txt", "old")
+	if err := primary.Chmod("/same.txt", 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := primary.Chmod("/chmod.txt", 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cfs.Chmod("/same.txt", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Chmod("/same.txt", 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Chmod("/chmod.txt", 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := cfs.OpenFile("/edited.txt", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("new"))
+	f.Close()
+
+	res, err := cfs.GC()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Removed != 1 || res.Bytes != 4 {
+		t.Errorf("GC() = %+v, want 1 file of 4 bytes", res)
+	}
+	if _, err := secondary.Stat("/same.txt"); !os.IsNotExist(err) {
+		t.Errorf("secondary copy of /same.txt still present: %v", err)
+	}
+	if cfs.modified["/same.txt"] {
+		t.Error("/same.txt still marked modified")
+	}
+	if data, err := cfs.ReadFile("/same.txt"); err != nil || string(data) != "same" {
+		t.Errorf("ReadFile(/same.txt) = %q, %v", data, err)
+	}
+	if info, err := cfs.Stat("/chmod.txt"); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Stat(/chmod.txt) = %v, %v; want mode 0600 kept", info, err)
+	}
+	if data, _ := cfs.ReadFile("/edited.txt"); string(data) != "new" {
+		t.Errorf("ReadFile(/edited.txt) = %q, want new", data)
+	}
+}
@@ -5,7 +5,17 @@ go 1.21
 require (
 	github.com/absfs/absfs v1.0.0
 	github.com/absfs/fstesting v1.0.0
+	github.com/absfs/inode v1.0.0
 	github.com/absfs/memfs v1.0.0
+	go.opentelemetry.io/otel v1.24.0
+	go.opentelemetry.io/otel/sdk v1.24.0
+	go.opentelemetry.io/otel/trace v1.24.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
-require github.com/absfs/inode v1.0.0 // indirect
+require (
+	github.com/go-logr/logr v1.4.1 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	go.opentelemetry.io/otel/metric v1.24.0 // indirect
+	golang.org/x/sys v0.17.0 // indirect
+)
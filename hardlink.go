@@ -0,0 +1,197 @@
+package cowfs
+
+import (
+	"errors"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/inode"
+)
+
+// Linker is implemented by filesystems that support hard links.
+type Linker interface {
+	Link(oldname, newname string) error
+}
+
+// LinkPolicy selects what copy-up does with files that have several hard
+// links in the primary.
+type LinkPolicy int
+
+const (
+	// BreakLinks copies up each name of a hard-linked file separately, so
+	// after a copy-up the names no longer share contents in the merged view.
+	// This is the default.
+	BreakLinks LinkPolicy = iota
+
+	// PreserveLinks copies a hard-linked file up once and links all of its
+	// other primary names to the copy in the secondary, so that they keep
+	// sharing contents. It requires the secondary to implement Linker, and
+	// falls back to BreakLinks otherwise. The other names are found by
+	// walking the primary once, the first time a hard-linked file is copied
+	// up; the primary is assumed not to change afterwards.
+	PreserveLinks
+)
+
+// WithLinkPolicy selects how copy-up treats hard-linked primary files.
+func WithLinkPolicy(p LinkPolicy) Option {
+	return func(fs *FileSystem) {
+		fs.linkPolicy = p
+	}
+}
+
+// Link creates newname as a hard link to oldname in the secondary, copying
+// oldname up first if needed. It fails with errors.ErrUnsupported unless
+// the secondary implements Linker.
+func (cfs *FileSystem) Link(oldname, newname string) (err error) {
+	defer cfs.audit(&err, AuditRecord{Op: "link", Path: oldname, NewPath: newname})
+	defer wrapLinkErr(&err, "link", oldname, newname)
+	oldname, newname = cfs.normalize(oldname), cfs.normalize(newname)
+	cfs.awaitCopies(oldname, newname)
+	if err := cfs.access(OpLink, oldname, newname); err != nil {
+		return err
+	}
+	linker, ok := cfs.secondary.(Linker)
+	if !ok {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: errors.ErrUnsupported}
+	}
+	defer cfs.beginOp()()
+	if cfs.frozen.Load() {
+		return ErrFrozen
+	}
+	if z, err := cfs.writeZone(oldname, newname); err != nil {
+		return err
+	} else if z == ZoneWriteThrough {
+		return cfs.linkPrimary(oldname, newname)
+	}
+	cfs.settle(oldname, newname)
+	if err := cfs.txTouch(oldname, newname); err != nil {
+		return err
+	}
+
+	if !cfs.exists(oldname) {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if cfs.exists(newname) {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrExist}
+	}
+	if err := cfs.markModified("link", oldname); err != nil {
+		return err
+	}
+	if err := cfs.materialize(oldname); err != nil {
+		return err
+	}
+	if err := cfs.ensureParent(newname); err != nil {
+		return err
+	}
+	removeAll(cfs.secondary, newname)
+	if err := linker.Link(oldname, newname); err != nil {
+		return err
+	}
+
+	cfs.mu.Lock()
+	cfs.modified[newname] = true
+	delete(cfs.deleted, newname)
+	cfs.mu.Unlock()
+	if err := cfs.syncDirs(newname); err != nil {
+		return err
+	}
+	cfs.notify(Event{Op: EventCreate, Path: newname})
+	return nil
+}
+
+// fileID identifies a file within one filesystem.
+type fileID struct {
+	dev, ino uint64
+}
+
+// fileIDOf extracts the identity and link count of a file from info.Sys,
+// which holds a *syscall.Stat_t for host files and an *inode.Inode for memfs
+// files.
+func fileIDOf(info os.FileInfo) (fileID, uint64, bool) {
+	switch sys := info.Sys().(type) {
+	case *inode.Inode:
+		return fileID{ino: sys.Ino}, sys.Nlink, true
+	}
+	return sysFileID(info)
+}
+
+// linkIndex maps the identities of hard-linked primary files to their names.
+type linkIndex struct {
+	once  sync.Once
+	names map[fileID][]string
+}
+
+// linkedNames returns the other primary names of the regular file name if it
+// has several hard links.
+func (cfs *FileSystem) linkedNames(name string, info os.FileInfo) []string {
+	id, nlink, ok := fileIDOf(info)
+	if !ok || nlink < 2 {
+		return nil
+	}
+	idx := &cfs.linkIdx
+	idx.once.Do(func() {
+		idx.names = make(map[fileID][]string)
+		indexLinks(cfs.primary, "/", idx.names)
+	})
+	var others []string
+	for _, other := range idx.names[id] {
+		if other != name {
+			others = append(others, other)
+		}
+	}
+	return others
+}
+
+func indexLinks(filer absfs.Filer, dir string, names map[fileID][]string) {
+	entries, err := filer.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		name := path.Join(dir, entry.Name())
+		switch {
+		case entry.IsDir():
+			indexLinks(filer, name, names)
+		case entry.Type().IsRegular():
+			info, err := lstatLayer(filer, name)
+			if err != nil {
+				continue
+			}
+			if id, nlink, ok := fileIDOf(info); ok && nlink > 1 {
+				names[id] = append(names[id], name)
+			}
+		}
+	}
+}
+
+// linkSiblings links the other primary names of the just copied-up file
+// name to its secondary copy and marks them modified. Names that have
+// already diverged from the primary are left alone.
+func (cfs *FileSystem) linkSiblings(name string, info os.FileInfo) {
+	linker, ok := cfs.secondary.(Linker)
+	if !ok || cfs.linkPolicy != PreserveLinks {
+		return
+	}
+	for _, other := range cfs.linkedNames(name, info) {
+		cfs.mu.RLock()
+		diverged := cfs.modified[other] || cfs.deleted[other]
+		cfs.mu.RUnlock()
+		if diverged {
+			continue
+		}
+		if err := cfs.ensureSecondaryDir(path.Dir(other)); err != nil {
+			continue
+		}
+		removeAll(cfs.secondary, other)
+		if err := linker.Link(name, other); err != nil {
+			cfs.debug("cowfs: link copy-up failed", "path", other, "target", name, "err", err)
+			continue
+		}
+		cfs.mu.Lock()
+		cfs.modified[other] = true
+		cfs.mu.Unlock()
+		cfs.debug("cowfs: link copy-up", "path", other, "target", name)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || freebsd)
+
+package cowfs
+
+import "os"
+
+func sysFileID(info os.FileInfo) (fileID, uint64, bool) {
+	return fileID{}, 0, false
+}
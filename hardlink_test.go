@@ -0,0 +1,79 @@
+package cowfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/absfs/cowfs/dirfs"
+)
+
+func newLinkedOverlay(t *testing.T, opts ...Option) *FileSystem {
+	t.Helper()
+	pdir, sdir := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(pdir, "a"), []byte("shared"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(pdir, "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(pdir, "a"), filepath.Join(pdir, "d", "b")); err != nil {
+		t.Skipf("hard links unavailable: %v", err)
+	}
+	primary, err := dirfs.New(pdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondary, err := dirfs.New(sdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(primary, secondary, opts...)
+}
+
+func TestLinkPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		policy LinkPolicy
+		want   string
+	}{
+		{BreakLinks, "shared"},
+		{PreserveLinks, "SHARED"},
+	} {
+		cfs := newLinkedOverlay(t, WithLinkPolicy(tt.policy))
+		f, err := cfs.OpenFile("/a", os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte("SHARED"))
+		f.Close()
+
+		if data, err := cfs.ReadFile("/d/b"); err != nil || string(data) != tt.want {
+			t.Errorf("policy %d: ReadFile(/d/b) = %q, %v; want %q", tt.policy, data, err, tt.want)
+		}
+	}
+}
+
+func TestLink(t *testing.T) {
+	cfs := newLinkedOverlay(t)
+	if err := cfs.Link("/a", "/c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Link("/a", "/c"); !errors.Is(err, os.ErrExist) {
+		t.Errorf("Link onto an existing name = %v, want ErrExist", err)
+	}
+	f, err := cfs.OpenFile("/c", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("linked"))
+	f.Close()
+	if data, _ := cfs.ReadFile("/a"); string(data) != "linked" {
+		t.Errorf("ReadFile(/a) = %q, want linked", data)
+	}
+
+	mem, _, _ := newMemOverlay(t)
+	if err := mem.Link("/x", "/y"); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("Link on memfs = %v, want ErrUnsupported", err)
+	}
+}
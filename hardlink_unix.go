@@ -0,0 +1,16 @@
+//go:build linux || darwin || freebsd
+
+package cowfs
+
+import (
+	"os"
+	"syscall"
+)
+
+func sysFileID(info os.FileInfo) (fileID, uint64, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}, 0, false
+	}
+	return fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}, uint64(st.Nlink), true
+}
@@ -0,0 +1,40 @@
+package cowfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+)
+
+// WithHasher sets the hash function the overlay digests file contents with,
+// SHA-256 by default, so that integrators can use the digest algorithm the
+// rest of their system uses, such as one from an xxHash or BLAKE3 package.
+// It is shared by every feature that compares or identifies contents: GC,
+// conflict detection, WithContentStore, BuildManifest and VerifyManifest,
+// and WithVerifyCopyUp given no hash function of its own.
+//
+// Digests made with one hash function do not match those of another, and
+// the fields named SHA256 of FileVersion and ManifestEntry hold digests of
+// the configured function. A content store, the bases kept by conflict
+// detection and manifests to be verified must have been made with the same
+// hash function.
+func WithHasher(newHash func() hash.Hash) Option {
+	return func(fs *FileSystem) {
+		fs.hasher = newHash
+	}
+}
+
+// newHash returns a new hash of the overlay's hash function.
+func (cfs *FileSystem) newHash() hash.Hash {
+	if cfs.hasher == nil {
+		return sha256.New()
+	}
+	return cfs.hasher()
+}
+
+// hashString returns the hex encoded digest of s.
+func (cfs *FileSystem) hashString(s string) string {
+	h := cfs.newHash()
+	h.Write([]byte(s))
+	return hex.EncodeToString(h.Sum(nil))
+}
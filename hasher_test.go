@@ -0,0 +1,58 @@
+package cowfs
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"testing"
+
+	"github.com/absfs/memfs"
+)
+
+func TestHasher(t *testing.T) {
+	primary := must(memfs.NewFS())
+	writeMemFile(t, primary, "/a.txt", "same")
+	writeMemFile(t, primary, "/b.txt", "same")
+	var hashes int
+	crc := func() hash.Hash {
+		hashes++
+		return crc32.NewIEEE()
+	}
+	cfs := New(primary, must(memfs.NewFS()), WithHasher(crc), WithContentStore(nil),
+		WithConflictDetection(), WithVerifyCopyUp(nil))
+
+	for _, name := range []string{"/a.txt", "/b.txt"} {
+		if err := cfs.Chmod(name, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if hashes == 0 {
+		t.Error("copy-ups were not verified with the hasher")
+	}
+	sum := fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte("same")))
+	if got := cfs.ContentStoreStats(); got.Objects != 1 || got.StoredBytes != 4 {
+		t.Errorf("ContentStoreStats = %+v; want the copies sharing 1 object", got)
+	}
+	if _, err := cfs.secondary.(*casSymFiler).objects.Stat(casDir + "/" + sum[:2] + "/" + sum); err != nil {
+		t.Errorf("object not stored by its CRC-32: %v", err)
+	}
+
+	writeMemFile(t, primary, "/a.txt", "changed")
+	conflicts, err := cfs.DetectConflicts()
+	if err != nil || len(conflicts) != 1 || conflicts[0].Base.SHA256 != sum {
+		t.Errorf("DetectConflicts() = %+v, %v; want /a.txt with its CRC-32 base", conflicts, err)
+	}
+
+	m := must(cfs.BuildManifest())
+	if len(m.Root) != 8 {
+		t.Errorf("manifest root %q is not a CRC-32", m.Root)
+	}
+	if drift, err := cfs.VerifyManifest(m); err != nil || len(drift) != 0 {
+		t.Errorf("VerifyManifest() = %v, %v; want no drift", drift, err)
+	}
+	other := New(primary, must(memfs.NewFS()))
+	if _, err := other.VerifyManifest(m); !errors.Is(err, ErrManifestInvalid) {
+		t.Errorf("VerifyManifest() with SHA-256 = %v, want ErrManifestInvalid", err)
+	}
+}
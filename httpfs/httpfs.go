@@ -0,0 +1,24 @@
+// Package httpfs serves the merged view of a cowfs overlay over HTTP. It
+// adapts an overlay to http.FileSystem, so that http.FileServer can serve a
+// base asset tree from the primary with hot overrides from the secondary:
+//
+//	overlay := cowfs.New(assets, overrides)
+//	http.Handle("/", http.FileServer(httpfs.New(overlay)))
+//
+// Directory listings are the merged, name-sorted listings of the overlay,
+// without deleted paths. Modification times are those of the layer a path
+// resolves to, and files are seekable, so conditional and range requests
+// work.
+package httpfs
+
+import (
+	"net/http"
+
+	"github.com/absfs/cowfs"
+)
+
+// New returns an http.FileSystem serving the merged view of cfs. The view is
+// read-only; changes made to cfs are visible to requests that follow them.
+func New(cfs *cowfs.FileSystem) http.FileSystem {
+	return http.FS(cfs.AsFS())
+}
@@ -0,0 +1,86 @@
+package httpfs
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/cowfs"
+	"github.com/absfs/memfs"
+)
+
+func writeFile(t *testing.T, fs absfs.Filer, name, data string) {
+	t.Helper()
+	f, err := fs.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(data))
+	f.Close()
+}
+
+func TestFileServer(t *testing.T) {
+	primary, _ := memfs.NewFS()
+	secondary, _ := memfs.NewFS()
+	primary.Mkdir("/static", 0755)
+	writeFile(t, primary, "/static/app.css", "body { color: black }")
+	writeFile(t, primary, "/static/old.js", "old")
+	overlay := cowfs.New(primary, secondary)
+	if err := overlay.WriteFile("/static/app.css", []byte("body { color: red }"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := overlay.Remove("/static/old.js"); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	overlay.Chtimes("/static/app.css", mtime, mtime)
+
+	server := httptest.NewServer(http.FileServer(New(overlay)))
+	defer server.Close()
+	get := func(path string, header map[string]string) (*http.Response, string) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	resp, body := get("/static/app.css", nil)
+	if body != "body { color: red }" {
+		t.Errorf("GET app.css = %q, want the override", body)
+	}
+	if lm := resp.Header.Get("Last-Modified"); lm != mtime.Format(http.TimeFormat) {
+		t.Errorf("Last-Modified = %q, want %q", lm, mtime.Format(http.TimeFormat))
+	}
+
+	resp, body = get("/static/app.css", map[string]string{"Range": "bytes=7-11"})
+	if resp.StatusCode != http.StatusPartialContent || body != "color" {
+		t.Errorf("range GET = %d %q, want 206 \"color\"", resp.StatusCode, body)
+	}
+
+	resp, body = get("/static/app.css", map[string]string{"If-Modified-Since": mtime.Format(http.TimeFormat)})
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("conditional GET status = %d, want 304", resp.StatusCode)
+	}
+
+	if resp, _ := get("/static/old.js", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET of deleted file status = %d, want 404", resp.StatusCode)
+	}
+
+	_, body = get("/static/", nil)
+	if !strings.Contains(body, "app.css") || strings.Contains(body, "old.js") {
+		t.Errorf("directory listing = %q, want app.css without old.js", body)
+	}
+}
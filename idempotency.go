@@ -0,0 +1,100 @@
+package cowfs
+
+import (
+	"context"
+	"sync"
+)
+
+// maxIdempotencyKeys bounds the number of completed idempotency keys
+// remembered. The oldest keys are forgotten first.
+const maxIdempotencyKeys = 1 << 16
+
+type idempotencyKey struct{}
+
+// WithIdempotencyKey returns a copy of ctx carrying the idempotency key key,
+// for use with Do.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKey{}, key)
+}
+
+// IdempotencyKeyFrom returns the idempotency key carried by ctx, if any.
+func IdempotencyKeyFrom(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(idempotencyKey{}).(string)
+	return key, ok
+}
+
+// Do runs op, which should perform one logical mutation of the overlay,
+// at most once per idempotency key. If ctx carries a key set with
+// WithIdempotencyKey and an operation with that key has already completed
+// successfully, Do returns nil without running op; if one is in progress, Do
+// waits for it and runs op only if it failed. Failed operations are not
+// recorded, so a retry runs them again. Without a key, Do simply runs op.
+//
+// This lets callers that deliver operations at least once, such as queue
+// consumers or RPC bridges that retry on timeouts, apply each of them
+// exactly once. Completed keys are remembered in memory, up to a bounded
+// number of the most recent ones.
+func (cfs *FileSystem) Do(ctx context.Context, op func() error) error {
+	key, ok := IdempotencyKeyFrom(ctx)
+	if !ok {
+		return op()
+	}
+	t := &cfs.idempotency
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		t.mu.Lock()
+		if t.done[key] {
+			t.mu.Unlock()
+			cfs.debug("cowfs: duplicate operation skipped", "key", key)
+			return nil
+		}
+		if wait, ok := t.pending[key]; ok {
+			t.mu.Unlock()
+			select {
+			case <-wait:
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if t.pending == nil {
+			t.pending = make(map[string]chan struct{})
+			t.done = make(map[string]bool)
+		}
+		wait := make(chan struct{})
+		t.pending[key] = wait
+		t.mu.Unlock()
+
+		err := op()
+
+		t.mu.Lock()
+		delete(t.pending, key)
+		if err == nil {
+			t.record(key)
+		}
+		t.mu.Unlock()
+		close(wait)
+		return err
+	}
+}
+
+// idempotencyTable tracks idempotency keys of operations run by Do.
+type idempotencyTable struct {
+	mu      sync.Mutex
+	pending map[string]chan struct{} // Closed when the operation returns
+	done    map[string]bool
+	order   []string // Completed keys, oldest first
+}
+
+// record marks key completed, forgetting the oldest key if the table is
+// full. t.mu must be held.
+func (t *idempotencyTable) record(key string) {
+	if len(t.order) >= maxIdempotencyKeys {
+		delete(t.done, t.order[0])
+		t.order = t.order[1:]
+	}
+	t.done[key] = true
+	t.order = append(t.order, key)
+}
@@ -0,0 +1,71 @@
+package cowfs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDoIdempotent(t *testing.T) {
+	cfs, _, _ := newMemOverlay(t)
+	ctx := WithIdempotencyKey(context.Background(), "op-1")
+
+	var runs atomic.Int32
+	op := func() error {
+		runs.Add(1)
+		return cfs.Mkdir("/dir", 0755)
+	}
+	for i := 0; i < 3; i++ {
+		if err := cfs.Do(ctx, op); err != nil {
+			t.Fatalf("Do() attempt %d error = %v", i, err)
+		}
+	}
+	if runs.Load() != 1 {
+		t.Errorf("op ran %d times, want once", runs.Load())
+	}
+
+	if err := cfs.Do(context.Background(), func() error { runs.Add(1); return nil }); err != nil || runs.Load() != 2 {
+		t.Errorf("Do() without a key did not run op")
+	}
+}
+
+func TestDoRetriesFailures(t *testing.T) {
+	cfs, _, _ := newMemOverlay(t)
+	ctx := WithIdempotencyKey(context.Background(), "op-1")
+	errFailed := errors.New("failed")
+
+	if err := cfs.Do(ctx, func() error { return errFailed }); err != errFailed {
+		t.Fatalf("Do() error = %v, want op's error", err)
+	}
+	ran := false
+	if err := cfs.Do(ctx, func() error { ran = true; return nil }); err != nil || !ran {
+		t.Errorf("retry after failure: ran = %v, err = %v", ran, err)
+	}
+}
+
+func TestDoConcurrent(t *testing.T) {
+	cfs, _, _ := newMemOverlay(t)
+	ctx := WithIdempotencyKey(context.Background(), "op-1")
+
+	var runs atomic.Int32
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cfs.Do(ctx, func() error {
+				runs.Add(1)
+				<-release
+				return nil
+			})
+		}()
+	}
+	close(release)
+	wg.Wait()
+	if runs.Load() != 1 {
+		t.Errorf("op ran %d times concurrently, want once", runs.Load())
+	}
+}
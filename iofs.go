@@ -0,0 +1,192 @@
+package cowfs
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/absfs/absfs"
+)
+
+// ioFS is a read-only io/fs view of a directory of the merged overlay. It
+// implements fs.ReadDirFS, fs.ReadFileFS, fs.StatFS, fs.GlobFS and fs.SubFS,
+// all honoring deletions and merging directory listings across both layers.
+type ioFS struct {
+	cfs  *FileSystem
+	root string // Overlay path of the directory
+}
+
+// Sub returns an io/fs view of the subtree of the merged overlay rooted at
+// the directory dir. The view implements fs.ReadDirFS, fs.ReadFileFS,
+// fs.StatFS, fs.GlobFS and fs.SubFS.
+func (cfs *FileSystem) Sub(dir string) (fs.FS, error) {
+	root := path.Join("/", dir)
+	info, err := cfs.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &fs.PathError{Op: "sub", Path: dir, Err: syscall.ENOTDIR}
+	}
+	return &ioFS{cfs: cfs, root: root}, nil
+}
+
+// AsFS returns a read-only io/fs view of the whole merged overlay, for
+// standard library consumers such as html/template, http.FS or fs.WalkDir.
+// It is Sub("/"): the view implements fs.ReadDirFS, fs.ReadFileFS,
+// fs.StatFS, fs.GlobFS and fs.SubFS, and its files have no write methods.
+func (cfs *FileSystem) AsFS() fs.FS {
+	return &ioFS{cfs: cfs, root: "/"}
+}
+
+// resolve returns the overlay path of the io/fs path name.
+func (f *ioFS) resolve(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return path.Join(f.root, name), nil
+}
+
+// Open implements fs.FS.
+func (f *ioFS) Open(name string) (fs.File, error) {
+	full, err := f.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := f.cfs.OpenFile(full, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, pathError("open", name, err)
+	}
+	if info.IsDir() {
+		return &ioDir{ioFile: ioFile{file}, fsys: f, name: name}, nil
+	}
+	return &ioFile{file}, nil
+}
+
+// Stat implements fs.StatFS.
+func (f *ioFS) Stat(name string) (fs.FileInfo, error) {
+	full, err := f.resolve("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.cfs.Stat(full)
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+	return info, nil
+}
+
+// ReadFile implements fs.ReadFileFS.
+func (f *ioFS) ReadFile(name string) ([]byte, error) {
+	full, err := f.resolve("readfile", name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := f.cfs.ReadFile(full)
+	if err != nil {
+		return nil, pathError("readfile", name, err)
+	}
+	return data, nil
+}
+
+// ReadDir implements fs.ReadDirFS.
+func (f *ioFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	full, err := f.resolve("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := f.cfs.ReadDir(full)
+	if err != nil {
+		return nil, pathError("readdir", name, err)
+	}
+	return entries, nil
+}
+
+// Glob implements fs.GlobFS. Matches are found in the merged directory
+// listings, so they span both layers and exclude deleted paths.
+func (f *ioFS) Glob(pattern string) ([]string, error) {
+	// Hide Glob so that fs.Glob walks ReadDir instead of recursing
+	return fs.Glob(struct{ fs.ReadDirFS }{f}, pattern)
+}
+
+// Sub implements fs.SubFS.
+func (f *ioFS) Sub(dir string) (fs.FS, error) {
+	full, err := f.resolve("sub", dir)
+	if err != nil {
+		return nil, err
+	}
+	if full == f.root {
+		return f, nil
+	}
+	info, err := f.cfs.Stat(full)
+	if err != nil {
+		return nil, pathError("sub", dir, err)
+	}
+	if !info.IsDir() {
+		return nil, &fs.PathError{Op: "sub", Path: dir, Err: syscall.ENOTDIR}
+	}
+	return &ioFS{cfs: f.cfs, root: full}, nil
+}
+
+// ioFile is a file opened through an ioFS. It exposes only the read
+// methods of the underlying handle.
+type ioFile struct {
+	f absfs.File
+}
+
+// Stat implements fs.File.
+func (f *ioFile) Stat() (fs.FileInfo, error) { return f.f.Stat() }
+
+// Read implements fs.File.
+func (f *ioFile) Read(p []byte) (int, error) { return f.f.Read(p) }
+
+// ReadAt implements io.ReaderAt.
+func (f *ioFile) ReadAt(p []byte, off int64) (int, error) { return f.f.ReadAt(p, off) }
+
+// Seek implements io.Seeker.
+func (f *ioFile) Seek(offset int64, whence int) (int64, error) { return f.f.Seek(offset, whence) }
+
+// Close implements fs.File.
+func (f *ioFile) Close() error { return f.f.Close() }
+
+// ioDir is a directory opened through an ioFS. It lists the merged
+// directory in name order, n entries at a time.
+type ioDir struct {
+	ioFile
+	fsys    *ioFS
+	name    string
+	entries []fs.DirEntry
+	read    bool
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (d *ioDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		entries, err := d.fsys.ReadDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.read = entries, true
+	}
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
@@ -0,0 +1,103 @@
+package cowfs
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func newIOFSOverlay(t *testing.T) *FileSystem {
+	t.Helper()
+	cfs, primary, _ := newMemOverlay(t)
+	primary.Mkdir("/dir", 0755)
+	primary.Mkdir("/dir/sub", 0755)
+	writeMemFile(t, primary, "/a.txt", "a")
+	writeMemFile(t, primary, "/b.txt", "b")
+	writeMemFile(t, primary, "/dir/c.txt", "c")
+	writeMemFile(t, primary, "/dir/sub/d.txt", "d")
+
+	f, err := cfs.OpenFile("/a.txt", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(" modified"))
+	f.Close()
+	if err := cfs.Remove("/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	f, err = cfs.OpenFile("/dir/new.txt", os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("new"))
+	f.Close()
+	return cfs
+}
+
+func TestSubFSTest(t *testing.T) {
+	cfs := newIOFSOverlay(t)
+	fsys, err := cfs.Sub("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(fsys, "a.txt", "dir/c.txt", "dir/new.txt", "dir/sub/d.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := cfs.Sub("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(sub, "c.txt", "new.txt", "sub/d.txt"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSubFSOverlay(t *testing.T) {
+	cfs := newIOFSOverlay(t)
+	fsys, err := cfs.Sub("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fs.Stat(fsys, "b.txt"); !os.IsNotExist(err) {
+		t.Errorf("Stat(b.txt) error = %v, want deleted", err)
+	}
+	if data, err := fs.ReadFile(fsys, "a.txt"); err != nil || string(data) != "a modified" {
+		t.Errorf("ReadFile(a.txt) = %q, %v", data, err)
+	}
+	matches, err := fs.Glob(fsys, "*/*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"dir/c.txt", "dir/new.txt"}; !reflect.DeepEqual(matches, want) {
+		t.Errorf("Glob(*/*.txt) = %v, want %v", matches, want)
+	}
+	if _, err := cfs.Sub("/a.txt"); err == nil {
+		t.Error("Sub(/a.txt) succeeded on a file")
+	}
+}
+
+func TestAsFS(t *testing.T) {
+	cfs := newIOFSOverlay(t)
+	fsys := cfs.AsFS()
+	if err := fstest.TestFS(fsys, "a.txt", "dir/c.txt", "dir/new.txt", "dir/sub/d.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := fsys.Open("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, ok := f.(io.Writer); ok {
+		t.Error("AsFS() file has a Write method")
+	}
+	data, err := io.ReadAll(f)
+	if err != nil || string(data) != "a modified" {
+		t.Errorf("ReadAll() = %q, %v, want the modified content", data, err)
+	}
+}
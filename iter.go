@@ -0,0 +1,87 @@
+package cowfs
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// iterMergeLimit is the merge limit of directory iterators on overlays
+// without WithMergeLimit.
+const iterMergeLimit = 4096
+
+// DirIterator steps through the merged listing of a directory one entry at
+// a time. It is returned by ReadDirIter.
+type DirIterator struct {
+	dir   *mergedDirFile
+	batch []os.FileInfo
+	entry fs.DirEntry
+	err   error
+	done  bool
+}
+
+// ReadDirIter returns an iterator over the merged entries of directory
+// name in name order. Unlike ReadDir, which holds both layer listings in
+// memory, the iterator merges with the external sort of WithMergeLimit,
+// using that limit or, without it, a default of a few thousand entries, so
+// memory use does not grow with the size of the directory. Like a directory
+// file, it reflects the overlay at the time of the first call to Next.
+//
+// The iterator must be closed to release the temporary files of a spilled
+// merge.
+func (cfs *FileSystem) ReadDirIter(name string) (_ *DirIterator, err error) {
+	defer wrapErr(&err, "readdir", name)
+	f, err := cfs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	dir, ok := f.(*mergedDirFile)
+	if !ok {
+		f.Close()
+		return nil, syscall.ENOTDIR
+	}
+	if dir.limit <= 0 {
+		dir.limit = iterMergeLimit
+	}
+	return &DirIterator{dir: dir}, nil
+}
+
+// Next advances the iterator to the next entry, which is then available
+// through Entry. It returns false when the listing is exhausted or an error
+// occurred, which Err reports.
+func (it *DirIterator) Next() bool {
+	if len(it.batch) == 0 && !it.done {
+		it.batch, it.err = it.dir.Readdir(it.dir.limit)
+		if it.err == io.EOF {
+			it.err = nil
+			it.done = true
+		} else if it.err != nil {
+			it.done = true
+		}
+	}
+	if len(it.batch) == 0 {
+		it.entry = nil
+		return false
+	}
+	it.entry = fs.FileInfoToDirEntry(it.batch[0])
+	it.batch = it.batch[1:]
+	return true
+}
+
+// Entry returns the current entry.
+func (it *DirIterator) Entry() fs.DirEntry {
+	return it.entry
+}
+
+// Err returns the error, if any, that ended the iteration.
+func (it *DirIterator) Err() error {
+	return it.err
+}
+
+// Close closes the directory and removes the files of a spilled merge.
+func (it *DirIterator) Close() error {
+	it.batch = nil
+	it.done = true
+	return it.dir.Close()
+}
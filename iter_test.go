@@ -0,0 +1,66 @@
+package cowfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestReadDirIter(t *testing.T) {
+	for _, limit := range []int{0, 3} {
+		cfs, primary, secondary := newMemOverlay(t)
+		WithMergeLimit(limit)(cfs)
+		primary.Mkdir("/dir", 0755)
+		var want []string
+		for i := 0; i < 8; i++ {
+			name := fmt.Sprintf("f%d", i)
+			if i%2 == 0 {
+				writeMemFile(t, primary, "/dir/"+name, "p")
+			} else if err := cfs.WriteFile("/dir/"+name, []byte("s"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if i != 4 {
+				want = append(want, name)
+			}
+		}
+		cfs.Remove("/dir/f4")
+
+		it, err := cfs.ReadDirIter("/dir")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for it.Next() {
+			names = append(names, it.Entry().Name())
+		}
+		if err := it.Err(); err != nil {
+			t.Fatalf("limit %d: Err() = %v", limit, err)
+		}
+		if !reflect.DeepEqual(names, want) {
+			t.Errorf("limit %d: iterated %v, want %v", limit, names, want)
+		}
+		if err := it.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := secondary.Stat(spillDir); !os.IsNotExist(err) {
+			t.Errorf("limit %d: spill directory left behind: %v", limit, err)
+		}
+		if limit > 0 && cfs.Stats().MergeSpills != 1 {
+			t.Errorf("limit %d: listing not merged on disk", limit)
+		}
+	}
+}
+
+func TestReadDirIterNotDir(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	writeMemFile(t, primary, "/file", "data")
+	if _, err := cfs.ReadDirIter("/file"); !errors.Is(err, syscall.ENOTDIR) {
+		t.Errorf("ReadDirIter() error = %v, want ENOTDIR", err)
+	}
+	if _, err := cfs.ReadDirIter("/missing"); !os.IsNotExist(err) {
+		t.Errorf("ReadDirIter() error = %v, want not exist", err)
+	}
+}
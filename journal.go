@@ -0,0 +1,372 @@
+package cowfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// journalName is the secondary file holding the journal.
+const journalName = "/.cowfs-journal~"
+
+// WithJournal records each mutating operation in a journal in the secondary
+// before carrying it out, and records its completion afterwards. A write
+// through a handle from OpenFile completes when the handle is closed.
+// Journal records are synced to the secondary before the operation
+// proceeds.
+//
+// New replays the operations a crash left incomplete, from the last one
+// started:
+//
+//   - An interrupted copy-up is rolled back: its partial secondary copy is
+//     removed and the path is served from the primary again, instead of the
+//     partial copy masking the primary content.
+//   - A file created or opened for writing and not closed is rolled back
+//     the same way, unless the secondary held it already, in which case
+//     its partial contents are left as they are.
+//   - WriteFile and Rename are rolled forward if their secondary rename
+//     took place, and back otherwise.
+//   - Remove, Chmod, Chtimes, Chown, Lchown and Truncate are carried out
+//     again, on the secondary copy if their copy-up completed.
+//
+// Stats reports the number of operations replayed as JournalRecoveries.
+//
+// Recovery relies on the overlay's markers surviving the crash, so the
+// journal is meant to be combined with WithStateStore. New replays the
+// journal after loading the saved state.
+func WithJournal() Option {
+	return func(fs *FileSystem) {
+		fs.journal = &journal{}
+	}
+}
+
+// journalEntry is a record of the journal: the start of operation Seq, the
+// point after which it is rolled forward if Step is set, or its completion
+// if Done is set.
+type journalEntry struct {
+	Seq     uint64      `json:"seq"`
+	Op      string      `json:"op,omitempty"`
+	Path    string      `json:"path,omitempty"`
+	NewPath string      `json:"newPath,omitempty"`
+	Prior   string      `json:"prior,omitempty"` // Status of Path before a write; see PathStatus
+	Mode    os.FileMode `json:"mode,omitempty"`
+	Size    int64       `json:"size,omitempty"`
+	Atime   *time.Time  `json:"atime,omitempty"`
+	Mtime   *time.Time  `json:"mtime,omitempty"`
+	UID     int         `json:"uid,omitempty"`
+	GID     int         `json:"gid,omitempty"`
+	Step    bool        `json:"step,omitempty"`
+	Done    bool        `json:"done,omitempty"`
+}
+
+// journal tracks the operations in progress.
+type journal struct {
+	mu       sync.Mutex
+	seq      uint64
+	inFlight int
+}
+
+// journalRecord is an operation in progress recorded in the journal. Its
+// methods do nothing on a nil record, which journalOp returns when there is
+// no journal.
+type journalRecord struct {
+	cfs  *FileSystem
+	seq  uint64
+	once sync.Once
+}
+
+// journalOp records the start of the operation e describes. The returned
+// record marks its progress and completion. The journal is emptied whenever
+// no operation is in progress.
+func (cfs *FileSystem) journalOp(e journalEntry) (*journalRecord, error) {
+	j := cfs.journal
+	if j == nil {
+		return nil, nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.seq++
+	e.Seq = j.seq
+	if err := cfs.appendJournal(e); err != nil {
+		return nil, err
+	}
+	j.inFlight++
+	return &journalRecord{cfs: cfs, seq: e.Seq}, nil
+}
+
+// writeEntry returns the journal record of opening name with flag for
+// writing, noting whether the secondary held it before.
+func (cfs *FileSystem) writeEntry(name string, flag int) journalEntry {
+	e := journalEntry{Op: "write", Path: name}
+	if flag&os.O_CREATE != 0 {
+		e.Op = "create"
+	}
+	if cfs.journal == nil {
+		return e
+	}
+	cfs.mu.RLock()
+	switch {
+	case cfs.modified[name]:
+		e.Prior = StatusModified.String()
+	case cfs.deleted[name]:
+		e.Prior = StatusDeleted.String()
+	}
+	cfs.mu.RUnlock()
+	return e
+}
+
+// step records that the operation has taken effect in the secondary, so
+// that recovery completes it instead of undoing it.
+func (r *journalRecord) step() {
+	if r == nil {
+		return
+	}
+	j := r.cfs.journal
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	r.cfs.appendJournal(journalEntry{Seq: r.seq, Step: true})
+}
+
+// done records the completion of the operation. Only the first call has an
+// effect.
+func (r *journalRecord) done() {
+	if r == nil {
+		return
+	}
+	r.once.Do(func() {
+		j := r.cfs.journal
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		j.inFlight--
+		if j.inFlight == 0 {
+			r.cfs.counters.secondary.meta()
+			r.cfs.secondary.Remove(journalName)
+			return
+		}
+		r.cfs.appendJournal(journalEntry{Seq: r.seq, Done: true})
+	})
+}
+
+// journalFile records the completion of the write its file was opened for
+// when it is closed.
+type journalFile struct {
+	absfs.File
+	record *journalRecord
+}
+
+func (f *journalFile) Close() error {
+	err := f.File.Close()
+	f.record.done()
+	return err
+}
+
+func (f *journalFile) ReadFrom(r io.Reader) (int64, error) { return readFrom(f.File, r) }
+func (f *journalFile) WriteTo(w io.Writer) (int64, error)  { return writeTo(f.File, w) }
+
+// appendJournal appends e to the journal and syncs it. j.mu must be held.
+func (cfs *FileSystem) appendJournal(e journalEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	cfs.counters.secondary.write(int64(len(data) + 1))
+	f, err := cfs.secondary.OpenFile(journalName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// recoverJournal replays the operations the journal records as incomplete
+// and empties it. They are replayed from the last one started, so that the
+// copy-ups an operation made are undone before the operation is.
+func (cfs *FileSystem) recoverJournal() {
+	data, err := cfs.secondary.ReadFile(journalName)
+	if err != nil {
+		return
+	}
+	pending := make(map[uint64]journalEntry)
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		var e journalEntry
+		if json.Unmarshal(sc.Bytes(), &e) != nil {
+			break // Torn final record
+		}
+		switch {
+		case e.Step:
+			if p, ok := pending[e.Seq]; ok {
+				p.Step = true
+				pending[e.Seq] = p
+			}
+		case e.Done:
+			delete(pending, e.Seq)
+		default:
+			pending[e.Seq] = e
+		}
+	}
+	entries := make([]journalEntry, 0, len(pending))
+	for _, e := range pending {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Seq > entries[j].Seq })
+
+	for _, e := range entries {
+		if !cfs.replay(e) {
+			cfs.debug("cowfs: incomplete operation left as is", "op", e.Op, "path", e.Path, "newPath", e.NewPath)
+			continue
+		}
+		cfs.counters.journalRecoveries.Add(1)
+		cfs.debug("cowfs: recovered incomplete operation", "op", e.Op, "path", e.Path)
+	}
+	cfs.secondary.Remove(journalName)
+	if len(entries) > 0 {
+		cfs.stateChanged()
+	}
+}
+
+// replay rolls the interrupted operation e back or forward, reporting
+// whether that changed anything.
+func (cfs *FileSystem) replay(e journalEntry) bool {
+	switch e.Op {
+	case "copyup":
+		cfs.discardWrite(e.Path, false)
+	case "create", "write":
+		// Writes to a file the secondary already held cannot be undone
+		if e.Prior == StatusModified.String() {
+			return false
+		}
+		cfs.discardWrite(e.Path, e.Prior == StatusDeleted.String())
+	case "writefile":
+		cfs.secondary.Remove(e.NewPath)
+		if !e.Step {
+			return false // The temporary file never replaced the old one
+		}
+		cfs.mu.Lock()
+		cfs.modified[e.Path] = true
+		delete(cfs.deleted, e.Path)
+		cfs.mu.Unlock()
+		cfs.setDelta(e.Path, false)
+	case "remove":
+		cfs.mu.Lock()
+		cfs.deleted[e.Path] = true
+		delete(cfs.modified, e.Path)
+		cfs.mu.Unlock()
+		cfs.setDelta(e.Path, false)
+		cfs.secondary.Remove(e.Path)
+	case "rename":
+		if !e.Step {
+			return false // Only the copy-ups it made, undone already
+		}
+		return cfs.replayRename(e.Path, e.NewPath)
+	case "chmod", "chtimes", "chown", "lchown", "truncate":
+		return cfs.replayAttr(e)
+	default:
+		return false
+	}
+	return true
+}
+
+// discardWrite removes the secondary copy of name, written by an
+// interrupted operation, so that name is served from the primary again, or
+// is deleted again if it was before.
+func (cfs *FileSystem) discardWrite(name string, deleted bool) {
+	cfs.secondary.Remove(name)
+	cfs.mu.Lock()
+	delete(cfs.modified, name)
+	if deleted {
+		cfs.deleted[name] = true
+	}
+	cfs.mu.Unlock()
+	cfs.setDelta(name, false)
+}
+
+// replayRename moves the overlay state of oldpath and the paths below it to
+// newpath, once the secondary rename of an interrupted Rename took place.
+func (cfs *FileSystem) replayRename(oldpath, newpath string) bool {
+	info, err := lstatLayer(cfs.secondary, newpath)
+	if err != nil {
+		return false
+	}
+	tree := []string{""}
+	var walk func(rel string)
+	walk = func(rel string) {
+		entries, _ := cfs.secondary.ReadDir(newpath + rel)
+		for _, entry := range entries {
+			tree = append(tree, rel+"/"+entry.Name())
+			if entry.IsDir() {
+				walk(rel + "/" + entry.Name())
+			}
+		}
+	}
+	if info.IsDir() {
+		walk("")
+	}
+	_, primaryErr := cfs.primary.Stat(newpath)
+
+	cfs.mu.Lock()
+	defer cfs.mu.Unlock()
+	if info.IsDir() {
+		cfs.clearOpaque(oldpath)
+		if primaryErr == nil {
+			cfs.setOpaque(newpath)
+		}
+	}
+	for _, rel := range tree {
+		cfs.moveMarkers(cfs.normalize(oldpath+rel), cfs.normalize(newpath+rel))
+	}
+	return true
+}
+
+// replayAttr applies the attribute change e, interrupted after the copy-up
+// it needed, to the secondary copy. Without one, the change was undone
+// along with its copy-up.
+func (cfs *FileSystem) replayAttr(e journalEntry) bool {
+	if !cfs.IsModified(e.Path) || cfs.isDelta(e.Path) {
+		return false
+	}
+	info, err := lstatLayer(cfs.secondary, e.Path)
+	if err != nil {
+		return false
+	}
+	switch e.Op {
+	case "chmod":
+		mode := info.Mode().Type() | e.Mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)
+		err = cfs.secondary.Chmod(e.Path, mode)
+	case "chtimes":
+		if e.Atime == nil || e.Mtime == nil {
+			return false
+		}
+		err = cfs.secondary.Chtimes(e.Path, *e.Atime, *e.Mtime)
+	case "chown":
+		err = cfs.secondary.Chown(e.Path, e.UID, e.GID)
+	case "lchown":
+		sl, ok := cfs.secondary.(absfs.SymLinker)
+		if !ok {
+			return false
+		}
+		err = sl.Lchown(e.Path, e.UID, e.GID)
+	case "truncate":
+		var f absfs.File
+		if f, err = cfs.secondary.OpenFile(e.Path, os.O_WRONLY, 0); err == nil {
+			err = f.Truncate(e.Size)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	}
+	return err == nil
+}
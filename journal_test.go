@@ -0,0 +1,180 @@
+package cowfs
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/memfs"
+)
+
+// crashedStore is a StateStore holding the state saved before a crash.
+type crashedStore struct{ state State }
+
+func (c *crashedStore) Load() (State, error) { return c.state, nil }
+func (c *crashedStore) Save(s State) error   { c.state = s; return nil }
+
+func TestJournalRecovery(t *testing.T) {
+	primary, _ := memfs.NewFS()
+	secondary, _ := memfs.NewFS()
+	writeMemFile(t, primary, "/big.txt", "complete primary content")
+	writeMemFile(t, primary, "/gone.txt", "primary")
+
+	// The process died copying /big.txt up and removing /gone.txt, after
+	// the state marking /big.txt modified was saved
+	writeMemFile(t, secondary, "/big.txt", "complete")
+	writeMemFile(t, secondary, "/gone.txt", "copy")
+	writeMemFile(t, secondary, journalName, strings.Join([]string{
+		`{"seq":1,"op":"chmod","path":"/big.txt"}`,
+		`{"seq":2,"op":"copyup","path":"/big.txt"}`,
+		`{"seq":3,"op":"chmod","path":"/other.txt"}`,
+		`{"seq":3,"done":true}`,
+		`{"seq":4,"op":"remove","path":"/gone.txt"}`,
+		`{"seq":5,"op":"cre`,
+	}, "\n"))
+	store := &crashedStore{state: State{Modified: []string{"/big.txt", "/gone.txt"}}}
+
+	cfs := New(primary, secondary, WithStateStore(store), WithJournal())
+	if data, _ := cfs.ReadFile("/big.txt"); string(data) != "complete primary content" {
+		t.Errorf("ReadFile(/big.txt) = %q, want the primary content", data)
+	}
+	if cfs.IsModified("/big.txt") {
+		t.Error("interrupted copy-up still marked modified")
+	}
+	if _, err := cfs.Stat("/gone.txt"); !os.IsNotExist(err) {
+		t.Errorf("Stat(/gone.txt) error = %v, want the removal carried out", err)
+	}
+	if _, err := secondary.Stat(journalName); !os.IsNotExist(err) {
+		t.Error("journal not emptied after recovery")
+	}
+	if s := cfs.Stats(); s.JournalRecoveries != 2 {
+		t.Errorf("JournalRecoveries = %d, want 2", s.JournalRecoveries)
+	}
+	if err := cfs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.state.Modified) != 0 || len(store.state.Deleted) != 1 {
+		t.Errorf("saved state = %+v, want only /gone.txt deleted", store.state)
+	}
+}
+
+func TestJournal(t *testing.T) {
+	cfs, primary, secondary := newMemOverlay(t)
+	WithJournal()(cfs)
+	strategy := &journalPeekStrategy{}
+	WithCopyUpStrategy(strategy)(cfs)
+	writeMemFile(t, primary, "/a.txt", "primary")
+
+	if err := cfs.Chmod("/a.txt", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.WriteFile("/b.txt", []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Rename("/b.txt", "/c.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Remove("/c.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := secondary.Stat(journalName); !os.IsNotExist(err) {
+		t.Error("journal left behind with no operation in progress")
+	}
+	if names := listNames(t, cfs, "/"); len(names) != 1 || names[0] != "a.txt" {
+		t.Errorf("ReadDir(/) = %v, want just a.txt", names)
+	}
+	if !strings.Contains(strategy.journal, `"op":"chmod","path":"/a.txt"`) ||
+		!strings.Contains(strategy.journal, `"op":"copyup","path":"/a.txt"`) {
+		t.Errorf("journal during copy-up = %q, want chmod and copyup records", strategy.journal)
+	}
+}
+
+// journalPeekStrategy copies files, keeping the journal as it was during
+// the copy.
+type journalPeekStrategy struct{ journal string }
+
+func (j *journalPeekStrategy) CopyUp(primary, secondary absfs.Filer, name string, info os.FileInfo) error {
+	data, _ := secondary.ReadFile(journalName)
+	j.journal = string(data)
+	return FullCopy{}.CopyUp(primary, secondary, name, info)
+}
+
+func TestJournalReplay(t *testing.T) {
+	primary, _ := memfs.NewFS()
+	secondary, _ := memfs.NewFS()
+	writeMemFile(t, primary, "/created.txt", "primary")
+	writeMemFile(t, primary, "/mode.txt", "primary")
+	writeMemFile(t, primary, "/old.txt", "primary")
+
+	// The process died writing files through open handles, after WriteFile
+	// and Rename published their secondary renames and after Chmod and
+	// Truncate copied their files up
+	secondary.Mkdir(writeDir, 0700)
+	writeMemFile(t, secondary, "/created.txt", "part")
+	writeMemFile(t, secondary, "/new.txt", "partial")
+	writeMemFile(t, secondary, "/kept.txt", "edited")
+	writeMemFile(t, secondary, "/written.txt", "written")
+	writeMemFile(t, secondary, writeDir+"/9", "unused")
+	writeMemFile(t, secondary, "/mode.txt", "primary")
+	writeMemFile(t, secondary, "/moved.txt", "primary")
+	writeMemFile(t, secondary, journalName, strings.Join([]string{
+		`{"seq":1,"op":"write","path":"/created.txt"}`,
+		`{"seq":2,"op":"create","path":"/new.txt"}`,
+		`{"seq":3,"op":"write","path":"/kept.txt","prior":"modified"}`,
+		`{"seq":4,"op":"writefile","path":"/written.txt","newPath":"` + writeDir + `/8"}`,
+		`{"seq":4,"step":true}`,
+		`{"seq":5,"op":"writefile","path":"/unwritten.txt","newPath":"` + writeDir + `/9"}`,
+		`{"seq":6,"op":"chmod","path":"/mode.txt","mode":384}`,
+		`{"seq":7,"op":"truncate","path":"/mode.txt","size":3}`,
+		`{"seq":8,"op":"rename","path":"/old.txt","newPath":"/moved.txt"}`,
+		`{"seq":8,"step":true}`,
+	}, "\n"))
+	store := &crashedStore{state: State{Modified: []string{"/created.txt", "/new.txt", "/kept.txt", "/mode.txt", "/old.txt"}}}
+
+	cfs := New(primary, secondary, WithStateStore(store), WithJournal())
+	for name, want := range map[string]string{
+		"/created.txt": "primary",
+		"/kept.txt":    "edited",
+		"/written.txt": "written",
+		"/mode.txt":    "pri",
+		"/moved.txt":   "primary",
+	} {
+		if data, err := cfs.ReadFile(name); err != nil || string(data) != want {
+			t.Errorf("ReadFile(%s) = %q, %v, want %q", name, data, err, want)
+		}
+	}
+	for _, name := range []string{"/new.txt", "/old.txt", "/unwritten.txt"} {
+		if _, err := cfs.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("Stat(%s) error = %v, want not exist", name, err)
+		}
+	}
+	if info, err := cfs.Stat("/mode.txt"); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Stat(/mode.txt) = %v, %v, want mode 0600", info, err)
+	}
+	if _, err := secondary.Stat(writeDir + "/9"); !os.IsNotExist(err) {
+		t.Error("temporary file of the interrupted WriteFile left behind")
+	}
+	if s := cfs.Stats(); s.JournalRecoveries != 6 {
+		t.Errorf("JournalRecoveries = %d, want 6", s.JournalRecoveries)
+	}
+}
+
+func TestJournalWriteHandle(t *testing.T) {
+	cfs, _, secondary := newMemOverlay(t)
+	WithJournal()(cfs)
+
+	f, err := cfs.OpenFile("/a.txt", os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := secondary.ReadFile(journalName); !strings.Contains(string(data), `"op":"create","path":"/a.txt"`) {
+		t.Errorf("journal with an open handle = %q, want a create record", data)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := secondary.Stat(journalName); !os.IsNotExist(err) {
+		t.Error("journal left behind after the handle was closed")
+	}
+}
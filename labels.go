@@ -0,0 +1,67 @@
+package cowfs
+
+import (
+	"fmt"
+	"io/fs"
+	"strings"
+	"sync"
+)
+
+// labelPAXPrefix prefixes the PAX global header records that carry labels
+// in tar streams written by ExportTar.
+const labelPAXPrefix = "COWFS.label."
+
+// labelSet holds the labels attached to an overlay.
+type labelSet struct {
+	mu     sync.RWMutex
+	labels map[string]string
+}
+
+// WithLabels attaches the given key/value labels to the overlay. See
+// SetLabel.
+func WithLabels(labels map[string]string) Option {
+	return func(fs *FileSystem) {
+		for k, v := range labels {
+			fs.SetLabel(k, v)
+		}
+	}
+}
+
+// SetLabel attaches the label key=value to the overlay, replacing any
+// previous value of key; an empty value removes the label. Labels carry no
+// meaning to the overlay itself. They identify it to tooling managing many
+// overlays, for example "build=1234" or "tenant=acme", and travel with the
+// layer tarballs written by ExportTar.
+//
+// Keys must be non-empty and must not contain "=" or NUL characters.
+func (cfs *FileSystem) SetLabel(key, value string) error {
+	if !validLabelKey(key) {
+		return fmt.Errorf("cowfs: invalid label key %q: %w", key, fs.ErrInvalid)
+	}
+	cfs.labels.mu.Lock()
+	defer cfs.labels.mu.Unlock()
+	if value == "" {
+		delete(cfs.labels.labels, key)
+		return nil
+	}
+	if cfs.labels.labels == nil {
+		cfs.labels.labels = make(map[string]string)
+	}
+	cfs.labels.labels[key] = value
+	return nil
+}
+
+// GetLabels returns a copy of the labels attached to the overlay.
+func (cfs *FileSystem) GetLabels() map[string]string {
+	cfs.labels.mu.RLock()
+	defer cfs.labels.mu.RUnlock()
+	labels := make(map[string]string, len(cfs.labels.labels))
+	for k, v := range cfs.labels.labels {
+		labels[k] = v
+	}
+	return labels
+}
+
+func validLabelKey(key string) bool {
+	return key != "" && !strings.ContainsAny(key, "=\x00")
+}
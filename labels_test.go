@@ -0,0 +1,75 @@
+package cowfs
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLabels(t *testing.T) {
+	cfs, _, _ := newMemOverlay(t)
+	WithLabels(map[string]string{"tenant": "acme"})(cfs)
+
+	if err := cfs.SetLabel("build", "1234"); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"tenant": "acme", "build": "1234"}
+	if got := cfs.GetLabels(); !reflect.DeepEqual(got, want) {
+		t.Errorf("GetLabels() = %v, want %v", got, want)
+	}
+	cfs.GetLabels()["tenant"] = "other"
+	cfs.SetLabel("build", "")
+	if got := cfs.GetLabels(); !reflect.DeepEqual(got, map[string]string{"tenant": "acme"}) {
+		t.Errorf("GetLabels() after removal = %v", got)
+	}
+	for _, key := range []string{"", "a=b"} {
+		if err := cfs.SetLabel(key, "x"); !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("SetLabel(%q) error = %v, want fs.ErrInvalid", key, err)
+		}
+	}
+}
+
+func TestLabelsTarRoundTrip(t *testing.T) {
+	src, primary, _ := newMemOverlay(t)
+	writeMemFile(t, primary, "/a.txt", "a")
+	src.SetLabel("tenant", "acme")
+	src.Chmod("/a.txt", 0600)
+
+	var buf bytes.Buffer
+	if err := src.ExportTar(&buf); err != nil {
+		t.Fatal(err)
+	}
+	dst, _, _ := newMemOverlay(t)
+	if err := dst.ImportTar(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := dst.GetLabels()["tenant"]; got != "acme" {
+		t.Errorf("imported label tenant = %q, want acme", got)
+	}
+	if !dst.IsModified("/a.txt") {
+		t.Error("file entry not imported after the label header")
+	}
+}
+
+func TestConfigLabels(t *testing.T) {
+	cfg, err := LoadConfig(strings.NewReader(`{"primary": {"type": "memfs"}, "secondary": {"type": "memfs"}, "labels": {"build": "1234"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfs, err := FromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfs.GetLabels()["build"]; got != "1234" {
+		t.Errorf("label build = %q, want 1234", got)
+	}
+
+	cfg.Labels = map[string]string{"a=b": "c"}
+	var cerr *ConfigError
+	if _, err := FromConfig(cfg); !errors.As(err, &cerr) || cerr.Field != "labels" {
+		t.Errorf("FromConfig() error = %v, want a labels ConfigError", err)
+	}
+}
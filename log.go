@@ -0,0 +1,23 @@
+package cowfs
+
+import (
+	"context"
+	"log/slog"
+)
+
+// WithLogger logs copy-ups, deletions, renames and layer fallback decisions
+// to logger at debug level, with the paths involved, byte counts and
+// durations.
+func WithLogger(logger *slog.Logger) Option {
+	return func(fs *FileSystem) {
+		fs.logger = logger
+	}
+}
+
+// debug logs msg at debug level if a logger is configured.
+func (cfs *FileSystem) debug(msg string, args ...any) {
+	if cfs.logger == nil || !cfs.logger.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	cfs.logger.Debug(msg, args...)
+}
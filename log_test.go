@@ -0,0 +1,47 @@
+package cowfs
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestWithLogger(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	var buf bytes.Buffer
+	WithLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))(cfs)
+	writeMemFile(t, primary, "/a.txt", "aaaa")
+
+	if err := cfs.Rename("/a.txt", "/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	cfs.Remove("/b.txt")
+	cfs.Stat("/missing")
+
+	out := buf.String()
+	for _, want := range []string{
+		`msg="cowfs: copy-up" path=/a.txt bytes=4 duration=`,
+		`msg="cowfs: rename" old=/a.txt new=/b.txt copiedUp=true`,
+		`msg="cowfs: remove" path=/b.txt`,
+		`msg="cowfs: fallback to secondary" op=stat path=/missing`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestWithLoggerLevel(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	var buf bytes.Buffer
+	WithLogger(slog.New(slog.NewTextHandler(&buf, nil)))(cfs)
+	writeMemFile(t, primary, "/a.txt", "aaaa")
+
+	if err := cfs.Chmod("/a.txt", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("debug records logged at info level:\n%s", buf.String())
+	}
+}
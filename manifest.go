@@ -0,0 +1,200 @@
+package cowfs
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ErrManifestInvalid is returned by VerifyManifest for a manifest whose
+// hashes do not add up to its root hash, such as one edited after it was
+// built.
+var ErrManifestInvalid = errors.New("cowfs: manifest hashes do not match its root")
+
+// Manifest is a Merkle tree of the merged view, as built by BuildManifest:
+// the hash of every file and directory, SHA-256 unless set with WithHasher, each directory's hash covering the
+// names, modes and hashes of its entries, up to the root hash, which
+// identifies the whole tree. Attesting to the root hash attests to exactly
+// what the overlay exposes. A Manifest encodes to JSON as is.
+type Manifest struct {
+	Root    string          `json:"root"`    // Hash of the root directory, hex encoded
+	Entries []ManifestEntry `json:"entries"` // In lexical path order, starting with "/"
+}
+
+// ManifestEntry is a file or directory of a Manifest.
+type ManifestEntry struct {
+	Path   string      `json:"path"`
+	Mode   fs.FileMode `json:"mode"`
+	Size   int64       `json:"size,omitempty"`   // Size of a regular file
+	Target string      `json:"target,omitempty"` // Target of a symbolic link
+	SHA256 string      `json:"sha256"`           // Hex encoded
+}
+
+// ManifestDrift is a path whose entry in the merged view differs from a
+// Manifest. Want is nil for a path the manifest lacks, and Got is nil for a
+// path the merged view lacks.
+type ManifestDrift struct {
+	Path string
+	Want *ManifestEntry // The manifest's entry
+	Got  *ManifestEntry // The merged view's entry
+}
+
+// BuildManifest hashes the merged view into a Manifest. Regular files are
+// hashed by their contents, symbolic links, which are not followed, by
+// their targets, and directories by their entries; modification times and
+// ownership are left out, so that the same tree built twice has the same
+// root hash. Other special files are recorded by their mode alone.
+//
+// BuildManifest reads every file in the merged view. Changes made while it
+// runs may or may not be reflected; use Barrier or Freeze for a manifest of
+// a settled state.
+func (cfs *FileSystem) BuildManifest() (*Manifest, error) {
+	m := &Manifest{}
+	err := cfs.Walk("/", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		e := ManifestEntry{Path: name, Mode: info.Mode()}
+		switch {
+		case info.Mode().IsRegular():
+			e.Size = info.Size()
+			if e.SHA256, err = cfs.hashFile(name); err != nil {
+				return err
+			}
+		case info.Mode()&fs.ModeSymlink != 0:
+			if e.Target, err = cfs.Readlink(name); err != nil {
+				return err
+			}
+			e.SHA256 = cfs.hashString(e.Target)
+		case !info.IsDir():
+			e.SHA256 = cfs.hashString("")
+		}
+		m.Entries = append(m.Entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	m.Root = hashDirs(m.Entries, cfs.hashString)
+	return m, nil
+}
+
+// VerifyManifest compares the merged view with m, returning the paths that
+// differ, in lexical order, or none if the overlay still exposes exactly
+// what m describes. It fails with ErrManifestInvalid if the hashes of m do
+// not add up to its root hash, so that only the root hash of a manifest
+// needs to come from a trusted source.
+func (cfs *FileSystem) VerifyManifest(m *Manifest) ([]ManifestDrift, error) {
+	want := append([]ManifestEntry(nil), m.Entries...)
+	if hashDirs(want, cfs.hashString) != m.Root || !sameEntries(want, m.Entries) {
+		return nil, ErrManifestInvalid
+	}
+	got, err := cfs.BuildManifest()
+	if err != nil {
+		return nil, err
+	}
+	if got.Root == m.Root {
+		return nil, nil
+	}
+
+	var drift []ManifestDrift
+	wanted := make(map[string]*ManifestEntry, len(m.Entries))
+	for i := range m.Entries {
+		wanted[m.Entries[i].Path] = &m.Entries[i]
+	}
+	for i := range got.Entries {
+		g := &got.Entries[i]
+		w, ok := wanted[g.Path]
+		delete(wanted, g.Path)
+		switch {
+		case !ok:
+			drift = append(drift, ManifestDrift{Path: g.Path, Got: g})
+		case w.Mode != g.Mode || !g.Mode.IsDir() && w.SHA256 != g.SHA256:
+			// Directories drift through their entries, which are listed
+			drift = append(drift, ManifestDrift{Path: g.Path, Want: w, Got: g})
+		}
+	}
+	for name, w := range wanted {
+		drift = append(drift, ManifestDrift{Path: name, Want: w})
+	}
+	sort.Slice(drift, func(i, j int) bool { return drift[i].Path < drift[j].Path })
+	return drift, nil
+}
+
+// hashFile returns the hex encoded digest of the contents of the merged
+// file name.
+func (cfs *FileSystem) hashFile(name string) (string, error) {
+	f, err := cfs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := cfs.newHash()
+	if _, err := cfs.copyBuffers().copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashDirs sets the hashes of the directories among entries from those of
+// their entries, deepest first, with hashString, and returns the hash of the
+// root.
+func hashDirs(entries []ManifestEntry, hashString func(string) string) string {
+	order := make([]int, len(entries))
+	for i := range order {
+		order[i] = i
+	}
+	depth := func(name string) int {
+		if name == "/" {
+			return 0
+		}
+		return strings.Count(name, "/")
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return depth(entries[order[a]].Path) > depth(entries[order[b]].Path)
+	})
+
+	listings := make(map[string]*strings.Builder)
+	root := hashString("")
+	for _, i := range order {
+		e := &entries[i]
+		if e.Mode.IsDir() {
+			var listing string
+			if b := listings[e.Path]; b != nil {
+				listing = b.String()
+			}
+			e.SHA256 = hashString(listing)
+		}
+		if e.Path == "/" {
+			root = e.SHA256
+			continue
+		}
+		dir := path.Dir(e.Path)
+		b := listings[dir]
+		if b == nil {
+			b = &strings.Builder{}
+			listings[dir] = b
+		}
+		fmt.Fprintf(b, "%s %s %s\n", e.Mode, path.Base(e.Path), e.SHA256)
+	}
+	return root
+}
+
+// sameEntries reports whether a and b have the same hashes.
+func sameEntries(a, b []ManifestEntry) bool {
+	for i := range a {
+		if a[i].SHA256 != b[i].SHA256 {
+			return false
+		}
+	}
+	return true
+}
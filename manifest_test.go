@@ -0,0 +1,73 @@
+package cowfs
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	primary.Mkdir("/bin", 0755)
+	writeMemFile(t, primary, "/bin/sh", "shell")
+	writeMemFile(t, primary, "/bin/ls", "list")
+	if err := cfs.WriteFile("/etc.conf", []byte("conf"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := cfs.BuildManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, e := range m.Entries {
+		paths = append(paths, e.Path)
+	}
+	if want := []string{"/", "/bin", "/bin/ls", "/bin/sh", "/etc.conf"}; !slices.Equal(paths, want) {
+		t.Errorf("manifest paths = %v; want %v", paths, want)
+	}
+	if m.Entries[0].SHA256 != m.Root {
+		t.Errorf("root entry hash %s; want the root hash %s", m.Entries[0].SHA256, m.Root)
+	}
+	again, err := cfs.BuildManifest()
+	if err != nil || again.Root != m.Root {
+		t.Errorf("rebuilt root = %v, %v; want %s", again.Root, err, m.Root)
+	}
+	if drift, err := cfs.VerifyManifest(m); err != nil || len(drift) != 0 {
+		t.Errorf("VerifyManifest of an unchanged overlay = %v, %v", drift, err)
+	}
+
+	// Changes below a directory change the root hash and are reported
+	if err := cfs.WriteFile("/bin/sh", []byte("patched"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Remove("/bin/ls"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.WriteFile("/bin/cat", []byte("cat"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	drift, err := cfs.VerifyManifest(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drift) != 3 || drift[0].Path != "/bin/cat" || drift[0].Want != nil ||
+		drift[1].Path != "/bin/ls" || drift[1].Got != nil ||
+		drift[2].Path != "/bin/sh" || drift[2].Want == nil || drift[2].Got == nil {
+		t.Errorf("VerifyManifest after changes = %+v", drift)
+	}
+
+	// A manifest edited to match the drifted overlay no longer adds up
+	data, _ := json.Marshal(m)
+	var forged Manifest
+	json.Unmarshal(data, &forged)
+	for i := range forged.Entries {
+		if forged.Entries[i].Path == "/bin/sh" {
+			forged.Entries[i].SHA256 = drift[2].Got.SHA256
+		}
+	}
+	if _, err := cfs.VerifyManifest(&forged); !errors.Is(err, ErrManifestInvalid) {
+		t.Errorf("VerifyManifest of a forged manifest = %v; want ErrManifestInvalid", err)
+	}
+}
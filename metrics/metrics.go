@@ -0,0 +1,192 @@
+// Package metrics exports the Stats of cowfs overlays to standard
+// monitoring systems: as expvar variables, which /debug/vars serves, and in
+// the Prometheus text exposition format, so that copy-up rates and layer
+// hit ratios show up in dashboards without custom glue:
+//
+//	metrics.Publish("cowfs", overlay)
+//
+//	exp := metrics.NewExporter()
+//	exp.Add("build", overlay)
+//	http.Handle("/metrics", exp)
+//
+// The exporter writes the exposition format itself rather than
+// implementing prometheus.Collector, so that using it does not add the
+// Prometheus client library to every program built with cowfs; Prometheus
+// and compatible agents scrape it as they would a client library's handler.
+package metrics
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/absfs/cowfs"
+)
+
+// Publish publishes the Stats of cfs as the expvar variable name, a map of
+// the counters keyed as by Stats.Map. Like expvar.Publish, it panics if name
+// is already published.
+func Publish(name string, cfs *cowfs.FileSystem) {
+	expvar.Publish(name, expvar.Func(func() any {
+		return cfs.Stats().Map()
+	}))
+}
+
+// gauges are the Stats.Map keys of values that go up and down, which are
+// exported as Prometheus gauges; all others are counters.
+var gauges = map[string]bool{
+	"copy_ups_in_flight":    true,
+	"copy_ups_waiting":      true,
+	"modified":              true,
+	"deleted":               true,
+	"deferred_chowns":       true,
+	"deletion_backlog":      true,
+	"write_back_backlog":    true,
+	"content_cache_entries": true,
+	"content_cache_bytes":   true,
+	"promotion_entries":     true,
+	"promotion_bytes":       true,
+}
+
+// Exporter serves the Stats of a set of overlays in the Prometheus text
+// exposition format. Each metric is named "cowfs_" followed by its
+// Stats.Map key, with "_total" appended for counters, and carries the
+// label overlay with the name the overlay was added under, along with the
+// overlay's own labels. An Exporter is safe for concurrent use.
+type Exporter struct {
+	mu       sync.Mutex
+	overlays map[string]*cowfs.FileSystem
+}
+
+// NewExporter returns an Exporter serving no overlays yet.
+func NewExporter() *Exporter {
+	return &Exporter{overlays: make(map[string]*cowfs.FileSystem)}
+}
+
+// Add exports the Stats of cfs under name, replacing an overlay added
+// under the same name.
+func (e *Exporter) Add(name string, cfs *cowfs.FileSystem) {
+	e.mu.Lock()
+	e.overlays[name] = cfs
+	e.mu.Unlock()
+}
+
+// Remove stops exporting the overlay added under name.
+func (e *Exporter) Remove(name string) {
+	e.mu.Lock()
+	delete(e.overlays, name)
+	e.mu.Unlock()
+}
+
+// ServeHTTP writes the metrics of the overlays.
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	e.WriteTo(w)
+}
+
+// sample is a value of one overlay for a metric.
+type sample struct {
+	labels string
+	value  float64
+}
+
+// WriteTo writes the metrics of the overlays to w in the text exposition
+// format, metrics and overlays sorted by name.
+func (e *Exporter) WriteTo(w io.Writer) (int64, error) {
+	e.mu.Lock()
+	names := make([]string, 0, len(e.overlays))
+	for name := range e.overlays {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	samples := make(map[string][]sample)
+	for _, name := range names {
+		cfs := e.overlays[name]
+		labels := formatLabels(name, cfs.GetLabels())
+		for key, value := range cfs.Stats().Map() {
+			samples[key] = append(samples[key], sample{labels: labels, value: value})
+		}
+	}
+	e.mu.Unlock()
+
+	keys := make([]string, 0, len(samples))
+	for key := range samples {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, key := range keys {
+		metric, kind := "cowfs_"+key+"_total", "counter"
+		if gauges[key] {
+			metric, kind = "cowfs_"+key, "gauge"
+		}
+		fmt.Fprintf(bw, "# TYPE %s %s\n", metric, kind)
+		for _, s := range samples[key] {
+			fmt.Fprintf(bw, "%s%s %s\n", metric, s.labels, strconv.FormatFloat(s.value, 'g', -1, 64))
+		}
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// formatLabels formats the label set of an overlay added under name with
+// the labels it carries. Label keys that are not valid Prometheus label
+// names have their invalid characters replaced by underscores.
+func formatLabels(name string, labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		if key != "overlay" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(`{overlay="`)
+	b.WriteString(escapeLabel(name))
+	b.WriteByte('"')
+	for _, key := range keys {
+		fmt.Fprintf(&b, `,%s="%s"`, labelName(key), escapeLabel(labels[key]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// labelName maps key to a valid Prometheus label name.
+func labelName(key string) string {
+	b := []byte(key)
+	for i, c := range b {
+		valid := c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || i > 0 && '0' <= c && c <= '9'
+		if !valid {
+			b[i] = '_'
+		}
+	}
+	if strings.HasPrefix(string(b), "__") {
+		return "label" + string(b) // Names starting with "__" are reserved
+	}
+	return string(b)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/absfs/cowfs"
+	"github.com/absfs/memfs"
+)
+
+func newOverlay(t *testing.T, opts ...cowfs.Option) *cowfs.FileSystem {
+	t.Helper()
+	primary, err := memfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondary, err := memfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := primary.OpenFile("/file", os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("data"))
+	f.Close()
+	return cowfs.New(primary, secondary, opts...)
+}
+
+func TestPublish(t *testing.T) {
+	cfs := newOverlay(t)
+	if err := cfs.Chmod("/file", 0600); err != nil {
+		t.Fatal(err)
+	}
+	Publish("cowfs_test", cfs)
+
+	var m map[string]float64
+	if err := json.Unmarshal([]byte(expvar.Get("cowfs_test").String()), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m["copy_ups"] != 1 || m["modified"] != 1 {
+		t.Errorf("published copy_ups = %v, modified = %v; want 1 and 1", m["copy_ups"], m["modified"])
+	}
+}
+
+func TestExporter(t *testing.T) {
+	build := newOverlay(t, cowfs.WithLabels(map[string]string{"team": `a"b`, "job-id": "7"}))
+	if _, err := build.ReadFile("/file"); err != nil {
+		t.Fatal(err)
+	}
+	e := NewExporter()
+	e.Add("build", build)
+	e.Add("idle", newOverlay(t))
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE cowfs_primary_hits_total counter\n",
+		`cowfs_primary_hits_total{overlay="build",job_id="7",team="a\"b"} 1` + "\n",
+		`cowfs_primary_hits_total{overlay="idle"} 0` + "\n",
+		"# TYPE cowfs_modified gauge\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("exposition lacks %q:\n%s", want, body)
+		}
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	e.Remove("idle")
+	var b strings.Builder
+	if _, err := e.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(b.String(), `overlay="idle"`) {
+		t.Error("removed overlay still exported")
+	}
+}
@@ -0,0 +1,161 @@
+package cowfs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// NamespaceFS is a writable view of an overlay rooted at a path prefix; see
+// Namespace.
+type NamespaceFS struct {
+	prefixFiler
+	cfs *FileSystem
+}
+
+// Namespace returns a writable view of the overlay rooted at prefix, for
+// tenants that must share one overlay. Every path used with the returned
+// view is cleaned and joined to prefix, so ".." cannot reach outside it, and
+// paths in returned errors and file names are relative to the namespace.
+//
+// The view keeps no state of its own: reads and writes go through this
+// overlay, see its merged view, copy up from its primary and are recorded
+// in its state, so changes made through the overlay show in the namespace
+// at once, and Stats, ExportTar and the like on this FileSystem include the
+// namespace's changes. The prefix directory must exist before anything is
+// created in the namespace.
+func (cfs *FileSystem) Namespace(prefix string) *NamespaceFS {
+	return &NamespaceFS{
+		prefixFiler: prefixFiler{fs: cfs, prefix: path.Clean("/" + prefix)},
+		cfs:         cfs,
+	}
+}
+
+// Status reports how name has diverged from the primary.
+func (n *NamespaceFS) Status(name string) PathStatus {
+	return n.cfs.Status(n.path(name))
+}
+
+// IsModified reports whether name has been modified or created through the
+// overlay.
+func (n *NamespaceFS) IsModified(name string) bool {
+	return n.cfs.IsModified(n.path(name))
+}
+
+// IsDeleted reports whether name has been deleted through the overlay.
+func (n *NamespaceFS) IsDeleted(name string) bool {
+	return n.cfs.IsDeleted(n.path(name))
+}
+
+// Symlink creates newname as a symbolic link to oldname, which is stored as
+// given.
+func (n *NamespaceFS) Symlink(oldname, newname string) error {
+	return n.fixErr(n.cfs.Symlink(oldname, n.path(newname)), newname)
+}
+
+// Readlink returns the target of the named symbolic link.
+func (n *NamespaceFS) Readlink(name string) (string, error) {
+	target, err := n.cfs.Readlink(n.path(name))
+	return target, n.fixErr(err, name)
+}
+
+// Lstat returns file info for the named file without following a final
+// symbolic link.
+func (n *NamespaceFS) Lstat(name string) (os.FileInfo, error) {
+	info, err := n.cfs.Lstat(n.path(name))
+	return info, n.fixErr(err, name)
+}
+
+// Lchown changes the owner and group of the named file without following a
+// final symbolic link.
+func (n *NamespaceFS) Lchown(name string, uid, gid int) error {
+	return n.fixErr(n.cfs.Lchown(n.path(name), uid, gid), name)
+}
+
+// prefixFiler confines a Filer to the subtree at prefix.
+type prefixFiler struct {
+	fs     absfs.Filer
+	prefix string
+}
+
+// path maps a namespace path to the underlying path.
+func (p *prefixFiler) path(name string) string {
+	return path.Join(p.prefix, path.Clean("/"+name))
+}
+
+// fixErr rewrites the underlying path in a PathError back to name.
+func (p *prefixFiler) fixErr(err error, name string) error {
+	var pe *os.PathError
+	if errors.As(err, &pe) {
+		return &os.PathError{Op: pe.Op, Path: name, Err: pe.Err}
+	}
+	return err
+}
+
+func (p *prefixFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	f, err := p.fs.OpenFile(p.path(name), flag, perm)
+	if err != nil {
+		return nil, p.fixErr(err, name)
+	}
+	return &prefixFile{File: f, name: name}, nil
+}
+
+func (p *prefixFiler) Mkdir(name string, perm os.FileMode) error {
+	return p.fixErr(p.fs.Mkdir(p.path(name), perm), name)
+}
+
+func (p *prefixFiler) Remove(name string) error {
+	return p.fixErr(p.fs.Remove(p.path(name)), name)
+}
+
+func (p *prefixFiler) Rename(oldpath, newpath string) error {
+	err := p.fs.Rename(p.path(oldpath), p.path(newpath))
+	var le *os.LinkError
+	if errors.As(err, &le) {
+		return &os.LinkError{Op: le.Op, Old: oldpath, New: newpath, Err: le.Err}
+	}
+	return p.fixErr(err, oldpath)
+}
+
+func (p *prefixFiler) Stat(name string) (os.FileInfo, error) {
+	info, err := p.fs.Stat(p.path(name))
+	return info, p.fixErr(err, name)
+}
+
+func (p *prefixFiler) Chmod(name string, mode os.FileMode) error {
+	return p.fixErr(p.fs.Chmod(p.path(name), mode), name)
+}
+
+func (p *prefixFiler) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return p.fixErr(p.fs.Chtimes(p.path(name), atime, mtime), name)
+}
+
+func (p *prefixFiler) Chown(name string, uid, gid int) error {
+	return p.fixErr(p.fs.Chown(p.path(name), uid, gid), name)
+}
+
+func (p *prefixFiler) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := p.fs.ReadDir(p.path(name))
+	return entries, p.fixErr(err, name)
+}
+
+func (p *prefixFiler) ReadFile(name string) ([]byte, error) {
+	data, err := p.fs.ReadFile(p.path(name))
+	return data, p.fixErr(err, name)
+}
+
+func (p *prefixFiler) Sub(dir string) (fs.FS, error) {
+	return absfs.FilerToFS(p, dir)
+}
+
+// prefixFile reports its namespace path as its name.
+type prefixFile struct {
+	absfs.File
+	name string
+}
+
+func (f *prefixFile) Name() string { return f.name }
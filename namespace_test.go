@@ -0,0 +1,97 @@
+package cowfs
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"testing"
+)
+
+func TestNamespace(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	if err := primary.Mkdir("/tenants", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := primary.Mkdir("/tenants/a", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeMemFile(t, primary, "/tenants/a/base.txt", "base")
+	writeMemFile(t, primary, "/secret.txt", "secret")
+
+	ns := cfs.Namespace("/tenants/a")
+	if data, err := ns.ReadFile("/base.txt"); err != nil || string(data) != "base" {
+		t.Fatalf("ReadFile(/base.txt) = %q, %v", data, err)
+	}
+	if _, err := ns.ReadFile("/../../secret.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("ReadFile escaping the namespace = %v, want not exist", err)
+	}
+
+	f, err := ns.OpenFile("/new.txt", os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Name() != "/new.txt" {
+		t.Errorf("Name() = %q, want /new.txt", f.Name())
+	}
+	f.Write([]byte("new"))
+	f.Close()
+	if err := ns.Remove("/base.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes are made through the parent overlay.
+	if data, err := cfs.ReadFile("/tenants/a/new.txt"); err != nil || string(data) != "new" {
+		t.Errorf("parent ReadFile(/tenants/a/new.txt) = %q, %v", data, err)
+	}
+	if _, err := cfs.Stat("/tenants/a/base.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("parent Stat of removed file = %v, want not exist", err)
+	}
+	if data, _ := primary.ReadFile("/tenants/a/base.txt"); string(data) != "base" {
+		t.Errorf("primary modified: %q", data)
+	}
+
+	entries, err := ns.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	if len(names) != 1 || names[0] != "new.txt" {
+		t.Errorf("ReadDir(/) = %v, want [new.txt]", names)
+	}
+
+	_, err = ns.Stat("/missing")
+	var pe *os.PathError
+	if !errors.As(err, &pe) || pe.Path != "/missing" {
+		t.Errorf("Stat error = %v, want PathError for /missing", err)
+	}
+}
+
+func TestNamespaceSharesState(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	if err := primary.Mkdir("/t", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeMemFile(t, primary, "/t/a", "old")
+
+	ns := cfs.Namespace("/t")
+	if err := ns.Remove("/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.WriteFile("/t/a", []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ns.ReadFile("/a"); err != nil || string(data) != "new" {
+		t.Errorf("ReadFile(/a) after a parent write = %q, %v", data, err)
+	}
+	if got, want := ns.Status("/a"), cfs.Status("/t/a"); got != want {
+		t.Errorf("Status(/a) = %v, parent reports %v", got, want)
+	}
+	entries, err := ns.ReadDir("/")
+	if err != nil || len(entries) != 1 || entries[0].Name() != "a" {
+		t.Errorf("ReadDir(/) = %v, %v, want [a]", entries, err)
+	}
+}
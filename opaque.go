@@ -0,0 +1,50 @@
+package cowfs
+
+import (
+	"path"
+	"strings"
+)
+
+// opaqueMarker is the entry that marks its directory opaque in a layer
+// tarball, following the OCI image layer convention.
+const opaqueMarker = whiteoutPrefix + whiteoutPrefix + ".opq"
+
+// isOpaque reports whether the primary contents of directory dir are hidden
+// because dir, or one of its parents, was removed and created again through
+// the overlay. Like opaque directories in overlayfs, such directories only
+// show what the secondary holds.
+func (cfs *FileSystem) isOpaque(dir string) bool {
+	cfs.mu.RLock()
+	defer cfs.mu.RUnlock()
+	if len(cfs.opaque) == 0 {
+		return false
+	}
+	for {
+		if cfs.opaque[dir] {
+			return true
+		}
+		parent := path.Dir(dir)
+		if parent == dir {
+			return false
+		}
+		dir = parent
+	}
+}
+
+// setOpaque marks dir opaque. cfs.mu must be held.
+func (cfs *FileSystem) setOpaque(dir string) {
+	if cfs.opaque == nil {
+		cfs.opaque = make(map[string]bool)
+	}
+	cfs.opaque[dir] = true
+}
+
+// clearOpaque removes the opaque marks of name and the directories below
+// it. cfs.mu must be held.
+func (cfs *FileSystem) clearOpaque(name string) {
+	for dir := range cfs.opaque {
+		if dir == name || strings.HasPrefix(dir, name+"/") {
+			delete(cfs.opaque, dir)
+		}
+	}
+}
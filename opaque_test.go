@@ -0,0 +1,100 @@
+package cowfs
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/absfs/memfs"
+)
+
+func listNames(t *testing.T, cfs *FileSystem, dir string) []string {
+	t.Helper()
+	entries, err := cfs.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir(%s) error = %v", dir, err)
+	}
+	names := []string{}
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestOpaqueDirectory(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	primary.MkdirAll("/d/sub", 0755)
+	writeMemFile(t, primary, "/d/old.txt", "old")
+	writeMemFile(t, primary, "/d/sub/x.txt", "x")
+
+	if err := cfs.Remove("/d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Mkdir("/d", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.WriteFile("/d/new.txt", []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if names := listNames(t, cfs, "/d"); !reflect.DeepEqual(names, []string{"new.txt"}) {
+		t.Errorf("ReadDir() = %v, want only new.txt", names)
+	}
+	f, err := cfs.OpenFile("/d", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos, _ := f.Readdir(-1)
+	f.Close()
+	if len(infos) != 1 || infos[0].Name() != "new.txt" {
+		t.Errorf("Readdir() returned %d entries, want only new.txt", len(infos))
+	}
+	for _, name := range []string{"/d/old.txt", "/d/sub", "/d/sub/x.txt"} {
+		if _, err := cfs.Stat(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Stat(%s) error = %v, want not exist", name, err)
+		}
+	}
+	if err := cfs.Chmod("/d/old.txt", 0600); err == nil {
+		t.Error("Chmod() brought back a hidden primary file")
+	}
+
+	// Hidden below recreated subdirectories too
+	if err := cfs.Mkdir("/d/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if names := listNames(t, cfs, "/d/sub"); len(names) != 0 {
+		t.Errorf("ReadDir(/d/sub) = %v, want empty", names)
+	}
+
+	// Exported and imported as an opaque marker
+	var buf bytes.Buffer
+	if err := cfs.ExportTar(&buf); err != nil {
+		t.Fatal(err)
+	}
+	entries := readTar(t, bytes.NewReader(buf.Bytes()))
+	if _, ok := entries["d/"+opaqueMarker]; !ok {
+		t.Errorf("ExportTar() entries = %v, want an opaque marker for d", entries)
+	}
+	secondary, _ := memfs.NewFS()
+	imported := New(primary, secondary)
+	if err := imported.ImportTar(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if names := listNames(t, imported, "/d"); !reflect.DeepEqual(names, []string{"new.txt", "sub"}) {
+		t.Errorf("imported ReadDir() = %v, want new.txt and sub", names)
+	}
+	if _, err := imported.Stat("/d/old.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("imported Stat() error = %v, want not exist", err)
+	}
+
+	// Removing the directory again drops the mark
+	cfs.Remove("/d/sub")
+	cfs.Remove("/d/new.txt")
+	cfs.Remove("/d")
+	if cfs.isOpaque("/d") {
+		t.Error("removed directory still opaque")
+	}
+}
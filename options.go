@@ -0,0 +1,5 @@
+package cowfs
+
+// Option configures optional behavior of a FileSystem. Options are applied by
+// New in the order they are given.
+type Option func(*FileSystem)
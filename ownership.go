@@ -0,0 +1,119 @@
+package cowfs
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// chownProbe is the scratch file used to find out whether the secondary
+// supports Chown.
+const chownProbe = "/.cowfs-chown~"
+
+// Support states of an optional secondary operation.
+const (
+	supportUnknown int32 = iota
+	supportYes
+	supportNo
+)
+
+// Owner is a numeric file owner and group.
+type Owner struct {
+	UID int
+	GID int
+}
+
+// Capabilities reports which optional operations the overlay can perform.
+type Capabilities struct {
+	Symlinks  bool // Both layers support symbolic links
+	Hardlinks bool // The secondary supports hard links
+	Chown     bool // The secondary supports Chown, as far as probed yet
+}
+
+// Capabilities reports which optional operations the overlay can perform
+// with its layers.
+//
+// Chown support is probed by the first call to Chown, since whether a
+// secondary accepts an owner change can depend on the owner requested. Until
+// then Chown is reported as supported.
+func (cfs *FileSystem) Capabilities() Capabilities {
+	_, hardlinks := cfs.secondary.(Linker)
+	return Capabilities{
+		Symlinks:  cfs.links,
+		Hardlinks: hardlinks,
+		Chown:     cfs.chownSupport.Load() != supportNo,
+	}
+}
+
+// DeferredOwners returns the ownership recorded by Chown calls that the
+// secondary could not carry out, keyed by path. The ownership is not visible
+// through the overlay; it is kept so that it can be applied when the
+// overlay's changes are copied to a destination that supports Chown.
+func (cfs *FileSystem) DeferredOwners() map[string]Owner {
+	cfs.mu.RLock()
+	defer cfs.mu.RUnlock()
+	owners := make(map[string]Owner, len(cfs.owners))
+	for name, o := range cfs.owners {
+		owners[name] = o
+	}
+	return owners
+}
+
+// deferChown records uid and gid as the owner of name instead of changing
+// it in the secondary, if the secondary does not support Chown. It reports
+// whether the ownership was recorded.
+func (cfs *FileSystem) deferChown(name string, uid, gid int) (bool, error) {
+	if cfs.canChown(uid, gid) {
+		return false, nil
+	}
+	if !cfs.exists(name) {
+		return false, &os.PathError{Op: "chown", Path: name, Err: os.ErrNotExist}
+	}
+	cfs.mu.Lock()
+	if cfs.owners == nil {
+		cfs.owners = make(map[string]Owner)
+	}
+	cfs.owners[name] = Owner{UID: uid, GID: gid}
+	cfs.mu.Unlock()
+	cfs.debug("cowfs: chown deferred", "path", name, "uid", uid, "gid", gid)
+	return true, nil
+}
+
+// canChown reports whether the secondary supports Chown, probing it with a
+// scratch file owned by uid and gid the first time. A probe that fails for
+// reasons other than Chown itself leaves the question open.
+func (cfs *FileSystem) canChown(uid, gid int) bool {
+	switch cfs.chownSupport.Load() {
+	case supportYes:
+		return true
+	case supportNo:
+		return false
+	}
+	f, err := cfs.secondary.OpenFile(chownProbe, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return true
+	}
+	f.Close()
+	defer cfs.secondary.Remove(chownProbe)
+
+	err = cfs.secondary.Chown(chownProbe, uid, gid)
+	switch {
+	case err == nil:
+		cfs.chownSupport.Store(supportYes)
+	case chownUnsupported(err):
+		cfs.chownSupport.Store(supportNo)
+		cfs.debug("cowfs: secondary does not support chown", "err", err)
+		return false
+	}
+	return true
+}
+
+// chownUnsupported reports whether err means the filesystem cannot change
+// file ownership, as opposed to a failure specific to one file.
+func chownUnsupported(err error) bool {
+	return errors.Is(err, errors.ErrUnsupported) ||
+		errors.Is(err, syscall.ENOTSUP) ||
+		errors.Is(err, syscall.ENOSYS) ||
+		errors.Is(err, syscall.EPERM) ||
+		errors.Is(err, syscall.EINVAL)
+}
@@ -0,0 +1,75 @@
+package cowfs
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/absfs/memfs"
+)
+
+type noChownFiler struct {
+	*memfs.FileSystem
+}
+
+func (noChownFiler) Chown(name string, uid, gid int) error {
+	return &os.PathError{Op: "chown", Path: name, Err: syscall.EPERM}
+}
+
+func TestChownDeferred(t *testing.T) {
+	_, primary, secondary := newMemOverlay(t)
+	writeMemFile(t, primary, "/a.txt", "aaaa")
+	cfs := New(primary, noChownFiler{secondary})
+
+	if !cfs.Capabilities().Chown {
+		t.Error("Chown reported unsupported before probing")
+	}
+	if err := cfs.Chown("/a.txt", 1000, 1000); err != nil {
+		t.Fatalf("Chown() error = %v", err)
+	}
+	if _, err := secondary.Stat("/a.txt"); err == nil {
+		t.Error("Chown copied the file up")
+	}
+	if _, err := secondary.Stat(chownProbe); err == nil {
+		t.Error("probe file left in secondary")
+	}
+	if cfs.Capabilities().Chown {
+		t.Error("Capabilities().Chown = true after a failed probe")
+	}
+	if o := cfs.DeferredOwners()["/a.txt"]; o != (Owner{UID: 1000, GID: 1000}) {
+		t.Errorf("DeferredOwners()[/a.txt] = %+v", o)
+	}
+	if err := cfs.Chown("/missing", 1, 1); !os.IsNotExist(err) {
+		t.Errorf("Chown(/missing) error = %v, want not exist", err)
+	}
+
+	if err := cfs.Rename("/a.txt", "/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	owners := cfs.DeferredOwners()
+	if _, ok := owners["/b.txt"]; !ok || len(owners) != 1 {
+		t.Errorf("DeferredOwners() after rename = %v", owners)
+	}
+	if s := cfs.Stats(); s.DeferredChowns != 1 {
+		t.Errorf("Stats().DeferredChowns = %d, want 1", s.DeferredChowns)
+	}
+	cfs.Remove("/b.txt")
+	if owners := cfs.DeferredOwners(); len(owners) != 0 {
+		t.Errorf("DeferredOwners() after remove = %v", owners)
+	}
+}
+
+func TestChownSupported(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	writeMemFile(t, primary, "/a.txt", "aaaa")
+
+	if err := cfs.Chown("/a.txt", 1000, 1000); err != nil {
+		t.Fatalf("Chown() error = %v", err)
+	}
+	if !cfs.IsModified("/a.txt") || len(cfs.DeferredOwners()) != 0 {
+		t.Error("Chown on a capable secondary was deferred")
+	}
+	if !cfs.Capabilities().Chown {
+		t.Error("Capabilities().Chown = false")
+	}
+}
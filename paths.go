@@ -0,0 +1,74 @@
+package cowfs
+
+import (
+	"path"
+	"strings"
+
+	"github.com/absfs/absfs"
+)
+
+// separatorer is implemented by layers that report their path separators,
+// such as osfs.
+type separatorer interface {
+	Separator() uint8
+	ListSeparator() uint8
+}
+
+// Separator returns the path separator of the secondary layer, or '/' if it
+// does not report one. If it is a backslash, as for osfs on Windows, every
+// operation accepts paths separated by backslashes or slashes, with or
+// without a leading drive letter, and passes them on to the layers with
+// slashes.
+func (cfs *FileSystem) Separator() uint8 {
+	if s, ok := cfs.secondary.(separatorer); ok {
+		return s.Separator()
+	}
+	return absfs.Separator
+}
+
+// ListSeparator returns the path list separator of the secondary layer, or
+// ':' if it does not report one.
+func (cfs *FileSystem) ListSeparator() uint8 {
+	if s, ok := cfs.secondary.(separatorer); ok {
+		return s.ListSeparator()
+	}
+	return absfs.ListSeparator
+}
+
+// WithCaseFolding makes the overlay treat paths that differ only in case as
+// the same path, for layers on case-insensitive filesystems. Paths are
+// lower-cased before they are tracked or passed to the layers, so files and
+// directories created through the overlay get lower-case names, and
+// deleting "/Readme.md" hides "/README.md" in the primary. Layers that are
+// case-sensitive need WithCaseInsensitive instead.
+func WithCaseFolding() Option {
+	return func(fs *FileSystem) {
+		fs.foldCase = true
+	}
+}
+
+// normalize returns the path the overlay tracks name under: name cleaned
+// and made absolute, so that "file.txt", "/dir/../file.txt" and
+// "/file.txt/" are all "/file.txt", and lower-cased with WithCaseFolding.
+// Over a secondary whose separator is a backslash, as on Windows,
+// backslashes separate elements too and a leading drive letter is dropped,
+// so "C:\dir\file.txt" is "/dir/file.txt". Exported operations normalize
+// the paths they are given before anything else, which keeps the overlay's
+// markers consistent, and pass the result on to the layers.
+func (cfs *FileSystem) normalize(name string) string {
+	if cfs.backslash {
+		name = strings.ReplaceAll(name, `\`, "/")
+		if len(name) >= 2 && name[1] == ':' && isDriveLetter(name[0]) {
+			name = name[2:]
+		}
+	}
+	name = path.Clean("/" + name)
+	if cfs.foldCase {
+		name = strings.ToLower(name)
+	}
+	return name
+}
+
+func isDriveLetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
@@ -0,0 +1,198 @@
+package cowfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/memfs"
+)
+
+func TestNormalizePaths(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	writeMemFile(t, primary, "/base.txt", "base")
+
+	if err := cfs.WriteFile("dir/../a.txt", []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !cfs.IsModified("/a.txt") || !cfs.IsModified("a.txt") {
+		t.Error("a.txt not tracked under its clean path")
+	}
+	if err := cfs.Remove("./base.txt/"); err != nil {
+		t.Fatal(err)
+	}
+	if !cfs.IsDeleted("/base.txt") {
+		t.Error("base.txt not tracked as deleted under its clean path")
+	}
+	if _, err := cfs.Stat("//base.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat(//base.txt) error = %v, want not exist", err)
+	}
+	if modified, deleted := cfs.state(); !reflect.DeepEqual(modified, []string{"/a.txt"}) || !reflect.DeepEqual(deleted, []string{"/base.txt"}) {
+		t.Errorf("state = %v, %v, want only clean paths", modified, deleted)
+	}
+}
+
+func TestCaseFolding(t *testing.T) {
+	primary := must(memfs.NewFS())
+	writeMemFile(t, primary, "/readme.md", "read me")
+	writeMemFile(t, primary, "/license", "license")
+	cfs := New(primary, must(memfs.NewFS()), WithCaseFolding())
+
+	if data, err := cfs.ReadFile("/README.md"); err != nil || string(data) != "read me" {
+		t.Errorf("ReadFile(/README.md) = %q, %v, want read me", data, err)
+	}
+	if err := cfs.Remove("/License"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfs.Stat("/license"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat(/license) after Remove(/License) error = %v, want not exist", err)
+	}
+	if err := cfs.WriteFile("/New.TXT", []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !cfs.IsModified("/NEW.txt") {
+		t.Error("/new.txt not modified under another spelling")
+	}
+	if names := listNames(t, cfs, "/"); !reflect.DeepEqual(names, []string{"new.txt", "readme.md"}) {
+		t.Errorf("ReadDir(/) = %v, want [new.txt readme.md]", names)
+	}
+}
+
+// TestCaseFoldingKeys checks that paths listed by case-insensitive layers
+// are tracked under their folded names.
+func TestCaseFoldingKeys(t *testing.T) {
+	testMixedCaseKeys(t, func(primary absfs.Filer) *FileSystem {
+		return New(newCaseFiler(primary), newCaseFiler(must(memfs.NewFS())), WithCaseFolding())
+	})
+}
+
+// testMixedCaseKeys checks listings, directory renames and tar imports of
+// overlays returned by newOverlay, which are case-insensitive over a primary
+// holding mixed-case names.
+func testMixedCaseKeys(t *testing.T, newOverlay func(primary absfs.Filer) *FileSystem) {
+	newPrimary := func() *memfs.FileSystem {
+		primary := must(memfs.NewFS())
+		if err := primary.MkdirAll("/Dir/Sub", 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeMemFile(t, primary, "/Dir/A.txt", "a")
+		writeMemFile(t, primary, "/Dir/B.txt", "b")
+		writeMemFile(t, primary, "/Dir/Sub/C.txt", "c")
+		writeMemFile(t, primary, "/Old.TXT", "old")
+		return primary
+	}
+
+	for _, limit := range []int{0, 1} {
+		cfs := newOverlay(newPrimary())
+		WithMergeLimit(limit)(cfs)
+		if err := cfs.Remove("/dir/a.txt"); err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"B.txt", "Sub"}
+		f, err := cfs.OpenFile("/DIR", os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names, err := f.Readdirnames(-1)
+		f.Close()
+		if err != nil || !reflect.DeepEqual(names, want) {
+			t.Errorf("limit %d: Readdirnames(/DIR) = %v, %v, want %v", limit, names, err, want)
+		}
+		it, err := cfs.ReadDirIter("/Dir")
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = nil
+		for it.Next() {
+			names = append(names, it.Entry().Name())
+		}
+		it.Close()
+		if !reflect.DeepEqual(names, want) {
+			t.Errorf("limit %d: ReadDirIter(/Dir) listed %v, want %v", limit, names, want)
+		}
+	}
+
+	cfs := newOverlay(newPrimary())
+	if err := cfs.Rename("/Dir", "/New"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/dir/a.txt", "/dir/b.txt", "/dir/sub/c.txt", "/Dir"} {
+		if _, err := cfs.Stat(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Stat(%s) after Rename(/Dir, /New) error = %v, want not exist", name, err)
+		}
+	}
+	if data, err := cfs.ReadFile("/new/sub/c.txt"); err != nil || string(data) != "c" {
+		t.Errorf("ReadFile(/new/sub/c.txt) = %q, %v, want c", data, err)
+	}
+
+	cfs = newOverlay(newPrimary())
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: ".wh.Old.txt", Typeflag: tar.TypeReg})
+	tw.WriteHeader(&tar.Header{Name: "Dir/Guide.MD", Typeflag: tar.TypeReg, Mode: 0644, Size: 5})
+	tw.Write([]byte("guide"))
+	tw.Close()
+	if err := cfs.ImportTar(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfs.Stat("/old.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat(/old.txt) after importing a whiteout error = %v, want not exist", err)
+	}
+	if !cfs.IsDeleted("/OLD.txt") || !cfs.IsModified("/dir/guide.md") {
+		t.Error("imported paths not tracked under their folded names")
+	}
+	if data, err := cfs.ReadFile("/dir/guide.md"); err != nil || string(data) != "guide" {
+		t.Errorf("ReadFile(/dir/guide.md) = %q, %v, want guide", data, err)
+	}
+}
+
+// windowsFiler reports Windows path separators for the Filer it wraps.
+type windowsFiler struct {
+	*memfs.FileSystem
+}
+
+func (windowsFiler) Separator() uint8     { return '\\' }
+func (windowsFiler) ListSeparator() uint8 { return ';' }
+
+func TestWindowsPaths(t *testing.T) {
+	primary := must(memfs.NewFS())
+	primary.Mkdir("/dir", 0755)
+	writeMemFile(t, primary, "/dir/file.txt", "primary")
+	cfs := New(primary, windowsFiler{must(memfs.NewFS())})
+
+	if cfs.Separator() != '\\' || cfs.ListSeparator() != ';' {
+		t.Errorf("separators = %q, %q, want the secondary's", cfs.Separator(), cfs.ListSeparator())
+	}
+	if data, err := cfs.ReadFile(`C:\dir\file.txt`); err != nil || string(data) != "primary" {
+		t.Errorf(`ReadFile(C:\dir\file.txt) = %q, %v, want primary`, data, err)
+	}
+	if err := cfs.WriteFile(`dir\new.txt`, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !cfs.IsModified("/dir/new.txt") {
+		t.Error(`dir\new.txt not tracked as /dir/new.txt`)
+	}
+	if err := cfs.Remove(`D:\dir\file.txt`); err != nil {
+		t.Fatal(err)
+	}
+	if names := listNames(t, cfs, `\dir`); !reflect.DeepEqual(names, []string{"new.txt"}) {
+		t.Errorf(`ReadDir(\dir) = %v, want [new.txt]`, names)
+	}
+
+	// Elsewhere a backslash is an ordinary character
+	plain, _, _ := newMemOverlay(t)
+	if plain.Separator() != '/' {
+		t.Errorf("memfs overlay separator = %q, want /", plain.Separator())
+	}
+	if err := plain.WriteFile(`a\b`, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !plain.IsModified(`/a\b`) {
+		t.Error(`a\b not tracked as a single name`)
+	}
+}
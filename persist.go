@@ -0,0 +1,209 @@
+package cowfs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// State is the overlay's record of the paths changed through it: the paths
+// served by the secondary, those hidden by deletion, the directories whose
+// primary contents are hidden, and the secondary copies stored as deltas.
+type State struct {
+	Modified []string `json:"modified"`
+	Deleted  []string `json:"deleted"`
+	Opaque   []string `json:"opaque"`
+	Deltas   []string `json:"deltas,omitempty"`
+
+	// Bases are the primary versions recorded by WithConflictDetection.
+	Bases map[string]FileVersion `json:"bases,omitempty"`
+}
+
+// StateStore persists the State of an overlay between processes. See
+// WithStateStore.
+type StateStore interface {
+	// Load returns the saved state. A store that holds no state yet
+	// returns the zero State and a nil error.
+	Load() (State, error)
+
+	// Save replaces the saved state with s.
+	Save(s State) error
+}
+
+// WithStateStore keeps the overlay's state in store, so that an overlay
+// whose layers outlive the process, such as two host directories, can be
+// recreated with its modifications and deletions intact. New loads the
+// saved state after applying all options. After mutations the state is
+// saved by a background task once Start is called, and Close saves it a
+// final time.
+//
+// If the state cannot be loaded, the overlay starts out empty and never
+// saves over the stored state, and Close returns the error.
+func WithStateStore(store StateStore) Option {
+	return func(fs *FileSystem) {
+		fs.store = &stateSaver{
+			store: store,
+			dirty: make(chan struct{}, 1),
+		}
+		fs.addTask("state", fs.runStateSaves)
+	}
+}
+
+// stateSaver saves the state of an overlay to its store.
+type stateSaver struct {
+	store   StateStore
+	dirty   chan struct{} // Signalled after mutations
+	loadErr error         // Failure to load, which disables saving
+}
+
+// loadState restores the state saved in the store.
+func (cfs *FileSystem) loadState() {
+	s, err := cfs.store.store.Load()
+	if err != nil {
+		cfs.store.loadErr = err
+		cfs.debug("cowfs: loading state failed", "err", err)
+		return
+	}
+	cfs.mu.Lock()
+	defer cfs.mu.Unlock()
+	for _, name := range s.Modified {
+		cfs.modified[name] = true
+	}
+	for _, name := range s.Deleted {
+		cfs.deleted[name] = true
+	}
+	for _, dir := range s.Opaque {
+		cfs.setOpaque(dir)
+	}
+	if len(s.Deltas) > 0 && cfs.deltas == nil {
+		cfs.deltas = make(map[string]bool)
+	}
+	for _, name := range s.Deltas {
+		cfs.deltas[name] = true
+	}
+	if c := cfs.conflicts; c != nil {
+		for name, v := range s.Bases {
+			c.bases[name] = v
+		}
+	}
+}
+
+// snapshotState returns the current state with sorted paths.
+func (cfs *FileSystem) snapshotState() State {
+	keys := func(m map[string]bool) []string {
+		names := []string{}
+		for name := range m {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names
+	}
+	var bases map[string]FileVersion
+	if c := cfs.conflicts; c != nil {
+		bases = c.snapshot()
+	}
+	cfs.mu.RLock()
+	defer cfs.mu.RUnlock()
+	return State{
+		Modified: keys(cfs.modified),
+		Deleted:  keys(cfs.deleted),
+		Opaque:   keys(cfs.opaque),
+		Deltas:   keys(cfs.deltas),
+		Bases:    bases,
+	}
+}
+
+// stateChanged schedules saving the state after a mutation.
+func (cfs *FileSystem) stateChanged() {
+	if cfs.store == nil {
+		return
+	}
+	select {
+	case cfs.store.dirty <- struct{}{}:
+	default:
+	}
+}
+
+// saveState saves the current state to the store.
+func (cfs *FileSystem) saveState() error {
+	if s := cfs.store; s == nil || s.loadErr != nil {
+		return nil
+	}
+	return cfs.store.store.Save(cfs.snapshotState())
+}
+
+// runStateSaves is the background task saving the state after mutations.
+func (cfs *FileSystem) runStateSaves(ctx context.Context) error {
+	if err := cfs.store.loadErr; err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-cfs.store.dirty:
+		}
+		if err := cfs.saveState(); err != nil {
+			cfs.debug("cowfs: saving state failed", "err", err)
+		}
+	}
+}
+
+// closeState saves the state a final time when the overlay is closed.
+func (cfs *FileSystem) closeState() error {
+	if cfs.store == nil {
+		return nil
+	}
+	if err := cfs.store.loadErr; err != nil {
+		return err
+	}
+	return cfs.saveState()
+}
+
+// JSONFile is a StateStore keeping the state as JSON in a host file. Saves
+// write a temporary file next to it and rename it into place, so the file
+// always holds a complete state.
+type JSONFile string
+
+// Load implements StateStore.
+func (f JSONFile) Load() (State, error) {
+	var s State
+	data, err := os.ReadFile(string(f))
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	err = json.Unmarshal(data, &s)
+	return s, err
+}
+
+// Save implements StateStore.
+func (f JSONFile) Save(s State) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(string(f)), filepath.Base(string(f))+".*~")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), string(f))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,119 @@
+package cowfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/absfs/cowfs/dirfs"
+	"github.com/absfs/memfs"
+)
+
+func TestStateStore(t *testing.T) {
+	dir := t.TempDir()
+	primaryDir, secondaryDir := filepath.Join(dir, "primary"), filepath.Join(dir, "secondary")
+	os.Mkdir(primaryDir, 0755)
+	os.Mkdir(secondaryDir, 0755)
+	os.WriteFile(filepath.Join(primaryDir, "a.txt"), []byte("primary"), 0644)
+	os.WriteFile(filepath.Join(primaryDir, "gone.txt"), []byte("primary"), 0644)
+	os.Mkdir(filepath.Join(primaryDir, "d"), 0755)
+	os.WriteFile(filepath.Join(primaryDir, "d", "old.txt"), []byte("old"), 0644)
+	store := JSONFile(filepath.Join(dir, "state.json"))
+
+	open := func() *FileSystem {
+		primary, err := dirfs.New(primaryDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		secondary, err := dirfs.New(secondaryDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return New(primary, secondary, WithStateStore(store))
+	}
+
+	cfs := open()
+	if err := cfs.WriteFile("/a.txt", []byte("modified"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Remove("/gone.txt"); err != nil {
+		t.Fatal(err)
+	}
+	cfs.Remove("/d/old.txt")
+	cfs.Remove("/d")
+	if err := cfs.Mkdir("/d", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new process sees the same merged view
+	cfs = open()
+	defer cfs.Close()
+	if data, _ := cfs.ReadFile("/a.txt"); string(data) != "modified" {
+		t.Errorf("ReadFile(/a.txt) = %q, want modified", data)
+	}
+	if _, err := cfs.Stat("/gone.txt"); !os.IsNotExist(err) {
+		t.Errorf("Stat(/gone.txt) error = %v, want not exist", err)
+	}
+	if _, err := cfs.Stat("/d/old.txt"); !os.IsNotExist(err) {
+		t.Errorf("Stat(/d/old.txt) error = %v, want not exist", err)
+	}
+	want := State{Modified: []string{"/a.txt", "/d"}, Deleted: []string{"/d/old.txt", "/gone.txt"}, Opaque: []string{"/d"}}
+	if got, err := store.Load(); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("Load() = %+v, %v, want %+v", got, err, want)
+	}
+}
+
+func TestStateStoreBackground(t *testing.T) {
+	store := &memStateStore{saved: make(chan State, 16)}
+	cfs, _, _ := newMemOverlay(t)
+	WithStateStore(store)(cfs)
+	if err := cfs.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer cfs.Close()
+
+	cfs.WriteFile("/a.txt", []byte("data"), 0644)
+	select {
+	case s := <-store.saved:
+		if len(s.Modified) != 1 || s.Modified[0] != "/a.txt" {
+			t.Errorf("saved %+v, want /a.txt modified", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("state not saved after a mutation")
+	}
+}
+
+func TestStateStoreLoadError(t *testing.T) {
+	errLoad := errors.New("unreadable")
+	store := &memStateStore{loadErr: errLoad, saved: make(chan State, 16)}
+	primary, _ := memfs.NewFS()
+	secondary, _ := memfs.NewFS()
+	cfs := New(primary, secondary, WithStateStore(store))
+	cfs.WriteFile("/a.txt", []byte("data"), 0644)
+	if err := cfs.Close(); !errors.Is(err, errLoad) {
+		t.Errorf("Close() error = %v, want the load error", err)
+	}
+	if len(store.saved) != 0 {
+		t.Error("state saved over an unreadable store")
+	}
+}
+
+// memStateStore is a StateStore reporting saves on a channel.
+type memStateStore struct {
+	loadErr error
+	saved   chan State
+}
+
+func (m *memStateStore) Load() (State, error) { return State{}, m.loadErr }
+
+func (m *memStateStore) Save(s State) error {
+	m.saved <- s
+	return nil
+}
@@ -0,0 +1,183 @@
+package cowfs
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// PlanOp is the kind of change listed in a Plan.
+type PlanOp int
+
+const (
+	// PlanCreate creates a path that does not exist yet.
+	PlanCreate PlanOp = iota
+
+	// PlanOverwrite replaces an existing path.
+	PlanOverwrite
+
+	// PlanDelete removes a path and everything below it.
+	PlanDelete
+
+	// PlanMerge writes the result of a MergeFunc for a conflicting path.
+	PlanMerge
+)
+
+func (op PlanOp) String() string {
+	switch op {
+	case PlanCreate:
+		return "create"
+	case PlanOverwrite:
+		return "overwrite"
+	case PlanDelete:
+		return "delete"
+	case PlanMerge:
+		return "merge"
+	}
+	return "unknown"
+}
+
+// PlanEntry is one change listed in a Plan.
+type PlanEntry struct {
+	Op   PlanOp
+	Path string
+	Dir  bool // The path is, or becomes, a directory
+}
+
+// Plan lists the changes a dry run found an operation would make, in the
+// order it would make them. See DryRun and PlanImportTar.
+type Plan struct {
+	Entries []PlanEntry
+}
+
+// add appends an entry to the plan.
+func (p *Plan) add(op PlanOp, name string, dir bool) {
+	p.Entries = append(p.Entries, PlanEntry{Op: op, Path: name, Dir: dir})
+}
+
+// String formats the plan one entry per line, as the operation and the
+// path, with a trailing slash for directories.
+func (p *Plan) String() string {
+	var b strings.Builder
+	for _, e := range p.Entries {
+		b.WriteString(e.Op.String())
+		b.WriteByte(' ')
+		b.WriteString(e.Path)
+		if e.Dir && e.Path != "/" {
+			b.WriteByte('/')
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// planCommit returns the changes to the primary that committing ch would
+// make, with the conflicting paths merged.
+func (cfs *FileSystem) planCommit(ch *commitChanges, conflicts []Conflict) Plan {
+	var plan Plan
+	merged := make(map[string]bool, len(conflicts))
+	for _, conflict := range conflicts {
+		merged[conflict.Path] = true
+	}
+	for _, name := range append(append([]string(nil), ch.deleted...), ch.opaque...) {
+		if info, err := cfs.primary.Stat(name); err == nil && !merged[name] {
+			plan.add(PlanDelete, name, info.IsDir())
+		}
+	}
+	stat := cfs.Stat
+	if cfs.links {
+		stat = cfs.Lstat
+	}
+	for _, name := range ch.modified {
+		if merged[name] {
+			continue
+		}
+		info, err := stat(name)
+		if err != nil {
+			continue // Below a deleted directory
+		}
+		existing, err := cfs.primary.Stat(name)
+		switch {
+		case err != nil || isOpaqueListed(ch.opaque, name):
+			plan.add(PlanCreate, name, info.IsDir())
+		case info.IsDir() && existing.IsDir():
+			// Only the directory's metadata changes
+		case info.IsDir() || info.Mode().IsRegular() || info.Mode()&os.ModeSymlink != 0:
+			plan.add(PlanOverwrite, name, info.IsDir())
+		}
+	}
+	for _, conflict := range conflicts {
+		plan.add(PlanMerge, conflict.Path, false)
+	}
+	return plan
+}
+
+// isOpaqueListed reports whether name is one of the sorted opaque
+// directories dirs or below one, so that a commit recreates it.
+func isOpaqueListed(dirs []string, name string) bool {
+	for _, dir := range dirs {
+		if name == dir || strings.HasPrefix(name, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// PlanImportTar reads the layer tarball r and returns the changes that
+// ImportTar would make to the merged view, without making them. Paths the
+// tarball replaces are listed with PlanOverwrite, new ones with PlanCreate,
+// and whiteouts of existing paths and opaque markers of existing
+// directories with PlanDelete.
+func (cfs *FileSystem) PlanImportTar(r io.Reader) (*Plan, error) {
+	plan := &Plan{}
+	created := make(map[string]bool)
+	exists := func(name string) bool {
+		return created[name] || cfs.exists(name)
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return plan, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+
+		name := cfs.normalize(hdr.Name)
+		dir, base := path.Split(name)
+		if base == opaqueMarker {
+			dir = path.Clean(dir)
+			if exists(dir) {
+				plan.add(PlanDelete, dir, true)
+			}
+			plan.add(PlanCreate, dir, true)
+			created[dir] = true
+			continue
+		}
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			deleted := path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+			if exists(deleted) {
+				info, err := cfs.Stat(deleted)
+				plan.add(PlanDelete, deleted, err == nil && info.IsDir())
+			}
+			delete(created, deleted)
+			continue
+		}
+
+		isDir := hdr.Typeflag == tar.TypeDir
+		switch {
+		case !exists(name):
+			plan.add(PlanCreate, name, isDir)
+		case !isDir:
+			plan.add(PlanOverwrite, name, false)
+		}
+		created[name] = true
+	}
+}
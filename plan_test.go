@@ -0,0 +1,98 @@
+package cowfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/absfs/memfs"
+)
+
+func TestCommitDryRun(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	primary.Mkdir("/dir", 0755)
+	writeMemFile(t, primary, "/dir/edit.txt", "primary")
+	writeMemFile(t, primary, "/gone.txt", "gone")
+	cfs.WriteFile("/dir/edit.txt", []byte("overlay"), 0644)
+	cfs.Mkdir("/new", 0755)
+	cfs.WriteFile("/new/file.txt", []byte("new"), 0644)
+	cfs.Remove("/gone.txt")
+
+	var plan Plan
+	if err := cfs.Commit(context.Background(), DryRun(&plan)); err != nil {
+		t.Fatal(err)
+	}
+	want := "delete /gone.txt\noverwrite /dir/edit.txt\ncreate /new/\ncreate /new/file.txt\n"
+	if got := plan.String(); got != want {
+		t.Errorf("plan =\n%s\nwant\n%s", got, want)
+	}
+	if data, _ := primary.ReadFile("/dir/edit.txt"); string(data) != "primary" {
+		t.Error("dry run wrote to the primary")
+	}
+	if !cfs.IsModified("/dir/edit.txt") || !cfs.IsDeleted("/gone.txt") {
+		t.Error("dry run cleared the overlay")
+	}
+}
+
+func TestCommitDryRunConflicts(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	WithConflictDetection()(cfs)
+	writeMemFile(t, primary, "/a.txt", "base")
+	cfs.WriteFile("/a.txt", []byte("ours"), 0644)
+	writeMemFile(t, primary, "/a.txt", "theirs")
+
+	var plan Plan
+	var conflictErr *ConflictError
+	if err := cfs.Commit(context.Background(), DryRun(&plan)); !errors.As(err, &conflictErr) {
+		t.Errorf("Commit() error = %v, want a *ConflictError", err)
+	}
+	called := false
+	merge := WithMergeFunc(func(string, io.Reader, io.Reader, io.Reader) (io.Reader, error) {
+		called = true
+		return nil, nil
+	})
+	if err := cfs.Commit(context.Background(), DryRun(&plan), merge); err != nil {
+		t.Fatal(err)
+	}
+	if called {
+		t.Error("dry run called the MergeFunc")
+	}
+	if want := []PlanEntry{{Op: PlanMerge, Path: "/a.txt"}}; !reflect.DeepEqual(plan.Entries, want) {
+		t.Errorf("plan = %+v, want %+v", plan.Entries, want)
+	}
+}
+
+func TestPlanImportTar(t *testing.T) {
+	src, primary, _ := newMemOverlay(t)
+	writeMemFile(t, primary, "/old.txt", "old")
+	writeMemFile(t, primary, "/edit.txt", "old")
+	src.Remove("/old.txt")
+	src.WriteFile("/edit.txt", []byte("new"), 0644)
+	src.Mkdir("/dir", 0755)
+	src.WriteFile("/dir/new.txt", []byte("new"), 0644)
+	var buf bytes.Buffer
+	if err := src.ExportTar(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	secondary, _ := memfs.NewFS()
+	dst := New(primary, secondary)
+	plan, err := dst.PlanImportTar(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]PlanOp{}
+	for _, e := range plan.Entries {
+		got[e.Path] = e.Op
+	}
+	want := map[string]PlanOp{"/old.txt": PlanDelete, "/edit.txt": PlanOverwrite, "/dir": PlanCreate, "/dir/new.txt": PlanCreate}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("PlanImportTar() = %v, want %v", plan.Entries, want)
+	}
+	if _, err := dst.Stat("/dir"); err == nil {
+		t.Error("PlanImportTar() applied the tarball")
+	}
+}
@@ -0,0 +1,97 @@
+package cowfs
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/memfs"
+)
+
+// ErrNotPooled is returned by Pool.Release for overlays the pool did not
+// hand out, or that were released already.
+var ErrNotPooled = errors.New("cowfs: overlay not handed out by this pool")
+
+// Pool hands out short-lived overlays over a shared primary, each with its
+// own in-memory secondary, for sandboxing requests or tests at scale.
+// Released overlays are discarded and their secondaries emptied and reused
+// by later overlays. A Pool is safe for concurrent use.
+type Pool struct {
+	primary absfs.Filer
+	opts    []Option
+
+	mu   sync.Mutex
+	idle []absfs.Filer               // Emptied secondaries ready for reuse
+	out  map[*FileSystem]absfs.Filer // Overlays handed out, with their secondaries
+}
+
+// NewPool returns a Pool of overlays over primary, configured with opts.
+func NewPool(primary absfs.Filer, opts ...Option) *Pool {
+	return &Pool{
+		primary: primary,
+		opts:    opts,
+		out:     make(map[*FileSystem]absfs.Filer),
+	}
+}
+
+// Get returns a new overlay over the pool's primary with no changes.
+func (p *Pool) Get() (*FileSystem, error) {
+	p.mu.Lock()
+	var secondary absfs.Filer
+	if n := len(p.idle); n > 0 {
+		secondary = p.idle[n-1]
+		p.idle = p.idle[:n-1]
+	}
+	p.mu.Unlock()
+
+	if secondary == nil {
+		mfs, err := memfs.NewFS()
+		if err != nil {
+			return nil, err
+		}
+		secondary = mfs
+	}
+	cfs := New(p.primary, secondary, p.opts...)
+
+	p.mu.Lock()
+	p.out[cfs] = secondary
+	p.mu.Unlock()
+	return cfs, nil
+}
+
+// Release closes an overlay returned by Get, discards its changes and
+// recycles its secondary. The overlay is frozen, and must not be used
+// afterwards. The error from Close, if any, is returned after the overlay
+// has been released.
+func (p *Pool) Release(cfs *FileSystem) error {
+	p.mu.Lock()
+	secondary, ok := p.out[cfs]
+	delete(p.out, cfs)
+	p.mu.Unlock()
+	if !ok {
+		return ErrNotPooled
+	}
+
+	err := cfs.Close()
+	cfs.opMu.Lock()
+	cfs.frozen.Store(true)
+	cfs.opMu.Unlock()
+
+	entries, _ := secondary.ReadDir("/")
+	for _, e := range entries {
+		removeAll(secondary, "/"+e.Name())
+	}
+	if entries, rerr := secondary.ReadDir("/"); rerr == nil && len(entries) == 0 {
+		p.mu.Lock()
+		p.idle = append(p.idle, secondary)
+		p.mu.Unlock()
+	}
+	return err
+}
+
+// Active returns the number of overlays handed out and not yet released.
+func (p *Pool) Active() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.out)
+}
@@ -0,0 +1,69 @@
+package cowfs
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/absfs/memfs"
+)
+
+func TestPool(t *testing.T) {
+	primary := must(memfs.NewFS())
+	writeMemFile(t, primary, "/base.txt", "base")
+	pool := NewPool(primary)
+
+	a, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Mkdir("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.WriteFile("/dir/a.txt", []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.WriteFile("/base.txt", []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := b.ReadFile("/base.txt"); string(data) != "base" {
+		t.Errorf("other overlay ReadFile(/base.txt) = %q, want base", data)
+	}
+	if n := pool.Active(); n != 2 {
+		t.Errorf("Active() = %d, want 2", n)
+	}
+
+	secondary := a.secondary
+	if err := pool.Release(a); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.WriteFile("/x", nil, 0644); !errors.Is(err, ErrFrozen) {
+		t.Errorf("WriteFile after Release error = %v, want ErrFrozen", err)
+	}
+	if err := pool.Release(a); !errors.Is(err, ErrNotPooled) {
+		t.Errorf("second Release error = %v, want ErrNotPooled", err)
+	}
+
+	// The recycled secondary comes back empty
+	c, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.secondary != secondary {
+		t.Error("released secondary was not reused")
+	}
+	if data, _ := c.ReadFile("/base.txt"); string(data) != "base" {
+		t.Errorf("recycled overlay ReadFile(/base.txt) = %q, want base", data)
+	}
+	if _, err := c.Stat("/dir"); err == nil {
+		t.Error("recycled overlay still holds /dir")
+	}
+	pool.Release(b)
+	pool.Release(c)
+	if n := pool.Active(); n != 0 {
+		t.Errorf("Active() = %d after releasing all, want 0", n)
+	}
+}
@@ -0,0 +1,150 @@
+package cowfs
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// defaultPreloadConcurrency is the number of files Preload copies at once
+// unless set with WithPreloadConcurrency.
+const defaultPreloadConcurrency = 4
+
+// WithPreloadConcurrency sets the number of files Preload copies up at once.
+func WithPreloadConcurrency(n int) Option {
+	return func(fs *FileSystem) {
+		fs.preloadConcurrency = n
+	}
+}
+
+// Preload copies the named primary files up into the secondary ahead of
+// their first write, so that latency-sensitive workloads do not pay for the
+// copy-up when they get there. Paths may be glob patterns, matched against
+// the merged view as by path.Match, and directories are preloaded with all
+// the files below them. Files already in the secondary are left alone.
+//
+// Files are copied concurrently, by default four at a time; see
+// WithPreloadConcurrency. Preload stops at the first failed copy-up, or
+// when ctx is done, and returns the error.
+func (cfs *FileSystem) Preload(ctx context.Context, paths ...string) error {
+	n := cfs.preloadConcurrency
+	if n <= 0 {
+		n = defaultPreloadConcurrency
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+	names := make(chan string)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range names {
+				if err := cfs.preloadFile(name); err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+	err := cfs.preloadNames(paths, func(name string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		select {
+		case names <- name:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	close(names)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return err
+}
+
+// preloadNames calls fn with every file named by paths, expanding glob
+// patterns and directories.
+func (cfs *FileSystem) preloadNames(paths []string, fn func(name string) error) error {
+	for _, p := range paths {
+		p = path.Join("/", p)
+		matches := []string{p}
+		if strings.ContainsAny(p, `*?[\`) {
+			var err error
+			matches, err = fs.Glob(&ioFS{cfs: cfs, root: "/"}, strings.TrimPrefix(p, "/"))
+			if err != nil {
+				return &os.PathError{Op: "preload", Path: p, Err: err}
+			}
+			for i := range matches {
+				matches[i] = "/" + matches[i]
+			}
+		}
+		for _, match := range matches {
+			err := cfs.Walk(match, func(name string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if d.IsDir() {
+					return nil
+				}
+				return fn(name)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// preloadFile copies primary file name up, unless it is in the secondary
+// already.
+func (cfs *FileSystem) preloadFile(name string) (err error) {
+	defer wrapErr(&err, "preload", name)
+	defer cfs.beginOp()()
+	if cfs.frozen.Load() {
+		return ErrFrozen
+	}
+
+	if l, _ := cfs.lookup(name, false); l != layerUnknown && l != layerPrimary {
+		return nil
+	}
+	if _, err := cfs.primaryStat(name); err != nil {
+		return nil // Only in the secondary
+	}
+	cfs.mu.Lock()
+	if cfs.modified[name] {
+		cfs.mu.Unlock()
+		return nil
+	}
+	cfs.modified[name] = true
+	cfs.mu.Unlock()
+	err = cfs.txTouch(name)
+	if err == nil {
+		err = cfs.copyUp(name)
+	}
+	if err != nil {
+		cfs.mu.Lock()
+		delete(cfs.modified, name)
+		cfs.mu.Unlock()
+		return unwrapRefused(err)
+	}
+	return nil
+}
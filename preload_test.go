@@ -0,0 +1,72 @@
+package cowfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestPreload(t *testing.T) {
+	cfs, primary, secondary := newMemOverlay(t)
+	WithPreloadConcurrency(2)(cfs)
+	primary.MkdirAll("/data/sub", 0755)
+	primary.Mkdir("/logs", 0755)
+	writeMemFile(t, primary, "/data/a.txt", "a")
+	writeMemFile(t, primary, "/data/sub/b.txt", "b")
+	writeMemFile(t, primary, "/logs/1.log", "1")
+	writeMemFile(t, primary, "/logs/2.log", "2")
+	writeMemFile(t, primary, "/logs/skip.txt", "skip")
+	writeMemFile(t, primary, "/cold.txt", "cold")
+	cfs.WriteFile("/data/new.txt", []byte("new"), 0644)
+
+	if err := cfs.Preload(context.Background(), "/data", "/logs/*.log"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/data/a.txt", "/data/sub/b.txt", "/logs/1.log", "/logs/2.log"} {
+		if data, err := secondary.ReadFile(name); err != nil || len(data) != 1 {
+			t.Errorf("secondary %s = %q, %v, want a copy", name, data, err)
+		}
+	}
+	for _, name := range []string{"/logs/skip.txt", "/cold.txt"} {
+		if _, err := secondary.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("%s preloaded", name)
+		}
+	}
+	if s := cfs.Stats(); s.CopyUps != 4 {
+		t.Errorf("copy-ups = %d, want 4", s.CopyUps)
+	}
+
+	// Preloaded files are not copied again on their first write
+	if err := cfs.WriteFile("/data/a.txt", []byte("written"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if s := cfs.Stats(); s.CopyUps != 4 {
+		t.Errorf("copy-ups after write = %d, want 4", s.CopyUps)
+	}
+}
+
+func TestPreloadErrors(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	writeMemFile(t, primary, "/a.txt", "a")
+
+	if err := cfs.Preload(context.Background(), "/missing"); !os.IsNotExist(err) {
+		t.Errorf("Preload(/missing) error = %v, want not exist", err)
+	}
+
+	errVeto := errors.New("vetoed")
+	OnFirstWrite(func(name string, size int64) error { return errVeto })(cfs)
+	if err := cfs.Preload(context.Background(), "/a.txt"); !errors.Is(err, errVeto) {
+		t.Errorf("Preload() error = %v, want the veto", err)
+	}
+	if cfs.IsModified("/a.txt") {
+		t.Error("failed preload left the file marked modified")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	OnFirstWrite(nil)(cfs)
+	if err := cfs.Preload(ctx, "/a.txt"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Preload() with cancelled context error = %v", err)
+	}
+}
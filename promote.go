@@ -0,0 +1,275 @@
+package cowfs
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/absfs/absfs"
+)
+
+// promoteDir is the secondary directory holding read-through copies of
+// primary files.
+const promoteDir = "/.cowfs-promoted~"
+
+// errPrimaryChanged reports a primary file that changed while it was being
+// copied.
+var errPrimaryChanged = errors.New("cowfs: primary file changed while being copied")
+
+// WithPromotion makes the secondary double as a read-through cache for a
+// slow primary, such as one backed by the network or an archive. Regular
+// files read from the primary through ReadFile or OpenFile are copied into
+// the secondary in the background, and later reads are served from the
+// copy. Copies are kept apart from the overlay's own changes: they are not
+// marked modified and never appear in the merged view. The copies take up
+// at most maxBytes in total; the least recently used are removed to make
+// room, and files larger than maxBytes are never copied.
+//
+// A copy is validated against the size and modification time of the
+// primary file on every read, so reads still make a metadata request to the
+// primary, which WithStatCache can save. Stale copies are dropped and
+// copied again. Copying happens in a background task once Start is called.
+// Stats reports the cache's activity as Promotion.
+func WithPromotion(maxBytes int64) Option {
+	return func(fs *FileSystem) {
+		fs.promotion = &promotionCache{
+			maxBytes: maxBytes,
+			lru:      list.New(),
+			entries:  make(map[string]*list.Element),
+			pending:  make(map[string]fingerprint),
+			wake:     make(chan struct{}, 1),
+		}
+		fs.addTask("promotion", fs.runPromotions)
+	}
+}
+
+// PromotionStats reports the activity of the read-through cache enabled by
+// WithPromotion.
+type PromotionStats struct {
+	Hits          uint64 // Primary reads served from a copy
+	Misses        uint64 // Primary reads that had to go to the primary
+	Promotions    uint64 // Files copied into the secondary
+	Invalidations uint64 // Copies dropped because the primary file changed
+	Evictions     uint64 // Copies dropped to stay within the size bound
+	Entries       int    // Number of copies
+	Bytes         int64  // Total size of the copies
+}
+
+type promotedEntry struct {
+	name string
+	fp   fingerprint
+}
+
+// promotionCache tracks the read-through copies of primary files and the
+// files queued to be copied.
+type promotionCache struct {
+	maxBytes int64
+	mu       sync.Mutex
+	lru      *list.List // Front is most recently used
+	entries  map[string]*list.Element
+	pending  map[string]fingerprint // Files queued for copying
+	wake     chan struct{}
+	counters PromotionStats
+}
+
+// promotedKey returns the secondary path of the copy of primary file name.
+func promotedKey(name string) string {
+	h := sha256.Sum256([]byte(name))
+	return promoteDir + "/" + hex.EncodeToString(h[:])
+}
+
+// lookup reports whether a copy of name matching fp is available. A
+// mismatching copy is stale; it is forgotten and its key returned for
+// removal.
+func (c *promotionCache) lookup(name string, fp fingerprint) (ok bool, stale string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, found := c.entries[name]
+	if !found {
+		c.counters.Misses++
+		return false, ""
+	}
+	if el.Value.(*promotedEntry).fp != fp {
+		c.remove(el)
+		c.counters.Invalidations++
+		c.counters.Misses++
+		return false, promotedKey(name)
+	}
+	c.lru.MoveToFront(el)
+	c.counters.Hits++
+	return true, ""
+}
+
+// queue schedules the copying of name, if it is small enough and not
+// already queued.
+func (c *promotionCache) queue(name string, fp fingerprint) {
+	if fp.size > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	if _, ok := c.pending[name]; ok {
+		c.mu.Unlock()
+		return
+	}
+	c.pending[name] = fp
+	c.mu.Unlock()
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next dequeues a file to copy.
+func (c *promotionCache) next() (string, fingerprint, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, fp := range c.pending {
+		delete(c.pending, name)
+		return name, fp, true
+	}
+	return "", fingerprint{}, false
+}
+
+// add records a copy of name, returning the keys of the copies evicted to
+// make room for it.
+func (c *promotionCache) add(name string, fp fingerprint) (evicted []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[name]; ok {
+		c.remove(el)
+	}
+	for c.counters.Bytes+fp.size > c.maxBytes && c.lru.Len() > 0 {
+		e := c.lru.Back().Value.(*promotedEntry)
+		c.remove(c.lru.Back())
+		c.counters.Evictions++
+		evicted = append(evicted, promotedKey(e.name))
+	}
+	c.entries[name] = c.lru.PushFront(&promotedEntry{name: name, fp: fp})
+	c.counters.Promotions++
+	c.counters.Entries++
+	c.counters.Bytes += fp.size
+	return evicted
+}
+
+func (c *promotionCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*promotedEntry)
+	delete(c.entries, e.name)
+	c.counters.Entries--
+	c.counters.Bytes -= e.fp.size
+}
+
+func (c *promotionCache) stats() PromotionStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counters
+}
+
+// openPromoted opens the primary file name for reading, serving it from its
+// read-through copy when that is current and queueing it to be copied
+// otherwise.
+func (cfs *FileSystem) openPromoted(name string) (absfs.File, error) {
+	info, err := cfs.primaryStat(name)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return cfs.primary.OpenFile(name, os.O_RDONLY, 0)
+	}
+	c := cfs.promotion
+	fp := fingerprintOf(info)
+	ok, stale := c.lookup(name, fp)
+	if ok {
+		f, err := cfs.secondary.OpenFile(promotedKey(name), os.O_RDONLY, 0)
+		if err == nil {
+			return &promotedFile{File: f, name: name, info: info}, nil
+		}
+	}
+	if stale != "" {
+		cfs.secondary.Remove(stale)
+	}
+	f, err := cfs.primary.OpenFile(name, os.O_RDONLY, 0)
+	if err == nil {
+		c.queue(name, fp)
+	}
+	return f, err
+}
+
+// readPromoted reads primary file name like openPromoted.
+func (cfs *FileSystem) readPromoted(name string) ([]byte, error) {
+	f, err := cfs.openPromoted(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	_, promoted := f.(*promotedFile)
+	cfs.counters.layer(!promoted).read(int64(len(data)))
+	return data, err
+}
+
+// runPromotions is the background task copying queued files.
+func (cfs *FileSystem) runPromotions(ctx context.Context) error {
+	c := cfs.promotion
+	for {
+		for {
+			name, fp, ok := c.next()
+			if !ok {
+				break
+			}
+			cfs.promote(name, fp)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.wake:
+		}
+	}
+}
+
+// promote copies primary file name into the secondary, provided it still
+// matches fp once copied.
+func (cfs *FileSystem) promote(name string, fp fingerprint) {
+	key := promotedKey(name)
+	if err := cfs.secondary.Mkdir(promoteDir, 0700); err != nil && !os.IsExist(err) {
+		cfs.debug("cowfs: promotion failed", "path", name, "err", err)
+		return
+	}
+	cfs.counters.primary.read(fp.size)
+	cfs.counters.secondary.write(fp.size)
+	err := copyFile(cfs.secondary, key, cfs.primary, name, 0600, false, cfs.copyBuffers())
+	if err == nil {
+		cfs.counters.primary.meta()
+		var info os.FileInfo
+		if info, err = cfs.primary.Stat(name); err == nil && fingerprintOf(info) != fp {
+			err = errPrimaryChanged
+		}
+	}
+	if err != nil {
+		cfs.secondary.Remove(key)
+		cfs.debug("cowfs: promotion failed", "path", name, "err", err)
+		return
+	}
+	for _, evicted := range cfs.promotion.add(name, fp) {
+		cfs.secondary.Remove(evicted)
+	}
+	cfs.debug("cowfs: promoted", "path", name, "size", fp.size)
+}
+
+// promotedFile is a read-through copy opened in place of its primary file.
+type promotedFile struct {
+	absfs.File
+	name string
+	info os.FileInfo // Primary file information
+}
+
+func (f *promotedFile) Name() string { return f.name }
+
+func (f *promotedFile) Stat() (os.FileInfo, error) { return f.info, nil }
@@ -0,0 +1,102 @@
+package cowfs
+
+import (
+	"context"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// waitPromotions waits until n files have been promoted in total.
+func waitPromotions(t *testing.T, cfs *FileSystem, n uint64) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for cfs.Stats().Promotion.Promotions < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("promotions = %d, want %d", cfs.Stats().Promotion.Promotions, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPromotion(t *testing.T) {
+	cfs, primary, secondary := newMemOverlay(t)
+	WithPromotion(1 << 20)(cfs)
+	writeMemFile(t, primary, "/p.txt", "primary")
+	if err := cfs.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer cfs.Close()
+
+	if data, err := cfs.ReadFile("/p.txt"); err != nil || string(data) != "primary" {
+		t.Fatalf("ReadFile() = %q, %v", data, err)
+	}
+	waitPromotions(t, cfs, 1)
+	reads := cfs.Stats().Primary.DataOps
+	if data, err := cfs.ReadFile("/p.txt"); err != nil || string(data) != "primary" {
+		t.Fatalf("ReadFile() = %q, %v", data, err)
+	}
+	s := cfs.Stats()
+	if s.Promotion.Hits != 1 || s.Primary.DataOps != reads {
+		t.Errorf("hits = %d, primary reads %d -> %d, want a read from the copy", s.Promotion.Hits, reads, s.Primary.DataOps)
+	}
+
+	// Copies are neither modifications nor part of the merged view
+	if cfs.IsModified("/p.txt") {
+		t.Error("promoted file marked modified")
+	}
+	if _, err := secondary.Stat("/p.txt"); !os.IsNotExist(err) {
+		t.Error("promoted copy stored under its own name")
+	}
+	if names := listNames(t, cfs, "/"); len(names) != 1 || names[0] != "p.txt" {
+		t.Errorf("ReadDir(/) = %v, want just p.txt", names)
+	}
+
+	f, err := cfs.OpenFile("/p.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, _ := f.Stat()
+	data, _ := io.ReadAll(f)
+	f.Close()
+	if f.Name() != "/p.txt" || info.Name() != "p.txt" || string(data) != "primary" {
+		t.Errorf("OpenFile() = %s, %s, %q, want the primary file", f.Name(), info.Name(), data)
+	}
+
+	// A changed primary file invalidates its copy
+	writeMemFile(t, primary, "/p.txt", "changed primary")
+	if data, _ := cfs.ReadFile("/p.txt"); string(data) != "changed primary" {
+		t.Errorf("ReadFile() = %q, want the changed primary", data)
+	}
+	if s := cfs.Stats(); s.Promotion.Invalidations != 1 {
+		t.Errorf("invalidations = %d, want 1", s.Promotion.Invalidations)
+	}
+	waitPromotions(t, cfs, 2)
+}
+
+func TestPromotionEviction(t *testing.T) {
+	cfs, primary, secondary := newMemOverlay(t)
+	WithPromotion(10)(cfs)
+	writeMemFile(t, primary, "/a", "aaaaaa")
+	writeMemFile(t, primary, "/b", "bbbbbb")
+	writeMemFile(t, primary, "/big", "too large to copy")
+	if err := cfs.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer cfs.Close()
+
+	cfs.ReadFile("/a")
+	waitPromotions(t, cfs, 1)
+	cfs.ReadFile("/b")
+	cfs.ReadFile("/big")
+	waitPromotions(t, cfs, 2)
+
+	s := cfs.Stats().Promotion
+	if s.Evictions != 1 || s.Entries != 1 || s.Bytes != 6 {
+		t.Errorf("evictions = %d, entries = %d, bytes = %d, want 1, 1, 6", s.Evictions, s.Entries, s.Bytes)
+	}
+	if _, err := secondary.Stat(promotedKey("/a")); !os.IsNotExist(err) {
+		t.Error("evicted copy left in the secondary")
+	}
+}
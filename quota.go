@@ -0,0 +1,178 @@
+package cowfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sync/atomic"
+
+	"github.com/absfs/absfs"
+)
+
+// ErrQuotaExceeded is returned when a copy-up or write would take the
+// secondary filesystem past the limit set with WithMaxSecondaryBytes.
+var ErrQuotaExceeded = errors.New("cowfs: secondary quota exceeded")
+
+// WithMaxSecondaryBytes limits the total size of regular files in the
+// secondary to n bytes. Copy-ups, writes, truncations and imports that would
+// exceed the limit fail with ErrQuotaExceeded, leaving the overlay unchanged.
+//
+// Usage is measured by walking the secondary when the option is applied and
+// tracked from then on as the overlay changes it, so changes made to the
+// secondary behind the overlay's back are not accounted for. Directories
+// count as zero bytes.
+func WithMaxSecondaryBytes(n int64) Option {
+	return func(fs *FileSystem) {
+		fs.quota = &quota{max: n}
+		fs.quota.used.Store(treeSize(fs.secondary, "/"))
+	}
+}
+
+type quota struct {
+	max  int64
+	used atomic.Int64
+}
+
+// adjustQuota accounts for n more bytes in the secondary for name, failing
+// with ErrQuotaExceeded if that would exceed the quota. Negative n releases
+// space and never fails.
+func (cfs *FileSystem) adjustQuota(op, name string, n int64) error {
+	q := cfs.quota
+	if q == nil || n == 0 {
+		return nil
+	}
+	if n < 0 {
+		q.used.Add(n)
+		return nil
+	}
+	for {
+		used := q.used.Load()
+		if used+n > q.max {
+			return &os.PathError{Op: op, Path: name, Err: ErrQuotaExceeded}
+		}
+		if q.used.CompareAndSwap(used, used+n) {
+			return nil
+		}
+	}
+}
+
+// secondarySize returns the size of name in the secondary if it is a regular
+// file there, and zero otherwise.
+func (cfs *FileSystem) secondarySize(name string) int64 {
+	if cfs.quota == nil {
+		return 0
+	}
+	info, err := cfs.secondary.Stat(name)
+	if err != nil || !info.Mode().IsRegular() {
+		return 0
+	}
+	return info.Size()
+}
+
+// treeSize returns the total size of the regular files at or below name in
+// filer.
+func treeSize(filer absfs.Filer, name string) int64 {
+	info, err := filer.Stat(name)
+	if err != nil {
+		return 0
+	}
+	if info.Mode().IsRegular() {
+		return info.Size()
+	}
+	if !info.IsDir() {
+		return 0
+	}
+	entries, err := filer.ReadDir(name)
+	if err != nil {
+		return 0
+	}
+	var total int64
+	for _, entry := range entries {
+		total += treeSize(filer, path.Join(name, entry.Name()))
+	}
+	return total
+}
+
+// quotaFile charges growth of a writable secondary file against the quota.
+type quotaFile struct {
+	absfs.File
+	fs     *FileSystem
+	name   string
+	size   int64 // Size of the file as far as this handle knows
+	append bool
+}
+
+// grow reserves the space needed to write n bytes at off, returning the
+// reservation.
+func (f *quotaFile) grow(off int64, n int) (int64, error) {
+	growth := off + int64(n) - f.size
+	if growth <= 0 {
+		return 0, nil
+	}
+	return growth, f.fs.adjustQuota("write", f.name, growth)
+}
+
+// wrote settles a reservation after n bytes were written at off.
+func (f *quotaFile) wrote(off int64, n int, reserved int64) {
+	end := off + int64(n)
+	used := int64(0)
+	if end > f.size {
+		used = end - f.size
+		f.size = end
+	}
+	f.fs.adjustQuota("write", f.name, used-reserved)
+}
+
+func (f *quotaFile) offset() int64 {
+	if f.append {
+		return f.size
+	}
+	off, err := f.File.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return f.size
+	}
+	return off
+}
+
+func (f *quotaFile) Write(p []byte) (int, error) {
+	off := f.offset()
+	reserved, err := f.grow(off, len(p))
+	if err != nil {
+		return 0, err
+	}
+	n, err := f.File.Write(p)
+	f.wrote(off, n, reserved)
+	return n, err
+}
+
+func (f *quotaFile) WriteAt(p []byte, off int64) (int, error) {
+	reserved, err := f.grow(off, len(p))
+	if err != nil {
+		return 0, err
+	}
+	n, err := f.File.WriteAt(p, off)
+	f.wrote(off, n, reserved)
+	return n, err
+}
+
+func (f *quotaFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+// WriteTo copies the file to w through the fast path of the underlying file.
+// There is no ReadFrom counterpart: writes go through Write, which charges
+// them against the quota as they are made.
+func (f *quotaFile) WriteTo(w io.Writer) (int64, error) { return writeTo(f.File, w) }
+
+func (f *quotaFile) Truncate(size int64) error {
+	if err := f.fs.adjustQuota("truncate", f.name, size-f.size); err != nil {
+		return err
+	}
+	if err := f.File.Truncate(size); err != nil {
+		f.fs.adjustQuota("truncate", f.name, f.size-size)
+		return err
+	}
+	f.size = size
+	return nil
+}
@@ -0,0 +1,62 @@
+package cowfs
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestMaxSecondaryBytes(t *testing.T) {
+	cfs, primary, secondary := newMemOverlay(t)
+	writeMemFile(t, secondary, "/existing.txt", "12345")
+	writeMemFile(t, primary, "/big.txt", "0123456789")
+	writeMemFile(t, primary, "/small.txt", "abc")
+	WithMaxSecondaryBytes(10)(cfs)
+
+	// 5 used; copying up 10 more bytes is refused and leaves no trace.
+	if err := cfs.Chmod("/big.txt", 0600); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("Chmod(/big.txt) = %v, want ErrQuotaExceeded", err)
+	}
+	if data, err := cfs.ReadFile("/big.txt"); err != nil || string(data) != "0123456789" {
+		t.Errorf("ReadFile(/big.txt) = %q, %v", data, err)
+	}
+
+	// 5 + 3 = 8 used.
+	if err := cfs.Chmod("/small.txt", 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := cfs.OpenFile("/new.txt", os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("xx")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("y")); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Write past quota = %v, want ErrQuotaExceeded", err)
+	}
+	// Overwriting in place needs no space.
+	if _, err := f.WriteAt([]byte("zz"), 0); err != nil {
+		t.Errorf("WriteAt in place = %v", err)
+	}
+	f.Close()
+
+	if err := cfs.Truncate("/small.txt", 4); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Truncate growing past quota = %v, want ErrQuotaExceeded", err)
+	}
+
+	// Removing frees space for the copy-up.
+	if err := cfs.Remove("/existing.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Remove("/new.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Truncate("/small.txt", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Chmod("/big.txt", 0600); err != nil {
+		t.Errorf("Chmod(/big.txt) after freeing space = %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+package cowfs
+
+import (
+	"sort"
+	"sync"
+)
+
+// WithReadTracking records the paths whose primary contents are read
+// through the overlay, for AccessedPaths to report, so that build systems
+// and dependency analyzers can learn exactly which primary files a task
+// depended on. A path is recorded when its primary file is opened for
+// reading or read with ReadFile, when its primary directory is listed, and
+// when it is copied up, since the secondary copy then derives from it.
+// Paths read from the secondary are not recorded, and neither are Stat and
+// the other metadata lookups. Symbolic links are recorded as the paths they
+// resolve to.
+func WithReadTracking() Option {
+	return func(fs *FileSystem) {
+		fs.reads = &readTracker{paths: make(map[string]bool)}
+	}
+}
+
+// readTracker records the primary paths read through an overlay.
+type readTracker struct {
+	mu    sync.Mutex
+	paths map[string]bool
+}
+
+// trackRead records that the primary contents of name were read.
+func (cfs *FileSystem) trackRead(name string) {
+	if cfs.reads == nil {
+		return
+	}
+	cfs.reads.mu.Lock()
+	cfs.reads.paths[name] = true
+	cfs.reads.mu.Unlock()
+}
+
+// AccessedPaths returns the paths whose primary contents were read since
+// the overlay was created or ResetAccessedPaths was last called, sorted.
+// It returns nil if WithReadTracking is not in effect.
+func (cfs *FileSystem) AccessedPaths() []string {
+	if cfs.reads == nil {
+		return nil
+	}
+	cfs.reads.mu.Lock()
+	defer cfs.reads.mu.Unlock()
+	names := make([]string, 0, len(cfs.reads.paths))
+	for name := range cfs.reads.paths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ResetAccessedPaths forgets the paths recorded so far, so that the reads
+// of the next task can be told apart from those before it.
+func (cfs *FileSystem) ResetAccessedPaths() {
+	if cfs.reads == nil {
+		return
+	}
+	cfs.reads.mu.Lock()
+	cfs.reads.paths = make(map[string]bool)
+	cfs.reads.mu.Unlock()
+}
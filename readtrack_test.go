@@ -0,0 +1,60 @@
+package cowfs
+
+import (
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestReadTracking(t *testing.T) {
+	_, primary, secondary := newMemOverlay(t)
+	primary.Mkdir("/src", 0755)
+	writeMemFile(t, primary, "/src/main.go", "package main")
+	writeMemFile(t, primary, "/src/util.go", "package main")
+	writeMemFile(t, primary, "/src/log.txt", "started")
+	writeMemFile(t, primary, "/README", "readme")
+	cfs := New(primary, secondary, WithReadTracking())
+
+	if _, err := cfs.ReadFile("/src/main.go"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := cfs.OpenFile("/src/util.go", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err := cfs.ReadDir("/src"); err != nil {
+		t.Fatal(err)
+	}
+	f, err = cfs.OpenFile("/src/log.txt", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(" again"))
+	f.Close()
+	// Neither metadata lookups nor reads of secondary files count
+	if _, err := cfs.Stat("/README"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.WriteFile("/out.bin", []byte("built"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfs.ReadFile("/out.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfs.ReadFile("/src/log.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"/src", "/src/log.txt", "/src/main.go", "/src/util.go"}
+	if got := cfs.AccessedPaths(); !slices.Equal(got, want) {
+		t.Errorf("AccessedPaths = %v; want %v", got, want)
+	}
+	cfs.ResetAccessedPaths()
+	if got := cfs.AccessedPaths(); len(got) != 0 {
+		t.Errorf("AccessedPaths after reset = %v", got)
+	}
+	if got := New(primary, secondary).AccessedPaths(); got != nil {
+		t.Errorf("AccessedPaths without tracking = %v; want nil", got)
+	}
+}
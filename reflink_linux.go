@@ -0,0 +1,15 @@
+package cowfs
+
+import "syscall"
+
+// ficlone is the FICLONE ioctl request number from linux/fs.h.
+const ficlone = 0x40049409
+
+// reflink clones the contents of the file open as src into dst.
+func reflink(dst, src uintptr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst, ficlone, src)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
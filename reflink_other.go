@@ -0,0 +1,10 @@
+//go:build !linux
+
+package cowfs
+
+import "errors"
+
+// reflink is not implemented on this platform.
+func reflink(dst, src uintptr) error {
+	return errors.ErrUnsupported
+}
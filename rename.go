@@ -0,0 +1,135 @@
+package cowfs
+
+import (
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// WithAtomicRename makes Rename atomic to readers of the merged view: a
+// concurrent Stat, Open, ReadFile or ReadDir sees either the old name or the
+// new one, never both or neither. Readers and the final step of each rename
+// exclude each other, which costs some read concurrency.
+//
+// Without this option a reader racing with a Rename may briefly see both
+// names.
+func WithAtomicRename() Option {
+	return func(fs *FileSystem) {
+		fs.viewMu = new(sync.RWMutex)
+	}
+}
+
+// viewLock holds back rename commits for the duration of a read. The
+// returned function releases it.
+func (cfs *FileSystem) viewLock() func() {
+	if cfs.viewMu == nil {
+		return func() {}
+	}
+	cfs.viewMu.RLock()
+	return cfs.viewMu.RUnlock
+}
+
+// commitLock excludes readers while a rename is published in the secondary
+// and the overlay state. The returned function releases it.
+func (cfs *FileSystem) commitLock() func() {
+	if cfs.viewMu == nil {
+		return func() {}
+	}
+	cfs.viewMu.Lock()
+	return cfs.viewMu.Unlock
+}
+
+// renameDir implements Rename for the directory oldpath. The merged tree
+// below it is copied up first, so that the secondary rename carries the
+// children only the primary has; every old path is then marked deleted and
+// every new one modified.
+func (cfs *FileSystem) renameDir(oldpath, newpath string, record *journalRecord) error {
+	if newpath == oldpath || strings.HasPrefix(newpath, oldpath+"/") {
+		return syscall.EINVAL
+	}
+	var tree []string // Paths below oldpath, relative to it
+	if err := cfs.copyUpTree(oldpath, "", &tree); err != nil {
+		return err
+	}
+	if err := cfs.ensureParent(newpath); err != nil {
+		return err
+	}
+
+	// The tree replaces whatever the primary has at newpath
+	_, primaryErr := cfs.primary.Stat(newpath)
+
+	unlock := cfs.commitLock()
+	cfs.counters.secondary.meta()
+	err := cfs.secondary.Rename(oldpath, newpath)
+	if err == nil {
+		cfs.mu.Lock()
+		cfs.clearOpaque(oldpath)
+		if primaryErr == nil {
+			cfs.setOpaque(newpath)
+		}
+		for _, rel := range append(tree, "") {
+			cfs.moveMarkers(cfs.normalize(oldpath+rel), cfs.normalize(newpath+rel))
+		}
+		cfs.mu.Unlock()
+		record.step()
+	}
+	unlock()
+	cfs.debug("cowfs: rename directory", "old", oldpath, "new", newpath, "entries", len(tree), "err", err)
+	if err != nil {
+		return err
+	}
+	if err := cfs.syncDirs(oldpath, newpath); err != nil {
+		return err
+	}
+	cfs.notify(Event{Op: EventRename, Path: newpath, OldPath: oldpath})
+	return nil
+}
+
+// moveMarkers moves the overlay state of from to to, after the secondary
+// copy of from was renamed to to. cfs.mu must be held.
+func (cfs *FileSystem) moveMarkers(from, to string) {
+	cfs.deleted[from] = true
+	delete(cfs.modified, from)
+	cfs.modified[to] = true
+	delete(cfs.deleted, to)
+	if o, ok := cfs.owners[from]; ok {
+		cfs.owners[to] = o
+		delete(cfs.owners, from)
+	} else {
+		delete(cfs.owners, to)
+	}
+}
+
+// copyUpTree copies the merged tree of directory dir into the secondary,
+// appending the paths below it, relative to the directory being renamed, to
+// tree. Unlike other copy-ups a failure is always reported, since the
+// children it would leave behind would be lost by the rename.
+func (cfs *FileSystem) copyUpTree(dir, rel string, tree *[]string) error {
+	if err := cfs.ensureSecondaryDir(dir); err != nil {
+		return err
+	}
+	entries, err := cfs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := cfs.normalize(path.Join(dir, entry.Name()))
+		*tree = append(*tree, rel+"/"+entry.Name())
+		if entry.IsDir() {
+			if err := cfs.copyUpTree(name, rel+"/"+entry.Name(), tree); err != nil {
+				return err
+			}
+			continue
+		}
+		if !cfs.IsModified(name) {
+			if err := cfs.copyUp(name); err != nil {
+				return unwrapRefused(err)
+			}
+		}
+		if err := cfs.materialize(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package cowfs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestAtomicRename(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	WithAtomicRename()(cfs)
+	const n = 50
+	for i := 0; i < n; i++ {
+		writeMemFile(t, primary, fmt.Sprintf("/f%d", i), "data")
+	}
+
+	var done atomic.Bool
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !done.Load() {
+				entries, err := cfs.ReadDir("/")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if len(entries) != n {
+					t.Errorf("ReadDir saw %d entries, want %d", len(entries), n)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		if err := cfs.Rename(fmt.Sprintf("/f%d", i), fmt.Sprintf("/g%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	done.Store(true)
+	wg.Wait()
+
+	for i := 0; i < n; i++ {
+		if data, err := cfs.ReadFile(fmt.Sprintf("/g%d", i)); err != nil || string(data) != "data" {
+			t.Errorf("ReadFile(/g%d) = %q, %v", i, data, err)
+		}
+	}
+}
+
+func TestRenameFailureKeepsSource(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	writeMemFile(t, primary, "/a.txt", "a")
+
+	if err := cfs.Rename("/a.txt", "/missing/b.txt"); err == nil {
+		t.Fatal("Rename into a missing directory succeeded")
+	}
+	if data, err := cfs.ReadFile("/a.txt"); err != nil || string(data) != "a" {
+		t.Errorf("ReadFile(/a.txt) after failed rename = %q, %v", data, err)
+	}
+	if cfs.IsModified("/missing/b.txt") {
+		t.Error("failed rename target marked modified")
+	}
+}
+
+func TestRenameDirectory(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	primary.MkdirAll("/src/sub", 0755)
+	primary.Mkdir("/src/empty", 0700)
+	writeMemFile(t, primary, "/src/a.txt", "a")
+	writeMemFile(t, primary, "/src/sub/b.txt", "b")
+	writeMemFile(t, primary, "/src/gone.txt", "gone")
+	if err := cfs.WriteFile("/src/sub/c.txt", []byte("c"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Remove("/src/gone.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cfs.Rename("/src", "/dst"); err != nil {
+		t.Fatalf("Rename() error = %v", err)
+	}
+	for name, want := range map[string]string{
+		"/dst/a.txt":     "a",
+		"/dst/sub/b.txt": "b",
+		"/dst/sub/c.txt": "c",
+	} {
+		if data, err := cfs.ReadFile(name); err != nil || string(data) != want {
+			t.Errorf("ReadFile(%s) = %q, %v, want %q", name, data, err, want)
+		}
+	}
+	if info, err := cfs.Stat("/dst/empty"); err != nil || !info.IsDir() || info.Mode().Perm() != 0700 {
+		t.Errorf("Stat(/dst/empty) = %v, %v, want a 0700 directory", info, err)
+	}
+	for _, name := range []string{"/dst/gone.txt", "/src", "/src/a.txt", "/src/sub/b.txt", "/src/sub/c.txt"} {
+		if _, err := cfs.Stat(name); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Stat(%s) error = %v, want not exist", name, err)
+		}
+	}
+	var names []string
+	cfs.Walk("/", func(name string, d fs.DirEntry, err error) error {
+		names = append(names, name)
+		return err
+	})
+	want := []string{"/", "/dst", "/dst/a.txt", "/dst/empty", "/dst/sub", "/dst/sub/b.txt", "/dst/sub/c.txt"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("Walk() = %v, want %v", names, want)
+	}
+	if data, _ := primary.ReadFile("/src/sub/b.txt"); string(data) != "b" {
+		t.Error("primary was modified")
+	}
+
+	if err := cfs.Rename("/dst", "/dst/sub/inner"); err == nil {
+		t.Error("Rename() into its own subtree succeeded")
+	}
+}
+
+func TestRenameDeletedSource(t *testing.T) {
+	cfs, primary, secondary := newMemOverlay(t)
+	writeMemFile(t, primary, "/a.txt", "primary")
+	if err := cfs.Remove("/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"/a.txt", "/missing.txt"} {
+		err := cfs.Rename(name, "/b.txt")
+		var linkErr *os.LinkError
+		if !errors.As(err, &linkErr) || !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Rename(%s) error = %v, want *os.LinkError wrapping ErrNotExist", name, err)
+		}
+	}
+	if _, err := cfs.Stat("/b.txt"); err == nil {
+		t.Error("Rename() resurrected the deleted file")
+	}
+	if _, err := secondary.Stat("/a.txt"); err == nil {
+		t.Error("Rename() copied up the deleted file")
+	}
+	if !cfs.IsDeleted("/a.txt") {
+		t.Error("source no longer marked deleted")
+	}
+}
+
+func TestRenameFileOntoDirectory(t *testing.T) {
+	cfs, primary, secondary := newMemOverlay(t)
+	if err := primary.MkdirAll("/a/a", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeMemFile(t, primary, "/a/a/a", "child")
+	writeMemFile(t, primary, "/a/b", "file")
+	if err := cfs.Mkdir("/c", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dir := range []string{"/a/a", "/c"} {
+		if err := cfs.Rename("/a/b", dir); !errors.Is(err, fs.ErrExist) {
+			t.Errorf("Rename(/a/b, %s) error = %v, want ErrExist", dir, err)
+		}
+		if info, err := cfs.Stat(dir); err != nil || !info.IsDir() {
+			t.Errorf("Stat(%s) = %v, %v, want the directory", dir, info, err)
+		}
+	}
+	if data, err := cfs.ReadFile("/a/a/a"); err != nil || string(data) != "child" {
+		t.Errorf("ReadFile(/a/a/a) = %q, %v, want the primary child", data, err)
+	}
+	if data, err := cfs.ReadFile("/a/b"); err != nil || string(data) != "file" {
+		t.Errorf("ReadFile(/a/b) = %q, %v, want the source left alone", data, err)
+	}
+	if _, err := secondary.Stat("/a/b"); err == nil {
+		t.Error("Rename() copied up the source")
+	}
+}
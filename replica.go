@@ -0,0 +1,200 @@
+package cowfs
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrNoReplica is returned by replication methods on a FileSystem created
+// without WithReplicaID.
+var ErrNoReplica = errors.New("cowfs: replication not enabled")
+
+// WithReplicaID enables replication of the overlay's modified and deleted
+// markers between nodes. id must be unique among the replicas. Every change
+// made through the overlay is stamped with a hybrid logical clock timestamp,
+// and ReplicaState and MergeReplicaState exchange and merge the stamped
+// markers with last-writer-wins semantics, so replicas that have seen the
+// same set of changes agree on which paths exist.
+//
+// Only the markers are replicated. File contents must be shipped separately,
+// for example as tar layers built with ExportTar, in response to events from
+// Subscribe.
+func WithReplicaID(id string) Option {
+	return func(fs *FileSystem) {
+		fs.replica = &replica{
+			clock:   hlc{node: id, now: time.Now},
+			markers: make(map[string]Marker),
+		}
+	}
+}
+
+// Timestamp is a hybrid logical clock reading: physical time, extended with
+// a logical counter for events within the same nanosecond and the replica ID
+// to break ties, giving a total order consistent with causality.
+type Timestamp struct {
+	Wall    int64  `json:"wall"` // Unix nanoseconds
+	Logical uint32 `json:"logical"`
+	Node    string `json:"node"`
+}
+
+// Compare returns -1, 0 or +1 depending on whether t is before, equal to or
+// after u.
+func (t Timestamp) Compare(u Timestamp) int {
+	switch {
+	case t.Wall != u.Wall:
+		return cmp64(t.Wall, u.Wall)
+	case t.Logical != u.Logical:
+		return cmp64(int64(t.Logical), int64(u.Logical))
+	case t.Node < u.Node:
+		return -1
+	case t.Node > u.Node:
+		return 1
+	}
+	return 0
+}
+
+func cmp64(a, b int64) int {
+	if a < b {
+		return -1
+	}
+	return 1
+}
+
+// Marker is the replicated state of one path: whether it was last deleted or
+// last written, and when.
+type Marker struct {
+	Deleted bool      `json:"deleted"`
+	Time    Timestamp `json:"time"`
+}
+
+// ReplicaState is a snapshot of a replica's markers, suitable for encoding
+// and sending to other replicas.
+type ReplicaState struct {
+	Replica string            `json:"replica"`
+	Markers map[string]Marker `json:"markers"`
+}
+
+type replica struct {
+	mu      sync.Mutex
+	clock   hlc
+	markers map[string]Marker
+}
+
+// hlc is a hybrid logical clock.
+type hlc struct {
+	node string
+	now  func() time.Time
+	last Timestamp
+}
+
+// tick returns a timestamp for a local event.
+func (c *hlc) tick() Timestamp {
+	wall := c.now().UnixNano()
+	if wall > c.last.Wall {
+		c.last = Timestamp{Wall: wall, Node: c.node}
+	} else {
+		c.last.Logical++
+	}
+	return c.last
+}
+
+// observe advances the clock past a remote timestamp.
+func (c *hlc) observe(t Timestamp) {
+	wall := c.now().UnixNano()
+	switch {
+	case wall > c.last.Wall && wall > t.Wall:
+		c.last = Timestamp{Wall: wall, Node: c.node}
+	case t.Wall > c.last.Wall:
+		c.last = Timestamp{Wall: t.Wall, Logical: t.Logical + 1, Node: c.node}
+	case t.Wall == c.last.Wall:
+		c.last.Logical = max(c.last.Logical, t.Logical) + 1
+	default:
+		c.last.Logical++
+	}
+}
+
+// stamp records a local change in the replicated markers.
+func (cfs *FileSystem) stamp(e Event) {
+	r := cfs.replica
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch e.Op {
+	case EventDelete:
+		r.markers[e.Path] = Marker{Deleted: true, Time: r.clock.tick()}
+	case EventRename:
+		r.markers[e.OldPath] = Marker{Deleted: true, Time: r.clock.tick()}
+		r.markers[e.Path] = Marker{Time: r.clock.tick()}
+	default:
+		r.markers[e.Path] = Marker{Time: r.clock.tick()}
+	}
+}
+
+// ReplicaState returns a snapshot of the replicated markers.
+func (cfs *FileSystem) ReplicaState() (ReplicaState, error) {
+	r := cfs.replica
+	if r == nil {
+		return ReplicaState{}, ErrNoReplica
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	markers := make(map[string]Marker, len(r.markers))
+	for name, m := range r.markers {
+		markers[name] = m
+	}
+	return ReplicaState{Replica: r.clock.node, Markers: markers}, nil
+}
+
+// MergeReplicaState merges the markers of another replica into this one.
+// For each path the marker with the later timestamp wins. A winning remote
+// deletion removes the path and everything below it from the overlay; a
+// winning remote write makes a locally deleted path visible again, with its
+// contents expected to arrive separately. Merging is commutative, associative
+// and idempotent. It returns the paths whose marker changed, in no
+// particular order.
+func (cfs *FileSystem) MergeReplicaState(s ReplicaState) ([]string, error) {
+	r := cfs.replica
+	if r == nil {
+		return nil, ErrNoReplica
+	}
+	defer cfs.beginOp()()
+	if cfs.frozen.Load() {
+		return nil, ErrFrozen
+	}
+	cfs.flushDeletions()
+	if err := cfs.txTouch("/"); err != nil {
+		return nil, err
+	}
+
+	var changed []string
+	r.mu.Lock()
+	for name, remote := range s.Markers {
+		r.clock.observe(remote.Time)
+		local, ok := r.markers[name]
+		if ok && local.Time.Compare(remote.Time) >= 0 {
+			continue
+		}
+		r.markers[name] = remote
+		changed = append(changed, name)
+	}
+	r.mu.Unlock()
+
+	for _, name := range changed {
+		if s.Markers[name].Deleted {
+			cfs.importWhiteout(name)
+			cfs.deliver(Event{Op: EventDelete, Path: name})
+			continue
+		}
+		cfs.mu.Lock()
+		undeleted := cfs.deleted[name]
+		delete(cfs.deleted, name)
+		cfs.mu.Unlock()
+		if undeleted {
+			cfs.deliver(Event{Op: EventCreate, Path: name})
+		}
+	}
+	return changed, nil
+}
@@ -0,0 +1,85 @@
+package cowfs
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func newReplica(t *testing.T, id string, now *int64) *FileSystem {
+	t.Helper()
+	cfs, primary, _ := newMemOverlay(t)
+	writeMemFile(t, primary, "/x.txt", "x")
+	writeMemFile(t, primary, "/y.txt", "y")
+	WithReplicaID(id)(cfs)
+	cfs.replica.clock.now = func() time.Time { return time.Unix(0, *now) }
+	return cfs
+}
+
+func TestMergeReplicaState(t *testing.T) {
+	var now int64 = 100
+	a := newReplica(t, "a", &now)
+	b := newReplica(t, "b", &now)
+
+	// a deletes both files; b later rewrites x. y is deleted everywhere, x
+	// survives because b's write is newer.
+	if err := a.Remove("/x.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Remove("/y.txt"); err != nil {
+		t.Fatal(err)
+	}
+	now = 200
+	if err := b.Chmod("/x.txt", 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	sa, _ := a.ReplicaState()
+	sb, _ := b.ReplicaState()
+	if _, err := a.MergeReplicaState(sb); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.MergeReplicaState(sa); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cfs := range []*FileSystem{a, b} {
+		if _, err := cfs.Stat("/x.txt"); err != nil {
+			t.Errorf("%s: Stat(/x.txt) = %v, want present", cfs.replica.clock.node, err)
+		}
+		if _, err := cfs.Stat("/y.txt"); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s: Stat(/y.txt) = %v, want deleted", cfs.replica.clock.node, err)
+		}
+	}
+
+	sa, _ = a.ReplicaState()
+	sb, _ = b.ReplicaState()
+	for name, m := range sa.Markers {
+		if sb.Markers[name] != m {
+			t.Errorf("marker %s diverged: %+v vs %+v", name, m, sb.Markers[name])
+		}
+	}
+
+	// Merging again changes nothing.
+	if changed, _ := a.MergeReplicaState(sb); len(changed) != 0 {
+		t.Errorf("second merge changed %v", changed)
+	}
+}
+
+func TestHLCObserve(t *testing.T) {
+	var now int64 = 10
+	c := hlc{node: "a", now: func() time.Time { return time.Unix(0, now) }}
+	c.tick()
+	c.observe(Timestamp{Wall: 50, Logical: 3, Node: "b"})
+	if got := c.tick(); got.Compare(Timestamp{Wall: 50, Logical: 3, Node: "b"}) <= 0 {
+		t.Errorf("tick after observe = %+v, want after remote", got)
+	}
+}
+
+func TestReplicaDisabled(t *testing.T) {
+	cfs, _, _ := newMemOverlay(t)
+	if _, err := cfs.ReplicaState(); !errors.Is(err, ErrNoReplica) {
+		t.Errorf("ReplicaState() = %v, want ErrNoReplica", err)
+	}
+}
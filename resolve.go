@@ -0,0 +1,117 @@
+package cowfs
+
+import (
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxResolutions bounds the number of cached resolutions. The cache is
+// simply emptied when it fills up.
+const maxResolutions = 1 << 16
+
+// WithResolutionCache caches, per path, which layer answered the last read
+// for up to ttl, so repeated reads of the same path go straight to the owning
+// layer instead of re-checking overlay state and probing the primary first.
+//
+// Every mutation made through the overlay invalidates all cached
+// resolutions. Changes made to the layers behind the overlay's back, such as
+// a file appearing in the primary, are noticed once the ttl expires.
+func WithResolutionCache(ttl time.Duration) Option {
+	return func(fs *FileSystem) {
+		fs.resolutions = &resolutionCache{
+			ttl:     ttl,
+			entries: make(map[string]resolution),
+		}
+	}
+}
+
+// layer is the outcome of resolving a path to the layer that serves it.
+type layer uint8
+
+const (
+	layerUnknown   layer = iota // Try the primary, then the secondary
+	layerPrimary                // Served by the primary
+	layerSecondary              // Not modified, but only present in the secondary
+	layerModified               // Modified; served by the secondary
+	layerDelta                  // Modified and stored as a delta
+	layerDeleted                // Deleted through the overlay
+)
+
+type resolution struct {
+	layer   layer
+	gen     uint64
+	expires time.Time
+}
+
+// resolutionCache maps paths to the layer that served them in a given
+// overlay generation.
+type resolutionCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]resolution
+	hits    atomic.Uint64
+	misses  atomic.Uint64
+}
+
+// resolve reports which layer serves name, along with the generation the
+// answer was computed in. layerUnknown means the caller has to probe the
+// primary and should record the outcome with remember.
+func (cfs *FileSystem) resolve(name string) (layer, uint64) {
+	return cfs.lookup(name, true)
+}
+
+// lookup is resolve, optionally without counting towards the resolution
+// cache statistics, for lookups that are not reads in their own right.
+func (cfs *FileSystem) lookup(name string, count bool) (layer, uint64) {
+	gen := cfs.gen.Load()
+	rc := cfs.resolutions
+	if rc != nil {
+		rc.mu.Lock()
+		r, ok := rc.entries[name]
+		rc.mu.Unlock()
+		if ok && r.gen == gen && time.Now().Before(r.expires) {
+			if count {
+				rc.hits.Add(1)
+			}
+			return r.layer, gen
+		}
+		if count {
+			rc.misses.Add(1)
+		}
+	}
+
+	cfs.mu.RLock()
+	isDeleted := cfs.deleted[name]
+	isModified := cfs.modified[name]
+	cfs.mu.RUnlock()
+
+	l := layerUnknown
+	switch {
+	case isDeleted:
+		l = layerDeleted
+	case isModified && cfs.isDelta(name):
+		l = layerDelta
+	case isModified:
+		l = layerModified
+	case cfs.isOpaque(path.Dir(name)):
+		l = layerSecondary
+	}
+	cfs.remember(name, gen, l)
+	return l, gen
+}
+
+// remember caches l as the resolution of name in generation gen.
+func (cfs *FileSystem) remember(name string, gen uint64, l layer) {
+	rc := cfs.resolutions
+	if rc == nil || l == layerUnknown {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if len(rc.entries) >= maxResolutions {
+		rc.entries = make(map[string]resolution)
+	}
+	rc.entries[name] = resolution{layer: l, gen: gen, expires: time.Now().Add(rc.ttl)}
+}
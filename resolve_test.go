@@ -0,0 +1,63 @@
+package cowfs
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestResolutionCache(t *testing.T) {
+	cfs, primary, secondary := newMemOverlay(t)
+	WithResolutionCache(time.Hour)(cfs)
+	writeMemFile(t, primary, "/p.txt", "primary")
+	writeMemFile(t, secondary, "/s.txt", "secondary")
+
+	for i := 0; i < 3; i++ {
+		if data, err := cfs.ReadFile("/p.txt"); err != nil || string(data) != "primary" {
+			t.Fatalf("ReadFile(/p.txt) = %q, %v", data, err)
+		}
+		if data, err := cfs.ReadFile("/s.txt"); err != nil || string(data) != "secondary" {
+			t.Fatalf("ReadFile(/s.txt) = %q, %v", data, err)
+		}
+	}
+	s := cfs.Stats()
+	if s.ResolutionHits != 4 || s.ResolutionMisses != 2 {
+		t.Errorf("resolution hits/misses = %d/%d, want 4/2", s.ResolutionHits, s.ResolutionMisses)
+	}
+
+	// A secondary-only path resolved from the cache skips the primary, even
+	// if the primary gains a file of the same name behind the overlay's back.
+	writeMemFile(t, primary, "/s.txt", "shadow")
+	if data, _ := cfs.ReadFile("/s.txt"); string(data) != "secondary" {
+		t.Errorf("ReadFile(/s.txt) = %q, want cached secondary resolution", data)
+	}
+
+	// Mutations through the overlay invalidate cached resolutions.
+	if err := cfs.Remove("/p.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfs.Stat("/p.txt"); !os.IsNotExist(err) {
+		t.Errorf("Stat(/p.txt) after Remove = %v, want not exist", err)
+	}
+	if data, _ := cfs.ReadFile("/s.txt"); string(data) != "shadow" {
+		t.Errorf("ReadFile(/s.txt) = %q, want primary after invalidation", data)
+	}
+}
+
+func TestResolutionCacheTTL(t *testing.T) {
+	cfs, primary, secondary := newMemOverlay(t)
+	WithResolutionCache(time.Nanosecond)(cfs)
+	writeMemFile(t, secondary, "/s.txt", "secondary")
+
+	if _, err := cfs.Stat("/s.txt"); err != nil {
+		t.Fatal(err)
+	}
+	writeMemFile(t, primary, "/s.txt", "primary")
+	time.Sleep(time.Millisecond)
+	if data, _ := cfs.ReadFile("/s.txt"); string(data) != "primary" {
+		t.Errorf("ReadFile(/s.txt) = %q, want primary after ttl", data)
+	}
+	if s := cfs.Stats(); s.ResolutionHits != 0 {
+		t.Errorf("ResolutionHits = %d, want 0", s.ResolutionHits)
+	}
+}
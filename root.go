@@ -0,0 +1,55 @@
+package cowfs
+
+import (
+	"io/fs"
+	"os"
+	"time"
+)
+
+// WithSyntheticRoot makes Stat and Lstat of "/" always report a directory
+// synthesized by the overlay, with permission bits perm and the given owner,
+// instead of the root of either layer. The owner is available as the Owner
+// returned by the FileInfo's Sys method.
+//
+// Without this option the root is taken from the primary, then the
+// secondary, and only synthesized, as a 0755 directory owned by 0:0, when
+// neither layer has a root entry, as with some archive-backed primaries.
+func WithSyntheticRoot(perm os.FileMode, owner Owner) Option {
+	return func(fs *FileSystem) {
+		fs.root.mode = os.ModeDir | perm.Perm()
+		fs.root.owner = owner
+		fs.rootForced = true
+	}
+}
+
+// rootInfo is the synthesized root directory of the merged view.
+type rootInfo struct {
+	mode    os.FileMode
+	owner   Owner
+	modTime time.Time
+}
+
+func (r *rootInfo) Name() string       { return "/" }
+func (r *rootInfo) Size() int64        { return 0 }
+func (r *rootInfo) Mode() fs.FileMode  { return r.mode }
+func (r *rootInfo) ModTime() time.Time { return r.modTime }
+func (r *rootInfo) IsDir() bool        { return true }
+func (r *rootInfo) Sys() any           { return r.owner }
+
+// statRoot implements Stat and Lstat of "/".
+func (cfs *FileSystem) statRoot() (os.FileInfo, error) {
+	if cfs.rootForced {
+		return &cfs.root, nil
+	}
+	cfs.counters.primary.meta()
+	if info, err := cfs.primary.Stat("/"); err == nil {
+		cfs.counters.hit(true)
+		return info, nil
+	}
+	cfs.counters.hit(false)
+	cfs.counters.secondary.meta()
+	if info, err := cfs.secondary.Stat("/"); err == nil {
+		return info, nil
+	}
+	return &cfs.root, nil
+}
@@ -0,0 +1,54 @@
+package cowfs
+
+import (
+	"io/fs"
+	"os"
+	"testing"
+)
+
+func TestSyntheticRootFallback(t *testing.T) {
+	cfs := New(&emptyFiler{}, &emptyFiler{})
+
+	info, err := cfs.Stat("/")
+	if err != nil {
+		t.Fatalf("Stat(/) error = %v", err)
+	}
+	if !info.IsDir() || info.Mode().Perm() != 0755 {
+		t.Errorf("Stat(/) = %v, want a 0755 directory", info.Mode())
+	}
+	entries, err := cfs.ReadDir("/")
+	if err != nil || len(entries) != 0 {
+		t.Errorf("ReadDir(/) = %v, %v, want an empty listing", entries, err)
+	}
+
+	fsys, err := cfs.Sub("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var walked []string
+	err = fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		walked = append(walked, p)
+		return err
+	})
+	if err != nil || len(walked) != 1 {
+		t.Errorf("WalkDir visited %v, error %v, want just the root", walked, err)
+	}
+}
+
+func TestWithSyntheticRoot(t *testing.T) {
+	cfs, _, _ := newMemOverlay(t)
+	WithSyntheticRoot(0700, Owner{UID: 10, GID: 20})(cfs)
+
+	for _, stat := range []func(string) (os.FileInfo, error){cfs.Stat, cfs.Lstat} {
+		info, err := stat("/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.IsDir() || info.Mode().Perm() != 0700 {
+			t.Errorf("root mode = %v, want a 0700 directory", info.Mode())
+		}
+		if owner, _ := info.Sys().(Owner); owner != (Owner{UID: 10, GID: 20}) {
+			t.Errorf("root owner = %+v", info.Sys())
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package cowfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+)
+
+var (
+	// ErrStarted is returned by Start when the background runtime is already
+	// running.
+	ErrStarted = errors.New("cowfs: background runtime already started")
+
+	// ErrClosed is returned by Start after the FileSystem has been closed.
+	ErrClosed = errors.New("cowfs: filesystem closed")
+)
+
+// PanicError reports a panic recovered from a background task.
+type PanicError struct {
+	Task  string // Name of the task that panicked
+	Value any    // Value passed to panic
+	Stack []byte // Stack trace of the panicking goroutine
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("cowfs: background task %s panicked: %v", e.Task, e.Value)
+}
+
+// task is a named background goroutine managed by the runtime. It must
+// return promptly once ctx is cancelled.
+type task struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// bgRuntime runs background tasks as a group: the first task to fail cancels
+// the others, and Close waits for all of them.
+type bgRuntime struct {
+	mu      sync.Mutex
+	tasks   []task
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	err     error
+	started bool
+	closed  bool
+}
+
+// Start launches the background goroutines of all enabled optional features,
+// such as janitors and pollers, under a single group derived from ctx. If
+// any of them fails, or panics, the rest are cancelled and the error is
+// returned by Close. Features that need background work do nothing in the
+// background until Start is called, apart from the copy-ups made by
+// WithAsyncCopyUp.
+//
+// Start returns ErrStarted if called more than once and ErrClosed after
+// Close.
+func (cfs *FileSystem) Start(ctx context.Context) error {
+	rt := &cfs.runtime
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if rt.closed {
+		return ErrClosed
+	}
+	if rt.started {
+		return ErrStarted
+	}
+	rt.started = true
+	rt.ctx, rt.cancel = context.WithCancel(ctx)
+	for _, t := range rt.tasks {
+		rt.launch(t)
+	}
+	return nil
+}
+
+// Close stops all background goroutines started by Start, waits for them to
+// exit and for copy-ups made by WithAsyncCopyUp, carries out secondary
+// removals still queued by WithDeferredDeletion and replications still
+// queued by WithWriteBack, saves the state kept by WithStateStore and
+// returns the first error any of the goroutines reported. Close is safe to
+// call on a FileSystem that was never started, and more than once.
+func (cfs *FileSystem) Close() error {
+	rt := &cfs.runtime
+	rt.mu.Lock()
+	rt.closed = true
+	cancel := rt.cancel
+	rt.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+	rt.wg.Wait()
+	cfs.flushDeletions()
+	cfs.flushWriteBack()
+	stateErr := cfs.closeState()
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if rt.err == nil {
+		return stateErr
+	}
+	return rt.err
+}
+
+// addTask registers a background task. It starts immediately if the runtime
+// is already running, and is discarded if the FileSystem is closed.
+func (cfs *FileSystem) addTask(name string, run func(ctx context.Context) error) {
+	rt := &cfs.runtime
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	t := task{name: name, run: run}
+	switch {
+	case rt.closed:
+	case rt.started:
+		rt.launch(t)
+	default:
+		rt.tasks = append(rt.tasks, t)
+	}
+}
+
+// spawn runs a one-off background task at once, whether or not the runtime
+// is started, and calls then with the PanicError it panicked with, or nil.
+// A panic is also reported by Close, and cancels the other tasks. Close
+// waits for spawned tasks.
+func (cfs *FileSystem) spawn(name string, run func(), then func(err error)) {
+	rt := &cfs.runtime
+	rt.wg.Add(1)
+	go func() {
+		defer rt.wg.Done()
+		err := func() (err error) {
+			defer recoverTask(name, &err)
+			run()
+			return nil
+		}()
+		then(err)
+		if err != nil {
+			rt.mu.Lock()
+			if rt.err == nil {
+				rt.err = err
+			}
+			cancel := rt.cancel
+			rt.mu.Unlock()
+			if cancel != nil {
+				cancel()
+			}
+		}
+	}()
+}
+
+// launch runs t in a new goroutine. rt.mu must be held.
+func (rt *bgRuntime) launch(t task) {
+	rt.wg.Add(1)
+	go func() {
+		defer rt.wg.Done()
+		if err := rt.run(t); err != nil && !errors.Is(err, context.Canceled) {
+			rt.mu.Lock()
+			if rt.err == nil {
+				rt.err = err
+			}
+			rt.mu.Unlock()
+			rt.cancel()
+		}
+	}()
+}
+
+// run calls t, converting a panic into a PanicError.
+func (rt *bgRuntime) run(t task) (err error) {
+	defer recoverTask(t.name, &err)
+	return t.run(rt.ctx)
+}
+
+// recoverTask sets *err to a PanicError if the task named name panicked. It
+// must be deferred by the task's goroutine.
+func recoverTask(name string, err *error) {
+	if v := recover(); v != nil {
+		*err = &PanicError{Task: name, Value: v, Stack: debug.Stack()}
+	}
+}
@@ -0,0 +1,83 @@
+package cowfs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRuntimeLifecycle(t *testing.T) {
+	cfs, _, _ := newMemOverlay(t)
+
+	ran := make(chan struct{})
+	stopped := make(chan struct{})
+	cfs.addTask("worker", func(ctx context.Context) error {
+		close(ran)
+		<-ctx.Done()
+		close(stopped)
+		return ctx.Err()
+	})
+
+	select {
+	case <-ran:
+		t.Fatal("task ran before Start")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	if err := cfs.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	if err := cfs.Start(context.Background()); !errors.Is(err, ErrStarted) {
+		t.Errorf("second Start() error = %v, want ErrStarted", err)
+	}
+	<-ran
+
+	if err := cfs.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+	select {
+	case <-stopped:
+	default:
+		t.Error("Close() returned before the task stopped")
+	}
+	if err := cfs.Start(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Errorf("Start() after Close error = %v, want ErrClosed", err)
+	}
+}
+
+func TestRuntimePanic(t *testing.T) {
+	cfs, _, _ := newMemOverlay(t)
+
+	cancelled := make(chan struct{})
+	cfs.addTask("sibling", func(ctx context.Context) error {
+		<-ctx.Done()
+		close(cancelled)
+		return nil
+	})
+	cfs.Start(context.Background())
+	cfs.addTask("faulty", func(ctx context.Context) error {
+		panic("boom")
+	})
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("panic did not cancel sibling tasks")
+	}
+
+	var perr *PanicError
+	if err := cfs.Close(); !errors.As(err, &perr) {
+		t.Fatalf("Close() error = %v, want *PanicError", err)
+	}
+	if perr.Task != "faulty" || perr.Value != "boom" || len(perr.Stack) == 0 {
+		t.Errorf("PanicError = %+v", perr)
+	}
+}
+
+func TestCloseWithoutStart(t *testing.T) {
+	cfs, _, _ := newMemOverlay(t)
+	if err := cfs.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+package cowfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// Shared reuses copy-ups across overlays that share a primary. The first
+// copy-up of a primary file stores a copy in Store, indexed by the file's
+// path, size, mode and modification time; later copy-ups of the same
+// unchanged file, by this or any other overlay using the same Store, are
+// served from the stored copy instead of the primary.
+//
+// Copies are cloned out of the store with a reflink where both filesystems
+// are backed by operating system files on a reflink-capable filesystem, which
+// makes warming up many overlays nearly free; otherwise the stored copy is
+// copied. Stored copies are never modified, so they are safe to share.
+// Nothing is ever removed from Store.
+type Shared struct {
+	Store absfs.Filer
+}
+
+// CopyUp implements CopyUpStrategy.
+func (s Shared) CopyUp(primary, secondary absfs.Filer, name string, info os.FileInfo) error {
+	return s.copyUpBuffered(primary, secondary, name, info, defaultBuffers)
+}
+
+func (s Shared) copyUpBuffered(primary, secondary absfs.Filer, name string, info os.FileInfo, buffers *bufferPool) error {
+	key := sharedKey(name, info)
+	if _, err := s.Store.Stat(key); err != nil {
+		if err := s.store(primary, name, key, buffers); err != nil {
+			return FullCopy{}.copyUpBuffered(primary, secondary, name, info, buffers)
+		}
+	}
+	return copyFile(secondary, name, s.Store, key, info.Mode().Perm(), true, buffers)
+}
+
+// store adds the primary file name to the store under key. The copy is
+// written under a temporary name first so concurrent overlays never see a
+// partial copy.
+func (s Shared) store(primary absfs.Filer, name, key string, buffers *bufferPool) error {
+	if err := s.Store.Mkdir(path.Dir(key), 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	tmp := key + "." + strconv.FormatInt(time.Now().UnixNano(), 36) + "~"
+	err := copyFile(s.Store, tmp, primary, name, 0444, true, buffers)
+	if err == nil {
+		err = replaceFile(s.Store, tmp, key)
+	}
+	if err != nil {
+		s.Store.Remove(tmp)
+	}
+	return err
+}
+
+// sharedKey returns the store path for a version of a primary file.
+func sharedKey(name string, info os.FileInfo) string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%d\x00%o", name, info.Size(), info.ModTime().UnixNano(), info.Mode())))
+	sum := hex.EncodeToString(h[:])
+	return "/" + sum[:2] + "/" + sum
+}
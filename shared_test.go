@@ -0,0 +1,61 @@
+package cowfs
+
+import (
+	"os"
+	"testing"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/memfs"
+)
+
+// openCounter counts OpenFile calls on the wrapped filesystem.
+type openCounter struct {
+	*memfs.FileSystem
+	opens int
+}
+
+func (o *openCounter) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	o.opens++
+	return o.FileSystem.OpenFile(name, flag, perm)
+}
+
+func TestSharedCopyUp(t *testing.T) {
+	mem, err := memfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeMemFile(t, mem, "/a.txt", "shared")
+	primary := &openCounter{FileSystem: mem}
+	store, err := memfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		secondary, err := memfs.NewFS()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfs := New(primary, secondary, WithCopyUpStrategy(Shared{Store: store}))
+		if err := cfs.Chmod("/a.txt", 0600); err != nil {
+			t.Fatal(err)
+		}
+		if data, err := secondary.ReadFile("/a.txt"); err != nil || string(data) != "shared" {
+			t.Fatalf("overlay %d: secondary copy = %q, %v", i, data, err)
+		}
+	}
+	if primary.opens != 1 {
+		t.Errorf("primary opened %d times, want 1", primary.opens)
+	}
+
+	// A changed primary file is stored afresh.
+	writeMemFile(t, mem, "/a.txt", "changed!")
+	secondary, _ := memfs.NewFS()
+	cfs := New(primary, secondary, WithCopyUpStrategy(Shared{Store: store}))
+	if err := cfs.Chmod("/a.txt", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := secondary.ReadFile("/a.txt"); string(data) != "changed!" {
+		t.Errorf("secondary copy after primary change = %q", data)
+	}
+}
@@ -0,0 +1,62 @@
+package cowfs
+
+import (
+	"errors"
+	"os"
+)
+
+// ErrOverlayFull is returned when a copy-up is refused because the secondary
+// filesystem does not have enough free space for it.
+var ErrOverlayFull = errors.New("cowfs: not enough free space in secondary")
+
+// SpaceReporter is implemented by filesystems that can report how many bytes
+// are available for new data, in the manner of statfs(2).
+type SpaceReporter interface {
+	AvailableSpace() (int64, error)
+}
+
+// SpaceProbe reports the number of bytes available in the secondary
+// filesystem.
+type SpaceProbe func() (int64, error)
+
+// WithSpaceCheck makes copy-ups fail fast with ErrOverlayFull when copying the
+// file would leave less than reserve bytes free in the secondary, instead of
+// running out of space partway through the copy. Free space is queried with
+// probe, or through SpaceReporter if probe is nil and the secondary implements
+// it. If free space cannot be determined the copy-up proceeds.
+func WithSpaceCheck(reserve int64, probe SpaceProbe) Option {
+	return func(fs *FileSystem) {
+		if probe == nil {
+			if r, ok := fs.secondary.(SpaceReporter); ok {
+				probe = r.AvailableSpace
+			}
+		}
+		fs.reserve = reserve
+		fs.probe = probe
+	}
+}
+
+// DiskSpaceProbe returns a SpaceProbe reporting the space available to
+// unprivileged users on the host filesystem containing dir. It is intended
+// for secondaries backed by a host directory.
+func DiskSpaceProbe(dir string) SpaceProbe {
+	return func() (int64, error) {
+		return diskAvailable(dir)
+	}
+}
+
+// checkSpace returns ErrOverlayFull if a copy-up of size bytes for name would
+// exceed the configured reserve.
+func (cfs *FileSystem) checkSpace(name string, size int64) error {
+	if cfs.probe == nil {
+		return nil
+	}
+	free, err := cfs.probe()
+	if err != nil {
+		return nil
+	}
+	if free-size < cfs.reserve {
+		return &os.PathError{Op: "copyup", Path: name, Err: ErrOverlayFull}
+	}
+	return nil
+}
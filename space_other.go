@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || freebsd)
+
+package cowfs
+
+import "errors"
+
+func diskAvailable(dir string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,80 @@
+package cowfs
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/absfs/memfs"
+)
+
+func TestSpaceCheck(t *testing.T) {
+	cfs, primary, secondary := newMemOverlay(t)
+	writeMemFile(t, primary, "/big.bin", "0123456789")
+	writeMemFile(t, primary, "/small.bin", "01")
+
+	WithSpaceCheck(5, func() (int64, error) { return 10, nil })(cfs)
+
+	_, err := cfs.OpenFile("/big.bin", os.O_WRONLY, 0)
+	if !errors.Is(err, ErrOverlayFull) {
+		t.Fatalf("OpenFile() error = %v, want ErrOverlayFull", err)
+	}
+	if _, err := secondary.Stat("/big.bin"); err == nil {
+		t.Error("refused copy-up left a partial copy in the secondary")
+	}
+	if data, err := cfs.ReadFile("/big.bin"); err != nil || string(data) != "0123456789" {
+		t.Errorf("ReadFile() after refused copy-up = %q, %v, want primary content", data, err)
+	}
+	if err := cfs.Chmod("/big.bin", 0600); !errors.Is(err, ErrOverlayFull) {
+		t.Errorf("Chmod() error = %v, want ErrOverlayFull", err)
+	}
+	if err := cfs.Rename("/big.bin", "/moved.bin"); !errors.Is(err, ErrOverlayFull) {
+		t.Errorf("Rename() error = %v, want ErrOverlayFull", err)
+	}
+	if _, err := cfs.Stat("/big.bin"); err != nil {
+		t.Errorf("Stat() after refused operations error = %v", err)
+	}
+
+	f, err := cfs.OpenFile("/small.bin", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v for copy-up within reserve", err)
+	}
+	f.Close()
+}
+
+func TestSpaceCheckProbeError(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	writeMemFile(t, primary, "/file", "data")
+	WithSpaceCheck(1<<40, func() (int64, error) { return 0, errors.New("unknown") })(cfs)
+
+	if err := cfs.Chmod("/file", 0600); err != nil {
+		t.Errorf("Chmod() error = %v, want copy-up to proceed when space is unknown", err)
+	}
+}
+
+type reportingFiler struct {
+	*memfs.FileSystem
+	free int64
+}
+
+func (r reportingFiler) AvailableSpace() (int64, error) { return r.free, nil }
+
+func TestSpaceCheckReporter(t *testing.T) {
+	_, primary, secondary := newMemOverlay(t)
+	writeMemFile(t, primary, "/file", "data")
+	cfs := New(primary, reportingFiler{FileSystem: secondary, free: 2}, WithSpaceCheck(0, nil))
+
+	if _, err := cfs.OpenFile("/file", os.O_RDWR, 0); !errors.Is(err, ErrOverlayFull) {
+		t.Errorf("OpenFile() error = %v, want ErrOverlayFull", err)
+	}
+}
+
+func TestDiskSpaceProbe(t *testing.T) {
+	free, err := DiskSpaceProbe(t.TempDir())()
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("disk space probing not supported on this platform")
+	}
+	if err != nil || free <= 0 {
+		t.Errorf("DiskSpaceProbe() = %d, %v", free, err)
+	}
+}
@@ -0,0 +1,28 @@
+package cowfs
+
+import (
+	"errors"
+	"io"
+	"syscall"
+)
+
+// seekData and seekHole are the lseek whence values, from unistd.h, that
+// find the next data and the next hole in a file.
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// nextData returns the range of the first data at or after off in f, or
+// io.EOF if only a hole follows off.
+func nextData(f io.Seeker, off int64) (start, end int64, err error) {
+	start, err = f.Seek(off, seekData)
+	if errors.Is(err, syscall.ENXIO) {
+		return 0, 0, io.EOF
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err = f.Seek(start, seekHole)
+	return start, end, err
+}
@@ -0,0 +1,59 @@
+package cowfs
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/absfs/cowfs/dirfs"
+	"github.com/absfs/memfs"
+)
+
+func TestSparseCopyUp(t *testing.T) {
+	pdir, sdir := t.TempDir(), t.TempDir()
+	const size = 64 << 20
+	f, err := os.Create(filepath.Join(pdir, "disk.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("boot"), 0)
+	f.WriteAt([]byte("data"), size/2)
+	f.Truncate(size)
+	f.Close()
+	probe := must(os.Open(filepath.Join(pdir, "disk.img")))
+	_, _, err = nextData(probe, 0)
+	probe.Close()
+	if err != nil {
+		t.Skipf("SEEK_DATA unavailable: %v", err)
+	}
+
+	cfs := New(must(dirfs.New(pdir)), must(dirfs.New(sdir)))
+	if err := cfs.Chmod("/disk.img", 0600); err != nil {
+		t.Fatal(err)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(filepath.Join(sdir, "disk.img"), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Size != size {
+		t.Errorf("secondary copy is %d bytes, want %d", st.Size, size)
+	}
+	if allocated := st.Blocks * 512; allocated >= size/2 {
+		t.Errorf("secondary copy allocates %d bytes, want its holes kept", allocated)
+	}
+
+	// Contents survive the copy, and copies to layers without holes
+	want := must(os.ReadFile(filepath.Join(pdir, "disk.img")))
+	if got := must(cfs.ReadFile("/disk.img")); !bytes.Equal(got, want) {
+		t.Error("sparse copy differs from the primary file")
+	}
+	mem := New(must(dirfs.New(pdir)), must(memfs.NewFS()))
+	if err := mem.Chmod("/disk.img", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got := must(mem.ReadFile("/disk.img")); !bytes.Equal(got, want) {
+		t.Error("sparse copy to memfs differs from the primary file")
+	}
+}
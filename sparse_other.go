@@ -0,0 +1,13 @@
+//go:build !linux
+
+package cowfs
+
+import (
+	"errors"
+	"io"
+)
+
+// nextData is not implemented on this platform.
+func nextData(f io.Seeker, off int64) (start, end int64, err error) {
+	return 0, 0, errors.ErrUnsupported
+}
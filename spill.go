@@ -0,0 +1,331 @@
+package cowfs
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/absfs/absfs"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// spillDir is the secondary directory holding the sorted runs of directory
+// listings merged on disk.
+const spillDir = "/.cowfs-merge~"
+
+// WithMergeLimit bounds the number of entries held in memory while merging
+// the listing of a directory opened through the overlay. Listings with more
+// entries are merged with an external sort instead: the layers are read
+// limit entries at a time, each batch is sorted and spilled to a temporary
+// file in the secondary, and the files are merged as the directory is read.
+// Such listings are returned in name order and cost extra secondary I/O, but
+// memory use no longer grows with the size of the directory. Stats reports
+// how often this happens as MergeSpills.
+//
+// The limit applies to listings read incrementally through Readdir,
+// Readdirnames and ReadDir on directory files, and through ReadDirIter.
+// FileSystem.ReadDir returns the whole listing at once and is not affected.
+func WithMergeLimit(limit int) Option {
+	return func(fs *FileSystem) {
+		fs.mergeLimit = limit
+	}
+}
+
+// spillEntry is a directory entry as stored in a spilled run.
+type spillEntry struct {
+	Name    string
+	Mode    os.FileMode
+	Size    int64
+	ModTime time.Time
+	Primary bool // Listed by the primary
+}
+
+func (e *spillEntry) info() os.FileInfo { return spillInfo{e} }
+
+// listed returns the info to list for e, the entry of path name.
+func (e *spillEntry) listed(cfs *FileSystem, name string) os.FileInfo {
+	if e.Primary {
+		return e.info()
+	}
+	return cfs.secondaryInfo(name, e.info())
+}
+
+// spillInfo is the os.FileInfo of a spilled entry.
+type spillInfo struct {
+	e *spillEntry
+}
+
+func (i spillInfo) Name() string       { return i.e.Name }
+func (i spillInfo) Size() int64        { return i.e.Size }
+func (i spillInfo) Mode() os.FileMode  { return i.e.Mode }
+func (i spillInfo) ModTime() time.Time { return i.e.ModTime }
+func (i spillInfo) IsDir() bool        { return i.e.Mode.IsDir() }
+func (i spillInfo) Sys() any           { return nil }
+
+// buildLimited builds the merged listing of f while holding at most the
+// configured number of entries in memory, spilling to sorted runs if the
+// directory turns out to be larger.
+func (f *mergedDirFile) buildLimited() (err error) {
+	cfs := f.fs
+	limit := f.limit
+	span := cfs.startSpan("cowfs.Readdir", attribute.String("cowfs.path", f.name))
+	defer func() { endSpan(span, err) }()
+
+	s := &spilledListing{fs: cfs, dir: f.name}
+	var batch []spillEntry
+	for _, l := range []struct {
+		filer   absfs.Filer
+		primary bool
+	}{{f.primary, true}, {f.secondary, false}} {
+		if l.primary && cfs.isOpaque(f.name) {
+			continue
+		}
+		dir, err := l.filer.OpenFile(f.name, os.O_RDONLY, 0)
+		if err != nil {
+			continue
+		}
+		for {
+			infos, rerr := dir.Readdir(limit)
+			for _, info := range infos {
+				name := info.Name()
+				if name == "." || name == ".." || (!l.primary && internalDir(f.name, name)) {
+					continue
+				}
+				batch = append(batch, spillEntry{
+					Name:    name,
+					Mode:    info.Mode(),
+					Size:    info.Size(),
+					ModTime: info.ModTime(),
+					Primary: l.primary,
+				})
+				if len(batch) > limit {
+					if err := s.writeRun(batch); err != nil {
+						dir.Close()
+						s.Close()
+						return err
+					}
+					batch = batch[:0]
+				}
+			}
+			if rerr != nil || len(infos) == 0 {
+				break
+			}
+		}
+		dir.Close()
+	}
+
+	if len(s.runs) == 0 {
+		// Small enough to merge in memory, as without a limit
+		result := make([]os.FileInfo, 0, len(batch))
+		seen := make(map[string]bool)
+		for i := range batch {
+			e := &batch[i]
+			entryPath := cfs.normalize(path.Join(f.name, e.Name))
+			if seen[entryPath] || cfs.isDeletedPath(entryPath) || (e.Primary && cfs.IsModified(entryPath)) {
+				continue
+			}
+			seen[entryPath] = true
+			result = append(result, e.listed(cfs, entryPath))
+		}
+		sort.Slice(result, func(i, j int) bool { return result[i].Name() < result[j].Name() })
+		f.merged = result
+		return nil
+	}
+
+	if len(batch) > 0 {
+		if err := s.writeRun(batch); err != nil {
+			s.Close()
+			return err
+		}
+	}
+	if err := s.open(); err != nil {
+		s.Close()
+		return err
+	}
+	cfs.counters.mergeSpills.Add(1)
+	span.SetAttributes(attribute.Int("cowfs.runs", len(s.runs)))
+	cfs.debug("cowfs: directory merge spilled", "path", f.name, "runs", len(s.runs))
+	f.spill = s
+	return nil
+}
+
+// isDeletedPath reports whether name is marked deleted.
+func (cfs *FileSystem) isDeletedPath(name string) bool {
+	cfs.mu.RLock()
+	defer cfs.mu.RUnlock()
+	return cfs.deleted[name]
+}
+
+// spilledListing merges sorted runs of directory entries stored in the
+// secondary.
+type spilledListing struct {
+	fs      *FileSystem
+	dir     string // Directory being listed
+	runs    []string
+	cursors runHeap
+}
+
+// writeRun sorts batch and writes it to a new run file.
+func (s *spilledListing) writeRun(batch []spillEntry) error {
+	sort.Slice(batch, func(i, j int) bool { return batch[i].Name < batch[j].Name })
+	secondary := s.fs.secondary
+	if err := secondary.Mkdir(spillDir, 0700); err != nil && !os.IsExist(err) {
+		return err
+	}
+	name := fmt.Sprintf("%s/%d", spillDir, s.fs.spillSeq.Add(1))
+	f, err := secondary.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, name)
+	s.fs.counters.mergeSpillRuns.Add(1)
+
+	w := bufio.NewWriter(f)
+	enc := gob.NewEncoder(w)
+	for i := range batch {
+		if err = enc.Encode(&batch[i]); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// open opens every run and positions it at its first entry.
+func (s *spilledListing) open() error {
+	for _, name := range s.runs {
+		f, err := s.fs.secondary.OpenFile(name, os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		c := &runCursor{f: f, dec: gob.NewDecoder(bufio.NewReader(f))}
+		if err := c.advance(); err == io.EOF {
+			f.Close()
+			continue
+		} else if err != nil {
+			f.Close()
+			return err
+		}
+		s.cursors = append(s.cursors, c)
+	}
+	heap.Init(&s.cursors)
+	return nil
+}
+
+// pop returns the next merged entry in name order. An entry listed by both
+// layers is taken from the primary, and deleted entries are skipped.
+func (s *spilledListing) pop() (os.FileInfo, error) {
+	for len(s.cursors) > 0 {
+		e, err := s.take()
+		if err != nil {
+			return nil, err
+		}
+		// Prefer the primary entry, unless the path was modified
+		entryPath := s.fs.normalize(path.Join(s.dir, e.Name))
+		modified := s.fs.IsModified(entryPath)
+		for len(s.cursors) > 0 && s.cursors[0].cur.Name == e.Name {
+			other, err := s.take()
+			if err != nil {
+				return nil, err
+			}
+			if other.Primary != modified {
+				e = other
+			}
+		}
+		if !s.fs.isDeletedPath(entryPath) {
+			return e.listed(s.fs, entryPath), nil
+		}
+	}
+	return nil, io.EOF
+}
+
+// take removes the smallest current entry from the heap, advancing its run.
+func (s *spilledListing) take() (*spillEntry, error) {
+	c := s.cursors[0]
+	e := c.cur
+	if err := c.advance(); err == io.EOF {
+		c.f.Close()
+		heap.Pop(&s.cursors)
+	} else if err != nil {
+		return nil, err
+	} else {
+		heap.Fix(&s.cursors, 0)
+	}
+	return e, nil
+}
+
+// next returns up to n merged entries, or all remaining ones if n <= 0,
+// following the conventions of mergedDirFile.Readdir.
+func (s *spilledListing) next(n int) ([]os.FileInfo, error) {
+	var result []os.FileInfo
+	for n <= 0 || len(result) < n {
+		info, err := s.pop()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, err
+		}
+		result = append(result, info)
+	}
+	if len(result) == 0 || (n > 0 && len(result) < n) {
+		return result, io.EOF
+	}
+	return result, nil
+}
+
+// Close closes and removes the run files.
+func (s *spilledListing) Close() error {
+	for _, c := range s.cursors {
+		c.f.Close()
+	}
+	s.cursors = nil
+	for _, name := range s.runs {
+		s.fs.secondary.Remove(name)
+	}
+	s.runs = nil
+	// Fails while other listings are spilled, which is fine
+	s.fs.secondary.Remove(spillDir)
+	return nil
+}
+
+// runCursor reads one run file.
+type runCursor struct {
+	f   absfs.File
+	dec *gob.Decoder
+	cur *spillEntry
+}
+
+func (c *runCursor) advance() error {
+	var e spillEntry
+	if err := c.dec.Decode(&e); err != nil {
+		return err
+	}
+	c.cur = &e
+	return nil
+}
+
+// runHeap orders run cursors by their current entry name.
+type runHeap []*runCursor
+
+func (h runHeap) Len() int           { return len(h) }
+func (h runHeap) Less(i, j int) bool { return h[i].cur.Name < h[j].cur.Name }
+func (h runHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x any)        { *h = append(*h, x.(*runCursor)) }
+func (h *runHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
@@ -0,0 +1,162 @@
+package cowfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestMergeLimitSpill(t *testing.T) {
+	cfs, primary, secondary := newMemOverlay(t)
+	WithMergeLimit(3)(cfs)
+	primary.Mkdir("/dir", 0755)
+	for i := 0; i < 6; i++ {
+		writeMemFile(t, primary, fmt.Sprintf("/dir/p%d", i), "p")
+	}
+	for _, name := range []string{"/dir/s0", "/dir/s1"} {
+		f, err := cfs.OpenFile(name, os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	if err := cfs.Chmod("/dir/p1", 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfs.Remove("/dir/p4")
+
+	dir, err := cfs.OpenFile("/dir", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for {
+		batch, err := dir.Readdirnames(2)
+		names = append(names, batch...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{"p0", "p1", "p2", "p3", "p5", "s0", "s1"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("Readdirnames() = %v, want %v", names, want)
+	}
+	if s := cfs.Stats(); s.MergeSpills != 1 || s.MergeSpillRuns < 2 {
+		t.Errorf("Stats() spills = %d, runs = %d, want 1 spill of several runs", s.MergeSpills, s.MergeSpillRuns)
+	}
+	if err := dir.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := secondary.Stat(spillDir); !os.IsNotExist(err) {
+		t.Errorf("spill directory left behind: %v", err)
+	}
+}
+
+func TestMergeLimitInMemory(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	WithMergeLimit(10)(cfs)
+	primary.Mkdir("/dir", 0755)
+	writeMemFile(t, primary, "/dir/a", "a")
+	writeMemFile(t, primary, "/dir/b", "b")
+	cfs.Remove("/dir/b")
+
+	dir, err := cfs.OpenFile("/dir", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+	entries, err := dir.ReadDir(-1)
+	if err != nil || len(entries) != 1 || entries[0].Name() != "a" {
+		t.Errorf("ReadDir(-1) = %v, %v, want just a", entries, err)
+	}
+	if s := cfs.Stats(); s.MergeSpills != 0 {
+		t.Errorf("small directory spilled")
+	}
+}
+
+func TestMergedListingOrder(t *testing.T) {
+	for _, limit := range []int{0, 10} {
+		cfs, primary, _ := newMemOverlay(t)
+		WithMergeLimit(limit)(cfs)
+		primary.Mkdir("/dir", 0755)
+		writeMemFile(t, primary, "/dir/b", "b")
+		writeMemFile(t, primary, "/dir/d", "d")
+		cfs.WriteFile("/dir/a", []byte("a"), 0644)
+		cfs.WriteFile("/dir/c", []byte("c"), 0644)
+		want := []string{"a", "b", "c", "d"}
+
+		entries, err := cfs.ReadDir("/dir")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		if !reflect.DeepEqual(names, want) {
+			t.Errorf("limit %d: ReadDir() = %v, want %v", limit, names, want)
+		}
+
+		// Pages of a directory handle continue where the last one ended
+		dir, err := cfs.OpenFile("/dir", os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = nil
+		for {
+			page, err := dir.ReadDir(3)
+			for _, e := range page {
+				names = append(names, e.Name())
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil || len(names) > len(want) {
+				t.Fatalf("limit %d: ReadDir(3) = %v, %v", limit, names, err)
+			}
+		}
+		dir.Close()
+		if !reflect.DeepEqual(names, want) {
+			t.Errorf("limit %d: paged ReadDir() = %v, want %v", limit, names, want)
+		}
+	}
+}
+
+func TestMergedListingModified(t *testing.T) {
+	for _, limit := range []int{0, 10, 1} {
+		cfs, primary, _ := newMemOverlay(t)
+		WithMergeLimit(limit)(cfs)
+		primary.Mkdir("/dir", 0755)
+		writeMemFile(t, primary, "/dir/a", "a")
+		writeMemFile(t, primary, "/dir/b", "b")
+		if err := cfs.WriteFile("/dir/a", []byte("modified"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		entries, err := cfs.ReadDir("/dir")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 2 {
+			t.Fatalf("limit %d: ReadDir() returned %d entries, want 2", limit, len(entries))
+		}
+		if info, _ := entries[0].Info(); info.Size() != int64(len("modified")) {
+			t.Errorf("limit %d: ReadDir() size of a = %d, want the modified size", limit, info.Size())
+		}
+
+		dir, err := cfs.OpenFile("/dir", os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		infos, _ := dir.Readdir(-1)
+		dir.Close()
+		if len(infos) != 2 || infos[0].Size() != int64(len("modified")) || infos[1].Size() != 1 {
+			t.Errorf("limit %d: Readdir() = %v, want a with the modified size and b", limit, infos)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package cowfs
+
+import (
+	"io"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/absfs/absfs"
+)
+
+// Split moves the part of the overlay below the directory root into a new,
+// independent overlay whose primary is the primary's subtree at root and
+// whose secondary is newSecondary, which should be empty. The changes made
+// below root, that is the secondary copies, the modified and deleted
+// markers and any deferred ownership, are copied into the new overlay and
+// then removed from this one, so that here root reverts to its primary
+// contents.
+//
+// Paths in the new overlay are relative to root. opts configure the new
+// overlay. Mutations of this overlay are held back while Split runs.
+func (cfs *FileSystem) Split(root string, newSecondary absfs.Filer, opts ...Option) (*FileSystem, error) {
+	cfs.opMu.Lock()
+	defer cfs.opMu.Unlock()
+	if cfs.frozen.Load() {
+		return nil, ErrFrozen
+	}
+	cfs.flushDeletions()
+
+	root = cfs.normalize(root)
+	info, err := cfs.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &os.PathError{Op: "split", Path: root, Err: syscall.ENOTDIR}
+	}
+
+	if err := cfs.txTouch(root); err != nil {
+		return nil, err
+	}
+	split := New(&prefixFiler{fs: cfs.primary, prefix: root}, newSecondary, opts...)
+	if _, err := cfs.secondary.Stat(root); err == nil {
+		if err := cfs.copyTree(split.secondary, root, root); err != nil {
+			return nil, err
+		}
+	}
+
+	modified, deleted := cfs.state()
+	cfs.mu.Lock()
+	for _, name := range modified {
+		if rel, ok := relativeTo(root, name); ok {
+			split.modified[rel] = true
+			delete(cfs.modified, name)
+			delete(cfs.deltas, name)
+		}
+	}
+	for _, name := range deleted {
+		if rel, ok := relativeTo(root, name); ok {
+			split.deleted[rel] = true
+			delete(cfs.deleted, name)
+		}
+	}
+	for name, o := range cfs.owners {
+		if rel, ok := relativeTo(root, name); ok {
+			if split.owners == nil {
+				split.owners = make(map[string]Owner)
+			}
+			split.owners[rel] = o
+			delete(cfs.owners, name)
+		}
+	}
+	if c, sc := cfs.conflicts, split.conflicts; c != nil {
+		c.mu.Lock()
+		for name, v := range c.bases {
+			if rel, ok := relativeTo(root, name); ok {
+				if sc != nil {
+					sc.bases[rel] = v
+				}
+				delete(c.bases, name)
+			}
+		}
+		c.mu.Unlock()
+	}
+	for dir := range cfs.opaque {
+		if rel, ok := relativeTo(root, dir); ok {
+			split.setOpaque(rel)
+			delete(cfs.opaque, dir)
+		}
+	}
+	cfs.mu.Unlock()
+
+	if cfs.quota != nil {
+		cfs.adjustQuota("split", root, -treeSize(cfs.secondary, root))
+	}
+	removeAll(cfs.secondary, root)
+	cfs.gen.Add(1)
+	cfs.stateChanged()
+	return split, nil
+}
+
+// relativeTo returns name relative to the directory root, as an absolute
+// path, if name is root or below it.
+func relativeTo(root, name string) (string, bool) {
+	if name == root {
+		return "/", true
+	}
+	if root == "/" {
+		return name, true
+	}
+	if strings.HasPrefix(name, root+"/") {
+		return strings.TrimPrefix(name, root), true
+	}
+	return "", false
+}
+
+// copyTree copies the secondary subtree at name to dst, with paths made
+// relative to root. Delta-encoded files are copied with their full contents,
+// and symbolic links are copied if dst supports them. Files whose contents
+// are in a content store dst shares refer to them instead of copying them.
+// The overlay's internal files are skipped, apart from the stored conflict
+// bases.
+func (cfs *FileSystem) copyTree(dst absfs.Filer, root, name string) error {
+	info, err := lstatLayer(cfs.secondary, name)
+	if err != nil {
+		return err
+	}
+	rel, _ := relativeTo(root, name)
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		sl, ok := dst.(absfs.SymLinker)
+		if !ok || !cfs.links {
+			return nil
+		}
+		target, err := cfs.secondary.(absfs.SymLinker).Readlink(name)
+		if err != nil {
+			return err
+		}
+		return sl.Symlink(target, rel)
+	} else if info.IsDir() {
+		if rel != "/" {
+			if err := dst.Mkdir(rel, info.Mode().Perm()); err != nil && !os.IsExist(err) {
+				return err
+			}
+		}
+		entries, err := cfs.secondary.ReadDir(name)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if internalDir(name, entry.Name()) && "/"+entry.Name() != basesDir {
+				continue
+			}
+			if err := cfs.copyTree(dst, root, path.Join(name, entry.Name())); err != nil {
+				return err
+			}
+		}
+	} else if shared, err := shareContent(cfs.secondary, name, dst, rel, info.Mode().Perm()); err != nil {
+		return err
+	} else if shared {
+		// The contents are in a store dst shares
+	} else if info.Mode().IsRegular() {
+		var src absfs.File
+		if cfs.isDelta(name) {
+			src, err = cfs.openDelta(name)
+		} else {
+			src, err = cfs.secondary.OpenFile(name, os.O_RDONLY, 0)
+		}
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		f, err := dst.OpenFile(rel, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, src)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	} else {
+		return nil
+	}
+	dst.Chmod(rel, info.Mode())
+	dst.Chtimes(rel, info.ModTime(), info.ModTime())
+	return nil
+}
@@ -0,0 +1,69 @@
+package cowfs
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/absfs/memfs"
+)
+
+func TestSplit(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	if err := primary.Mkdir("/box", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeMemFile(t, primary, "/box/base.txt", "base")
+	writeMemFile(t, primary, "/box/gone.txt", "gone")
+	writeMemFile(t, primary, "/outside.txt", "outside")
+
+	f, err := cfs.OpenFile("/box/base.txt", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("edited"))
+	f.Close()
+	if err := cfs.Remove("/box/gone.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Mkdir("/box/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Chmod("/outside.txt", 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	newSecondary, err := memfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	split, err := cfs.Split("/box", newSecondary)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := split.ReadFile("/base.txt"); err != nil || string(data) != "edited" {
+		t.Errorf("split ReadFile(/base.txt) = %q, %v", data, err)
+	}
+	if _, err := split.Stat("/gone.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("split Stat(/gone.txt) = %v, want not exist", err)
+	}
+	if info, err := split.Stat("/sub"); err != nil || !info.IsDir() {
+		t.Errorf("split Stat(/sub) = %v, %v", info, err)
+	}
+
+	// The original reverts to the primary below /box and keeps the rest.
+	if data, err := cfs.ReadFile("/box/base.txt"); err != nil || string(data) != "base" {
+		t.Errorf("original ReadFile(/box/base.txt) = %q, %v", data, err)
+	}
+	if _, err := cfs.Stat("/box/gone.txt"); err != nil {
+		t.Errorf("original Stat(/box/gone.txt) = %v", err)
+	}
+	if cfs.Status("/outside.txt") != StatusModified {
+		t.Errorf("Status(/outside.txt) = %v, want modified", cfs.Status("/outside.txt"))
+	}
+
+	if _, err := cfs.Split("/outside.txt", newSecondary); err == nil {
+		t.Error("Split of a file succeeded")
+	}
+}
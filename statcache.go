@@ -0,0 +1,118 @@
+package cowfs
+
+import (
+	"container/list"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WithStatCache caches the results of Stat requests made to the primary,
+// both the file information of existing paths and the absence of missing
+// ones, for up to ttl. At most size paths are cached; the least recently
+// used is dropped to make room for a new one. This saves the primary
+// lookup that Stat and existence checks otherwise pay on every call, which
+// matters when the primary is slow to answer.
+//
+// Like WithResolutionCache, every mutation made through the overlay
+// invalidates all cached results, and changes made to the primary behind
+// the overlay's back are noticed once the ttl expires. Stats reports the
+// cache's activity as StatCacheHits and StatCacheMisses.
+func WithStatCache(size int, ttl time.Duration) Option {
+	return func(fs *FileSystem) {
+		fs.statCache = &statCache{
+			size:    size,
+			ttl:     ttl,
+			lru:     list.New(),
+			entries: make(map[string]*list.Element),
+		}
+	}
+}
+
+type statEntry struct {
+	name    string
+	info    os.FileInfo // Nil if the path does not exist in the primary
+	gen     uint64
+	expires time.Time
+}
+
+// statCache is an LRU of primary Stat results.
+type statCache struct {
+	size    int
+	ttl     time.Duration
+	mu      sync.Mutex
+	lru     *list.List // Front is most recently used
+	entries map[string]*list.Element
+	hits    atomic.Uint64
+	misses  atomic.Uint64
+}
+
+// get returns the cached result for name if it was stored in generation gen
+// and has not expired.
+func (c *statCache) get(name string, gen uint64) (*statEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[name]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*statEntry)
+	if e.gen != gen || !time.Now().Before(e.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, name)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return e, true
+}
+
+// put stores the result of a Stat of name made in generation gen.
+func (c *statCache) put(name string, gen uint64, info os.FileInfo) {
+	if c.size <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[name]; ok {
+		c.lru.Remove(el)
+	}
+	for c.lru.Len() >= c.size {
+		e := c.lru.Remove(c.lru.Back()).(*statEntry)
+		delete(c.entries, e.name)
+	}
+	c.entries[name] = c.lru.PushFront(&statEntry{
+		name:    name,
+		info:    info,
+		gen:     gen,
+		expires: time.Now().Add(c.ttl),
+	})
+}
+
+// primaryStat stats name in the primary, answering from the stat cache when
+// it holds a current result.
+func (cfs *FileSystem) primaryStat(name string) (os.FileInfo, error) {
+	c := cfs.statCache
+	if c == nil {
+		cfs.counters.primary.meta()
+		return cfs.primary.Stat(name)
+	}
+	gen := cfs.gen.Load()
+	if e, ok := c.get(name, gen); ok {
+		c.hits.Add(1)
+		if e.info == nil {
+			return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+		}
+		return e.info, nil
+	}
+	c.misses.Add(1)
+	cfs.counters.primary.meta()
+	info, err := cfs.primary.Stat(name)
+	switch {
+	case err == nil:
+		c.put(name, gen, info)
+	case os.IsNotExist(err):
+		c.put(name, gen, nil)
+	}
+	return info, err
+}
@@ -0,0 +1,65 @@
+package cowfs
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStatCache(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	WithStatCache(2, time.Hour)(cfs)
+	writeMemFile(t, primary, "/p.txt", "primary")
+
+	for i := 0; i < 3; i++ {
+		if info, err := cfs.Stat("/p.txt"); err != nil || info.Size() != 7 {
+			t.Fatalf("Stat(/p.txt) = %v, %v", info, err)
+		}
+		if _, err := cfs.Stat("/missing"); !os.IsNotExist(err) {
+			t.Fatalf("Stat(/missing) error = %v, want not exist", err)
+		}
+	}
+	s := cfs.Stats()
+	if s.StatCacheHits != 4 || s.StatCacheMisses != 2 {
+		t.Errorf("stat cache hits/misses = %d/%d, want 4/2", s.StatCacheHits, s.StatCacheMisses)
+	}
+
+	// Both positive and negative results hide changes behind the overlay's
+	// back until invalidated by a mutation
+	writeMemFile(t, primary, "/missing", "now here")
+	if _, err := cfs.Stat("/missing"); err == nil {
+		t.Error("Stat(/missing) not answered from the cache")
+	}
+	if err := cfs.WriteFile("/other.txt", []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfs.Stat("/missing"); err != nil {
+		t.Errorf("Stat(/missing) after invalidation error = %v", err)
+	}
+
+	// The least recently used path is evicted
+	cfs.Stat("/p.txt")
+	cfs.Stat("/missing")
+	cfs.Stat("/absent")
+	before := cfs.Stats().StatCacheMisses
+	cfs.Stat("/p.txt")
+	if cfs.Stats().StatCacheMisses != before+1 {
+		t.Error("least recently used entry not evicted")
+	}
+}
+
+func TestStatCacheTTL(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	WithStatCache(100, time.Nanosecond)(cfs)
+	if _, err := cfs.Stat("/p.txt"); !os.IsNotExist(err) {
+		t.Fatalf("Stat() error = %v, want not exist", err)
+	}
+	writeMemFile(t, primary, "/p.txt", "primary")
+	time.Sleep(time.Millisecond)
+	if _, err := cfs.Stat("/p.txt"); err != nil {
+		t.Errorf("Stat() after ttl error = %v", err)
+	}
+	if s := cfs.Stats(); s.StatCacheHits != 0 {
+		t.Errorf("stat cache hits = %d, want 0", s.StatCacheHits)
+	}
+}
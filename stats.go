@@ -0,0 +1,262 @@
+package cowfs
+
+import (
+	"expvar"
+	"sync/atomic"
+)
+
+// Stats is a snapshot of overlay activity counters.
+type Stats struct {
+	CopyUps        uint64 // Files copied from primary to secondary
+	CopyUpBytes    uint64 // Bytes copied from primary to secondary
+	CopyUpFailures uint64 // Copy-ups that failed or were refused
+	PrimaryHits    uint64 // Reads served by the primary filesystem
+	SecondaryHits  uint64 // Reads served by the secondary filesystem
+	Modified       int    // Paths currently marked modified
+	Deleted        int    // Paths currently marked deleted
+	DeferredChowns int    // Paths with ownership recorded instead of applied
+
+	DeferredDeletions uint64 // Secondary removals queued; see WithDeferredDeletion
+	DeletionBacklog   int    // Queued secondary removals not carried out yet
+
+	WriteBacks        uint64 // Paths replicated to the primary; see WithWriteBack
+	WriteBackFailures uint64 // Replications to the primary that failed
+	WriteBackBacklog  int    // Paths queued for replication to the primary
+
+	CopyUpsInFlight int // Copy-ups currently copying data
+	CopyUpsWaiting  int // Copy-ups waiting; see WithMaxConcurrentCopyUps
+
+	JournalRecoveries uint64 // Incomplete operations replayed; see WithJournal
+	AuditFailures     uint64 // Records the audit log could not be written; see WithAuditLog
+
+	ResolutionHits   uint64 // Path resolutions served by the resolution cache
+	ResolutionMisses uint64 // Path resolutions that had to be recomputed
+
+	StatCacheHits   uint64 // Primary Stat requests answered by the stat cache
+	StatCacheMisses uint64 // Primary Stat requests the stat cache passed on
+
+	MergeSpills    uint64 // Directory listings merged on disk; see WithMergeLimit
+	MergeSpillRuns uint64 // Sorted runs written by those merges
+
+	Primary   LayerStats // Requests made to the primary filesystem
+	Secondary LayerStats // Requests made to the secondary filesystem
+
+	ContentCache ContentCacheStats // Content cache activity, if enabled
+	Promotion    PromotionStats    // Read-through cache activity, if enabled
+}
+
+// LayerStats counts the requests the overlay made to one layer, separating
+// metadata operations from data operations. Request counts matter as much
+// as bytes when a layer is backed by an object store that bills or
+// throttles per request.
+//
+// Metadata operations are Stat, Lstat, Readlink, ReadDir, Mkdir, Remove,
+// Rename, Chmod, Chtimes, Chown and Truncate. Data operations are calls
+// reading or writing file contents, including whole-file reads and the
+// transfers made by copy-ups.
+type LayerStats struct {
+	MetadataOps uint64 // Metadata requests
+	DataOps     uint64 // Content reads and writes
+	ReadBytes   uint64 // Bytes read by data operations
+	WriteBytes  uint64 // Bytes written by data operations
+}
+
+// Map returns the counters keyed by snake_case metric names, for exporters
+// such as expvar or Prometheus collectors that work with flat name/value
+// pairs.
+func (s Stats) Map() map[string]float64 {
+	return map[string]float64{
+		"copy_ups":                    float64(s.CopyUps),
+		"copy_up_bytes":               float64(s.CopyUpBytes),
+		"copy_up_failures":            float64(s.CopyUpFailures),
+		"copy_ups_in_flight":          float64(s.CopyUpsInFlight),
+		"copy_ups_waiting":            float64(s.CopyUpsWaiting),
+		"journal_recoveries":          float64(s.JournalRecoveries),
+		"audit_failures":              float64(s.AuditFailures),
+		"primary_hits":                float64(s.PrimaryHits),
+		"secondary_hits":              float64(s.SecondaryHits),
+		"modified":                    float64(s.Modified),
+		"deleted":                     float64(s.Deleted),
+		"deferred_chowns":             float64(s.DeferredChowns),
+		"deferred_deletions":          float64(s.DeferredDeletions),
+		"deletion_backlog":            float64(s.DeletionBacklog),
+		"write_backs":                 float64(s.WriteBacks),
+		"write_back_failures":         float64(s.WriteBackFailures),
+		"write_back_backlog":          float64(s.WriteBackBacklog),
+		"resolution_hits":             float64(s.ResolutionHits),
+		"resolution_misses":           float64(s.ResolutionMisses),
+		"stat_cache_hits":             float64(s.StatCacheHits),
+		"stat_cache_misses":           float64(s.StatCacheMisses),
+		"merge_spills":                float64(s.MergeSpills),
+		"merge_spill_runs":            float64(s.MergeSpillRuns),
+		"primary_metadata_ops":        float64(s.Primary.MetadataOps),
+		"primary_data_ops":            float64(s.Primary.DataOps),
+		"primary_read_bytes":          float64(s.Primary.ReadBytes),
+		"primary_write_bytes":         float64(s.Primary.WriteBytes),
+		"secondary_metadata_ops":      float64(s.Secondary.MetadataOps),
+		"secondary_data_ops":          float64(s.Secondary.DataOps),
+		"secondary_read_bytes":        float64(s.Secondary.ReadBytes),
+		"secondary_write_bytes":       float64(s.Secondary.WriteBytes),
+		"content_cache_hits":          float64(s.ContentCache.Hits),
+		"content_cache_misses":        float64(s.ContentCache.Misses),
+		"content_cache_invalidations": float64(s.ContentCache.Invalidations),
+		"content_cache_evictions":     float64(s.ContentCache.Evictions),
+		"content_cache_entries":       float64(s.ContentCache.Entries),
+		"content_cache_bytes":         float64(s.ContentCache.Bytes),
+		"promotion_hits":              float64(s.Promotion.Hits),
+		"promotion_misses":            float64(s.Promotion.Misses),
+		"promotions":                  float64(s.Promotion.Promotions),
+		"promotion_invalidations":     float64(s.Promotion.Invalidations),
+		"promotion_evictions":         float64(s.Promotion.Evictions),
+		"promotion_entries":           float64(s.Promotion.Entries),
+		"promotion_bytes":             float64(s.Promotion.Bytes),
+	}
+}
+
+// Stats returns a snapshot of the overlay's activity counters.
+func (cfs *FileSystem) Stats() Stats {
+	cfs.mu.RLock()
+	modified, deleted, owners := len(cfs.modified), len(cfs.deleted), len(cfs.owners)
+	cfs.mu.RUnlock()
+
+	var backlog int
+	if q := cfs.deletions; q != nil {
+		backlog = q.len()
+	}
+	var writeBackBacklog int
+	if q := cfs.writeBack; q != nil {
+		writeBackBacklog = q.len()
+	}
+
+	var resHits, resMisses uint64
+	if rc := cfs.resolutions; rc != nil {
+		resHits, resMisses = rc.hits.Load(), rc.misses.Load()
+	}
+
+	var promotion PromotionStats
+	if c := cfs.promotion; c != nil {
+		promotion = c.stats()
+	}
+
+	var statHits, statMisses uint64
+	if sc := cfs.statCache; sc != nil {
+		statHits, statMisses = sc.hits.Load(), sc.misses.Load()
+	}
+
+	return Stats{
+		CopyUps:           cfs.counters.copyUps.Load(),
+		CopyUpBytes:       cfs.counters.copyUpBytes.Load(),
+		CopyUpFailures:    cfs.counters.copyUpFailures.Load(),
+		CopyUpsInFlight:   int(cfs.counters.copyUpsInFlight.Load()),
+		CopyUpsWaiting:    int(cfs.counters.copyUpsWaiting.Load()),
+		JournalRecoveries: cfs.counters.journalRecoveries.Load(),
+		AuditFailures:     cfs.counters.auditFailures.Load(),
+		PrimaryHits:       cfs.counters.primaryHits.Load(),
+		SecondaryHits:     cfs.counters.secondaryHits.Load(),
+		Modified:          modified,
+		Deleted:           deleted,
+		DeferredChowns:    owners,
+		DeferredDeletions: cfs.counters.deferredDeletions.Load(),
+		DeletionBacklog:   backlog,
+		WriteBacks:        cfs.counters.writeBacks.Load(),
+		WriteBackFailures: cfs.counters.writeBackFailures.Load(),
+		WriteBackBacklog:  writeBackBacklog,
+		ResolutionHits:    resHits,
+		ResolutionMisses:  resMisses,
+		StatCacheHits:     statHits,
+		StatCacheMisses:   statMisses,
+		MergeSpills:       cfs.counters.mergeSpills.Load(),
+		MergeSpillRuns:    cfs.counters.mergeSpillRuns.Load(),
+		Primary:           cfs.counters.primary.snapshot(),
+		Secondary:         cfs.counters.secondary.snapshot(),
+		ContentCache:      cfs.ContentCacheStats(),
+		Promotion:         promotion,
+	}
+}
+
+// Var returns an expvar.Var that reports the current Stats as JSON, for
+// publishing with expvar.Publish.
+func (cfs *FileSystem) Var() expvar.Var {
+	return expvar.Func(func() any {
+		return cfs.Stats()
+	})
+}
+
+// counters holds the live values behind Stats.
+type counters struct {
+	copyUps        atomic.Uint64
+	copyUpBytes    atomic.Uint64
+	copyUpFailures atomic.Uint64
+	primaryHits    atomic.Uint64
+	secondaryHits  atomic.Uint64
+	mergeSpills    atomic.Uint64
+	mergeSpillRuns atomic.Uint64
+
+	deferredDeletions atomic.Uint64
+	writeBacks        atomic.Uint64
+	writeBackFailures atomic.Uint64
+
+	copyUpsInFlight atomic.Int64
+	copyUpsWaiting  atomic.Int64
+
+	journalRecoveries atomic.Uint64
+	auditFailures     atomic.Uint64
+
+	primary   layerCounters
+	secondary layerCounters
+}
+
+// hit records a read served by the primary or the secondary.
+func (c *counters) hit(primary bool) {
+	if primary {
+		c.primaryHits.Add(1)
+	} else {
+		c.secondaryHits.Add(1)
+	}
+}
+
+// layer returns the request counters of the primary or the secondary.
+func (c *counters) layer(primary bool) *layerCounters {
+	if primary {
+		return &c.primary
+	}
+	return &c.secondary
+}
+
+// layerCounters holds the live values behind LayerStats.
+type layerCounters struct {
+	metadataOps atomic.Uint64
+	dataOps     atomic.Uint64
+	readBytes   atomic.Uint64
+	writeBytes  atomic.Uint64
+}
+
+// meta records a metadata request.
+func (c *layerCounters) meta() {
+	c.metadataOps.Add(1)
+}
+
+// read records a data request that read n bytes.
+func (c *layerCounters) read(n int64) {
+	c.dataOps.Add(1)
+	if n > 0 {
+		c.readBytes.Add(uint64(n))
+	}
+}
+
+// write records a data request that wrote n bytes.
+func (c *layerCounters) write(n int64) {
+	c.dataOps.Add(1)
+	if n > 0 {
+		c.writeBytes.Add(uint64(n))
+	}
+}
+
+func (c *layerCounters) snapshot() LayerStats {
+	return LayerStats{
+		MetadataOps: c.metadataOps.Load(),
+		DataOps:     c.dataOps.Load(),
+		ReadBytes:   c.readBytes.Load(),
+		WriteBytes:  c.writeBytes.Load(),
+	}
+}
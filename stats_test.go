@@ -0,0 +1,106 @@
+package cowfs
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	writeMemFile(t, primary, "/a.txt", "aaaa")
+	writeMemFile(t, primary, "/b.txt", "bb")
+
+	cfs.ReadFile("/a.txt")
+	cfs.Stat("/b.txt")
+	if err := cfs.Chmod("/a.txt", 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfs.ReadFile("/a.txt")
+	cfs.Remove("/b.txt")
+
+	s := cfs.Stats()
+	if s.CopyUps != 1 || s.CopyUpBytes != 4 {
+		t.Errorf("copy-up stats = %d/%d, want 1/4", s.CopyUps, s.CopyUpBytes)
+	}
+	if s.PrimaryHits != 2 || s.SecondaryHits != 1 {
+		t.Errorf("hits = %d primary, %d secondary, want 2 and 1", s.PrimaryHits, s.SecondaryHits)
+	}
+	if s.Modified != 1 || s.Deleted != 1 {
+		t.Errorf("state sizes = %d modified, %d deleted, want 1 and 1", s.Modified, s.Deleted)
+	}
+	if m := s.Map(); m["copy_up_bytes"] != 4 || m["deleted"] != 1 {
+		t.Errorf("Map() = %v", m)
+	}
+}
+
+func TestStatsCopyUpFailures(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	WithSpaceCheck(0, func() (int64, error) { return 0, nil })(cfs)
+	writeMemFile(t, primary, "/a.txt", "aaaa")
+
+	cfs.OpenFile("/a.txt", os.O_RDWR, 0)
+	if s := cfs.Stats(); s.CopyUpFailures != 1 || s.CopyUps != 0 {
+		t.Errorf("Stats() = %+v, want one failed copy-up", s)
+	}
+}
+
+func TestStatsVar(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	writeMemFile(t, primary, "/a.txt", "aaaa")
+	cfs.Remove("/a.txt")
+
+	var s Stats
+	if err := json.Unmarshal([]byte(cfs.Var().String()), &s); err != nil {
+		t.Fatalf("Var() produced invalid JSON: %v", err)
+	}
+	if s.Deleted != 1 {
+		t.Errorf("Var() Deleted = %d, want 1", s.Deleted)
+	}
+}
+
+func TestStatsLayerOps(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	writeMemFile(t, primary, "/a.txt", "aaaa")
+
+	cfs.Stat("/a.txt")
+	cfs.ReadDir("/")
+	f, err := cfs.OpenFile("/a.txt", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2)
+	f.Read(buf)
+	f.Close()
+
+	// memfs supports symbolic links, so Stat and OpenFile each add an Lstat
+	s := cfs.Stats()
+	if s.Primary.MetadataOps != 4 || s.Primary.DataOps != 1 || s.Primary.ReadBytes != 2 {
+		t.Errorf("Primary = %+v, want 4 metadata ops and 1 data op reading 2 bytes", s.Primary)
+	}
+	if s.Secondary.MetadataOps != 1 || s.Secondary.DataOps != 0 {
+		t.Errorf("Secondary = %+v, want 1 metadata op from the merged listing", s.Secondary)
+	}
+
+	if err := cfs.Chmod("/a.txt", 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err = cfs.OpenFile("/a.txt", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("bb"))
+	f.Close()
+
+	s = cfs.Stats()
+	if s.Primary.DataOps != 2 || s.Primary.ReadBytes != 6 {
+		t.Errorf("Primary = %+v, want the copy-up counted as a 4 byte read", s.Primary)
+	}
+	// OpenFile adds an Lstat of the modified file, checking for a directory
+	if s.Secondary.MetadataOps != 4 || s.Secondary.DataOps != 2 || s.Secondary.WriteBytes != 6 {
+		t.Errorf("Secondary = %+v, want Chmod, two Lstats, the copy-up and one 2 byte write", s.Secondary)
+	}
+	if m := s.Map(); m["secondary_write_bytes"] != 6 || m["primary_metadata_ops"] != 4 {
+		t.Errorf("Map() = %v", m)
+	}
+}
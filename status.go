@@ -0,0 +1,72 @@
+package cowfs
+
+// PathStatus describes how a path in the overlay relates to the primary.
+type PathStatus int
+
+const (
+	// StatusPristine means the path has not been changed through the
+	// overlay; it is served by the primary, if it exists at all.
+	StatusPristine PathStatus = iota
+
+	// StatusModified means the path exists in the primary and has been
+	// modified; it is served by the secondary.
+	StatusModified
+
+	// StatusDeleted means the path has been deleted through the overlay.
+	StatusDeleted
+
+	// StatusCreated means the path has been created through the overlay and
+	// has no primary counterpart.
+	StatusCreated
+)
+
+func (s PathStatus) String() string {
+	switch s {
+	case StatusPristine:
+		return "pristine"
+	case StatusModified:
+		return "modified"
+	case StatusDeleted:
+		return "deleted"
+	case StatusCreated:
+		return "created"
+	}
+	return "unknown"
+}
+
+// Status reports how name has diverged from the primary.
+func (cfs *FileSystem) Status(name string) PathStatus {
+	name = cfs.normalize(name)
+	cfs.mu.RLock()
+	isDeleted := cfs.deleted[name]
+	isModified := cfs.modified[name]
+	cfs.mu.RUnlock()
+
+	switch {
+	case isDeleted:
+		return StatusDeleted
+	case !isModified:
+		return StatusPristine
+	}
+	if _, err := cfs.primaryStat(name); err != nil {
+		return StatusCreated
+	}
+	return StatusModified
+}
+
+// IsModified reports whether name has been modified or created through the
+// overlay, so that it is served by the secondary.
+func (cfs *FileSystem) IsModified(name string) bool {
+	name = cfs.normalize(name)
+	cfs.mu.RLock()
+	defer cfs.mu.RUnlock()
+	return cfs.modified[name]
+}
+
+// IsDeleted reports whether name has been deleted through the overlay.
+func (cfs *FileSystem) IsDeleted(name string) bool {
+	name = cfs.normalize(name)
+	cfs.mu.RLock()
+	defer cfs.mu.RUnlock()
+	return cfs.deleted[name]
+}
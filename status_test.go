@@ -0,0 +1,48 @@
+package cowfs
+
+import (
+	"os"
+	"testing"
+)
+
+func TestStatus(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	writeMemFile(t, primary, "/pristine.txt", "p")
+	writeMemFile(t, primary, "/modified.txt", "m")
+	writeMemFile(t, primary, "/deleted.txt", "d")
+
+	if err := cfs.Chmod("/modified.txt", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Remove("/deleted.txt"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := cfs.OpenFile("/created.txt", os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	for _, tt := range []struct {
+		name     string
+		status   PathStatus
+		modified bool
+		deleted  bool
+	}{
+		{"/pristine.txt", StatusPristine, false, false},
+		{"/modified.txt", StatusModified, true, false},
+		{"/deleted.txt", StatusDeleted, false, true},
+		{"/created.txt", StatusCreated, true, false},
+		{"/missing.txt", StatusPristine, false, false},
+	} {
+		if got := cfs.Status(tt.name); got != tt.status {
+			t.Errorf("Status(%s) = %v, want %v", tt.name, got, tt.status)
+		}
+		if got := cfs.IsModified(tt.name); got != tt.modified {
+			t.Errorf("IsModified(%s) = %v, want %v", tt.name, got, tt.modified)
+		}
+		if got := cfs.IsDeleted(tt.name); got != tt.deleted {
+			t.Errorf("IsDeleted(%s) = %v, want %v", tt.name, got, tt.deleted)
+		}
+	}
+}
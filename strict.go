@@ -0,0 +1,75 @@
+package cowfs
+
+import (
+	"io/fs"
+	"os"
+)
+
+// WithStrictErrors makes the overlay report failures it otherwise
+// tolerates, as *fs.PathError values naming the operation and path:
+//
+//   - Remove fails if the secondary copy cannot be removed, instead of only
+//     hiding the path. It also fails for paths that exist nowhere, even with
+//     WithLenientRemove.
+//   - Rename and metadata changes such as Chmod fail if the file cannot be
+//     copied up from the primary, instead of carrying on with whatever the
+//     secondary holds.
+//   - ReadDir fails if the secondary directory exists but cannot be read,
+//     instead of listing only the primary's entries.
+//
+// A failed operation leaves the overlay state as it was. Without this option
+// the overlay stays lenient, favoring availability over consistency.
+func WithStrictErrors() Option {
+	return func(fs *FileSystem) {
+		fs.strict = true
+	}
+}
+
+// WithLenientRemove restores the behavior of earlier versions, in which
+// Remove succeeds for paths that exist in neither layer and marks them
+// deleted anyway. It is meant for callers that relied on that behavior; by
+// default Remove fails with fs.ErrNotExist, like os.Remove.
+func WithLenientRemove() Option {
+	return func(fs *FileSystem) {
+		fs.lenientRemove = true
+	}
+}
+
+// pathError reports err, returned while performing op on name, as an
+// *fs.PathError naming that operation and path. An *fs.PathError or
+// *os.LinkError from a layer is unwrapped first, so its own operation and
+// paths are replaced.
+func pathError(op, name string, err error) error {
+	switch e := err.(type) {
+	case *fs.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// wrapErr rewrites *err, if set, as an *fs.PathError for op on name. It is
+// deferred by the overlay's exported operations so that their errors follow
+// the conventions of the os package.
+func wrapErr(err *error, op, name string) {
+	if *err != nil {
+		*err = pathError(op, name, *err)
+	}
+}
+
+// wrapLinkErr is wrapErr for operations on two paths, which report
+// *os.LinkError.
+func wrapLinkErr(err *error, op, oldname, newname string) {
+	if *err == nil {
+		return
+	}
+	e := *err
+	switch le := e.(type) {
+	case *os.LinkError:
+		e = le.Err
+	case *fs.PathError:
+		e = le.Err
+	}
+	*err = &os.LinkError{Op: op, Old: oldname, New: newname, Err: e}
+}
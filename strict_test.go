@@ -0,0 +1,86 @@
+package cowfs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/memfs"
+)
+
+type failingStrategy struct{}
+
+func (failingStrategy) CopyUp(primary, secondary absfs.Filer, name string, info os.FileInfo) error {
+	return syscall.EIO
+}
+
+type failingRemoveFiler struct {
+	*memfs.FileSystem
+}
+
+func (failingRemoveFiler) Remove(name string) error {
+	return &os.PathError{Op: "remove", Path: name, Err: syscall.EIO}
+}
+
+func TestStrictErrorsCopyUp(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	WithCopyUpStrategy(failingStrategy{})(cfs)
+	writeMemFile(t, primary, "/a.txt", "a")
+
+	// Lenient: the failed copy-up surfaces as whatever the secondary says
+	if err := cfs.Chmod("/a.txt", 0600); err == nil {
+		t.Error("lenient Chmod() succeeded without a secondary copy")
+	}
+
+	cfs, primary, _ = newMemOverlay(t)
+	WithCopyUpStrategy(failingStrategy{})(cfs)
+	WithStrictErrors()(cfs)
+	writeMemFile(t, primary, "/a.txt", "a")
+
+	var pe *fs.PathError
+	err := cfs.Chmod("/a.txt", 0600)
+	if !errors.As(err, &pe) || pe.Op != "chmod" || !errors.Is(err, syscall.EIO) {
+		t.Errorf("strict Chmod() error = %v, want chmod PathError wrapping EIO", err)
+	}
+	if cfs.IsModified("/a.txt") {
+		t.Error("failed Chmod left the file marked modified")
+	}
+	err = cfs.Rename("/a.txt", "/b.txt")
+	var le *os.LinkError
+	if !errors.As(err, &le) || le.Op != "rename" || !errors.Is(err, syscall.EIO) {
+		t.Errorf("strict Rename() error = %v, want rename LinkError wrapping EIO", err)
+	}
+	if _, err := cfs.Stat("/a.txt"); err != nil {
+		t.Errorf("failed Rename hid the source: %v", err)
+	}
+}
+
+func TestStrictErrorsRemove(t *testing.T) {
+	_, primary, secondary := newMemOverlay(t)
+	cfs := New(primary, failingRemoveFiler{secondary}, WithStrictErrors())
+
+	if err := cfs.Remove("/missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Remove(/missing) error = %v, want not exist", err)
+	}
+	if cfs.IsDeleted("/missing") {
+		t.Error("missing path marked deleted")
+	}
+
+	writeMemFile(t, secondary, "/a.txt", "a")
+	err := cfs.Remove("/a.txt")
+	var pe *fs.PathError
+	if !errors.As(err, &pe) || pe.Op != "remove" || !errors.Is(err, syscall.EIO) {
+		t.Errorf("Remove() error = %v, want remove PathError wrapping EIO", err)
+	}
+	if cfs.IsDeleted("/a.txt") {
+		t.Error("failed Remove marked the path deleted")
+	}
+
+	lenient := New(primary, failingRemoveFiler{secondary})
+	if err := lenient.Remove("/a.txt"); err != nil || !lenient.IsDeleted("/a.txt") {
+		t.Errorf("lenient Remove() = %v, want the path hidden", err)
+	}
+}
@@ -0,0 +1,246 @@
+package cowfs
+
+import (
+	"errors"
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/absfs/absfs"
+)
+
+// maxLinkHops bounds the number of symbolic links followed when resolving a
+// path, as with ELOOP in the operating system.
+const maxLinkHops = 40
+
+// Symlink creates newname as a symbolic link to oldname in the secondary. It
+// fails with errors.ErrUnsupported unless both layers implement
+// absfs.SymLinker.
+func (cfs *FileSystem) Symlink(oldname, newname string) (err error) {
+	defer cfs.audit(&err, AuditRecord{Op: "symlink", Path: newname, Target: oldname})
+	defer wrapErr(&err, "symlink", newname)
+	newname = cfs.normalize(newname)
+	if err := cfs.access(OpSymlink, newname); err != nil {
+		return err
+	}
+	if !cfs.links {
+		return &os.PathError{Op: "symlink", Path: newname, Err: errors.ErrUnsupported}
+	}
+	defer cfs.beginOp()()
+	if cfs.frozen.Load() {
+		return ErrFrozen
+	}
+	if z, err := cfs.writeZone(newname); err != nil {
+		return err
+	} else if z == ZoneWriteThrough {
+		return cfs.primary.(absfs.SymLinker).Symlink(oldname, newname)
+	}
+	cfs.settle(newname)
+	if err := cfs.txTouch(newname); err != nil {
+		return err
+	}
+
+	if cfs.exists(newname) {
+		return &os.PathError{Op: "symlink", Path: newname, Err: os.ErrExist}
+	}
+	if err := cfs.ensureParent(newname); err != nil {
+		return err
+	}
+	// Clear out a hidden secondary copy left behind by an earlier deletion
+	removeAll(cfs.secondary, newname)
+	if err := cfs.secondary.(absfs.SymLinker).Symlink(oldname, newname); err != nil {
+		return err
+	}
+
+	cfs.mu.Lock()
+	cfs.modified[newname] = true
+	delete(cfs.deleted, newname)
+	cfs.mu.Unlock()
+	if err := cfs.syncDirs(newname); err != nil {
+		return err
+	}
+	cfs.notify(Event{Op: EventCreate, Path: newname})
+	return nil
+}
+
+// Readlink returns the destination of the symbolic link name in the merged
+// view.
+func (cfs *FileSystem) Readlink(name string) (_ string, err error) {
+	defer wrapErr(&err, "readlink", name)
+	name = cfs.normalize(name)
+	if err := cfs.access(OpStat, name); err != nil {
+		return "", err
+	}
+	if !cfs.links {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: errors.ErrUnsupported}
+	}
+	if cfs.zoneOf(name) != ZoneOverlay {
+		return cfs.primary.(absfs.SymLinker).Readlink(name)
+	}
+	defer cfs.viewLock()()
+	l, _ := cfs.resolve(name)
+	return cfs.readlink(name, l)
+}
+
+// Lstat is like Stat but does not follow a symbolic link at name. Layers
+// that do not implement absfs.SymLinker are queried with Stat.
+func (cfs *FileSystem) Lstat(name string) (_ os.FileInfo, err error) {
+	defer wrapErr(&err, "lstat", name)
+	name = cfs.normalize(name)
+	cfs.awaitCopies(name)
+	if err := cfs.access(OpStat, name); err != nil {
+		return nil, err
+	}
+	if cfs.zoneOf(name) != ZoneOverlay {
+		return lstatLayer(cfs.primary, name)
+	}
+	defer cfs.viewLock()()
+	if name == "/" {
+		return cfs.statRoot()
+	}
+	l, _ := cfs.resolve(name)
+	return cfs.lstat(name, l)
+}
+
+// Lchown is like Chown but changes the owner of a symbolic link itself
+// rather than its destination. Symbolic links are copied up as links.
+func (cfs *FileSystem) Lchown(name string, uid, gid int) (err error) {
+	defer cfs.audit(&err, AuditRecord{Op: "lchown", Path: name, Owner: &Owner{UID: uid, GID: gid}})
+	defer wrapErr(&err, "lchown", name)
+	name = cfs.normalize(name)
+	cfs.awaitCopies(name)
+	if err := cfs.access(OpChown, name); err != nil {
+		return err
+	}
+	if !cfs.links {
+		return &os.PathError{Op: "lchown", Path: name, Err: errors.ErrUnsupported}
+	}
+	defer cfs.beginOp()()
+	if cfs.frozen.Load() {
+		return ErrFrozen
+	}
+	if z, err := cfs.writeZone(name); err != nil {
+		return err
+	} else if z == ZoneWriteThrough {
+		return cfs.primary.(absfs.SymLinker).Lchown(name, uid, gid)
+	}
+	if err := cfs.txTouch(name); err != nil {
+		return err
+	}
+	record, err := cfs.journalOp(journalEntry{Op: "lchown", Path: name, UID: uid, GID: gid})
+	if err != nil {
+		return err
+	}
+	defer record.done()
+
+	if err := cfs.markModified("lchown", name); err != nil {
+		return err
+	}
+	cfs.counters.secondary.meta()
+	if err := cfs.secondary.(absfs.SymLinker).Lchown(name, uid, gid); err != nil {
+		return err
+	}
+	if err := cfs.syncStrict(name); err != nil {
+		return err
+	}
+	cfs.notify(Event{Op: EventModify, Path: name})
+	return nil
+}
+
+// lstat implements Lstat for name resolved to l.
+func (cfs *FileSystem) lstat(name string, l layer) (os.FileInfo, error) {
+	switch l {
+	case layerDeleted:
+		return nil, &os.PathError{Op: "lstat", Path: name, Err: os.ErrNotExist}
+	case layerDelta:
+		cfs.counters.secondary.meta()
+		return cfs.deltaStat(name)
+	case layerModified, layerSecondary:
+		cfs.counters.secondary.meta()
+		return lstatLayer(cfs.secondary, name)
+	}
+	cfs.counters.primary.meta()
+	if info, err := lstatLayer(cfs.primary, name); err == nil {
+		return info, nil
+	}
+	cfs.counters.secondary.meta()
+	return lstatLayer(cfs.secondary, name)
+}
+
+// readlink implements Readlink for name resolved to l.
+func (cfs *FileSystem) readlink(name string, l layer) (string, error) {
+	switch l {
+	case layerDeleted:
+		return "", &os.PathError{Op: "readlink", Path: name, Err: os.ErrNotExist}
+	case layerModified, layerSecondary:
+		cfs.counters.secondary.meta()
+		return cfs.secondary.(absfs.SymLinker).Readlink(name)
+	}
+	cfs.counters.primary.meta()
+	if info, err := lstatLayer(cfs.primary, name); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		cfs.counters.primary.meta()
+		return cfs.primary.(absfs.SymLinker).Readlink(name)
+	}
+	cfs.counters.secondary.meta()
+	return cfs.secondary.(absfs.SymLinker).Readlink(name)
+}
+
+// follow resolves symbolic links at name through the merged view, so that a
+// link in one layer may point at a file in the other. Only the final path
+// element is resolved; links in parent directories are left to the layers.
+// A name that is not a link, or does not exist, is returned unchanged.
+func (cfs *FileSystem) follow(name string) (string, error) {
+	if !cfs.links {
+		return name, nil
+	}
+	for i := 0; i < maxLinkHops; i++ {
+		l, _ := cfs.lookup(name, false)
+		info, err := cfs.lstat(name, l)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			return name, nil
+		}
+		target, err := cfs.readlink(name, l)
+		if err != nil {
+			return "", err
+		}
+		if !path.IsAbs(target) {
+			target = path.Join(path.Dir(name), target)
+		}
+		name = target
+	}
+	return "", &os.PathError{Op: "open", Path: name, Err: syscall.ELOOP}
+}
+
+// copyUpLink copies the primary symbolic link name into the secondary as a
+// link.
+func (cfs *FileSystem) copyUpLink(name string) error {
+	target, err := cfs.primary.(absfs.SymLinker).Readlink(name)
+	if err != nil {
+		return err
+	}
+	if err := cfs.ensureSecondaryDir(path.Dir(name)); err != nil {
+		return err
+	}
+	removeAll(cfs.secondary, name)
+	if err := cfs.secondary.(absfs.SymLinker).Symlink(target, name); err != nil {
+		cfs.counters.copyUpFailures.Add(1)
+		return err
+	}
+	cfs.counters.copyUps.Add(1)
+	cfs.debug("cowfs: copy-up", "path", name, "link", target)
+	return nil
+}
+
+func lstatLayer(filer absfs.Filer, name string) (os.FileInfo, error) {
+	if sl, ok := filer.(absfs.SymLinker); ok {
+		return sl.Lstat(name)
+	}
+	return filer.Stat(name)
+}
+
+// supportsLinks reports whether both layers implement absfs.SymLinker.
+func supportsLinks(primary, secondary absfs.Filer) bool {
+	_, p := primary.(absfs.SymLinker)
+	_, s := secondary.(absfs.SymLinker)
+	return p && s
+}
@@ -0,0 +1,98 @@
+package cowfs
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestSymlink(t *testing.T) {
+	cfs, primary, secondary := newMemOverlay(t)
+	writeMemFile(t, primary, "/target.txt", "target")
+	if err := primary.Symlink("/target.txt", "/plink"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A link in the secondary resolves to a file only the primary has.
+	if err := cfs.Symlink("target.txt", "/slink"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := secondary.Lstat("/slink"); err != nil {
+		t.Errorf("Symlink did not create the link in the secondary: %v", err)
+	}
+	for _, name := range []string{"/plink", "/slink"} {
+		if data, err := cfs.ReadFile(name); err != nil || string(data) != "target" {
+			t.Errorf("ReadFile(%s) = %q, %v", name, data, err)
+		}
+		info, err := cfs.Lstat(name)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("Lstat(%s) = %v, %v; want a link", name, info, err)
+		}
+		if info, err := cfs.Stat(name); err != nil || !info.Mode().IsRegular() {
+			t.Errorf("Stat(%s) = %v, %v; want the target", name, info, err)
+		}
+	}
+	if target, err := cfs.Readlink("/slink"); err != nil || target != "target.txt" {
+		t.Errorf("Readlink(/slink) = %q, %v", target, err)
+	}
+	if err := cfs.Symlink("/x", "/target.txt"); !errors.Is(err, os.ErrExist) {
+		t.Errorf("Symlink over an existing file = %v, want ErrExist", err)
+	}
+
+	// Copy-up preserves links.
+	if err := cfs.Rename("/plink", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := secondary.Lstat("/moved"); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("copied-up link = %v, %v; want a link", info, err)
+	}
+	if target, _ := cfs.Readlink("/moved"); target != "/target.txt" {
+		t.Errorf("Readlink(/moved) = %q, want /target.txt", target)
+	}
+
+	// Writing through a link writes the target via the overlay.
+	f, err := cfs.OpenFile("/slink", os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("rewritten"))
+	f.Close()
+	if data, _ := cfs.ReadFile("/target.txt"); string(data) != "rewritten" {
+		t.Errorf("ReadFile(/target.txt) = %q, want rewritten", data)
+	}
+	if data, _ := primary.ReadFile("/target.txt"); string(data) != "target" {
+		t.Errorf("primary modified through link: %q", data)
+	}
+}
+
+func TestSymlinkLoop(t *testing.T) {
+	cfs, _, _ := newMemOverlay(t)
+	if err := cfs.Symlink("/b", "/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Symlink("/a", "/b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfs.Stat("/a"); err == nil {
+		t.Error("Stat of a link loop succeeded")
+	}
+}
+
+func TestSymlinkTar(t *testing.T) {
+	src, _, _ := newMemOverlay(t)
+	if err := src.Symlink("/somewhere", "/link"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := src.ExportTar(&buf); err != nil {
+		t.Fatal(err)
+	}
+	dst, _, _ := newMemOverlay(t)
+	if err := dst.ImportTar(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if target, err := dst.Readlink("/link"); err != nil || target != "/somewhere" {
+		t.Errorf("Readlink(/link) after import = %q, %v", target, err)
+	}
+}
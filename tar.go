@@ -0,0 +1,432 @@
+package cowfs
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/absfs/absfs"
+)
+
+// whiteoutPrefix marks a deleted entry in a layer tarball, following the
+// OCI image layer and overlayfs conventions.
+const whiteoutPrefix = ".wh."
+
+// ExportTar writes the overlay delta to w as a tar stream. Only entries that
+// were added or modified in the secondary filesystem are included, and every
+// deletion is recorded as a whiteout entry (".wh.<name>") so the result can be
+// applied as a container image layer or used as a backup increment.
+// Directories that were removed and created again are marked opaque with a
+// ".wh..wh..opq" entry, hiding what lower layers hold below them. As OCI
+// layers should, the stream lists whiteouts and opaque markers ahead of the
+// other entries of their directory. The overlay's labels, if any, are
+// recorded in a leading PAX global header.
+func (cfs *FileSystem) ExportTar(w io.Writer) error {
+	cfs.flushDeletions()
+	modified, deleted := cfs.state()
+
+	tw := tar.NewWriter(w)
+	whiteouts := make(map[string][]string) // Whiteout entries by tar directory
+	for _, name := range deleted {
+		if name == "/" || hasDeletedAncestor(deleted, name) {
+			continue
+		}
+		dir, base := path.Split(tarName(name))
+		whiteouts[dir] = append(whiteouts[dir], dir+whiteoutPrefix+base)
+	}
+	writeWhiteouts := func(dir string) error {
+		for _, name := range whiteouts[dir] {
+			hdr := &tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     name,
+				Mode:     0644,
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+		}
+		delete(whiteouts, dir)
+		return nil
+	}
+
+	if labels := cfs.GetLabels(); len(labels) > 0 {
+		hdr := &tar.Header{Typeflag: tar.TypeXGlobalHeader, PAXRecords: make(map[string]string)}
+		for k, v := range labels {
+			hdr.PAXRecords[labelPAXPrefix+k] = v
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+	}
+	for _, name := range modified {
+		if hasDeletedAncestor(deleted, name) {
+			continue
+		}
+		for _, dir := range tarDirs(tarName(name)) {
+			if err := writeWhiteouts(dir); err != nil {
+				return err
+			}
+		}
+		if err := cfs.exportEntry(tw, name); err != nil {
+			return err
+		}
+		cfs.mu.RLock()
+		opaque := cfs.opaque[name]
+		cfs.mu.RUnlock()
+		if opaque {
+			hdr := &tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     path.Join(tarName(name), opaqueMarker),
+				Mode:     0644,
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+		}
+	}
+	dirs := make([]string, 0, len(whiteouts))
+	for dir := range whiteouts {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		if err := writeWhiteouts(dir); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// tarDirs returns the tar directories containing the tar entry name, from
+// the root, "", down to its parent.
+func tarDirs(name string) []string {
+	dirs := []string{""}
+	for i := 0; i < len(name); i++ {
+		if name[i] == '/' && i+1 < len(name) {
+			dirs = append(dirs, name[:i+1])
+		}
+	}
+	return dirs
+}
+
+// ImportTar applies a layer tarball read from r onto the overlay. Regular
+// files and directories are written to the secondary filesystem and marked
+// modified, and whiteout entries (".wh.<name>") mark the named path deleted,
+// removing any secondary copy. Opaque markers (".wh..wh..opq") hide the
+// primary's contents of their directory. This is the inverse of ExportTar and also
+// accepts layers produced by other tools.
+//
+// As in OCI image layers, whiteouts and opaque markers only hide what the
+// overlay held before the import: a whiteout for a path the tarball itself
+// creates is ignored, and an opaque directory keeps the entries the tarball
+// puts in it, wherever they appear in the stream.
+//
+// Directory entries for directories that already exist in the merged view
+// are applied to the secondary without hiding the primary's children. Labels
+// recorded by ExportTar are set on the overlay.
+func (cfs *FileSystem) ImportTar(r io.Reader) error {
+	defer cfs.beginOp()()
+	if cfs.frozen.Load() {
+		return ErrFrozen
+	}
+	cfs.flushDeletions()
+	if err := cfs.txTouch("/"); err != nil {
+		return err
+	}
+
+	layer := make(map[string]bool) // Paths created by the tarball, with their parents
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			cfs.importLabels(hdr)
+			continue
+		}
+
+		name := cfs.normalize(hdr.Name)
+		dir, base := path.Split(name)
+		if base == opaqueMarker {
+			dir = path.Clean(dir)
+			if err := cfs.importOpaque(dir, layer); err != nil {
+				return err
+			}
+			cfs.notify(Event{Op: EventModify, Path: dir})
+			continue
+		}
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			deleted := path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+			if layer[deleted] {
+				continue
+			}
+			cfs.importWhiteout(deleted)
+			cfs.notify(Event{Op: EventDelete, Path: deleted})
+			continue
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = cfs.importDir(name, hdr)
+		case tar.TypeReg, tar.TypeRegA:
+			err = cfs.importFile(name, hdr, tr)
+		case tar.TypeSymlink:
+			err = cfs.importSymlink(name, hdr)
+		default:
+			err = fmt.Errorf("cowfs: unsupported tar entry type %q for %s", hdr.Typeflag, hdr.Name)
+		}
+		if err != nil {
+			return err
+		}
+		for p := name; !layer[p]; p = path.Dir(p) {
+			layer[p] = true
+		}
+		cfs.notify(Event{Op: EventModify, Path: name})
+	}
+}
+
+// importLabels sets the labels recorded in the PAX global header hdr.
+func (cfs *FileSystem) importLabels(hdr *tar.Header) {
+	for k, v := range hdr.PAXRecords {
+		if key, ok := strings.CutPrefix(k, labelPAXPrefix); ok {
+			cfs.SetLabel(key, v)
+		}
+	}
+}
+
+// importWhiteout marks name and everything below it deleted.
+func (cfs *FileSystem) importWhiteout(name string) {
+	cfs.mu.Lock()
+	cfs.deleted[name] = true
+	delete(cfs.modified, name)
+	delete(cfs.deltas, name)
+	cfs.clearOpaque(name)
+	prefix := name + "/"
+	for p := range cfs.modified {
+		if strings.HasPrefix(p, prefix) {
+			delete(cfs.modified, p)
+			delete(cfs.deltas, p)
+		}
+	}
+	cfs.mu.Unlock()
+
+	if cfs.quota != nil {
+		cfs.adjustQuota("import", name, -treeSize(cfs.secondary, name))
+	}
+	removeAll(cfs.secondary, name)
+}
+
+// importOpaque marks dir opaque, hiding the primary's contents of it and
+// removing the secondary entries in it that are not in layer.
+func (cfs *FileSystem) importOpaque(dir string, layer map[string]bool) error {
+	if err := cfs.ensureSecondaryDir(dir); err != nil {
+		return err
+	}
+	entries, _ := cfs.secondary.ReadDir(dir)
+	for _, e := range entries {
+		name := cfs.normalize(path.Join(dir, e.Name()))
+		if layer[name] || internalDir(dir, e.Name()) {
+			continue
+		}
+		cfs.mu.Lock()
+		prefix := name + "/"
+		for p := range cfs.modified {
+			if p == name || strings.HasPrefix(p, prefix) {
+				delete(cfs.modified, p)
+				delete(cfs.deltas, p)
+				cfs.clearOpaque(p)
+			}
+		}
+		cfs.mu.Unlock()
+		if cfs.quota != nil {
+			cfs.adjustQuota("import", name, -treeSize(cfs.secondary, name))
+		}
+		removeAll(cfs.secondary, name)
+	}
+	cfs.mu.Lock()
+	cfs.setOpaque(dir)
+	cfs.modified[dir] = true
+	delete(cfs.deleted, dir)
+	cfs.mu.Unlock()
+	return nil
+}
+
+func (cfs *FileSystem) importDir(name string, hdr *tar.Header) error {
+	_, statErr := cfs.Stat(name)
+	if err := cfs.ensureSecondaryDir(path.Dir(name)); err != nil {
+		return err
+	}
+	if info, err := cfs.secondary.Stat(name); err != nil || !info.IsDir() {
+		if err == nil {
+			cfs.secondary.Remove(name)
+		}
+		if err := cfs.secondary.Mkdir(name, os.FileMode(hdr.Mode).Perm()); err != nil {
+			return err
+		}
+	}
+	if err := cfs.secondary.Chmod(name, os.FileMode(hdr.Mode).Perm()|os.ModeDir); err != nil {
+		return err
+	}
+	cfs.secondary.Chtimes(name, hdr.ModTime, hdr.ModTime)
+
+	cfs.mu.Lock()
+	if statErr != nil {
+		cfs.modified[name] = true
+	}
+	delete(cfs.deleted, name)
+	cfs.mu.Unlock()
+	return nil
+}
+
+func (cfs *FileSystem) importFile(name string, hdr *tar.Header, r io.Reader) error {
+	if err := cfs.ensureSecondaryDir(path.Dir(name)); err != nil {
+		return err
+	}
+	growth := hdr.Size - cfs.secondarySize(name)
+	if err := cfs.adjustQuota("import", name, growth); err != nil {
+		return err
+	}
+	perm := os.FileMode(hdr.Mode).Perm()
+	f, err := cfs.secondary.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		cfs.adjustQuota("import", name, -growth)
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	cfs.secondary.Chmod(name, perm)
+	cfs.secondary.Chtimes(name, hdr.ModTime, hdr.ModTime)
+	cfs.setDelta(name, false)
+
+	cfs.mu.Lock()
+	cfs.modified[name] = true
+	delete(cfs.deleted, name)
+	cfs.mu.Unlock()
+	return nil
+}
+
+func (cfs *FileSystem) importSymlink(name string, hdr *tar.Header) error {
+	if !cfs.links {
+		return fmt.Errorf("cowfs: symbolic link %s: %w", hdr.Name, errors.ErrUnsupported)
+	}
+	if err := cfs.ensureSecondaryDir(path.Dir(name)); err != nil {
+		return err
+	}
+	removeAll(cfs.secondary, name)
+	if err := cfs.secondary.(absfs.SymLinker).Symlink(hdr.Linkname, name); err != nil {
+		return err
+	}
+	cfs.setDelta(name, false)
+
+	cfs.mu.Lock()
+	cfs.modified[name] = true
+	delete(cfs.deleted, name)
+	cfs.mu.Unlock()
+	return nil
+}
+
+// exportEntry writes the secondary copy of name to tw. Entries that were
+// marked modified but never materialized in the secondary are skipped.
+func (cfs *FileSystem) exportEntry(tw *tar.Writer, name string) error {
+	info, err := lstatLayer(cfs.secondary, name)
+	if err != nil {
+		return nil
+	}
+	if info.Mode()&os.ModeSymlink != 0 && cfs.links {
+		target, err := cfs.secondary.(absfs.SymLinker).Readlink(name)
+		if err != nil {
+			return err
+		}
+		return tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeSymlink,
+			Name:     tarName(name),
+			Linkname: target,
+			Mode:     int64(info.Mode().Perm()),
+			ModTime:  info.ModTime(),
+		})
+	}
+	if !info.IsDir() && !info.Mode().IsRegular() {
+		return nil
+	}
+
+	hdr := &tar.Header{
+		Name:    tarName(name),
+		Mode:    int64(info.Mode().Perm()),
+		ModTime: info.ModTime(),
+	}
+	if info.IsDir() {
+		if hdr.Name == "" {
+			return nil
+		}
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+		return tw.WriteHeader(hdr)
+	}
+
+	hdr.Typeflag = tar.TypeReg
+	var f absfs.File
+	if cfs.isDelta(name) {
+		d, err := cfs.openDelta(name)
+		if err != nil {
+			return err
+		}
+		f, info = d, d.info
+	} else if f, err = cfs.secondary.OpenFile(name, os.O_RDONLY, 0); err != nil {
+		return err
+	}
+	hdr.Size = info.Size()
+	defer f.Close()
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, f, hdr.Size)
+	return err
+}
+
+// state returns sorted snapshots of the modified and deleted path sets.
+func (cfs *FileSystem) state() (modified, deleted []string) {
+	cfs.mu.RLock()
+	for name := range cfs.modified {
+		modified = append(modified, name)
+	}
+	for name := range cfs.deleted {
+		deleted = append(deleted, name)
+	}
+	cfs.mu.RUnlock()
+
+	sort.Strings(modified)
+	sort.Strings(deleted)
+	return modified, deleted
+}
+
+// hasDeletedAncestor reports whether any parent directory of name appears in
+// the sorted deleted list.
+func hasDeletedAncestor(deleted []string, name string) bool {
+	for dir := path.Dir(name); dir != name; name, dir = dir, path.Dir(dir) {
+		i := sort.SearchStrings(deleted, dir)
+		if i < len(deleted) && deleted[i] == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// tarName converts an overlay path into the relative form used in tarballs.
+func tarName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
@@ -0,0 +1,274 @@
+package cowfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/absfs/memfs"
+)
+
+func newMemOverlay(t testing.TB) (*FileSystem, *memfs.FileSystem, *memfs.FileSystem) {
+	t.Helper()
+	primary, err := memfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondary, err := memfs.NewFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(primary, secondary), primary, secondary
+}
+
+func readTar(t *testing.T, r io.Reader) map[string]string {
+	t.Helper()
+	entries := make(map[string]string)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[hdr.Name] = string(data)
+	}
+}
+
+func TestExportTar(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	primary.Mkdir("/dir", 0755)
+	writeMemFile(t, primary, "/dir/keep.txt", "keep")
+	writeMemFile(t, primary, "/dir/gone.txt", "gone")
+	writeMemFile(t, primary, "/edit.txt", "old")
+
+	if err := cfs.Remove("/dir/gone.txt"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := cfs.OpenFile("/edit.txt", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("new"))
+	f.Close()
+	if err := cfs.Mkdir("/added", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := cfs.ExportTar(&buf); err != nil {
+		t.Fatalf("ExportTar() error = %v", err)
+	}
+	entries := readTar(t, &buf)
+
+	want := map[string]string{
+		"added/":           "",
+		"edit.txt":         "new",
+		"dir/.wh.gone.txt": "",
+	}
+	if len(entries) != len(want) {
+		t.Errorf("ExportTar() entries = %v, want %v", entries, want)
+	}
+	for name, data := range want {
+		got, ok := entries[name]
+		if !ok {
+			t.Errorf("missing entry %q", name)
+			continue
+		}
+		if got != data {
+			t.Errorf("entry %q = %q, want %q", name, got, data)
+		}
+	}
+}
+
+func TestExportTarSkipsNestedWhiteouts(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	primary.Mkdir("/dir", 0755)
+	writeMemFile(t, primary, "/dir/a.txt", "a")
+
+	cfs.Remove("/dir/a.txt")
+	cfs.Remove("/dir")
+
+	var buf bytes.Buffer
+	if err := cfs.ExportTar(&buf); err != nil {
+		t.Fatal(err)
+	}
+	entries := readTar(t, &buf)
+	if len(entries) != 1 {
+		t.Fatalf("ExportTar() entries = %v, want only the directory whiteout", entries)
+	}
+	if _, ok := entries[".wh.dir"]; !ok {
+		t.Errorf("missing whiteout for /dir, got %v", entries)
+	}
+}
+
+func writeMemFile(t testing.TB, fs *memfs.FileSystem, name, data string) {
+	t.Helper()
+	f, err := fs.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImportTar(t *testing.T) {
+	src, srcPrimary, _ := newMemOverlay(t)
+	srcPrimary.Mkdir("/dir", 0755)
+	writeMemFile(t, srcPrimary, "/dir/gone.txt", "gone")
+
+	cfs, primary, secondary := newMemOverlay(t)
+	primary.Mkdir("/dir", 0755)
+	writeMemFile(t, primary, "/dir/gone.txt", "gone")
+	writeMemFile(t, primary, "/dir/keep.txt", "keep")
+
+	src.Remove("/dir/gone.txt")
+	src.Mkdir("/new", 0700)
+	f, err := src.OpenFile("/new/file.txt", os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("imported"))
+	f.Close()
+
+	var buf bytes.Buffer
+	if err := src.ExportTar(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.ImportTar(&buf); err != nil {
+		t.Fatalf("ImportTar() error = %v", err)
+	}
+
+	if _, err := cfs.Stat("/dir/gone.txt"); !os.IsNotExist(err) {
+		t.Errorf("Stat(whited out file) error = %v, want not exist", err)
+	}
+	if data, err := cfs.ReadFile("/dir/keep.txt"); err != nil || string(data) != "keep" {
+		t.Errorf("ReadFile(untouched primary file) = %q, %v", data, err)
+	}
+	data, err := cfs.ReadFile("/new/file.txt")
+	if err != nil || string(data) != "imported" {
+		t.Errorf("ReadFile(imported file) = %q, %v", data, err)
+	}
+	if info, err := secondary.Stat("/new/file.txt"); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("secondary Stat(imported file) = %v, %v, want mode 0600", info, err)
+	}
+	if !cfs.modified["/new/file.txt"] || !cfs.deleted["/dir/gone.txt"] {
+		t.Error("ImportTar() did not update overlay state")
+	}
+}
+
+func TestImportTarWhiteoutRemovesSecondaryCopy(t *testing.T) {
+	cfs, _, secondary := newMemOverlay(t)
+	cfs.Mkdir("/dir", 0755)
+	f, _ := cfs.OpenFile("/dir/file", os.O_CREATE|os.O_WRONLY, 0644)
+	f.Close()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: ".wh.dir", Typeflag: tar.TypeReg})
+	tw.Close()
+
+	if err := cfs.ImportTar(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := secondary.Stat("/dir"); err == nil {
+		t.Error("whiteout did not remove the secondary directory")
+	}
+	if cfs.modified["/dir/file"] {
+		t.Error("whiteout did not clear modified state below the directory")
+	}
+}
+
+func TestExportTarWhiteoutsFirst(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	primary.Mkdir("/dir", 0755)
+	writeMemFile(t, primary, "/dir/z.txt", "z")
+	writeMemFile(t, primary, "/top.txt", "top")
+
+	if err := cfs.Remove("/dir/z.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Remove("/top.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.WriteFile("/dir/a.txt", []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.WriteFile("/b.txt", []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := cfs.ExportTar(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var order []string
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		order = append(order, hdr.Name)
+	}
+	index := make(map[string]int)
+	for i, name := range order {
+		index[name] = i
+	}
+	for whiteout, sibling := range map[string]string{".wh.top.txt": "b.txt", "dir/.wh.z.txt": "dir/a.txt"} {
+		w, wok := index[whiteout]
+		s, sok := index[sibling]
+		if !wok || !sok || w > s {
+			t.Errorf("entries %v; want %s ahead of %s", order, whiteout, sibling)
+		}
+	}
+}
+
+func TestImportTarSameLayerWhiteouts(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	primary.Mkdir("/dir", 0755)
+	writeMemFile(t, primary, "/dir/primary.txt", "primary")
+	if err := cfs.WriteFile("/dir/earlier.txt", []byte("earlier"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Whiteouts and opaque markers after the entries they would hide only
+	// hide what the overlay held before
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range []struct{ name, data string }{
+		{"dir/new.txt", "new"},
+		{"dir/.wh..wh..opq", ""},
+		{"other/kept.txt", "kept"},
+		{"other/.wh.kept.txt", ""},
+	} {
+		tw.WriteHeader(&tar.Header{Name: e.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(e.data))})
+		tw.Write([]byte(e.data))
+	}
+	tw.Close()
+	if err := cfs.ImportTar(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := listNames(t, cfs, "/dir"); len(got) != 1 || got[0] != "new.txt" {
+		t.Errorf("ReadDir(/dir) = %v; want only new.txt", got)
+	}
+	if data, err := cfs.ReadFile("/other/kept.txt"); err != nil || string(data) != "kept" {
+		t.Errorf("ReadFile(/other/kept.txt) = %q, %v; want the entry whited out by its own layer kept", data, err)
+	}
+}
@@ -0,0 +1,31 @@
+package cowfs
+
+import (
+	"testing"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/memfs"
+)
+
+// TestFS returns an overlay over base with an in-memory secondary, for tests
+// that need to change a shared fixture tree without affecting other tests.
+// The overlay is configured with opts, and is closed and its changes
+// discarded when the test and its subtests complete.
+func TestFS(t testing.TB, base absfs.Filer, opts ...Option) *FileSystem {
+	t.Helper()
+	secondary, err := memfs.NewFS()
+	if err != nil {
+		t.Fatalf("cowfs: creating secondary: %v", err)
+	}
+	cfs := New(base, secondary, opts...)
+	t.Cleanup(func() {
+		if err := cfs.Close(); err != nil {
+			t.Errorf("cowfs: closing overlay: %v", err)
+		}
+		cfs.opMu.Lock()
+		cfs.frozen.Store(true)
+		cfs.opMu.Unlock()
+		removeAll(secondary, "/")
+	})
+	return cfs
+}
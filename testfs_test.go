@@ -0,0 +1,30 @@
+package cowfs
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/absfs/memfs"
+)
+
+func TestTestFS(t *testing.T) {
+	base := must(memfs.NewFS())
+	writeMemFile(t, base, "/fixture.txt", "fixture")
+
+	var inner *FileSystem
+	t.Run("mutate", func(t *testing.T) {
+		inner = TestFS(t, base)
+		if err := inner.WriteFile("/fixture.txt", []byte("changed"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := inner.Remove("/fixture.txt"); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if data, err := base.ReadFile("/fixture.txt"); err != nil || string(data) != "fixture" {
+		t.Errorf("base ReadFile(/fixture.txt) = %q, %v, want fixture", data, err)
+	}
+	if err := inner.WriteFile("/new.txt", nil, 0644); !errors.Is(err, ErrFrozen) {
+		t.Errorf("WriteFile after cleanup error = %v, want ErrFrozen", err)
+	}
+}
@@ -0,0 +1,450 @@
+package cowfs
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// WithTieredSecondary splits the secondary into two tiers: the secondary
+// given to New, typically a memfs, keeps the tree and the contents of small,
+// recently used files, and disk, typically a dirfs over a scratch directory,
+// takes the contents of larger or colder files. A file is spilled to disk
+// when a writable handle to it is closed with more than threshold bytes, and
+// the least recently used files are spilled whenever the contents kept in
+// memory exceed memoryBudget bytes. A threshold or budget of zero or less
+// does not limit.
+//
+// A spilled file keeps an empty placeholder in memory holding its mode and
+// place in the tree; its contents are read and written on disk from then
+// on, until it is removed or opened with O_TRUNC. Spilled contents are kept
+// under generated names at the root of disk, which should be dedicated to
+// the overlay, and the mapping from paths to them lives in memory, so a
+// tiered secondary does not outlive the process. Files being written, and
+// files open for reading, stay where they are until their handles are
+// closed. Optional interfaces of the secondary besides symbolic links, such
+// as Linker, are not available in this mode.
+func WithTieredSecondary(disk absfs.Filer, threshold, memoryBudget int64) Option {
+	return func(fs *FileSystem) {
+		fs.secondary = newTieredFiler(fs.secondary, disk, threshold, memoryBudget)
+		fs.links = supportsLinks(fs.primary, fs.secondary)
+	}
+}
+
+// TieredStats reports where the files of a tiered secondary are kept.
+type TieredStats struct {
+	MemoryFiles int    // Files whose contents are kept in memory
+	MemoryBytes int64  // Total size of those contents
+	DiskFiles   int    // Files whose contents were spilled to disk
+	Spills      uint64 // Files spilled to disk so far
+}
+
+// TieredStats returns the tiered secondary counters. It returns the zero
+// value if WithTieredSecondary is not in effect.
+func (cfs *FileSystem) TieredStats() TieredStats {
+	t := asTiered(cfs.secondary)
+	if t == nil {
+		return TieredStats{}
+	}
+	return t.stats()
+}
+
+// tieredEntry is a regular file of a tiered secondary.
+type tieredEntry struct {
+	object string // Name of the contents on disk, if spilled
+	size   int64  // Size of the contents in memory, if not spilled
+	used   uint64 // Clock reading at the last use
+	open   int    // Open handles
+}
+
+// tieredFiler is an absfs.Filer keeping the contents of the files of the
+// Filer it wraps either there or on disk.
+type tieredFiler struct {
+	absfs.Filer             // Memory tier
+	disk        absfs.Filer // Disk tier
+	threshold   int64       // Largest file kept in memory, if positive
+	budget      int64       // Most bytes kept in memory, if positive
+
+	mu       sync.Mutex
+	files    map[string]*tieredEntry // Files written through the filer by path
+	memBytes int64                   // Bytes of the files kept in memory
+	clock    uint64                  // Ticks on every use
+	seq      uint64                  // Names spilled contents
+	spills   uint64
+}
+
+// newTieredFiler wraps memory in a tieredFiler spilling to disk, keeping
+// its support for symbolic links.
+func newTieredFiler(memory, disk absfs.Filer, threshold, budget int64) absfs.Filer {
+	var wrapped absfs.Filer
+	var t *tieredFiler
+	if _, ok := memory.(absfs.SymLinker); ok {
+		s := &tieredSymFiler{}
+		wrapped, t = s, &s.tieredFiler
+	} else {
+		t = &tieredFiler{}
+		wrapped = t
+	}
+	t.Filer, t.disk, t.threshold, t.budget = memory, disk, threshold, budget
+	t.files = make(map[string]*tieredEntry)
+	return wrapped
+}
+
+// asTiered returns the tieredFiler of a secondary, or nil if it is not one.
+func asTiered(filer absfs.Filer) *tieredFiler {
+	switch t := filer.(type) {
+	case *tieredFiler:
+		return t
+	case *tieredSymFiler:
+		return &t.tieredFiler
+	}
+	return nil
+}
+
+func (t *tieredFiler) stats() TieredStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := TieredStats{MemoryBytes: t.memBytes, Spills: t.spills}
+	for _, e := range t.files {
+		if e.object != "" {
+			s.DiskFiles++
+		} else {
+			s.MemoryFiles++
+		}
+	}
+	return s
+}
+
+// use returns the entry of name, creating it if create is set, and records
+// a use of it. It returns nil for a file not written through the filer.
+// t.mu must be held.
+func (t *tieredFiler) use(name string, create bool) *tieredEntry {
+	e := t.files[name]
+	if e == nil && create {
+		e = &tieredEntry{}
+		t.files[name] = e
+	}
+	if e != nil {
+		t.clock++
+		e.used = t.clock
+	}
+	return e
+}
+
+// lookup returns the name of the spilled contents of name, if any.
+func (t *tieredFiler) lookup(name string) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e := t.files[name]; e != nil && e.object != "" {
+		return e.object, true
+	}
+	return "", false
+}
+
+// drop forgets name, removing its spilled contents. t.mu must be held.
+func (t *tieredFiler) drop(name string) {
+	e := t.files[name]
+	if e == nil {
+		return
+	}
+	if e.object != "" {
+		t.disk.Remove(e.object)
+	} else {
+		t.memBytes -= e.size
+	}
+	delete(t.files, name)
+}
+
+// closed records that a handle to name, the file of e, was closed, and
+// spills files as needed once one written in memory is.
+func (t *tieredFiler) closed(name string, e *tieredEntry, write bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e.open--
+	if !write || e.object != "" || t.files[name] != e {
+		return
+	}
+	if info, err := t.Filer.Stat(name); err == nil {
+		t.memBytes += info.Size() - e.size
+		e.size = info.Size()
+	}
+	if t.threshold > 0 && e.size > t.threshold && e.open == 0 {
+		t.spill(name, e)
+	}
+	t.balance()
+}
+
+// balance spills the least recently used files until the contents kept in
+// memory fit the budget. t.mu must be held.
+func (t *tieredFiler) balance() {
+	for t.budget > 0 && t.memBytes > t.budget {
+		var name string
+		var coldest *tieredEntry
+		for n, e := range t.files {
+			if e.object != "" || e.open > 0 || e.size == 0 {
+				continue
+			}
+			if coldest == nil || e.used < coldest.used {
+				name, coldest = n, e
+			}
+		}
+		if coldest == nil || t.spill(name, coldest) != nil {
+			return
+		}
+	}
+}
+
+// spill moves the contents of name to disk, leaving an empty placeholder
+// with the same mode and modification time. t.mu must be held.
+func (t *tieredFiler) spill(name string, e *tieredEntry) error {
+	info, err := t.Filer.Stat(name)
+	if err != nil {
+		return err
+	}
+	t.seq++
+	obj := fmt.Sprintf("/%d", t.seq)
+	if err := copyFile(t.disk, obj, t.Filer, name, 0600, false, defaultBuffers); err != nil {
+		t.disk.Remove(obj)
+		return err
+	}
+	f, err := t.Filer.OpenFile(name, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		t.disk.Remove(obj)
+		return err
+	}
+	f.Close()
+	mtime := info.ModTime()
+	t.Filer.Chtimes(name, mtime, mtime)
+	t.disk.Chtimes(obj, mtime, mtime)
+
+	t.memBytes -= e.size
+	e.object, e.size = obj, 0
+	t.spills++
+	return nil
+}
+
+// spilled reports info of name with the size and modification time of its
+// spilled contents, if any.
+func (t *tieredFiler) spilled(name string, info os.FileInfo) os.FileInfo {
+	if !info.Mode().IsRegular() {
+		return info
+	}
+	obj, ok := t.lookup(path.Clean("/" + name))
+	if !ok {
+		return info
+	}
+	if data, err := t.disk.Stat(obj); err == nil {
+		return tieredInfo{FileInfo: info, size: data.Size(), modTime: data.ModTime()}
+	}
+	return info
+}
+
+// spilledEntries reports the entries of directory dir with the sizes and
+// modification times of their spilled contents.
+func (t *tieredFiler) spilledEntries(dir string, entries []fs.DirEntry) []fs.DirEntry {
+	for i, e := range entries {
+		name := path.Join("/", dir, e.Name())
+		if _, ok := t.lookup(name); !ok {
+			continue
+		}
+		if info, err := e.Info(); err == nil {
+			entries[i] = fs.FileInfoToDirEntry(t.spilled(name, info))
+		}
+	}
+	return entries
+}
+
+func (t *tieredFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	clean := path.Clean("/" + name)
+	write := openOp(flag) == OpWrite
+	t.mu.Lock()
+	e := t.use(clean, false)
+	if e != nil && e.object != "" && flag&os.O_EXCL == 0 {
+		if flag&os.O_TRUNC == 0 {
+			f, err := t.disk.OpenFile(e.object, flag&^os.O_CREATE, 0)
+			if err != nil {
+				t.mu.Unlock()
+				return nil, err
+			}
+			e.open++
+			t.mu.Unlock()
+			return &tieredFile{File: f, t: t, name: clean, entry: e, spilled: true}, nil
+		}
+		// Truncated contents start over in memory
+		t.disk.Remove(e.object)
+		e.object = ""
+	}
+	t.mu.Unlock()
+
+	f, err := t.Filer.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e = t.use(clean, write); e == nil {
+		return &tieredFile{File: f, t: t, name: clean}, nil
+	}
+	e.open++
+	return &tieredFile{File: f, t: t, name: clean, entry: e, write: write}, nil
+}
+
+func (t *tieredFiler) Remove(name string) error {
+	if err := t.Filer.Remove(name); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.drop(path.Clean("/" + name))
+	return nil
+}
+
+// Rename renames oldpath, carrying the spilled contents of it and the files
+// below it along.
+func (t *tieredFiler) Rename(oldpath, newpath string) error {
+	if err := t.Filer.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	oldpath, newpath = path.Clean("/"+oldpath), path.Clean("/"+newpath)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.drop(newpath)
+	for name, e := range t.files {
+		if rel, ok := relativeTo(oldpath, name); ok {
+			delete(t.files, name)
+			t.files[path.Join(newpath, rel)] = e
+		}
+	}
+	return nil
+}
+
+func (t *tieredFiler) Stat(name string) (os.FileInfo, error) {
+	info, err := t.Filer.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return t.spilled(name, info), nil
+}
+
+// Chtimes sets the times of name, and of its spilled contents, which report
+// the modification time of a spilled file.
+func (t *tieredFiler) Chtimes(name string, atime, mtime time.Time) error {
+	if err := t.Filer.Chtimes(name, atime, mtime); err != nil {
+		return err
+	}
+	if obj, ok := t.lookup(path.Clean("/" + name)); ok {
+		return t.disk.Chtimes(obj, atime, mtime)
+	}
+	return nil
+}
+
+func (t *tieredFiler) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := t.Filer.ReadDir(name)
+	return t.spilledEntries(name, entries), err
+}
+
+func (t *tieredFiler) ReadFile(name string) ([]byte, error) {
+	clean := path.Clean("/" + name)
+	t.mu.Lock()
+	t.use(clean, false)
+	t.mu.Unlock()
+	if obj, ok := t.lookup(clean); ok {
+		return t.disk.ReadFile(obj)
+	}
+	return t.Filer.ReadFile(name)
+}
+
+func (t *tieredFiler) Sub(dir string) (fs.FS, error) {
+	return absfs.FilerToFS(t, dir)
+}
+
+// tieredSymFiler is a tieredFiler over a Filer that supports symbolic
+// links.
+type tieredSymFiler struct {
+	tieredFiler
+}
+
+func (t *tieredSymFiler) sl() absfs.SymLinker {
+	return t.Filer.(absfs.SymLinker)
+}
+
+func (t *tieredSymFiler) Symlink(oldname, newname string) error {
+	return t.sl().Symlink(oldname, newname)
+}
+
+func (t *tieredSymFiler) Readlink(name string) (string, error) {
+	return t.sl().Readlink(name)
+}
+
+func (t *tieredSymFiler) Lstat(name string) (os.FileInfo, error) {
+	info, err := t.sl().Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	return t.spilled(name, info), nil
+}
+
+func (t *tieredSymFiler) Lchown(name string, uid, gid int) error {
+	return t.sl().Lchown(name, uid, gid)
+}
+
+// tieredInfo reports the size and modification time of a file's spilled
+// contents instead of those of its placeholder.
+type tieredInfo struct {
+	os.FileInfo
+	size    int64
+	modTime time.Time
+}
+
+func (i tieredInfo) Size() int64        { return i.size }
+func (i tieredInfo) ModTime() time.Time { return i.modTime }
+
+// tieredFile is a handle to a file of a tieredFiler, in memory or, if
+// spilled, on disk.
+type tieredFile struct {
+	absfs.File
+	t       *tieredFiler
+	name    string
+	entry   *tieredEntry // The file's entry, if tracked
+	write   bool         // Opened for writing
+	spilled bool         // File is the spilled contents
+
+	once sync.Once
+}
+
+func (f *tieredFile) Name() string { return f.name }
+
+func (f *tieredFile) Stat() (os.FileInfo, error) {
+	if !f.spilled {
+		return f.File.Stat()
+	}
+	return f.t.Stat(f.name)
+}
+
+func (f *tieredFile) Readdir(n int) ([]os.FileInfo, error) {
+	infos, err := f.File.Readdir(n)
+	for i, info := range infos {
+		infos[i] = f.t.spilled(path.Join(f.name, info.Name()), info)
+	}
+	return infos, err
+}
+
+func (f *tieredFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries, err := f.File.ReadDir(n)
+	return f.t.spilledEntries(f.name, entries), err
+}
+
+// Close closes the file, spilling files to disk as needed once one written
+// in memory is.
+func (f *tieredFile) Close() error {
+	err := f.File.Close()
+	if f.entry != nil {
+		f.once.Do(func() { f.t.closed(f.name, f.entry, f.write) })
+	}
+	return err
+}
@@ -0,0 +1,78 @@
+package cowfs
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/absfs/cowfs/dirfs"
+	"github.com/absfs/memfs"
+)
+
+func TestTieredSecondary(t *testing.T) {
+	primary := must(memfs.NewFS())
+	memory := must(memfs.NewFS())
+	scratch := t.TempDir()
+	disk := must(dirfs.New(scratch))
+	writeMemFile(t, primary, "/small.txt", "small")
+	cfs := New(primary, memory, WithTieredSecondary(disk, 16, 24))
+
+	// Small files stay in memory
+	if err := cfs.WriteFile("/a.txt", []byte(strings.Repeat("a", 10)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Chmod("/small.txt", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got := cfs.TieredStats(); got.MemoryFiles != 2 || got.MemoryBytes != 15 || got.DiskFiles != 0 {
+		t.Errorf("TieredStats = %+v; want 2 files, 15 bytes in memory", got)
+	}
+
+	// Large files spill at once
+	big := strings.Repeat("b", 100)
+	if err := cfs.WriteFile("/big.txt", []byte(big), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := memory.ReadFile("/big.txt"); len(data) != 0 {
+		t.Errorf("memory tier holds %d bytes of big.txt, want a placeholder", len(data))
+	}
+	info, err := cfs.Stat("/big.txt")
+	if err != nil || info.Size() != 100 || info.Mode().Perm() != 0640 {
+		t.Errorf("Stat(/big.txt) = %v, %v; want 100 bytes, mode 0640", info, err)
+	}
+	if data, _ := cfs.ReadFile("/big.txt"); string(data) != big {
+		t.Errorf("ReadFile(/big.txt) = %d bytes, want the spilled contents", len(data))
+	}
+
+	// Exceeding the budget spills the least recently used file
+	cfs.ReadFile("/a.txt")
+	if err := cfs.WriteFile("/c.txt", []byte(strings.Repeat("c", 12)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := cfs.TieredStats(); got.MemoryFiles != 2 || got.MemoryBytes != 22 || got.DiskFiles != 2 || got.Spills != 2 {
+		t.Errorf("TieredStats after exceeding the budget = %+v; want a.txt and c.txt in memory", got)
+	}
+	if data, _ := cfs.ReadFile("/small.txt"); string(data) != "small" {
+		t.Errorf("ReadFile(/small.txt) = %q after spilling", data)
+	}
+
+	// Spilled files can be appended to, renamed and removed
+	f := must(cfs.OpenFile("/big.txt", os.O_WRONLY|os.O_APPEND, 0))
+	must(f.WriteString("!"))
+	f.Close()
+	if err := cfs.Rename("/big.txt", "/moved.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := cfs.ReadFile("/moved.txt"); string(data) != big+"!" {
+		t.Errorf("ReadFile(/moved.txt) = %d bytes, want the appended contents", len(data))
+	}
+	if err := cfs.Remove("/moved.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Remove("/small.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(scratch); len(entries) != 0 {
+		t.Errorf("scratch directory holds %d entries after removals, want none", len(entries))
+	}
+}
@@ -0,0 +1,41 @@
+package cowfs
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/absfs/cowfs"
+
+// WithTracerProvider records OpenTelemetry spans for expensive operations,
+// currently copy-ups, merged directory listings and commits, using tracers
+// from tp. Spans carry the path and, where known, the size involved; commit
+// spans carry the number of modified, deleted and conflicting paths
+// instead.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(fs *FileSystem) {
+		fs.tracer = tp.Tracer(tracerName)
+	}
+}
+
+// startSpan starts a span named name. Without a tracer it returns a no-op
+// span, so callers can end it unconditionally.
+func (cfs *FileSystem) startSpan(name string, attrs ...attribute.KeyValue) trace.Span {
+	if cfs.tracer == nil {
+		return trace.SpanFromContext(context.Background())
+	}
+	_, span := cfs.tracer.Start(context.Background(), name, trace.WithAttributes(attrs...))
+	return span
+}
+
+// endSpan records err, if any, on span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
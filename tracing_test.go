@@ -0,0 +1,145 @@
+package cowfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestWithTracerProvider(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	rec := tracetest.NewSpanRecorder()
+	WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))(cfs)
+	writeMemFile(t, primary, "/a.txt", "aaaa")
+	writeMemFile(t, primary, "/b.txt", "bb")
+
+	if err := cfs.Chmod("/a.txt", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfs.ReadDir("/"); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := rec.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	attrs := func(i int) map[attribute.Key]attribute.Value {
+		m := make(map[attribute.Key]attribute.Value)
+		for _, kv := range spans[i].Attributes() {
+			m[kv.Key] = kv.Value
+		}
+		return m
+	}
+	if spans[0].Name() != "cowfs.CopyUp" {
+		t.Errorf("span 0 = %q, want cowfs.CopyUp", spans[0].Name())
+	}
+	if a := attrs(0); a["cowfs.path"].AsString() != "/a.txt" || a["cowfs.size"].AsInt64() != 4 {
+		t.Errorf("copy-up attributes = %v", a)
+	}
+	if spans[1].Name() != "cowfs.ReadDir" {
+		t.Errorf("span 1 = %q, want cowfs.ReadDir", spans[1].Name())
+	}
+	if a := attrs(1); a["cowfs.path"].AsString() != "/" || a["cowfs.entries"].AsInt64() != 2 {
+		t.Errorf("readdir attributes = %v", a)
+	}
+}
+
+func TestCommitSpan(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	rec := tracetest.NewSpanRecorder()
+	WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))(cfs)
+	writeMemFile(t, primary, "/a.txt", "a")
+	writeMemFile(t, primary, "/b.txt", "b")
+	if err := cfs.WriteFile("/a.txt", []byte("edited"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Remove("/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cfs.Commit(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cfs.Remove("/a.txt")
+	if err := cfs.Commit(ctx); err == nil {
+		t.Fatal("Commit() with a cancelled context succeeded")
+	}
+
+	var commits []sdktrace.ReadOnlySpan
+	for _, span := range rec.Ended() {
+		if span.Name() == "cowfs.Commit" {
+			commits = append(commits, span)
+		}
+	}
+	if len(commits) != 2 {
+		t.Fatalf("got %d commit spans, want 2", len(commits))
+	}
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range commits[0].Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	if attrs["cowfs.modified"].AsInt64() != 1 || attrs["cowfs.deleted"].AsInt64() != 1 {
+		t.Errorf("commit attributes = %v, want one modified and one deleted path", attrs)
+	}
+	if commits[0].Status().Code != codes.Unset {
+		t.Errorf("successful commit status = %v", commits[0].Status())
+	}
+	if commits[1].Status().Code != codes.Error || len(commits[1].Events()) == 0 {
+		t.Errorf("failed commit status = %v, events = %v, want the error recorded", commits[1].Status(), commits[1].Events())
+	}
+}
+
+func TestCommitMergeSpan(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	rec := tracetest.NewSpanRecorder()
+	WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))(cfs)
+	WithConflictDetection()(cfs)
+	writeMemFile(t, primary, "/conf.txt", "base")
+	cfs.WriteFile("/conf.txt", []byte("ours"), 0644)
+	writeMemFile(t, primary, "/conf.txt", "theirs")
+
+	failing := func(string, io.Reader, io.Reader, io.Reader) (io.Reader, error) {
+		return nil, errors.New("cannot merge")
+	}
+	if err := cfs.Commit(context.Background(), WithMergeFunc(failing)); err == nil {
+		t.Fatal("Commit() succeeded despite the failed merge")
+	}
+	merge := func(string, io.Reader, io.Reader, io.Reader) (io.Reader, error) {
+		return strings.NewReader("merged"), nil
+	}
+	if err := cfs.Commit(context.Background(), WithMergeFunc(merge)); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := rec.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2 commits", len(spans))
+	}
+	for i, span := range spans {
+		var conflicts int64 = -1
+		for _, kv := range span.Attributes() {
+			if kv.Key == "cowfs.conflicts" {
+				conflicts = kv.Value.AsInt64()
+			}
+		}
+		if span.Name() != "cowfs.Commit" || conflicts != 1 {
+			t.Errorf("span %d = %q with %d conflicts, want cowfs.Commit with 1", i, span.Name(), conflicts)
+		}
+	}
+	if spans[0].Status().Code != codes.Error || !strings.Contains(spans[0].Status().Description, "cannot merge") {
+		t.Errorf("failed merge status = %v, want the merge error", spans[0].Status())
+	}
+	if spans[1].Status().Code != codes.Unset {
+		t.Errorf("merged commit status = %v", spans[1].Status())
+	}
+}
@@ -0,0 +1,348 @@
+package cowfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// txDir is the secondary directory holding the backups of an open
+// transaction.
+const txDir = "/.cowfs-tx~"
+
+var (
+	// ErrTxInProgress is returned by Begin while another transaction is
+	// open.
+	ErrTxInProgress = errors.New("cowfs: transaction already in progress")
+
+	// ErrTxDone is returned by Commit and Rollback of a transaction that
+	// has already been committed or rolled back.
+	ErrTxDone = errors.New("cowfs: transaction already finished")
+)
+
+// Tx is an open transaction. See Begin.
+type Tx struct {
+	cfs   *FileSystem
+	state *txState
+}
+
+// txState records what an open transaction needs to undo its changes: the
+// overlay markers when it began and backups of the secondary paths it
+// touched.
+type txState struct {
+	mu       sync.Mutex
+	modified map[string]bool
+	deleted  map[string]bool
+	opaque   map[string]bool
+	deltas   map[string]bool
+	owners   map[string]Owner
+	used     int64 // Secondary usage counted against the quota
+	bases    map[string]FileVersion
+
+	roots   []string            // Touched paths, none below another
+	backups map[string]txBackup // Secondary state of each touched path
+	seq     int
+}
+
+// txBackup is the secondary state of a path before the transaction touched
+// it.
+type txBackup struct {
+	exists  bool
+	mode    os.FileMode
+	modTime time.Time
+	link    string // Destination of a symbolic link
+	key     string // Backup copy of a regular file
+}
+
+// Begin opens a transaction grouping the mutations that follow until Commit
+// or Rollback. Rollback undoes them: files written in the secondary are
+// restored to their earlier contents or removed, and the overlay's markers
+// return to what they were, so callers get all-or-nothing updates of
+// several files. Commit keeps the changes.
+//
+// Transactions are not isolated: every mutation made through the overlay
+// while a transaction is open is part of it, whichever goroutine makes it.
+// Before a path is first changed, its secondary version is backed up in
+// the secondary, which costs a copy of each file changed; a mutation whose
+// backup fails fails without changes. Only one
+// transaction can be open at a time; Begin returns ErrTxInProgress
+// otherwise.
+func (cfs *FileSystem) Begin() (*Tx, error) {
+	cfs.opMu.Lock()
+	defer cfs.opMu.Unlock()
+	if cfs.frozen.Load() {
+		return nil, ErrFrozen
+	}
+	cfs.flushDeletions()
+
+	cfs.txMu.Lock()
+	defer cfs.txMu.Unlock()
+	if cfs.tx != nil {
+		return nil, ErrTxInProgress
+	}
+	t := &txState{backups: make(map[string]txBackup)}
+	cfs.mu.RLock()
+	t.modified = copyMarkers(cfs.modified)
+	t.deleted = copyMarkers(cfs.deleted)
+	t.opaque = copyMarkers(cfs.opaque)
+	t.deltas = copyMarkers(cfs.deltas)
+	t.owners = make(map[string]Owner, len(cfs.owners))
+	for name, o := range cfs.owners {
+		t.owners[name] = o
+	}
+	cfs.mu.RUnlock()
+	if cfs.quota != nil {
+		t.used = cfs.quota.used.Load()
+	}
+	if cfs.conflicts != nil {
+		t.bases = cfs.conflicts.snapshot()
+	}
+	cfs.tx = t
+	return &Tx{cfs: cfs, state: t}, nil
+}
+
+// copyMarkers returns a copy of m, preserving nil.
+func copyMarkers(m map[string]bool) map[string]bool {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]bool, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// finish closes the transaction, reporting ErrTxDone if it already was.
+// cfs.opMu must be held.
+func (tx *Tx) finish() error {
+	cfs := tx.cfs
+	cfs.txMu.Lock()
+	defer cfs.txMu.Unlock()
+	if cfs.tx != tx.state {
+		return ErrTxDone
+	}
+	cfs.tx = nil
+	return nil
+}
+
+// Commit keeps the changes made during the transaction and discards its
+// backups.
+func (tx *Tx) Commit() error {
+	cfs := tx.cfs
+	cfs.opMu.Lock()
+	defer cfs.opMu.Unlock()
+	if err := tx.finish(); err != nil {
+		return err
+	}
+	removeAll(cfs.secondary, txDir)
+	return nil
+}
+
+// Rollback undoes the changes made during the transaction: the secondary
+// versions of the paths it changed are restored, paths it created are
+// removed, and the overlay markers are reset to what they were at Begin.
+// Changes made to the layers behind the overlay's back are not undone.
+// Rollback of a frozen overlay fails with ErrFrozen and leaves the
+// transaction open.
+func (tx *Tx) Rollback() error {
+	cfs := tx.cfs
+	cfs.opMu.Lock()
+	defer cfs.opMu.Unlock()
+	if cfs.frozen.Load() {
+		return ErrFrozen
+	}
+	if err := tx.finish(); err != nil {
+		return err
+	}
+	cfs.flushDeletions()
+	t := tx.state
+
+	for _, root := range t.roots {
+		cfs.discardTouched(root)
+	}
+	names := make([]string, 0, len(t.backups))
+	for name, b := range t.backups {
+		if b.exists {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names) // Parents first
+	var firstErr error
+	for _, name := range names {
+		if err := cfs.restoreBackup(name, t.backups[name]); err != nil && firstErr == nil {
+			firstErr = &os.PathError{Op: "rollback", Path: name, Err: err}
+		}
+	}
+	removeAll(cfs.secondary, txDir)
+
+	cfs.mu.Lock()
+	cfs.modified = t.modified
+	cfs.deleted = t.deleted
+	cfs.opaque = t.opaque
+	cfs.owners = t.owners
+	if cfs.deltas != nil {
+		cfs.deltas = t.deltas
+	}
+	cfs.mu.Unlock()
+	if cfs.quota != nil {
+		cfs.quota.used.Store(t.used)
+	}
+	if c := cfs.conflicts; c != nil {
+		c.mu.Lock()
+		c.bases = t.bases
+		c.mu.Unlock()
+	}
+	cfs.gen.Add(1)
+	cfs.stateChanged()
+	cfs.debug("cowfs: transaction rolled back", "paths", len(t.backups))
+	return firstErr
+}
+
+// discardTouched removes the secondary version of the touched path root,
+// keeping the overlay's internal files, including the transaction's
+// backups.
+func (cfs *FileSystem) discardTouched(root string) {
+	if root != "/" {
+		removeAll(cfs.secondary, root)
+		return
+	}
+	entries, _ := cfs.secondary.ReadDir("/")
+	for _, e := range entries {
+		if !internalDir("/", e.Name()) {
+			removeAll(cfs.secondary, "/"+e.Name())
+		}
+	}
+}
+
+// restoreBackup puts the backed up secondary version b of name back.
+func (cfs *FileSystem) restoreBackup(name string, b txBackup) error {
+	switch {
+	case b.mode.IsDir():
+		if err := cfs.secondary.Mkdir(name, b.mode.Perm()); err != nil && !os.IsExist(err) {
+			return err
+		}
+	case b.mode&os.ModeSymlink != 0:
+		if err := cfs.secondary.(absfs.SymLinker).Symlink(b.link, name); err != nil {
+			return err
+		}
+		return nil
+	default:
+		if err := copyFile(cfs.secondary, name, cfs.secondary, b.key, b.mode.Perm(), false, cfs.copyBuffers()); err != nil {
+			return err
+		}
+	}
+	cfs.secondary.Chmod(name, b.mode)
+	return cfs.secondary.Chtimes(name, b.modTime, b.modTime)
+}
+
+// txTouch backs up the secondary versions of names and everything below
+// them, unless already backed up, before the open transaction, if any,
+// changes them. A backup that fails is reported, and the change must not be
+// made, since Rollback could not undo it.
+func (cfs *FileSystem) txTouch(names ...string) error {
+	cfs.txMu.Lock()
+	t := cfs.tx
+	cfs.txMu.Unlock()
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, name := range names {
+		name = path.Clean("/" + name)
+		if t.covers(name) {
+			continue
+		}
+		if err := cfs.backupTree(t, name); err != nil {
+			return err
+		}
+		kept := t.roots[:0]
+		for _, root := range t.roots {
+			if !strings.HasPrefix(root, name+"/") && name != "/" {
+				kept = append(kept, root)
+			}
+		}
+		t.roots = append(kept, name)
+	}
+	return nil
+}
+
+// covers reports whether name is at or below a touched path.
+func (t *txState) covers(name string) bool {
+	for _, root := range t.roots {
+		if root == name || root == "/" || strings.HasPrefix(name, root+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// backupTree backs up the secondary version of name and, for a directory,
+// its contents, skipping paths backed up before. t.mu must be held.
+func (cfs *FileSystem) backupTree(t *txState, name string) error {
+	if _, ok := t.backups[name]; ok {
+		return nil
+	}
+	if name == "/" {
+		// The root itself always exists and is never removed
+		entries, err := cfs.secondary.ReadDir(name)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if internalDir(name, e.Name()) {
+				continue
+			}
+			if err := cfs.backupTree(t, name+e.Name()); err != nil {
+				return err
+			}
+		}
+		t.backups[name] = txBackup{}
+		return nil
+	}
+	info, err := lstatLayer(cfs.secondary, name)
+	if os.IsNotExist(err) {
+		t.backups[name] = txBackup{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	b := txBackup{exists: true, mode: info.Mode(), modTime: info.ModTime()}
+	switch {
+	case info.IsDir():
+		entries, err := cfs.secondary.ReadDir(name)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := cfs.backupTree(t, path.Join(name, e.Name())); err != nil {
+				return err
+			}
+		}
+	case info.Mode()&os.ModeSymlink != 0:
+		if b.link, err = cfs.secondary.(absfs.SymLinker).Readlink(name); err != nil {
+			return err
+		}
+	case info.Mode().IsRegular():
+		if err := cfs.secondary.Mkdir(txDir, 0700); err != nil && !os.IsExist(err) {
+			return err
+		}
+		t.seq++
+		b.key = fmt.Sprintf("%s/%d", txDir, t.seq)
+		if err := copyFile(cfs.secondary, b.key, cfs.secondary, name, 0600, false, cfs.copyBuffers()); err != nil {
+			cfs.secondary.Remove(b.key)
+			return err
+		}
+	}
+	t.backups[name] = b
+	return nil
+}
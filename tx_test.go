@@ -0,0 +1,124 @@
+package cowfs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/memfs"
+)
+
+func TestTransactionRollback(t *testing.T) {
+	cfs, primary, secondary := newMemOverlay(t)
+	primary.Mkdir("/dir", 0755)
+	writeMemFile(t, primary, "/dir/a.txt", "primary a")
+	writeMemFile(t, primary, "/b.txt", "primary b")
+	if err := cfs.WriteFile("/c.txt", []byte("before"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := cfs.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfs.Begin(); !errors.Is(err, ErrTxInProgress) {
+		t.Errorf("second Begin() error = %v, want ErrTxInProgress", err)
+	}
+	cfs.WriteFile("/dir/a.txt", []byte("changed a"), 0644)
+	cfs.Remove("/b.txt")
+	cfs.WriteFile("/c.txt", []byte("during"), 0644)
+	cfs.Mkdir("/new", 0755)
+	cfs.WriteFile("/new/d.txt", []byte("d"), 0644)
+	if names := listNames(t, cfs, "/"); !reflect.DeepEqual(names, []string{"c.txt", "dir", "new"}) {
+		t.Errorf("ReadDir() during transaction = %v", names)
+	}
+
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"/dir/a.txt": "primary a", "/b.txt": "primary b", "/c.txt": "before"} {
+		if data, err := cfs.ReadFile(name); err != nil || string(data) != want {
+			t.Errorf("ReadFile(%s) = %q, %v, want %q", name, data, err, want)
+		}
+	}
+	if _, err := cfs.Stat("/new"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat(/new) error = %v, want not exist", err)
+	}
+	if cfs.IsModified("/dir/a.txt") || cfs.IsDeleted("/b.txt") || !cfs.IsModified("/c.txt") {
+		t.Error("overlay markers not restored")
+	}
+	for _, name := range []string{"/dir", "/dir/a.txt", "/new", txDir} {
+		if _, err := secondary.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("secondary still has %s: %v", name, err)
+		}
+	}
+	if err := tx.Rollback(); !errors.Is(err, ErrTxDone) {
+		t.Errorf("second Rollback() error = %v, want ErrTxDone", err)
+	}
+}
+
+func TestTransactionCommit(t *testing.T) {
+	cfs, primary, secondary := newMemOverlay(t)
+	writeMemFile(t, primary, "/a.txt", "primary")
+	cfs.WriteFile("/a.txt", []byte("first"), 0644)
+
+	tx, err := cfs.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfs.WriteFile("/a.txt", []byte("second"), 0644)
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := cfs.ReadFile("/a.txt"); string(data) != "second" {
+		t.Errorf("ReadFile() = %q, want the committed content", data)
+	}
+	if _, err := secondary.Stat(txDir); !os.IsNotExist(err) {
+		t.Errorf("transaction backups left behind: %v", err)
+	}
+	if err := tx.Rollback(); !errors.Is(err, ErrTxDone) {
+		t.Errorf("Rollback() after Commit() error = %v, want ErrTxDone", err)
+	}
+	if _, err := cfs.Begin(); err != nil {
+		t.Errorf("Begin() after Commit() error = %v", err)
+	}
+}
+
+// noBackupFiler refuses to create transaction backups.
+type noBackupFiler struct {
+	*memfs.FileSystem
+}
+
+func (f noBackupFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	if strings.HasPrefix(name, txDir+"/") && flag&os.O_CREATE != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.ENOSPC}
+	}
+	return f.FileSystem.OpenFile(name, flag, perm)
+}
+
+func TestTransactionBackupFailure(t *testing.T) {
+	_, primary, secondary := newMemOverlay(t)
+	cfs := New(primary, noBackupFiler{secondary})
+	if err := cfs.WriteFile("/a.txt", []byte("before"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := cfs.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.WriteFile("/a.txt", []byte("during"), 0644); !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("WriteFile() = %v, want the backup error", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := cfs.ReadFile("/a.txt"); err != nil || string(data) != "before" {
+		t.Errorf("a.txt after Rollback() = %q, %v, want %q", data, err, "before")
+	}
+}
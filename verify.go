@@ -0,0 +1,156 @@
+package cowfs
+
+import (
+	"bytes"
+	"errors"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/absfs/absfs"
+)
+
+// ErrCopyUpCorrupt is returned by operations whose copy-up produced a
+// secondary copy that does not match the primary file; see WithVerifyCopyUp.
+var ErrCopyUpCorrupt = errors.New("cowfs: copy-up does not match the primary")
+
+// WithVerifyCopyUp verifies every copy-up of a regular file with a digest
+// from newHash, such as crc32.NewIEEE, or from the hash function set with
+// WithHasher if newHash is nil: the digest of the primary contents,
+// computed as the copy-up strategy reads them, is compared with the digest
+// of the secondary copy, read back once the copy is made.
+// Strategies that do not read the primary file from start to end in one
+// pass, such as reflinks or copies of sparse files, have it read again
+// instead. A copy that does not match is removed, and the operation that
+// needed it fails with ErrCopyUpCorrupt, even without WithStrictErrors.
+//
+// Verification guards against silent corruption by flaky network-backed
+// layers at the cost of reading every copy back from the secondary.
+func WithVerifyCopyUp(newHash func() hash.Hash) Option {
+	return func(fs *FileSystem) {
+		if newHash == nil {
+			newHash = fs.newHash
+		}
+		fs.verifyHash = newHash
+	}
+}
+
+// digestFiler is the primary as read by verified copy-ups. It digests the
+// contents of the file being copied up as they are read.
+type digestFiler struct {
+	absfs.Filer
+	name string
+	hash hash.Hash
+	file *digestFile // The last handle to name opened
+}
+
+func (d *digestFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	f, err := d.Filer.OpenFile(name, flag, perm)
+	if err != nil || name != d.name {
+		return f, err
+	}
+	d.hash.Reset()
+	d.file = &digestFile{File: f, hash: d.hash, sequential: true}
+	if _, ok := f.(fder); ok {
+		return &digestFdFile{d.file}, nil
+	}
+	return d.file, nil
+}
+
+// sum returns the digest of the file read through d, or nil if it was not
+// read from start to end in one pass.
+func (d *digestFiler) sum() []byte {
+	if d.file == nil || !d.file.sequential || !d.file.eof {
+		return nil
+	}
+	return d.hash.Sum(nil)
+}
+
+// digestFile digests what is read from it as long as it is read in order.
+type digestFile struct {
+	absfs.File
+	hash       hash.Hash
+	sequential bool // Read from the start with Read alone
+	eof        bool // Read to the end
+}
+
+func (f *digestFile) Read(b []byte) (int, error) {
+	n, err := f.File.Read(b)
+	if f.sequential {
+		f.hash.Write(b[:n])
+	}
+	if err == io.EOF {
+		f.eof = true
+	}
+	return n, err
+}
+
+func (f *digestFile) ReadAt(b []byte, off int64) (int, error) {
+	f.sequential = false
+	return f.File.ReadAt(b, off)
+}
+
+func (f *digestFile) Seek(offset int64, whence int) (int64, error) {
+	f.sequential = false
+	return f.File.Seek(offset, whence)
+}
+
+// digestFdFile is a digestFile over a file descriptor, which reflinks can
+// clone without reading.
+type digestFdFile struct {
+	*digestFile
+}
+
+func (f *digestFdFile) Fd() uintptr { return f.File.(fder).Fd() }
+
+// verifySource wraps src, the primary as read by the copy-up of name, to
+// digest the contents read, if copy-ups are verified.
+func (cfs *FileSystem) verifySource(src absfs.Filer, name string) (absfs.Filer, *digestFiler) {
+	if cfs.verifyHash == nil {
+		return src, nil
+	}
+	d := &digestFiler{Filer: src, name: name, hash: cfs.verifyHash()}
+	return d, d
+}
+
+// verifyCopy compares the secondary copy of name with the primary file,
+// whose digest d computed while copying. A copy that does not match is
+// removed.
+func (cfs *FileSystem) verifyCopy(name string, d *digestFiler) error {
+	if d == nil {
+		return nil
+	}
+	want := d.sum()
+	if want == nil {
+		var err error
+		if want, err = cfs.digest(cfs.primary, name, &cfs.counters.primary); err != nil {
+			return err
+		}
+	}
+	got, err := cfs.digest(cfs.secondary, name, &cfs.counters.secondary)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, want) {
+		cfs.secondary.Remove(name)
+		cfs.debug("cowfs: copy-up corrupt", "path", name)
+		return &refusedError{ErrCopyUpCorrupt}
+	}
+	return nil
+}
+
+// digest returns the digest of name in filer, counting the read in c.
+func (cfs *FileSystem) digest(filer absfs.Filer, name string, c *layerCounters) ([]byte, error) {
+	f, err := filer.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := cfs.verifyHash()
+	n, err := cfs.copyBuffers().copy(h, readerOnly{f})
+	c.read(n)
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
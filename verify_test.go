@@ -0,0 +1,73 @@
+package cowfs
+
+import (
+	"crypto/sha256"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/memfs"
+)
+
+// corruptFiler flips the bits of the first byte of every write while
+// corrupt is set.
+type corruptFiler struct {
+	absfs.Filer
+	corrupt bool
+}
+
+func (c *corruptFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	f, err := c.Filer.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &corruptFile{File: f, c: c}, nil
+}
+
+type corruptFile struct {
+	absfs.File
+	c *corruptFiler
+}
+
+func (f *corruptFile) Write(b []byte) (int, error) {
+	if f.c.corrupt && len(b) > 0 {
+		b = append([]byte{^b[0]}, b[1:]...)
+	}
+	return f.File.Write(b)
+}
+
+func TestVerifyCopyUp(t *testing.T) {
+	primary := must(memfs.NewFS())
+	secondary := &corruptFiler{Filer: must(memfs.NewFS())}
+	writeMemFile(t, primary, "/good.txt", "intact")
+	writeMemFile(t, primary, "/bad.txt", "intact")
+	cfs := New(primary, secondary, WithVerifyCopyUp(sha256.New))
+
+	if err := cfs.Chmod("/good.txt", 0600); err != nil {
+		t.Fatalf("Chmod of a faithful copy-up = %v", err)
+	}
+
+	secondary.corrupt = true
+	err := cfs.Chmod("/bad.txt", 0600)
+	if !errors.Is(err, ErrCopyUpCorrupt) {
+		t.Fatalf("Chmod of a corrupted copy-up = %v, want ErrCopyUpCorrupt", err)
+	}
+	if _, err := secondary.Stat("/bad.txt"); !os.IsNotExist(err) {
+		t.Errorf("corrupted copy left in the secondary: %v", err)
+	}
+	if data, _ := cfs.ReadFile("/bad.txt"); string(data) != "intact" {
+		t.Errorf("ReadFile(/bad.txt) = %q, want the primary contents", data)
+	}
+	if _, err := cfs.OpenFile("/bad.txt", os.O_WRONLY|os.O_APPEND, 0); !errors.Is(err, ErrCopyUpCorrupt) {
+		t.Errorf("OpenFile for appending = %v, want ErrCopyUpCorrupt", err)
+	}
+	if got := cfs.Stats().CopyUpFailures; got != 2 {
+		t.Errorf("CopyUpFailures = %d, want 2", got)
+	}
+
+	secondary.corrupt = false
+	if err := cfs.Chmod("/bad.txt", 0600); err != nil {
+		t.Errorf("Chmod once the secondary recovered = %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+package cowfs
+
+import (
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/absfs/absfs"
+)
+
+// ReadOnlyView is a read-only handle on the merged view of a FileSystem. Its
+// method set contains no mutating operations, so code that accepts a
+// ReadOnlyView is statically unable to modify the overlay. The view is live:
+// changes made through the FileSystem are visible through it, unless it was
+// returned by Freeze, which makes it a snapshot.
+type ReadOnlyView struct {
+	fs *FileSystem
+}
+
+// ReadOnly returns a read-only view of the overlay.
+func (cfs *FileSystem) ReadOnly() ReadOnlyView {
+	return ReadOnlyView{fs: cfs}
+}
+
+// ReadOnlyFile is a file opened through a ReadOnlyView. Like the view, its
+// method set contains no mutating operations, and the overlay's file it
+// wraps cannot be recovered from it.
+type ReadOnlyFile interface {
+	fs.ReadDirFile
+	io.ReaderAt
+	io.Seeker
+	Name() string
+}
+
+// Open opens the named file for reading.
+func (v ReadOnlyView) Open(name string) (ReadOnlyFile, error) {
+	f, err := v.fs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	return readOnlyFile{f}, nil
+}
+
+// readOnlyFile exposes the reading methods of a file.
+type readOnlyFile struct {
+	f absfs.File
+}
+
+func (r readOnlyFile) Name() string                              { return r.f.Name() }
+func (r readOnlyFile) Read(b []byte) (int, error)                { return r.f.Read(b) }
+func (r readOnlyFile) ReadAt(b []byte, off int64) (int, error)   { return r.f.ReadAt(b, off) }
+func (r readOnlyFile) Seek(off int64, whence int) (int64, error) { return r.f.Seek(off, whence) }
+func (r readOnlyFile) Stat() (fs.FileInfo, error)                { return r.f.Stat() }
+func (r readOnlyFile) ReadDir(n int) ([]fs.DirEntry, error)      { return r.f.ReadDir(n) }
+func (r readOnlyFile) Close() error                              { return r.f.Close() }
+
+// Stat returns file info for the named file.
+func (v ReadOnlyView) Stat(name string) (os.FileInfo, error) {
+	return v.fs.Stat(name)
+}
+
+// ReadFile reads the named file and returns its contents.
+func (v ReadOnlyView) ReadFile(name string) ([]byte, error) {
+	return v.fs.ReadFile(name)
+}
+
+// ReadDir reads the named directory and returns its merged entries.
+func (v ReadOnlyView) ReadDir(name string) ([]fs.DirEntry, error) {
+	return v.fs.ReadDir(name)
+}
+
+// Sub returns an fs.FS corresponding to the subtree rooted at dir.
+func (v ReadOnlyView) Sub(dir string) (fs.FS, error) {
+	return v.fs.Sub(dir)
+}
+
+// ExportTar writes the overlay delta to w as a tar stream. See
+// FileSystem.ExportTar.
+func (v ReadOnlyView) ExportTar(w io.Writer) error {
+	return v.fs.ExportTar(w)
+}
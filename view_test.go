@@ -0,0 +1,50 @@
+package cowfs
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/absfs/absfs"
+)
+
+func TestReadOnlyView(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	writeMemFile(t, primary, "/file.txt", "primary")
+	view := cfs.ReadOnly()
+
+	f, err := cfs.OpenFile("/file.txt", os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("changed"))
+	f.Close()
+
+	data, err := view.ReadFile("/file.txt")
+	if err != nil || string(data) != "changed" {
+		t.Errorf("ReadFile() = %q, %v, want live overlay content", data, err)
+	}
+
+	r, err := view.Open("/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = io.ReadAll(r)
+	r.Close()
+	if string(data) != "changed" {
+		t.Errorf("Open() read %q", data)
+	}
+	if _, ok := r.(io.Writer); ok {
+		t.Error("file opened through the view is an io.Writer")
+	}
+	if _, ok := r.(absfs.File); ok {
+		t.Error("file opened through the view is an absfs.File")
+	}
+
+	if _, err := view.Stat("/file.txt"); err != nil {
+		t.Errorf("Stat() error = %v", err)
+	}
+	if entries, err := view.ReadDir("/"); err != nil || len(entries) != 1 {
+		t.Errorf("ReadDir() = %v, %v", entries, err)
+	}
+}
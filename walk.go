@@ -0,0 +1,57 @@
+package cowfs
+
+import (
+	"io/fs"
+	"path"
+)
+
+// Walk walks the merged tree rooted at root, calling fn for each file or
+// directory in the tree, including root, in lexical order, as fs.WalkDir
+// does. Directory listings merge both layers, deleted paths and the
+// subtrees below them are skipped, and entries of modified paths describe
+// the secondary copy. Walk does not follow symbolic links.
+func (cfs *FileSystem) Walk(root string, fn fs.WalkDirFunc) error {
+	info, err := cfs.Lstat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = cfs.walkDir(root, fs.FileInfoToDirEntry(info), fn)
+	}
+	if err == fs.SkipDir || err == fs.SkipAll {
+		return nil
+	}
+	return err
+}
+
+// walkDir recursively descends name, which d describes, calling fn.
+func (cfs *FileSystem) walkDir(name string, d fs.DirEntry, fn fs.WalkDirFunc) error {
+	if err := fn(name, d, nil); err != nil || !d.IsDir() {
+		if err == fs.SkipDir && d.IsDir() {
+			// Successfully skipped directory
+			err = nil
+		}
+		return err
+	}
+
+	entries, err := cfs.ReadDir(name)
+	if err != nil {
+		// Second call, to report the ReadDir error
+		err = fn(name, d, err)
+		if err != nil {
+			if err == fs.SkipDir && d.IsDir() {
+				err = nil
+			}
+			return err
+		}
+	}
+
+	for _, entry := range entries {
+		if err := cfs.walkDir(path.Join(name, entry.Name()), entry, fn); err != nil {
+			if err == fs.SkipDir {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
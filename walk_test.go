@@ -0,0 +1,75 @@
+package cowfs
+
+import (
+	"io/fs"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestWalk(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	primary.Mkdir("/dir", 0755)
+	primary.Mkdir("/gone", 0755)
+	writeMemFile(t, primary, "/dir/a.txt", "a")
+	writeMemFile(t, primary, "/gone/b.txt", "b")
+	writeMemFile(t, primary, "/c.txt", "c")
+
+	cfs.Remove("/gone")
+	if err := cfs.Truncate("/c.txt", 0); err != nil {
+		t.Fatal(err)
+	}
+	f, err := cfs.OpenFile("/dir/new.txt", os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	var walked []string
+	sizes := make(map[string]int64)
+	err = cfs.Walk("/", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		walked = append(walked, name)
+		if info, err := d.Info(); err == nil && !d.IsDir() {
+			sizes[name] = info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/", "/c.txt", "/dir", "/dir/a.txt", "/dir/new.txt"}
+	if !reflect.DeepEqual(walked, want) {
+		t.Errorf("Walk visited %v, want %v", walked, want)
+	}
+	if sizes["/c.txt"] != 0 {
+		t.Errorf("entry for modified /c.txt has size %d, want 0", sizes["/c.txt"])
+	}
+}
+
+func TestWalkSkipDir(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	primary.Mkdir("/dir", 0755)
+	writeMemFile(t, primary, "/dir/a.txt", "a")
+	writeMemFile(t, primary, "/z.txt", "z")
+
+	var walked []string
+	err := cfs.Walk("/", func(name string, d fs.DirEntry, err error) error {
+		walked = append(walked, name)
+		if name == "/dir" {
+			return fs.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/", "/dir", "/z.txt"}; !reflect.DeepEqual(walked, want) {
+		t.Errorf("Walk visited %v, want %v", walked, want)
+	}
+	if err := cfs.Walk("/missing", func(string, fs.DirEntry, error) error { return nil }); err != nil {
+		t.Errorf("Walk(/missing) error = %v, want fn's nil result", err)
+	}
+}
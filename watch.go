@@ -0,0 +1,146 @@
+package cowfs
+
+import (
+	"path"
+	"sync"
+)
+
+// eventBuffer is the capacity of subscription channels.
+const eventBuffer = 64
+
+// EventOp describes the kind of change an Event reports.
+type EventOp int
+
+const (
+	EventCreate EventOp = iota + 1 // A file or directory was created
+	EventModify                    // Contents or metadata changed, or a file was opened for writing
+	EventRename                    // A path was renamed; Event.OldPath holds the old name
+	EventDelete                    // A path was removed
+)
+
+func (op EventOp) String() string {
+	switch op {
+	case EventCreate:
+		return "create"
+	case EventModify:
+		return "modify"
+	case EventRename:
+		return "rename"
+	case EventDelete:
+		return "delete"
+	}
+	return "unknown"
+}
+
+// Event reports a change made through the overlay.
+type Event struct {
+	Op      EventOp
+	Path    string
+	OldPath string // Previous name, for EventRename
+}
+
+type subscriber struct {
+	pattern string
+	ch      chan Event
+}
+
+// watchers is the set of active subscriptions.
+type watchers struct {
+	mu   sync.RWMutex
+	subs map[*subscriber]struct{}
+}
+
+// Subscribe delivers an Event for every successful create, modify, rename or
+// delete made through the overlay to a path matching pattern, using the
+// syntax of path.Match. A rename is delivered if either its old or its new
+// path matches. Changes made to the layers directly are not reported.
+//
+// Events are delivered on a buffered channel. A subscriber that falls behind
+// misses events rather than blocking the filesystem. The returned function
+// ends the subscription and closes the channel; it may be called more than
+// once. If pattern is malformed the channel is closed immediately.
+func (cfs *FileSystem) Subscribe(pattern string) (<-chan Event, func()) {
+	sub := &subscriber{pattern: pattern, ch: make(chan Event, eventBuffer)}
+	if _, err := path.Match(pattern, ""); err != nil {
+		close(sub.ch)
+		return sub.ch, func() {}
+	}
+
+	w := &cfs.watchers
+	w.mu.Lock()
+	if w.subs == nil {
+		w.subs = make(map[*subscriber]struct{})
+	}
+	w.subs[sub] = struct{}{}
+	w.mu.Unlock()
+
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			w.mu.Lock()
+			delete(w.subs, sub)
+			close(sub.ch)
+			w.mu.Unlock()
+		})
+	}
+}
+
+// watched reports whether there are any subscribers.
+func (cfs *FileSystem) watched() bool {
+	w := &cfs.watchers
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return len(w.subs) > 0
+}
+
+// notify records a change made through the overlay and delivers it to
+// subscribers.
+func (cfs *FileSystem) notify(e Event) {
+	cfs.stamp(e)
+	cfs.queueWriteBack(e)
+	cfs.deliver(e)
+}
+
+// deliver sends e to matching subscribers without blocking.
+func (cfs *FileSystem) deliver(e Event) {
+	w := &cfs.watchers
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	for sub := range w.subs {
+		if !sub.matches(e.Path) && (e.OldPath == "" || !sub.matches(e.OldPath)) {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+		default:
+		}
+	}
+}
+
+func (s *subscriber) matches(name string) bool {
+	ok, _ := path.Match(s.pattern, name)
+	return ok
+}
+
+// exists reports whether name is visible in the merged view, without
+// touching the hit counters or the resolution cache.
+func (cfs *FileSystem) exists(name string) bool {
+	cfs.mu.RLock()
+	isDeleted := cfs.deleted[name]
+	isModified := cfs.modified[name]
+	cfs.mu.RUnlock()
+
+	switch {
+	case isDeleted:
+		return false
+	case isModified:
+		return true
+	}
+	if !cfs.isOpaque(path.Dir(name)) {
+		if _, err := cfs.primaryStat(name); err == nil {
+			return true
+		}
+	}
+	_, err := cfs.secondary.Stat(name)
+	return err == nil
+}
@@ -0,0 +1,89 @@
+package cowfs
+
+import (
+	"os"
+	"testing"
+)
+
+func TestSubscribe(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	writeMemFile(t, primary, "/a.yaml", "a: 1")
+
+	events, cancel := cfs.Subscribe("/*.yaml")
+	defer cancel()
+
+	f, err := cfs.OpenFile("/b.yaml", os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := cfs.Chmod("/a.yaml", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Rename("/a.yaml", "/a.bak"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Remove("/b.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Mkdir("/ignored", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Event{
+		{Op: EventCreate, Path: "/b.yaml"},
+		{Op: EventModify, Path: "/a.yaml"},
+		{Op: EventRename, Path: "/a.bak", OldPath: "/a.yaml"},
+		{Op: EventDelete, Path: "/b.yaml"},
+	}
+	for _, w := range want {
+		select {
+		case e := <-events:
+			if e != w {
+				t.Errorf("event = %+v, want %+v", e, w)
+			}
+		default:
+			t.Fatalf("missing event %+v", w)
+		}
+	}
+	select {
+	case e := <-events:
+		t.Errorf("unexpected event %+v", e)
+	default:
+	}
+}
+
+func TestSubscribeCancel(t *testing.T) {
+	cfs, _, _ := newMemOverlay(t)
+	events, cancel := cfs.Subscribe("*")
+	cancel()
+	cancel()
+	if _, ok := <-events; ok {
+		t.Error("channel open after cancel")
+	}
+	if err := cfs.Mkdir("/d", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	bad, _ := cfs.Subscribe("[")
+	if _, ok := <-bad; ok {
+		t.Error("channel open for malformed pattern")
+	}
+}
+
+func TestSubscribeSlowConsumer(t *testing.T) {
+	cfs, _, _ := newMemOverlay(t)
+	events, cancel := cfs.Subscribe("/*")
+	defer cancel()
+	if err := cfs.Mkdir("/d", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < eventBuffer*2; i++ {
+		if err := cfs.Chmod("/d", 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(events); n != eventBuffer {
+		t.Errorf("buffered %d events, want %d", n, eventBuffer)
+	}
+}
@@ -0,0 +1,386 @@
+package cowfs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/absfs/absfs"
+)
+
+// WithWhiteoutFiles keeps the overlay's deletions and opaque directories in
+// the secondary itself, as the whiteout files (".wh.<name>") and opaque
+// markers (".wh..wh..opq") of an unpacked OCI image layer, so that a
+// secondary on a host directory can be packed as a layer by container
+// tooling, or unpacked from one, and reopened as an overlay without a
+// separate state file. New rebuilds the overlay's state from the secondary:
+// every entry in it is modified, and every whiteout and opaque marker is
+// restored. The markers are written as WithStateStore saves state, by a
+// background task once Start is called and by Close; this option replaces
+// any state store.
+//
+// The markers are hidden from the merged view, and names starting with
+// ".wh." cannot be created through the overlay. Delta storage cannot be
+// recorded this way, so saving fails while files are stored as deltas, and
+// the primary versions recorded by WithConflictDetection are not kept.
+// Optional interfaces of the secondary besides symbolic links, such as
+// Linker, are not available in this mode.
+func WithWhiteoutFiles() Option {
+	return func(fs *FileSystem) {
+		store := whiteoutStore{filer: fs.secondary}
+		fs.secondary = newWhiteoutFiler(fs.secondary)
+		fs.links = supportsLinks(fs.primary, fs.secondary)
+		WithStateStore(store)(fs)
+	}
+}
+
+// isWhiteout reports whether the base name of name is reserved for
+// whiteout files and opaque markers.
+func isWhiteout(name string) bool {
+	return strings.HasPrefix(path.Base(name), whiteoutPrefix)
+}
+
+// whiteoutStore is a StateStore keeping the state as whiteout files and
+// opaque markers in a secondary.
+type whiteoutStore struct {
+	filer absfs.Filer
+}
+
+// Load implements StateStore.
+func (w whiteoutStore) Load() (State, error) {
+	s := State{Modified: []string{}, Deleted: []string{}, Opaque: []string{}}
+	err := w.load(&s, "/")
+	if errors.Is(err, fs.ErrNotExist) {
+		err = nil
+	}
+	return s, err
+}
+
+func (w whiteoutStore) load(s *State, dir string) error {
+	entries, err := w.filer.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	deleted := make(map[string]bool)
+	for _, e := range entries {
+		switch {
+		case e.Name() == opaqueMarker:
+			s.Opaque = append(s.Opaque, dir)
+		case isWhiteout(e.Name()):
+			name := path.Join(dir, strings.TrimPrefix(e.Name(), whiteoutPrefix))
+			deleted[name] = true
+			s.Deleted = append(s.Deleted, name)
+		}
+	}
+	for _, e := range entries {
+		name := path.Join(dir, e.Name())
+		if isWhiteout(name) || deleted[name] || internalDir(dir, e.Name()) {
+			continue
+		}
+		s.Modified = append(s.Modified, name)
+		if e.IsDir() {
+			if err := w.load(s, name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Save implements StateStore, creating the markers s needs and removing
+// those it no longer does.
+func (w whiteoutStore) Save(s State) error {
+	if len(s.Deltas) > 0 {
+		return errors.New("cowfs: whiteout files cannot record delta-encoded files")
+	}
+	sort.Strings(s.Deleted)
+	want := make(map[string]bool)
+	for _, name := range s.Deleted {
+		if name != "/" && !hasDeletedAncestor(s.Deleted, name) {
+			dir, base := path.Split(name)
+			want[dir+whiteoutPrefix+base] = true
+		}
+	}
+	for _, dir := range s.Opaque {
+		want[path.Join(dir, opaqueMarker)] = true
+	}
+
+	have := make(map[string]bool)
+	if err := w.markers("/", have); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for name := range have {
+		if !want[name] {
+			if err := w.filer.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	for name := range want {
+		if have[name] {
+			continue
+		}
+		if err := w.mkdirAll(path.Dir(name)); err != nil {
+			return err
+		}
+		f, err := w.filer.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markers adds the markers below dir to have.
+func (w whiteoutStore) markers(dir string, have map[string]bool) error {
+	entries, err := w.filer.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := path.Join(dir, e.Name())
+		switch {
+		case isWhiteout(name):
+			have[name] = true
+		case e.IsDir() && !internalDir(dir, e.Name()):
+			if err := w.markers(name, have); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// mkdirAll creates dir and its parents if missing.
+func (w whiteoutStore) mkdirAll(dir string) error {
+	if _, err := w.filer.Stat(dir); err == nil {
+		return nil
+	}
+	if parent := path.Dir(dir); parent != dir {
+		if err := w.mkdirAll(parent); err != nil {
+			return err
+		}
+	}
+	if err := w.filer.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+// newWhiteoutFiler wraps filer in a whiteoutFiler, keeping its support for
+// symbolic links.
+func newWhiteoutFiler(filer absfs.Filer) absfs.Filer {
+	if _, ok := filer.(absfs.SymLinker); ok {
+		return &whiteoutSymFiler{whiteoutFiler{filer}}
+	}
+	return &whiteoutFiler{filer}
+}
+
+// whiteoutFiler is an absfs.Filer hiding the whiteout files and opaque
+// markers in the Filer it wraps.
+type whiteoutFiler struct {
+	absfs.Filer
+}
+
+func notExist(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
+
+func reserved(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: syscall.EINVAL}
+}
+
+func (w *whiteoutFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	if isWhiteout(name) {
+		if flag&os.O_CREATE != 0 {
+			return nil, reserved("open", name)
+		}
+		return nil, notExist("open", name)
+	}
+	f, err := w.Filer.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &whiteoutDir{File: f}, nil
+}
+
+func (w *whiteoutFiler) Mkdir(name string, perm os.FileMode) error {
+	if isWhiteout(name) {
+		return reserved("mkdir", name)
+	}
+	return w.Filer.Mkdir(name, perm)
+}
+
+// Remove removes name, and the markers in it if it is a directory holding
+// nothing else.
+func (w *whiteoutFiler) Remove(name string) error {
+	if isWhiteout(name) {
+		return notExist("remove", name)
+	}
+	err := w.Filer.Remove(name)
+	if err == nil {
+		return nil
+	}
+	entries, readErr := w.Filer.ReadDir(name)
+	if readErr != nil || len(entries) == 0 {
+		return err
+	}
+	for _, e := range entries {
+		if !isWhiteout(e.Name()) {
+			return err
+		}
+	}
+	for _, e := range entries {
+		w.Filer.Remove(path.Join(name, e.Name()))
+	}
+	return w.Filer.Remove(name)
+}
+
+func (w *whiteoutFiler) Rename(oldpath, newpath string) error {
+	if isWhiteout(oldpath) || isWhiteout(newpath) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EINVAL}
+	}
+	return w.Filer.Rename(oldpath, newpath)
+}
+
+func (w *whiteoutFiler) Stat(name string) (os.FileInfo, error) {
+	if isWhiteout(name) {
+		return nil, notExist("stat", name)
+	}
+	return w.Filer.Stat(name)
+}
+
+func (w *whiteoutFiler) Chmod(name string, mode os.FileMode) error {
+	if isWhiteout(name) {
+		return notExist("chmod", name)
+	}
+	return w.Filer.Chmod(name, mode)
+}
+
+func (w *whiteoutFiler) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	if isWhiteout(name) {
+		return notExist("chtimes", name)
+	}
+	return w.Filer.Chtimes(name, atime, mtime)
+}
+
+func (w *whiteoutFiler) Chown(name string, uid, gid int) error {
+	if isWhiteout(name) {
+		return notExist("chown", name)
+	}
+	return w.Filer.Chown(name, uid, gid)
+}
+
+func (w *whiteoutFiler) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := w.Filer.ReadDir(name)
+	kept := entries[:0]
+	for _, e := range entries {
+		if !isWhiteout(e.Name()) {
+			kept = append(kept, e)
+		}
+	}
+	return kept, err
+}
+
+func (w *whiteoutFiler) ReadFile(name string) ([]byte, error) {
+	if isWhiteout(name) {
+		return nil, notExist("readfile", name)
+	}
+	return w.Filer.ReadFile(name)
+}
+
+func (w *whiteoutFiler) Sub(dir string) (fs.FS, error) {
+	return absfs.FilerToFS(w, dir)
+}
+
+// whiteoutSymFiler is a whiteoutFiler over a Filer that supports symbolic
+// links.
+type whiteoutSymFiler struct {
+	whiteoutFiler
+}
+
+func (w *whiteoutSymFiler) sl() absfs.SymLinker {
+	return w.Filer.(absfs.SymLinker)
+}
+
+func (w *whiteoutSymFiler) Symlink(oldname, newname string) error {
+	if isWhiteout(newname) {
+		return reserved("symlink", newname)
+	}
+	return w.sl().Symlink(oldname, newname)
+}
+
+func (w *whiteoutSymFiler) Readlink(name string) (string, error) {
+	if isWhiteout(name) {
+		return "", notExist("readlink", name)
+	}
+	return w.sl().Readlink(name)
+}
+
+func (w *whiteoutSymFiler) Lstat(name string) (os.FileInfo, error) {
+	if isWhiteout(name) {
+		return nil, notExist("lstat", name)
+	}
+	return w.sl().Lstat(name)
+}
+
+func (w *whiteoutSymFiler) Lchown(name string, uid, gid int) error {
+	if isWhiteout(name) {
+		return notExist("lchown", name)
+	}
+	return w.sl().Lchown(name, uid, gid)
+}
+
+// whiteoutDir wraps a file handle of a whiteoutFiler to hide markers from
+// directory listings.
+type whiteoutDir struct {
+	absfs.File
+}
+
+func (d *whiteoutDir) Readdir(n int) ([]os.FileInfo, error) {
+	for {
+		infos, err := d.File.Readdir(n)
+		kept := infos[:0]
+		for _, info := range infos {
+			if !isWhiteout(info.Name()) {
+				kept = append(kept, info)
+			}
+		}
+		// A page of markers alone must not end the listing early
+		if len(kept) > 0 || len(infos) == 0 || err != nil || n <= 0 {
+			return kept, err
+		}
+	}
+}
+
+func (d *whiteoutDir) Readdirnames(n int) ([]string, error) {
+	infos, err := d.Readdir(n)
+	names := make([]string, len(infos))
+	for i, info := range infos {
+		names[i] = info.Name()
+	}
+	return names, err
+}
+
+func (d *whiteoutDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	for {
+		entries, err := d.File.ReadDir(n)
+		kept := entries[:0]
+		for _, e := range entries {
+			if !isWhiteout(e.Name()) {
+				kept = append(kept, e)
+			}
+		}
+		if len(kept) > 0 || len(entries) == 0 || err != nil || n <= 0 {
+			return kept, err
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package cowfs
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWhiteoutFiles(t *testing.T) {
+	_, primary, secondary := newMemOverlay(t)
+	primary.Mkdir("/etc", 0755)
+	writeMemFile(t, primary, "/etc/passwd", "root")
+	writeMemFile(t, primary, "/etc/hosts", "localhost")
+	primary.Mkdir("/var", 0755)
+	writeMemFile(t, primary, "/var/cache", "stale")
+
+	cfs := New(primary, secondary, WithWhiteoutFiles())
+	if err := cfs.Remove("/etc/passwd"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Remove("/var/cache"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Remove("/var"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Mkdir("/var", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.WriteFile("/var/log", []byte("log"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.WriteFile("/etc/.wh.hosts", nil, 0644); err == nil {
+		t.Error("created a file with a reserved name")
+	}
+	if err := cfs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The secondary holds an unpacked OCI layer
+	for _, name := range []string{"/etc/.wh.passwd", "/var/.wh..wh..opq", "/var/log"} {
+		if _, err := secondary.Stat(name); err != nil {
+			t.Errorf("secondary lacks %s: %v", name, err)
+		}
+	}
+	if got := listNames(t, cfs, "/etc"); len(got) != 1 || got[0] != "hosts" {
+		t.Errorf("ReadDir(/etc) = %v; want markers hidden", got)
+	}
+
+	// A new overlay over the same layers picks the state up from them
+	reopened := New(primary, secondary, WithWhiteoutFiles())
+	if _, err := reopened.Stat("/etc/passwd"); err == nil {
+		t.Error("deleted /etc/passwd visible after reopening")
+	}
+	if got := listNames(t, reopened, "/var"); len(got) != 1 || got[0] != "log" {
+		t.Errorf("ReadDir(/var) after reopening = %v; want only log", got)
+	}
+	if data, err := reopened.ReadFile("/etc/hosts"); err != nil || string(data) != "localhost" {
+		t.Errorf("ReadFile(/etc/hosts) = %q, %v", data, err)
+	}
+
+	// Undoing a deletion removes its whiteout
+	if err := reopened.WriteFile("/etc/passwd", []byte("admin"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := secondary.Stat("/etc/.wh.passwd"); err == nil {
+		t.Error("whiteout of a recreated file left behind")
+	}
+
+	var buf bytes.Buffer
+	if err := New(primary, secondary, WithWhiteoutFiles()).ExportTar(&buf); err != nil {
+		t.Fatal(err)
+	}
+	entries := readTar(t, &buf)
+	for _, name := range []string{"var/.wh..wh..opq", "var/log", "etc/passwd"} {
+		if _, ok := entries[name]; !ok {
+			t.Errorf("ExportTar of the reopened overlay lacks %s: %v", name, entries)
+		}
+	}
+	for name := range entries {
+		if name == "etc/.wh.passwd" {
+			t.Errorf("ExportTar of the reopened overlay has %s", name)
+		}
+	}
+}
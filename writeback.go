@@ -0,0 +1,206 @@
+package cowfs
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/absfs/absfs"
+)
+
+// WithWriteBack makes the overlay a write-back cache in front of a writable
+// primary: every change made through it is applied to the secondary as
+// usual and then replicated to the primary by a background task, once
+// Start is called, and by Close. Readers of the merged view see changes at
+// once; the primary catches up with them later.
+//
+// Replication copies the path's current state in the merged view rather
+// than replaying operations, so repeated changes to a path are written back
+// once. Files being written are replicated when their handles are closed.
+// A directory is replicated with its merged children, and children only the
+// primary still has are removed from it. A replication that fails, for
+// example because the primary is read-only, is logged, counted as
+// WriteBackFailures in Stats and not retried until the path changes again.
+//
+// The overlay keeps its modified and deleted markers after replication, so
+// reads keep being served by the secondary. Delta storage depends on
+// unchanging primary files and is disabled by this option.
+func WithWriteBack() Option {
+	return func(fs *FileSystem) {
+		fs.writeBack = &writeBackQueue{
+			pending: make(map[string]bool),
+			wake:    make(chan struct{}, 1),
+		}
+		fs.addTask("write-back", fs.runWriteBack)
+	}
+}
+
+// writeBackQueue holds paths still to be replicated to the primary, each
+// once.
+type writeBackQueue struct {
+	work    sync.Mutex // Held while paths are replicated
+	mu      sync.Mutex // Protects paths and pending
+	paths   []string
+	pending map[string]bool
+	wake    chan struct{}
+}
+
+// push queues name unless it is already queued.
+func (q *writeBackQueue) push(name string) {
+	q.mu.Lock()
+	if !q.pending[name] {
+		q.pending[name] = true
+		q.paths = append(q.paths, name)
+	}
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pop dequeues the oldest queued path. A change made to it from then on
+// queues it again. q.work must be held.
+func (q *writeBackQueue) pop() (string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.paths) == 0 {
+		return "", false
+	}
+	name := q.paths[0]
+	q.paths[0] = ""
+	q.paths = q.paths[1:]
+	delete(q.pending, name)
+	return name, true
+}
+
+// len returns the number of queued paths.
+func (q *writeBackQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.paths)
+}
+
+// queueWriteBack queues the paths changed by e for replication.
+func (cfs *FileSystem) queueWriteBack(e Event) {
+	if cfs.writeBack == nil {
+		return
+	}
+	if e.OldPath != "" {
+		cfs.writeBack.push(e.OldPath)
+	}
+	cfs.writeBack.push(e.Path)
+}
+
+// runWriteBack is the background task draining the write-back queue.
+func (cfs *FileSystem) runWriteBack(ctx context.Context) error {
+	q := cfs.writeBack
+	for {
+		cfs.flushWriteBack()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-q.wake:
+		}
+	}
+}
+
+// flushWriteBack replicates all queued paths.
+func (cfs *FileSystem) flushWriteBack() {
+	q := cfs.writeBack
+	if q == nil {
+		return
+	}
+	q.work.Lock()
+	defer q.work.Unlock()
+	for {
+		name, ok := q.pop()
+		if !ok {
+			return
+		}
+		err := cfs.writeBackPath(name)
+		if err != nil {
+			cfs.counters.writeBackFailures.Add(1)
+		} else {
+			cfs.counters.writeBacks.Add(1)
+		}
+		cfs.debug("cowfs: write back", "path", name, "err", err)
+	}
+}
+
+// writeBackPath makes the primary's name match the merged view.
+func (cfs *FileSystem) writeBackPath(name string) error {
+	info, err := cfs.Lstat(name)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		if _, err := lstatLayer(cfs.primary, name); err != nil {
+			return nil
+		}
+		removeAll(cfs.primary, name)
+		if _, err := lstatLayer(cfs.primary, name); err == nil {
+			return &os.PathError{Op: "remove", Path: name, Err: fs.ErrExist}
+		}
+		return nil
+	case err != nil:
+		return err
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := cfs.Readlink(name)
+		if err != nil {
+			return err
+		}
+		sl, ok := cfs.primary.(absfs.SymLinker)
+		if !ok {
+			return errors.ErrUnsupported
+		}
+		if err := cfs.ensurePrimaryDir(path.Dir(name)); err != nil {
+			return err
+		}
+		removeAll(cfs.primary, name)
+		return sl.Symlink(target, name)
+	case info.IsDir():
+		return cfs.writeBackDir(name)
+	}
+	if !cfs.IsModified(name) {
+		return nil
+	}
+	if err := cfs.ensurePrimaryDir(path.Dir(name)); err != nil {
+		return err
+	}
+	f, err := cfs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := cfs.writePrimary(name, f, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return cfs.primary.Chtimes(name, info.ModTime(), info.ModTime())
+}
+
+// writeBackDir replicates the directory name and its merged children.
+func (cfs *FileSystem) writeBackDir(name string) error {
+	if err := cfs.ensurePrimaryDir(name); err != nil {
+		return err
+	}
+	entries, err := cfs.ReadDir(name)
+	if err != nil {
+		return err
+	}
+	merged := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		merged[entry.Name()] = true
+		if err := cfs.writeBackPath(path.Join(name, entry.Name())); err != nil {
+			return err
+		}
+	}
+	stale, _ := cfs.primary.ReadDir(name)
+	for _, entry := range stale {
+		if !merged[entry.Name()] && !internalDir(name, entry.Name()) {
+			removeAll(cfs.primary, path.Join(name, entry.Name()))
+		}
+	}
+	return nil
+}
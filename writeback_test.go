@@ -0,0 +1,142 @@
+package cowfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/memfs"
+)
+
+func TestWriteBack(t *testing.T) {
+	_, primary, secondary := newMemOverlay(t)
+	if err := primary.Mkdir("/dir", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeMemFile(t, primary, "/dir/old.txt", "old")
+	writeMemFile(t, primary, "/gone.txt", "gone")
+	writeMemFile(t, primary, "/moved.txt", "moved")
+	cfs := New(primary, secondary, WithWriteBack())
+
+	if err := cfs.WriteFile("/dir/new.txt", []byte("new"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := cfs.OpenFile("/dir/old.txt", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("rewrote")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Remove("/gone.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Rename("/moved.txt", "/dir/moved.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Mkdir("/empty", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if s := cfs.Stats(); s.WriteBackBacklog == 0 || s.WriteBacks != 0 {
+		t.Errorf("before Start: backlog %d, write-backs %d; want queued paths only", s.WriteBackBacklog, s.WriteBacks)
+	}
+
+	if err := cfs.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for cfs.Stats().WriteBackBacklog > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if err := cfs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{
+		"/dir/new.txt":   "new",
+		"/dir/old.txt":   "rewrote",
+		"/dir/moved.txt": "moved",
+	} {
+		if data, err := primary.ReadFile(name); err != nil || string(data) != want {
+			t.Errorf("primary %s = %q, %v; want %q", name, data, err, want)
+		}
+	}
+	for _, name := range []string{"/gone.txt", "/moved.txt"} {
+		if _, err := primary.Stat(name); err == nil {
+			t.Errorf("primary still has %s", name)
+		}
+	}
+	if info, err := primary.Stat("/empty"); err != nil || !info.IsDir() {
+		t.Errorf("primary /empty = %v, %v; want a directory", info, err)
+	}
+	if s := cfs.Stats(); s.WriteBackBacklog != 0 || s.WriteBackFailures != 0 || s.WriteBacks == 0 {
+		t.Errorf("after Close: %+v", s)
+	}
+	if !cfs.IsModified("/dir/new.txt") {
+		t.Error("write-back cleared the overlay's modified marker")
+	}
+}
+
+func TestWriteBackOpaqueDir(t *testing.T) {
+	_, primary, secondary := newMemOverlay(t)
+	if err := primary.Mkdir("/dir", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeMemFile(t, primary, "/dir/stale.txt", "stale")
+	cfs := New(primary, secondary, WithWriteBack())
+
+	if err := cfs.Remove("/dir/stale.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Remove("/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Mkdir("/dir", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.WriteFile("/dir/fresh.txt", []byte("fresh"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if names := must(primary.ReadDir("/dir")); len(names) != 1 || names[0].Name() != "fresh.txt" {
+		t.Errorf("primary /dir = %v; want only fresh.txt", names)
+	}
+}
+
+// readOnlyFiler fails every change.
+type readOnlyFiler struct {
+	absfs.Filer
+}
+
+func (readOnlyFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+}
+
+func TestWriteBackFailure(t *testing.T) {
+	primary := must(memfs.NewFS())
+	secondary := must(memfs.NewFS())
+	cfs := New(readOnlyFiler{primary}, secondary, WithWriteBack())
+	if err := cfs.WriteFile("/file.txt", []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s := cfs.Stats(); s.WriteBackFailures != 1 || s.WriteBacks != 0 {
+		t.Errorf("write-backs %d, failures %d; want 0 and 1", s.WriteBacks, s.WriteBackFailures)
+	}
+	if data, err := cfs.ReadFile("/file.txt"); err != nil || string(data) != "data" {
+		t.Errorf("ReadFile = %q, %v; want the overlay's contents", data, err)
+	}
+	if _, err := primary.Stat("/file.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("primary Stat = %v; want not exist", err)
+	}
+}
@@ -0,0 +1,117 @@
+package cowfs
+
+import (
+	"fmt"
+	"os"
+)
+
+// writeDir is the secondary directory holding the temporary files of
+// WriteFile.
+const writeDir = "/.cowfs-write~"
+
+// WriteFile writes data to the named file, creating it with perm if it does
+// not exist in the merged view; an existing file keeps its permissions. The
+// data is written to a uniquely named temporary file in a hidden secondary
+// directory, which is then renamed into place and published in the overlay
+// state in one step, so readers of the merged view see either the previous
+// contents or all of data, never a partial write. The primary version of the
+// file is never copied up.
+func (cfs *FileSystem) WriteFile(name string, data []byte, perm os.FileMode) (err error) {
+	defer cfs.audit(&err, AuditRecord{Op: "writefile", Path: name, Mode: perm})
+	defer wrapErr(&err, "writefile", name)
+	name = cfs.normalize(name)
+	cfs.awaitCopies(name)
+	if err := cfs.access(OpWrite, name); err != nil {
+		return err
+	}
+	defer cfs.beginOp()()
+	if cfs.frozen.Load() {
+		return ErrFrozen
+	}
+	if z, err := cfs.writeZone(name); err != nil {
+		return err
+	} else if z == ZoneWriteThrough {
+		return cfs.writeFilePrimary(name, data, perm)
+	}
+
+	name, err = cfs.follow(name)
+	if err != nil {
+		return err
+	}
+	cfs.settle(name)
+	if err := cfs.txTouch(name); err != nil {
+		return err
+	}
+	op := EventCreate
+	if info, err := cfs.Stat(name); err == nil {
+		op = EventModify
+		perm = info.Mode().Perm()
+	}
+	if err := cfs.ensureParent(name); err != nil {
+		return err
+	}
+
+	size := int64(len(data))
+	before := cfs.secondarySize(name)
+	if err := cfs.adjustQuota("writefile", name, size-before); err != nil {
+		return err
+	}
+	cfs.recordTakeover(name)
+	tmp := fmt.Sprintf("%s/%d", writeDir, cfs.spillSeq.Add(1))
+	record, err := cfs.journalOp(journalEntry{Op: "writefile", Path: name, NewPath: tmp})
+	if err != nil {
+		cfs.adjustQuota("writefile", name, before-size)
+		return err
+	}
+	defer record.done()
+	if err := cfs.writeTemp(tmp, data, perm); err != nil {
+		cfs.secondary.Remove(tmp)
+		cfs.adjustQuota("writefile", name, before-size)
+		return err
+	}
+	cfs.counters.secondary.write(size)
+
+	unlock := cfs.commitLock()
+	err = replaceFile(cfs.secondary, tmp, name)
+	if err == nil {
+		cfs.mu.Lock()
+		cfs.modified[name] = true
+		delete(cfs.deleted, name)
+		cfs.mu.Unlock()
+		cfs.setDelta(name, false)
+		record.step()
+	}
+	unlock()
+	if err != nil {
+		cfs.secondary.Remove(tmp)
+		cfs.adjustQuota("writefile", name, before-size)
+		return err
+	}
+
+	cfs.encodeDelta(name)
+	if err := cfs.syncDirs(name); err != nil {
+		return err
+	}
+	cfs.notify(Event{Op: op, Path: name})
+	return nil
+}
+
+// writeTemp writes data to the new secondary file tmp in writeDir, syncing
+// it unless durability is disabled.
+func (cfs *FileSystem) writeTemp(tmp string, data []byte, perm os.FileMode) error {
+	if err := cfs.secondary.Mkdir(writeDir, 0700); err != nil && !os.IsExist(err) {
+		return err
+	}
+	f, err := cfs.secondary.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil && cfs.durability != DurabilityNone {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
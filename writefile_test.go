@@ -0,0 +1,191 @@
+package cowfs
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/absfs/absfs"
+	"github.com/absfs/memfs"
+)
+
+// lockedFiler serializes calls to a Filer that is not safe for concurrent
+// use, such as memfs.
+type lockedFiler struct {
+	absfs.Filer
+	mu sync.Mutex
+}
+
+func (l *lockedFiler) OpenFile(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.Filer.OpenFile(name, flag, perm)
+}
+
+func (l *lockedFiler) Mkdir(name string, perm os.FileMode) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.Filer.Mkdir(name, perm)
+}
+
+func (l *lockedFiler) Remove(name string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.Filer.Remove(name)
+}
+
+func (l *lockedFiler) Rename(oldpath, newpath string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.Filer.Rename(oldpath, newpath)
+}
+
+func (l *lockedFiler) Stat(name string) (os.FileInfo, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.Filer.Stat(name)
+}
+
+func (l *lockedFiler) Chmod(name string, mode os.FileMode) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.Filer.Chmod(name, mode)
+}
+
+func (l *lockedFiler) Chtimes(name string, atime, mtime time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.Filer.Chtimes(name, atime, mtime)
+}
+
+func (l *lockedFiler) Chown(name string, uid, gid int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.Filer.Chown(name, uid, gid)
+}
+
+func (l *lockedFiler) ReadDir(name string) ([]fs.DirEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.Filer.ReadDir(name)
+}
+
+func (l *lockedFiler) ReadFile(name string) ([]byte, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.Filer.ReadFile(name)
+}
+
+// tempFiles returns the temporary files WriteFile left in secondary.
+func tempFiles(t *testing.T, cfs *FileSystem) []string {
+	t.Helper()
+	entries, err := cfs.secondary.ReadDir(writeDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestWriteFile(t *testing.T) {
+	cfs, primary, _ := newMemOverlay(t)
+	primary.Mkdir("/dir", 0755)
+	writeMemFile(t, primary, "/dir/a.txt", "original")
+	primary.Chmod("/dir/a.txt", 0640)
+
+	if err := cfs.WriteFile("/dir/a.txt", []byte("new"), 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if data, _ := cfs.ReadFile("/dir/a.txt"); string(data) != "new" {
+		t.Errorf("ReadFile() = %q, want new", data)
+	}
+	if info, _ := cfs.Stat("/dir/a.txt"); info.Mode().Perm() != 0640 {
+		t.Errorf("mode = %v, want the existing 0640", info.Mode().Perm())
+	}
+	if data, _ := primary.ReadFile("/dir/a.txt"); string(data) != "original" {
+		t.Error("primary was modified")
+	}
+	if names := tempFiles(t, cfs); len(names) != 0 {
+		t.Errorf("temporary files %v left in secondary", names)
+	}
+	if names := listNames(t, cfs, "/"); len(names) != 1 || names[0] != "dir" {
+		t.Errorf("ReadDir(/) = %v, want only dir", names)
+	}
+	if s := cfs.Stats(); s.CopyUps != 0 {
+		t.Errorf("WriteFile copied up %d files", s.CopyUps)
+	}
+
+	cfs.Remove("/dir/a.txt")
+	if err := cfs.WriteFile("/dir/a.txt", []byte("again"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if cfs.IsDeleted("/dir/a.txt") || !cfs.IsModified("/dir/a.txt") {
+		t.Error("recreated file still marked deleted")
+	}
+	if info, _ := cfs.Stat("/dir/a.txt"); info.Mode().Perm() != 0600 {
+		t.Errorf("mode = %v, want 0600 for a new file", info.Mode().Perm())
+	}
+}
+
+func TestWriteFileQuota(t *testing.T) {
+	cfs, _, _ := newMemOverlay(t)
+	WithMaxSecondaryBytes(4)(cfs)
+
+	if err := cfs.WriteFile("/big", []byte("too large"), 0644); err == nil {
+		t.Fatal("WriteFile() over quota succeeded")
+	}
+	if names := tempFiles(t, cfs); len(names) != 0 {
+		t.Errorf("temporary files %v left after a refused write", names)
+	}
+	if err := cfs.WriteFile("/small", []byte("ok"), 0644); err != nil {
+		t.Errorf("WriteFile() within quota error = %v", err)
+	}
+}
+
+func TestWriteFileConcurrent(t *testing.T) {
+	cfs := New(&lockedFiler{Filer: must(memfs.NewFS())}, &lockedFiler{Filer: must(memfs.NewFS())})
+	const writers = 8
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			data := []byte(fmt.Sprintf("writer %d", w))
+			for i := 0; i < 50; i++ {
+				if err := cfs.WriteFile("/shared.txt", data, 0644); err != nil {
+					t.Error(err)
+					return
+				}
+				if entries, err := cfs.ReadDir("/"); err != nil || len(entries) != 1 {
+					t.Errorf("ReadDir(/) = %v, %v, want only shared.txt", entries, err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	data, err := cfs.ReadFile("/shared.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var valid bool
+	for w := 0; w < writers; w++ {
+		valid = valid || string(data) == fmt.Sprintf("writer %d", w)
+	}
+	if !valid {
+		t.Errorf("ReadFile() = %q, want the data of one writer", data)
+	}
+	if names := tempFiles(t, cfs); len(names) != 0 {
+		t.Errorf("temporary files %v left in secondary", names)
+	}
+}
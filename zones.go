@@ -0,0 +1,165 @@
+package cowfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/absfs/absfs"
+)
+
+// ErrPassThrough is returned by operations that would change a path in a
+// ZonePassThrough zone.
+var ErrPassThrough = errors.New("cowfs: path is in a pass-through zone")
+
+// Zone selects how the overlay treats the paths matching a Rule.
+type Zone int
+
+const (
+	// ZoneOverlay paths are copied up on their first change, as without
+	// rules.
+	ZoneOverlay Zone = iota
+
+	// ZonePassThrough paths are read from the primary and never changed:
+	// operations that would change them fail with ErrPassThrough.
+	ZonePassThrough
+
+	// ZoneWriteThrough paths are read from the primary, and changes to them
+	// are made directly in the primary.
+	ZoneWriteThrough
+)
+
+func (z Zone) String() string {
+	switch z {
+	case ZoneOverlay:
+		return "overlay"
+	case ZonePassThrough:
+		return "pass-through"
+	case ZoneWriteThrough:
+		return "write-through"
+	}
+	return fmt.Sprintf("Zone(%d)", int(z))
+}
+
+// parseZone returns the Zone whose String is s.
+func parseZone(s string) (Zone, error) {
+	for z := ZoneOverlay; z <= ZoneWriteThrough; z++ {
+		if s == z.String() {
+			return z, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown zone %q", s)
+}
+
+// Rule places the paths matching Pattern in Zone. Patterns have the syntax
+// of WithPaths patterns: "usr/**" matches /usr and everything below it.
+type Rule struct {
+	Pattern string
+	Zone    Zone
+}
+
+// WithRules sets the zone of the paths matching rules, for trees mixing
+// policies such as a read-only /usr next to a /var written to the primary:
+//
+//	cowfs.WithRules(
+//		cowfs.Rule{Pattern: "usr/**", Zone: cowfs.ZonePassThrough},
+//		cowfs.Rule{Pattern: "var/**", Zone: cowfs.ZoneWriteThrough},
+//	)
+//
+// The first rule a path matches decides its zone; paths matching none are
+// in ZoneOverlay. Paths in the other zones bypass the secondary and the
+// overlay state entirely, so changes made through the primary in a
+// write-through zone are not tracked: they are not reported by Status,
+// Diff, Stats or Subscribe, and are neither journaled nor undone by a
+// transaction's Rollback. Rename and Link between paths in different zones
+// fail with syscall.EXDEV, as across mount points.
+//
+// Patterns with invalid syntax never match; FromConfig reports them. The
+// rules should be set when the overlay is created, before it holds changes
+// to the paths they cover.
+func WithRules(rules ...Rule) Option {
+	return func(fs *FileSystem) {
+		fs.rules = append(fs.rules, rules...)
+	}
+}
+
+// zoneOf returns the zone of name.
+func (cfs *FileSystem) zoneOf(name string) Zone {
+	for _, r := range cfs.rules {
+		if matchPattern(r.Pattern, name) {
+			return r.Zone
+		}
+	}
+	return ZoneOverlay
+}
+
+// writeZone returns the zone in which a change to names is made, failing
+// if one of them is in a pass-through zone or if they are in different
+// zones.
+func (cfs *FileSystem) writeZone(names ...string) (Zone, error) {
+	if len(cfs.rules) == 0 {
+		return ZoneOverlay, nil
+	}
+	zone := cfs.zoneOf(names[0])
+	for _, name := range names {
+		z := cfs.zoneOf(name)
+		if z == ZonePassThrough {
+			return z, ErrPassThrough
+		}
+		if z != zone {
+			return z, syscall.EXDEV
+		}
+	}
+	return zone, nil
+}
+
+// openZoned implements OpenFile for name outside ZoneOverlay.
+func (cfs *FileSystem) openZoned(name string, flag int, perm os.FileMode) (absfs.File, error) {
+	if openOp(flag) == OpWrite {
+		defer cfs.beginOp()()
+		if cfs.frozen.Load() {
+			return nil, ErrFrozen
+		}
+		if _, err := cfs.writeZone(name); err != nil {
+			return nil, err
+		}
+	}
+	f, err := cfs.primary.OpenFile(name, flag, perm)
+	if err == nil && openOp(flag) != OpWrite {
+		cfs.trackRead(name)
+	}
+	return f, err
+}
+
+// truncatePrimary truncates the primary file name to size.
+func (cfs *FileSystem) truncatePrimary(name string, size int64) error {
+	f, err := cfs.primary.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeFilePrimary implements WriteFile in the primary, keeping the
+// permissions of an existing file.
+func (cfs *FileSystem) writeFilePrimary(name string, data []byte, perm os.FileMode) error {
+	if info, err := cfs.primary.Stat(name); err == nil {
+		perm = info.Mode().Perm()
+	}
+	return cfs.writePrimary(name, bytes.NewReader(data), perm)
+}
+
+// linkPrimary implements Link in the primary.
+func (cfs *FileSystem) linkPrimary(oldname, newname string) error {
+	linker, ok := cfs.primary.(Linker)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	return linker.Link(oldname, newname)
+}
@@ -0,0 +1,78 @@
+package cowfs
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestRules(t *testing.T) {
+	_, primary, secondary := newMemOverlay(t)
+	for _, dir := range []string{"/usr", "/var", "/home"} {
+		if err := primary.Mkdir(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeMemFile(t, primary, "/usr/lib.so", "lib")
+	writeMemFile(t, primary, "/var/log", "one\n")
+	cfs := New(primary, secondary, WithRules(
+		Rule{Pattern: "usr/**", Zone: ZonePassThrough},
+		Rule{Pattern: "/var/**", Zone: ZoneWriteThrough},
+	))
+
+	// Pass-through: reads come from the primary, changes are refused
+	if data, err := cfs.ReadFile("/usr/lib.so"); err != nil || string(data) != "lib" {
+		t.Fatalf("ReadFile(/usr/lib.so) = %q, %v", data, err)
+	}
+	for name, err := range map[string]error{
+		"WriteFile": cfs.WriteFile("/usr/lib.so", []byte("x"), 0o644),
+		"Remove":    cfs.Remove("/usr/lib.so"),
+		"Mkdir":     cfs.Mkdir("/usr/local", 0o755),
+		"Chmod":     cfs.Chmod("/usr", 0o700),
+	} {
+		if !errors.Is(err, ErrPassThrough) {
+			t.Errorf("%s in pass-through zone = %v; want ErrPassThrough", name, err)
+		}
+	}
+	if _, err := cfs.OpenFile("/usr/new", os.O_CREATE|os.O_WRONLY, 0o644); !errors.Is(err, ErrPassThrough) {
+		t.Errorf("OpenFile(/usr/new) = %v; want ErrPassThrough", err)
+	}
+
+	// Write-through: changes land in the primary, not the overlay
+	if err := cfs.WriteFile("/var/log", []byte("two\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Mkdir("/var/cache", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfs.Rename("/var/log", "/var/cache/log"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := primary.ReadFile("/var/cache/log"); err != nil || string(data) != "two\n" {
+		t.Errorf("primary /var/cache/log = %q, %v; want the written contents", data, err)
+	}
+	if data, err := cfs.ReadFile("/var/cache/log"); err != nil || string(data) != "two\n" {
+		t.Errorf("ReadFile(/var/cache/log) = %q, %v", data, err)
+	}
+	if _, err := secondary.Stat("/var"); err == nil {
+		t.Error("write-through changes reached the secondary")
+	}
+	if cfs.IsModified("/var/cache/log") {
+		t.Error("write-through file marked modified")
+	}
+
+	// Overlay paths are unaffected, and cannot be renamed across zones
+	if err := cfs.WriteFile("/home/notes", []byte("overlay"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := primary.Stat("/home/notes"); err == nil {
+		t.Error("overlay write reached the primary")
+	}
+	if err := cfs.Rename("/home/notes", "/var/notes"); !errors.Is(err, syscall.EXDEV) {
+		t.Errorf("Rename across zones = %v; want EXDEV", err)
+	}
+	if err := cfs.Rename("/var/cache/log", "/usr/log"); !errors.Is(err, ErrPassThrough) {
+		t.Errorf("Rename into pass-through zone = %v; want ErrPassThrough", err)
+	}
+}